@@ -0,0 +1,273 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/fatedier/fft/pkg/dedup"
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/receiver"
+	"github.com/fatedier/fft/pkg/sender"
+
+	"github.com/cheggaaa/pb"
+)
+
+// chunks in each DedupChunks and indexes in each DedupRequest, so messages are not too large
+const (
+	dedupChunksBatch  = 8192
+	dedupRequestBatch = 50000
+)
+
+type dedupChunk struct {
+	offset int64
+	size   int64
+	hash   dedup.Hash
+}
+
+// splitChunks splits f into chunks by content.
+func splitChunks(f io.Reader) ([]dedupChunk, error) {
+	chunks := make([]dedupChunk, 0)
+	var offset int64
+	err := dedup.Split(f, func(data []byte) error {
+		chunks = append(chunks, dedupChunk{
+			offset: offset,
+			size:   int64(len(data)),
+			hash:   dedup.Sum(data),
+		})
+		offset += int64(len(data))
+		return nil
+	})
+	return chunks, err
+}
+
+func writeDedupChunks(conn net.Conn, chunks []dedupChunk) error {
+	for i := 0; i < len(chunks); i += dedupChunksBatch {
+		end := i + dedupChunksBatch
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		m := &msg.DedupChunks{
+			Sizes:  make([]int64, 0, end-i),
+			Hashes: make([]byte, 0, (end-i)*len(dedup.Hash{})),
+		}
+		for _, c := range chunks[i:end] {
+			m.Sizes = append(m.Sizes, c.size)
+			m.Hashes = append(m.Hashes, c.hash[:]...)
+		}
+		if err := msg.WriteMsg(conn, m); err != nil {
+			return err
+		}
+	}
+	return msg.WriteMsg(conn, &msg.DedupChunks{Last: true})
+}
+
+// readDedupChunks reads chunks of sender's file, they should cover exactly fsize bytes.
+func readDedupChunks(conn net.Conn, fsize int64) ([]dedupChunk, error) {
+	chunks := make([]dedupChunk, 0)
+	var offset int64
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read dedup chunks error: %v", err)
+		}
+		m, ok := raw.(*msg.DedupChunks)
+		if !ok {
+			return nil, fmt.Errorf("read dedup chunks format error")
+		}
+		hashSize := len(dedup.Hash{})
+		if len(m.Hashes) != len(m.Sizes)*hashSize {
+			return nil, fmt.Errorf("dedup chunk hashes don't match sizes")
+		}
+		for i, size := range m.Sizes {
+			if size <= 0 || size > dedup.MaxChunkSize {
+				return nil, fmt.Errorf("invalid dedup chunk size %d", size)
+			}
+			c := dedupChunk{offset: offset, size: size}
+			copy(c.hash[:], m.Hashes[i*hashSize:])
+			chunks = append(chunks, c)
+			offset += size
+		}
+		if m.Last {
+			break
+		}
+	}
+	if offset != fsize {
+		return nil, fmt.Errorf("dedup chunks cover %d bytes, file size is %d", offset, fsize)
+	}
+	return chunks, nil
+}
+
+func readDedupRequest(conn net.Conn, count int) ([]int, error) {
+	wanted := make([]int, 0)
+	for {
+		// receiver may take a while to copy chunks from it's cache
+		conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read dedup request error: %v", err)
+		}
+		m, ok := raw.(*msg.DedupRequest)
+		if !ok {
+			return nil, fmt.Errorf("read dedup request format error")
+		}
+		for _, idx := range m.Chunks {
+			if idx < 0 || idx >= int64(count) {
+				return nil, fmt.Errorf("invalid chunk index %d in dedup request", idx)
+			}
+			wanted = append(wanted, int(idx))
+		}
+		if m.Last {
+			return wanted, nil
+		}
+	}
+}
+
+// sendDedup announces chunks of f and sends chunks receiver doesn't have in it's cache.
+func (svc *Service) sendDedup(conn net.Conn, m *msg.SendFileResp, f *os.File, chunks []dedupChunk) error {
+	if err := writeDedupChunks(conn, chunks); err != nil {
+		return err
+	}
+	wanted, err := readDedupRequest(conn, len(chunks))
+	if err != nil {
+		return err
+	}
+
+	var size, total int64
+	for _, c := range chunks {
+		total += c.size
+	}
+	for _, idx := range wanted {
+		size += chunks[idx].size
+	}
+	fmt.Printf("Dedup: %d of %d chunks are not in receiver's cache, send %s of %s\n", len(wanted), len(chunks),
+		pb.Format(size).To(pb.U_BYTES).String(), pb.Format(total).To(pb.U_BYTES).String())
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	bar := pb.New(int(size))
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	if !svc.debugMode {
+		bar.Start()
+	}
+	callback := func(n int) {
+		bar.Add(n)
+	}
+
+	// each chunk is sent as a file, so frames are placed by chunk index and offset in the chunk
+	files := make([]sender.File, 0, len(wanted))
+	for _, idx := range wanted {
+		c := chunks[idx]
+		files = append(files, sender.File{
+			ID:   uint32(idx),
+			Size: c.size,
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(fio.NewCallbackReader(io.NewSectionReader(f, c.offset, c.size), callback)), nil
+			},
+		})
+	}
+	s, err := sender.NewFilesSender(files, svc.frameSize, svc.cacheCount)
+	if err != nil {
+		return err
+	}
+	err = svc.sendStreams(conn, m, s)
+	if !svc.debugMode {
+		bar.Finish()
+	}
+	return err
+}
+
+// chunkWriter writes a chunk to it's offset in the file.
+type chunkWriter struct {
+	w      io.WriterAt
+	offset int64
+	size   int64
+}
+
+func (cw *chunkWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > cw.size {
+		return 0, fmt.Errorf("write out of range of chunk")
+	}
+	return cw.w.WriteAt(p, cw.offset+off)
+}
+
+// recvDedup copies chunks in our cache to f and receives others from sender,
+// received chunks are verified and saved to the cache. It returns bytes copied from the cache.
+func (svc *Service) recvDedup(conn net.Conn, id string, m *msg.ReceiveFileResp, f *partFile, callback func(int)) (cached int64, err error) {
+	chunks, err := readDedupChunks(conn, m.Fsize)
+	if err != nil {
+		return 0, err
+	}
+	if err = f.Truncate(m.Fsize); err != nil {
+		return 0, err
+	}
+
+	wanted := make(map[int]dedupChunk)
+	indexes := make([]int64, 0)
+	for i, c := range chunks {
+		if data, ok := svc.chunkCache.Get(c.hash); ok && int64(len(data)) == c.size {
+			if _, err = f.WriteAt(data, c.offset); err != nil {
+				return 0, err
+			}
+			callback(len(data))
+			cached += c.size
+			continue
+		}
+		wanted[i] = c
+		indexes = append(indexes, int64(i))
+	}
+	for i := 0; i < len(indexes); i += dedupRequestBatch {
+		end := i + dedupRequestBatch
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		if err = msg.WriteMsg(conn, &msg.DedupRequest{Chunks: indexes[i:end]}); err != nil {
+			return 0, err
+		}
+	}
+	if err = msg.WriteMsg(conn, &msg.DedupRequest{Last: true}); err != nil {
+		return 0, err
+	}
+
+	if len(wanted) > 0 {
+		dst := fio.NewCallbackWriterAt(f, callback)
+		recv := receiver.NewFilesReceiver(func(fileID uint32) (io.WriterAt, error) {
+			c, ok := wanted[int(fileID)]
+			if !ok {
+				return nil, fmt.Errorf("chunk %d is not requested", fileID)
+			}
+			return &chunkWriter{w: dst, offset: c.offset, size: c.size}, nil
+		}, svc.cacheCount)
+		if err = svc.recvStreams(conn, id, m, recv); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, dedup.MaxChunkSize)
+	for _, idx := range indexes {
+		c := chunks[idx]
+		data := buf[:c.size]
+		if _, err = f.ReadAt(data, c.offset); err != nil {
+			return 0, err
+		}
+		if dedup.Sum(data) != c.hash {
+			return 0, fmt.Errorf("chunk %d is broken, file is not received completely", idx)
+		}
+		if err = svc.chunkCache.Put(c.hash, data); err != nil {
+			log(svc.debugMode, "save chunk to cache error: %v", err)
+		}
+	}
+	if err = svc.chunkCache.Evict(); err != nil {
+		log(svc.debugMode, "evict chunk cache error: %v", err)
+	}
+	return cached, nil
+}
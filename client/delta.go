@@ -0,0 +1,170 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/fatedier/fft/pkg/delta"
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/receiver"
+)
+
+const (
+	// blocks of signature in each DeltaSignature message
+	deltaSignatureBatch = 16384
+
+	// the new file is rebuilt to this temporary file and renamed to the target path after it's verified
+	deltaTempSuffix = ".fft-delta"
+)
+
+// sendDeltaSignature sends signature of the regular file at path to sender by conn.
+// It returns the file opened and it's signature, or an empty signature if there is no such file.
+func sendDeltaSignature(conn net.Conn, path string) (*os.File, *delta.Signature, error) {
+	var f *os.File
+	if path != "" {
+		if finfo, err := os.Stat(path); err == nil && finfo.Mode().IsRegular() {
+			if f, err = os.Open(path); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if f == nil {
+		return nil, delta.NewSignature(0), msg.WriteMsg(conn, &msg.DeltaSignature{Last: true})
+	}
+
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	blockSize := delta.BlockSize(finfo.Size())
+	sig, err := delta.ComputeSignature(f, blockSize, deltaSignatureBatch, func(sig *delta.Signature, from int) error {
+		return msg.WriteMsg(conn, &msg.DeltaSignature{
+			BlockSize: int64(blockSize),
+			Blocks:    sig.MarshalBlocks(from, sig.Len()),
+		})
+	})
+	if err == nil {
+		err = msg.WriteMsg(conn, &msg.DeltaSignature{BlockSize: int64(blockSize), Last: true})
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, sig, nil
+}
+
+// readDeltaSignature reads signature of receiver's file from conn.
+func readDeltaSignature(conn net.Conn) (*delta.Signature, error) {
+	var sig *delta.Signature
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read delta signature error: %v", err)
+		}
+		m, ok := raw.(*msg.DeltaSignature)
+		if !ok {
+			return nil, fmt.Errorf("read delta signature format error")
+		}
+		if m.BlockSize < 0 || m.BlockSize > delta.MaxBlockSize {
+			return nil, fmt.Errorf("invalid delta block size %d", m.BlockSize)
+		}
+		if sig == nil {
+			sig = delta.NewSignature(int(m.BlockSize))
+		} else if sig.BlockSize != int(m.BlockSize) {
+			return nil, fmt.Errorf("delta block size is changed")
+		}
+		if err = sig.UnmarshalBlocks(m.Blocks); err != nil {
+			return nil, err
+		}
+		if m.Last {
+			return sig, nil
+		}
+	}
+}
+
+// newDeltaSource returns a reader of delta of f against sig, it's read as a stream by sender.
+// Stats can be got from statsCh after all delta is read.
+func newDeltaSource(f io.Reader, sig *delta.Signature) (src io.ReadCloser, statsCh <-chan *delta.Stats) {
+	pr, pw := io.Pipe()
+	ch := make(chan *delta.Stats, 1)
+	go func() {
+		stats, err := delta.Encode(pw, f, sig)
+		pw.CloseWithError(err)
+		ch <- stats
+	}()
+	return pr, ch
+}
+
+// deltaFile is the temporary file a new file is rebuilt to.
+type deltaFile struct {
+	path string
+	old  *os.File
+	tmp  *os.File
+}
+
+// newDeltaReceiver sends signature of the file at path to sender and returns a Receiver rebuilding the new file.
+// The new file is written to w if path is empty.
+func newDeltaReceiver(conn net.Conn, path string, w io.Writer, callback func(int), window int) (*receiver.Receiver, *deltaFile, error) {
+	old, sig, err := sendDeltaSignature(conn, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	df := &deltaFile{path: path, old: old}
+	if path != "" {
+		if df.tmp, err = os.Create(path + deltaTempSuffix); err != nil {
+			df.Close()
+			return nil, nil, err
+		}
+		w = df.tmp
+	}
+
+	var oldAt io.ReaderAt
+	if old != nil {
+		oldAt = old
+	}
+	patcher := delta.NewPatcher(oldAt, sig.BlockSize, sig.Len(), fio.NewCallbackWriter(w, callback))
+	return receiver.NewDeltaReceiver(0, patcher, window), df, nil
+}
+
+// Commit replaces the old file with the new one by policy, see finalize. It returns the final path.
+func (df *deltaFile) Commit(noClobber, rename bool) (string, error) {
+	if df.tmp == nil {
+		return df.path, nil
+	}
+	// old file can't be replaced while it's open on some systems
+	if df.old != nil {
+		df.old.Close()
+		df.old = nil
+	}
+	err := df.tmp.Sync()
+	if err == nil {
+		err = df.tmp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	path, err := finalize(df.tmp.Name(), df.path, noClobber, rename)
+	if err != nil {
+		return "", err
+	}
+	df.tmp = nil
+	return path, nil
+}
+
+// Close removes the temporary file if it's not committed.
+func (df *deltaFile) Close() {
+	if df.old != nil {
+		df.old.Close()
+	}
+	if df.tmp != nil {
+		df.tmp.Close()
+		os.Remove(df.tmp.Name())
+	}
+}
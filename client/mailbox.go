@@ -0,0 +1,512 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/e2e"
+	"github.com/fatedier/fft/pkg/fname"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/receiver"
+	"github.com/fatedier/fft/pkg/stream"
+
+	"github.com/cheggaaa/pb"
+)
+
+const (
+	// files are split into larger chunks in mailbox mode since each chunk is a file on workers
+	mailboxChunkSize = 4 * 1024 * 1024
+
+	// how many chunks are uploaded or fetched in parallel
+	mailboxConcurrency = 4
+)
+
+// sendMailbox uploads the file to storage workers, receiver can get it by id later
+// without waiting for sender online.
+func (svc *Service) sendMailbox(id string, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.IsDir() {
+		return fmt.Errorf("send file can't be a directory")
+	}
+	// receiver rejects names which are not safe, find it before waiting for receiver
+	name, err := fname.CleanName(finfo.Name())
+	if err != nil {
+		return err
+	}
+
+	sealer, err := e2e.NewSealer(svc.key, id)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("tcp", svc.serverAddr)
+	if err != nil {
+		return err
+	}
+	conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+
+	msg.WriteMsg(conn, &msg.PutMailbox{
+		ID:              id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.capabilities(),
+		Name:            name,
+		Fsize:           finfo.Size(),
+		ChunkSize:       mailboxChunkSize,
+		Replicas:        int64(svc.replicas),
+	})
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	raw, err := msg.ReadMsg(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	m, ok := raw.(*msg.PutMailboxResp)
+	if !ok {
+		return fmt.Errorf("get put mailbox response format error")
+	}
+	if m.Error != "" {
+		return fmt.Errorf(m.Error)
+	}
+	if err = msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return fmt.Errorf("ffts %v", err)
+	}
+	if len(m.Workers) == 0 || m.Replicas <= 0 {
+		return fmt.Errorf("no available storage workers")
+	}
+	if m.UploadToken == "" {
+		return fmt.Errorf("ffts doesn't issue upload tokens, please upgrade it")
+	}
+	if svc.debugMode {
+		fmt.Printf("Workers: %v Replicas: %d\n", m.Workers, m.Replicas)
+	}
+
+	chunks := int((finfo.Size() + mailboxChunkSize - 1) / mailboxChunkSize)
+	locations := make([][]int, chunks)
+
+	bar := pb.New(int(finfo.Size() * m.Replicas))
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	if !svc.debugMode {
+		bar.Start()
+	}
+
+	var (
+		wait sync.WaitGroup
+		mu   sync.Mutex
+	)
+	jobCh := make(chan int)
+	errCh := make(chan error, 1)
+	for i := 0; i < mailboxConcurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			u := newChunkUploader(id, m.Workers, m.UploadToken, svc.debugMode)
+			defer u.Close()
+
+			buf := make([]byte, mailboxChunkSize)
+			for chunkID := range jobCh {
+				n, err := f.ReadAt(buf, int64(chunkID)*mailboxChunkSize)
+				if err != nil && err != io.EOF {
+					select {
+					case errCh <- err:
+					default:
+					}
+					continue
+				}
+				frame, err := svc.sealChunk(sealer, uint64(chunkID), buf[:n])
+				if err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					continue
+				}
+
+				for r := 0; r < int(m.Replicas); r++ {
+					idx := (chunkID + r) % len(m.Workers)
+					if err = u.Put(idx, frame); err != nil {
+						log(svc.debugMode, "[%s] upload chunk %d error: %v", m.Workers[idx], chunkID, err)
+						continue
+					}
+					mu.Lock()
+					locations[chunkID] = append(locations[chunkID], idx)
+					mu.Unlock()
+					bar.Add(n)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < chunks && err == nil; i++ {
+		select {
+		case jobCh <- i:
+		case err = <-errCh:
+		}
+	}
+	close(jobCh)
+	wait.Wait()
+	if err == nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+	}
+	if !svc.debugMode {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, locs := range locations {
+		if len(locs) == 0 {
+			return fmt.Errorf("chunk %d can't be uploaded to any storage worker", i)
+		}
+	}
+
+	msg.WriteMsg(conn, &msg.CommitMailbox{
+		ID:        id,
+		Locations: locations,
+	})
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	raw, err = msg.ReadMsg(conn)
+	if err != nil {
+		return err
+	}
+	resp, ok := raw.(*msg.CommitMailboxResp)
+	if !ok {
+		return fmt.Errorf("get commit mailbox response format error")
+	}
+	if resp.Error != "" {
+		return fmt.Errorf(resp.Error)
+	}
+	fmt.Printf("ID: %s\n", id)
+	fmt.Printf("Uploaded, receiver can get it by this ID before %s\n", time.Unix(resp.ExpireAt, 0).Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// sealChunk compresses chunk if possible and encrypts it end to end if sealer is not nil.
+func (svc *Service) sealChunk(sealer *e2e.Sealer, chunkID uint64, data []byte) (*stream.Frame, error) {
+	frame := stream.NewFrame(0, chunkID, nil)
+
+	payload := data
+	if svc.codec != nil {
+		compressed, err := codec.Compress(svc.codec, nil, data, 0.9)
+		if err == nil {
+			payload = compressed
+			frame.Flags |= stream.FlagCompressed
+		} else if err != codec.ErrIncompressible {
+			return nil, err
+		}
+	}
+
+	if sealer == nil {
+		frame.Buf = payload
+		return frame, nil
+	}
+	sealed, err := sealer.Seal(make([]byte, 0, len(payload)+sealer.Overhead()), chunkID, payload)
+	if err != nil {
+		return nil, err
+	}
+	frame.Flags |= stream.FlagEncrypted
+	frame.Buf = sealed
+	return frame, nil
+}
+
+// fetchMailbox gets all chunks from storage workers and saves them by recv.
+func (svc *Service) fetchMailbox(id string, m *msg.ReceiveFileResp, recv *receiver.Receiver) error {
+	sealer, err := e2e.NewSealer(svc.key, id)
+	if err != nil {
+		return err
+	}
+
+	recvErrCh := make(chan error, 1)
+	go func() {
+		recvErrCh <- recv.Run()
+	}()
+
+	var wait sync.WaitGroup
+	jobCh := make(chan int)
+	errCh := make(chan error, 1)
+	for i := 0; i < mailboxConcurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			f := newChunkFetcher(id, m.Workers, svc.debugMode)
+			defer f.Close()
+
+			for chunkID := range jobCh {
+				if err := fetchChunk(f, sealer, chunkID, m, recv); err != nil {
+					// wakes up the dispatcher if it's waiting for this chunk
+					recv.Abort(err)
+					select {
+					case errCh <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	// chunks are fetched in order and never past receiver's window, so in-order receiver keeps few chunks in memory
+	for i := 0; i < len(m.Locations) && err == nil; i++ {
+		if err = recv.WaitWindow(uint64(i)); err != nil {
+			break
+		}
+		select {
+		case jobCh <- i:
+		case err = <-errCh:
+		}
+	}
+	close(jobCh)
+	wait.Wait()
+	if err == nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = recv.RecvFrame(stream.NewLastFrame(0, uint64(len(m.Locations)), uint64(m.Fsize))); err != nil {
+		return err
+	}
+	return <-recvErrCh
+}
+
+// fetchChunk tries all workers which have the chunk, starting from different ones to spread the load.
+func fetchChunk(f *chunkFetcher, sealer *e2e.Sealer, chunkID int, m *msg.ReceiveFileResp, recv *receiver.Receiver) error {
+	locs := m.Locations[chunkID]
+	for r := 0; r < len(locs); r++ {
+		idx := locs[(chunkID+r)%len(locs)]
+		if idx < 0 || idx >= len(m.Workers) {
+			continue
+		}
+		frame, err := f.Get(idx, uint64(chunkID))
+		if err != nil {
+			log(f.debugMode, "[%s] fetch chunk %d error: %v", m.Workers[idx], chunkID, err)
+			continue
+		}
+
+		plain, err := sealer.Open(nil, uint64(chunkID), frame.Buf)
+		if err != nil {
+			return err
+		}
+		frame.Flags &^= stream.FlagEncrypted
+		frame.Offset = uint64(chunkID) * uint64(m.FrameSize)
+		frame.Buf = plain
+		return recv.RecvFrame(frame)
+	}
+	return fmt.Errorf("chunk %d can't be fetched from any storage worker", chunkID)
+}
+
+// dialStorageWorker sends req to worker and waits for it's response.
+// Chunks are encrypted end to end, TLS is still used to hide the mailbox ID.
+func dialStorageWorker(addr string, req msg.Message) (net.Conn, error) {
+	return dialChunkWorker(addr, nil, req)
+}
+
+// dialChunkWorker sends req to worker and waits for it's response, TLS is not used if key is not empty.
+func dialChunkWorker(addr string, key []byte, req msg.Message) (net.Conn, error) {
+	conn, err := dialWorker(addr, key)
+	if err != nil {
+		return nil, err
+	}
+	msg.WriteMsg(conn, req)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	raw, err := msg.ReadMsg(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var (
+		errStr          string
+		protocolVersion int64
+	)
+	switch m := raw.(type) {
+	case *msg.NewStoreStreamResp:
+		errStr, protocolVersion = m.Error, m.ProtocolVersion
+	case *msg.NewFetchStreamResp:
+		errStr, protocolVersion = m.Error, m.ProtocolVersion
+	case *msg.NewSeedStreamResp:
+		errStr, protocolVersion = m.Error, m.ProtocolVersion
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("read chunk stream response format error")
+	}
+	if errStr != "" {
+		conn.Close()
+		return nil, fmt.Errorf(errStr)
+	}
+	if err = msg.CheckProtocolVersion(protocolVersion); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fftw %v", err)
+	}
+	return conn, nil
+}
+
+// chunkUploader keeps one store stream to each worker.
+// Workers failed once are skipped, their chunks are only stored on other replicas.
+type chunkUploader struct {
+	id        string
+	workers   []string
+	token     string
+	streams   map[int]*stream.FrameStream
+	failed    map[int]bool
+	debugMode bool
+}
+
+func newChunkUploader(id string, workers []string, token string, debugMode bool) *chunkUploader {
+	return &chunkUploader{
+		id:        id,
+		workers:   workers,
+		token:     token,
+		streams:   make(map[int]*stream.FrameStream),
+		failed:    make(map[int]bool),
+		debugMode: debugMode,
+	}
+}
+
+// Put returns after worker has saved the chunk.
+func (u *chunkUploader) Put(idx int, frame *stream.Frame) error {
+	if u.failed[idx] {
+		return fmt.Errorf("worker is unavailable")
+	}
+	s, ok := u.streams[idx]
+	if !ok {
+		conn, err := dialStorageWorker(u.workers[idx], &msg.NewStoreStream{
+			ID:              u.id,
+			ProtocolVersion: msg.ProtocolVersion,
+			UploadToken:     u.token,
+		})
+		if err != nil {
+			u.failed[idx] = true
+			return err
+		}
+		s = stream.NewFrameStream(conn)
+		u.streams[idx] = s
+	}
+
+	err := s.WriteFrame(frame)
+	if err == nil {
+		var ack *stream.Ack
+		ack, err = s.ReadAck()
+		if err == nil && ack.FrameID != frame.FrameID {
+			err = fmt.Errorf("ack frame id %d mismatch", ack.FrameID)
+		}
+	}
+	if err != nil {
+		s.Close()
+		delete(u.streams, idx)
+		u.failed[idx] = true
+		return err
+	}
+	return nil
+}
+
+func (u *chunkUploader) Close() {
+	for _, s := range u.streams {
+		s.WriteFrame(&stream.Frame{
+			Version: stream.Version1,
+			Type:    stream.TypeClose,
+		})
+		s.Close()
+	}
+}
+
+// chunkFetcher keeps one fetch stream to each worker.
+type chunkFetcher struct {
+	id        string
+	workers   []string
+	conns     map[int]net.Conn
+	streams   map[int]*stream.FrameStream
+	failed    map[int]bool
+	debugMode bool
+}
+
+func newChunkFetcher(id string, workers []string, debugMode bool) *chunkFetcher {
+	return &chunkFetcher{
+		id:        id,
+		workers:   workers,
+		conns:     make(map[int]net.Conn),
+		streams:   make(map[int]*stream.FrameStream),
+		failed:    make(map[int]bool),
+		debugMode: debugMode,
+	}
+}
+
+func (f *chunkFetcher) Get(idx int, chunkID uint64) (*stream.Frame, error) {
+	if f.failed[idx] {
+		return nil, fmt.Errorf("worker is unavailable")
+	}
+	conn, ok := f.conns[idx]
+	if !ok {
+		var err error
+		conn, err = dialStorageWorker(f.workers[idx], &msg.NewFetchStream{
+			ID:              f.id,
+			ProtocolVersion: msg.ProtocolVersion,
+		})
+		if err != nil {
+			f.failed[idx] = true
+			return nil, err
+		}
+		f.conns[idx] = conn
+		f.streams[idx] = stream.NewFrameStream(conn)
+	}
+	s := f.streams[idx]
+
+	err := msg.WriteMsg(conn, &msg.FetchChunk{
+		ChunkID: int64(chunkID),
+	})
+	var frame *stream.Frame
+	if err == nil {
+		frame, err = s.ReadFrame()
+		if err == nil && frame.FrameID != chunkID {
+			err = fmt.Errorf("frame id %d mismatch", frame.FrameID)
+		}
+	}
+	if err != nil {
+		s.Close()
+		delete(f.conns, idx)
+		delete(f.streams, idx)
+		f.failed[idx] = true
+		return nil, err
+	}
+
+	if frame.Type == stream.TypeError {
+		return nil, fmt.Errorf(string(frame.Buf))
+	}
+	if frame.Type != stream.TypeData {
+		return nil, fmt.Errorf("unexpected frame type %d", frame.Type)
+	}
+	return frame, nil
+}
+
+func (f *chunkFetcher) Close() {
+	for _, s := range f.streams {
+		s.Close()
+	}
+}
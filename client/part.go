@@ -0,0 +1,202 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	partSuffix = ".fft-part"
+
+	// max tries to find a free name with rename policy
+	maxRenameTries = 1000
+)
+
+// partFile is where a file is received to, it replaces the destination only after it's received completely.
+// Ranges written to it are recorded, since a preallocated file always has the right size.
+type partFile struct {
+	*os.File
+	path      string
+	size      int64
+	committed bool
+
+	// offset of next Write
+	offset  int64
+	written spans
+	mu      sync.Mutex
+}
+
+// createPartFile creates path.fft-part and reserves size bytes for it.
+func createPartFile(path string, size int64) (*partFile, error) {
+	f, err := os.OpenFile(path+partSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = preallocate(f, size); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("preallocate %d bytes for %s error: %v", size, f.Name(), err)
+	}
+	return &partFile{
+		File: f,
+		path: path,
+		size: size,
+	}, nil
+}
+
+func (pf *partFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := pf.File.WriteAt(p, off)
+	pf.mu.Lock()
+	pf.written.add(off, off+int64(n))
+	pf.mu.Unlock()
+	return n, err
+}
+
+// Write writes p after data written by last Write, it's used by receivers writing frames in order.
+func (pf *partFile) Write(p []byte) (int, error) {
+	n, err := pf.WriteAt(p, pf.offset)
+	pf.offset += int64(n)
+	return n, err
+}
+
+// Commit flushes the file to disk, checks all bytes of it are written and moves it to the destination by policy.
+// It returns the final path.
+func (pf *partFile) Commit(noClobber, rename bool) (string, error) {
+	pf.mu.Lock()
+	missing := pf.written.missing(pf.size)
+	pf.mu.Unlock()
+	if missing > 0 {
+		return "", fmt.Errorf("received file is incomplete, %d of %d bytes are missing", missing, pf.size)
+	}
+
+	if err := pf.Sync(); err != nil {
+		return "", err
+	}
+	info, err := pf.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != pf.size {
+		return "", fmt.Errorf("received file size is %d, expect %d", info.Size(), pf.size)
+	}
+	if err = pf.File.Close(); err != nil {
+		return "", err
+	}
+
+	path, err := finalize(pf.Name(), pf.path, noClobber, rename)
+	if err != nil {
+		return "", err
+	}
+	pf.committed = true
+
+	// the new name is lost in a crash until the directory is flushed
+	if err = syncDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Close removes the part file if it's not committed, a half-written file never looks complete.
+func (pf *partFile) Close() {
+	if pf.committed {
+		return
+	}
+	pf.File.Close()
+	os.Remove(pf.Name())
+}
+
+// finalize moves tmp to path. Existing file at path is replaced by default,
+// it's kept if noClobber is true, or tmp is moved to a free name like name_1.ext if rename is true.
+func finalize(tmp string, path string, noClobber, rename bool) (string, error) {
+	switch {
+	case rename:
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		candidate := path
+		for i := 1; i <= maxRenameTries; i++ {
+			err := moveNoReplace(tmp, candidate)
+			if err == nil {
+				return candidate, nil
+			}
+			if !os.IsExist(err) {
+				return "", err
+			}
+			candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+		}
+		return "", fmt.Errorf("no free name for %s", path)
+	case noClobber:
+		if err := moveNoReplace(tmp, path); err != nil {
+			if os.IsExist(err) {
+				return "", fmt.Errorf("%s already exists", path)
+			}
+			return "", err
+		}
+		return path, nil
+	default:
+		return path, os.Rename(tmp, path)
+	}
+}
+
+// moveNoReplace moves src to dst only if dst doesn't exist.
+// A hard link fails atomically if dst exists, rename is used if hard links are not supported.
+func moveNoReplace(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	if _, serr := os.Lstat(dst); serr == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: os.ErrExist}
+	}
+	return os.Rename(src, dst)
+}
+
+// spans are sorted and merged ranges [start, end) of written bytes.
+type spans []span
+
+type span struct {
+	start int64
+	end   int64
+}
+
+func (s *spans) add(start, end int64) {
+	if start >= end {
+		return
+	}
+	list := *s
+	// first span which may touch [start, end)
+	i := sort.Search(len(list), func(i int) bool { return list[i].end >= start })
+	j := i
+	for j < len(list) && list[j].start <= end {
+		if list[j].start < start {
+			start = list[j].start
+		}
+		if list[j].end > end {
+			end = list[j].end
+		}
+		j++
+	}
+	merged := append(list[:i:i], span{start, end})
+	*s = append(merged, list[j:]...)
+}
+
+// missing returns how many bytes in [0, size) are not written.
+func (s spans) missing(size int64) int64 {
+	missing := size
+	for _, sp := range s {
+		start, end := sp.start, sp.end
+		if end > size {
+			end = size
+		}
+		if start < end {
+			missing -= end - start
+		}
+	}
+	return missing
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpans(t *testing.T) {
+	var s spans
+	s.add(10, 20)
+	s.add(30, 40)
+	s.add(0, 5)
+	s.add(15, 25)
+	s.add(50, 50)
+	if len(s) != 3 || s[1] != (span{10, 25}) {
+		t.Fatalf("spans %v", s)
+	}
+	if missing := s.missing(40); missing != 40-5-15-10 {
+		t.Fatalf("missing %d bytes", missing)
+	}
+	s.add(5, 30)
+	if len(s) != 1 || s[0] != (span{0, 40}) {
+		t.Fatalf("spans %v after filling gaps", s)
+	}
+	if missing := s.missing(40); missing != 0 {
+		t.Fatalf("missing %d bytes", missing)
+	}
+	if missing := s.missing(45); missing != 5 {
+		t.Fatalf("missing %d bytes after the end", missing)
+	}
+}
+
+func TestPartFileCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fft-part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	pf, err := createPartFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pf.WriteAt([]byte("56789"), 5); err != nil {
+		t.Fatal(err)
+	}
+	// preallocated file has the right size, but it's not received completely
+	if _, err = pf.Commit(false, false); err == nil {
+		t.Fatalf("commit incomplete file: expect error")
+	}
+	if _, err = pf.Write([]byte("01234")); err != nil {
+		t.Fatal(err)
+	}
+	finalPath, err := pf.Commit(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.Close()
+
+	data, err := ioutil.ReadFile(finalPath)
+	if err != nil || string(data) != "0123456789" || finalPath != path {
+		t.Fatalf("committed file %s: %q, %v", finalPath, data, err)
+	}
+	if _, err = os.Stat(path + partSuffix); !os.IsNotExist(err) {
+		t.Fatalf("part file is left")
+	}
+}
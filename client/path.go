@@ -0,0 +1,333 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+const (
+	// broken paths to a worker are redialed after 1s, 2s, 4s ... and given up after maxRedials failures in a row
+	redialBaseDelay = time.Second
+	redialMaxDelay  = 8 * time.Second
+	maxRedials      = 5
+
+	// how long to wait for server's answer of GetWorkers
+	getWorkersTimeout = 10 * time.Second
+
+	// a retired path is closed by sender after frames through it are acked, receiver closes it after this time
+	retireTimeout = 30 * time.Second
+)
+
+// pathManager keeps a stream to each worker until the transfer is done. Broken streams are redialed with backoff,
+// workers which can't be reached are reported to server for a fresh list shared with the peer.
+// Server also pushes workers registering and leaving in transfer, new workers are used at once
+// and paths to workers which have left are retired.
+type pathManager struct {
+	// connection to server, workers are not refreshed if it's nil
+	conn       net.Conn
+	generation int64
+
+	// broken streams are redialed only if the peer supports resuming, otherwise nobody is paired with them
+	resume bool
+
+	// runStream blocks until the stream to addr is closed, it returns an error if the stream can't be set up.
+	// The stream should be closed gracefully after retireCh is closed.
+	runStream func(addr string, retireCh <-chan struct{}) error
+	streams   sync.WaitGroup
+
+	// no more streams are started after waiting is true
+	waiting bool
+	mu      sync.Mutex
+
+	doneCh    <-chan struct{}
+	lostCh    chan string
+	debugMode bool
+
+	// messages from server are read by readLoop until readStopCh is closed
+	respCh     chan *msg.GetWorkersResp
+	eventCh    chan *msg.WorkerEvent
+	readStopCh chan struct{}
+	readDoneCh chan struct{}
+}
+
+func newPathManager(conn net.Conn, serverVersion int64, resume bool, runStream func(addr string, retireCh <-chan struct{}) error,
+	doneCh <-chan struct{}, debugMode bool) *pathManager {
+
+	// old server doesn't answer GetWorkers, and new workers are useless if the peer can't resume
+	if serverVersion < msg.ProtocolVersionGetWorkers || !resume {
+		conn = nil
+	}
+	return &pathManager{
+		conn:       conn,
+		resume:     resume,
+		runStream:  runStream,
+		doneCh:     doneCh,
+		lostCh:     make(chan string),
+		debugMode:  debugMode,
+		respCh:     make(chan *msg.GetWorkersResp),
+		eventCh:    make(chan *msg.WorkerEvent),
+		readStopCh: make(chan struct{}),
+		readDoneCh: make(chan struct{}),
+	}
+}
+
+// run keeps streams to workers until doneCh is closed, it returns an error if all workers are lost.
+func (pm *pathManager) run(workers []string) error {
+	if pm.conn != nil {
+		go pm.readLoop()
+		defer pm.stopReading()
+	}
+
+	// retireCh of each running path, paths to workers removed by server are retired only if there are others
+	paths := make(map[string]chan struct{})
+	removed := make(map[string]bool)
+	lost := make([]string, 0)
+
+	start := func(addr string) {
+		delete(removed, addr)
+		if _, ok := paths[addr]; ok {
+			return
+		}
+		log(pm.debugMode, "[%s] new worker", addr)
+		retireCh := make(chan struct{})
+		paths[addr] = retireCh
+		go pm.keep(addr, retireCh)
+	}
+	retireRemoved := func() {
+		if len(removed) >= len(paths) {
+			return
+		}
+		for addr := range removed {
+			log(pm.debugMode, "[%s] retire worker", addr)
+			close(paths[addr])
+			delete(paths, addr)
+			delete(removed, addr)
+		}
+	}
+	for _, addr := range workers {
+		start(addr)
+	}
+
+	// not nil while waiting for GetWorkersResp, workers are asked again after it if more are lost in waiting
+	var (
+		respTimeoutCh <-chan time.Time
+		askAgain      bool
+	)
+	ask := func() {
+		if respTimeoutCh != nil {
+			askAgain = true
+			return
+		}
+		if err := pm.askWorkers(lost); err != nil {
+			log(pm.debugMode, "get workers error: %v", err)
+			return
+		}
+		respTimeoutCh = time.After(getWorkersTimeout)
+	}
+
+	for {
+		select {
+		case addr := <-pm.lostCh:
+			if _, ok := paths[addr]; !ok {
+				continue
+			}
+			delete(paths, addr)
+			delete(removed, addr)
+			lost = append(lost, addr)
+			log(pm.debugMode, "[%s] worker is lost", addr)
+			ask()
+		case m := <-pm.respCh:
+			respTimeoutCh = nil
+			if m.Error != "" {
+				log(pm.debugMode, "get workers error: %s", m.Error)
+			} else {
+				pm.generation = m.Generation
+				// server's list is shared with the peer, paths not in it are retired
+				for addr := range paths {
+					if !containsString(m.Workers, addr) {
+						removed[addr] = true
+					}
+				}
+				for _, addr := range m.Workers {
+					// peer may still reach the worker we can't
+					if !containsString(lost, addr) {
+						start(addr)
+					}
+				}
+				retireRemoved()
+			}
+			if askAgain {
+				askAgain = false
+				ask()
+			}
+		case <-respTimeoutCh:
+			respTimeoutCh = nil
+			log(pm.debugMode, "get workers error: timeout")
+		case e := <-pm.eventCh:
+			pm.generation = e.Generation
+			for _, addr := range e.Added {
+				// worker has registered again, try it again
+				lost = removeAddr(lost, addr)
+				start(addr)
+			}
+			for _, addr := range e.Removed {
+				if _, ok := paths[addr]; ok {
+					removed[addr] = true
+				}
+			}
+			retireRemoved()
+		case <-pm.doneCh:
+			return nil
+		}
+
+		if len(paths) == 0 && respTimeoutCh == nil {
+			break
+		}
+	}
+
+	select {
+	case <-pm.doneCh:
+		return nil
+	default:
+	}
+	return fmt.Errorf("all paths to workers are lost")
+}
+
+// keep runs streams to addr one after another until doneCh or retireCh is closed,
+// addr is lost after maxRedials failures in a row, or after the first stream if the peer can't resume.
+func (pm *pathManager) keep(addr string, retireCh <-chan struct{}) {
+	delay := redialBaseDelay
+	failures := 0
+	for {
+		pm.mu.Lock()
+		if pm.waiting {
+			pm.mu.Unlock()
+			return
+		}
+		pm.streams.Add(1)
+		pm.mu.Unlock()
+
+		err := pm.runStream(addr, retireCh)
+		pm.streams.Done()
+		select {
+		case <-pm.doneCh:
+			return
+		case <-retireCh:
+			return
+		default:
+		}
+
+		if err != nil {
+			failures++
+			log(pm.debugMode, "[%s] %v", addr, err)
+		} else {
+			failures, delay = 0, redialBaseDelay
+		}
+		if failures >= maxRedials || !pm.resume {
+			select {
+			case pm.lostCh <- addr:
+			case <-pm.doneCh:
+			case <-retireCh:
+			}
+			return
+		}
+
+		log(pm.debugMode, "[%s] redial in %s", addr, delay)
+		select {
+		case <-time.After(delay):
+		case <-pm.doneCh:
+			return
+		case <-retireCh:
+			return
+		}
+		if delay *= 2; delay > redialMaxDelay {
+			delay = redialMaxDelay
+		}
+	}
+}
+
+// askWorkers asks server for workers except lost ones, the answer is read by readLoop and the peer gets the same list.
+func (pm *pathManager) askWorkers(lost []string) error {
+	if pm.conn == nil {
+		return fmt.Errorf("server doesn't support refreshing workers")
+	}
+	return msg.WriteMsg(pm.conn, &msg.GetWorkers{
+		Generation: pm.generation,
+		Lost:       lost,
+	})
+}
+
+// readLoop reads answers of GetWorkers and WorkerEvent pushed by server until stopReading is called.
+func (pm *pathManager) readLoop() {
+	defer close(pm.readDoneCh)
+	for {
+		raw, err := msg.ReadMsg(pm.conn)
+		if err != nil {
+			return
+		}
+		switch m := raw.(type) {
+		case *msg.GetWorkersResp:
+			select {
+			case pm.respCh <- m:
+			case <-pm.readStopCh:
+				return
+			}
+		case *msg.WorkerEvent:
+			select {
+			case pm.eventCh <- m:
+			case <-pm.readStopCh:
+				return
+			}
+		default:
+			// unknown messages are ignored
+		}
+	}
+}
+
+// stopReading stops readLoop, conn can be read by others after it returns.
+func (pm *pathManager) stopReading() {
+	close(pm.readStopCh)
+	pm.conn.SetReadDeadline(time.Now())
+	<-pm.readDoneCh
+	pm.conn.SetReadDeadline(time.Time{})
+}
+
+// wait waits for streams to be closed until timeout.
+func (pm *pathManager) wait(timeout time.Duration) {
+	pm.mu.Lock()
+	pm.waiting = true
+	pm.mu.Unlock()
+
+	closedCh := make(chan struct{})
+	go func() {
+		pm.streams.Wait()
+		close(closedCh)
+	}()
+	select {
+	case <-closedCh:
+	case <-time.After(timeout):
+	}
+}
+
+func removeAddr(list []string, addr string) []string {
+	newList := make([]string, 0, len(list))
+	for _, tmp := range list {
+		if tmp != addr {
+			newList = append(newList, tmp)
+		}
+	}
+	return newList
+}
+
+func containsString(list []string, s string) bool {
+	for _, tmp := range list {
+		if tmp == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func TestPathManagerWithoutResume(t *testing.T) {
+	var dials int32
+	doneCh := make(chan struct{})
+	pm := newPathManager(nil, msg.ProtocolVersion, false, func(addr string, retireCh <-chan struct{}) error {
+		atomic.AddInt32(&dials, 1)
+		return fmt.Errorf("broken")
+	}, doneCh, false)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pm.run([]string{"a", "b"})
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("all paths are broken: expect error")
+		}
+	case <-time.After(redialBaseDelay / 2):
+		t.Fatalf("broken paths are redialed though peer can't resume")
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("%d streams are dialed, expect 2", n)
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cheggaaa/pb"
+)
+
+// recvPolicy decides which files receiver accepts, it's applied to each file of a directory too.
+type recvPolicy struct {
+	// bytes, 0 means no limit
+	maxSize int64
+
+	// lower case extensions with dot, empty means all files are allowed
+	allowExt map[string]bool
+
+	// ask user before receiving
+	confirm bool
+}
+
+func newRecvPolicy(maxSizeMB int64, allowExt string, confirm bool) *recvPolicy {
+	p := &recvPolicy{
+		maxSize:  maxSizeMB * 1024 * 1024,
+		allowExt: make(map[string]bool),
+		confirm:  confirm,
+	}
+	for _, ext := range strings.Split(allowExt, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		p.allowExt[ext] = true
+	}
+	return p
+}
+
+// check returns why the file is not accepted.
+func (p *recvPolicy) check(name string, size int64) error {
+	if p.maxSize > 0 && size > p.maxSize {
+		return fmt.Errorf("%s is larger than max size %s", pb.Format(size).To(pb.U_BYTES).String(),
+			pb.Format(p.maxSize).To(pb.U_BYTES).String())
+	}
+	if len(p.allowExt) > 0 && !p.allowExt[strings.ToLower(path.Ext(name))] {
+		return fmt.Errorf("extension of %s is not allowed", name)
+	}
+	return nil
+}
+
+// ask prints question to out and reads the answer from stdin, only "y" or "yes" means yes.
+func (p *recvPolicy) ask(out io.Writer, question string) (bool, error) {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for f, so disk full is found before receiving.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	// some filesystems don't support fallocate
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
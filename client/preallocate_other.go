@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"os"
+)
+
+// preallocate only extends f to size, space may be not reserved on disk.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -3,12 +3,16 @@ package client
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fatedier/fft/pkg/e2e"
+	"github.com/fatedier/fft/pkg/fname"
 	fio "github.com/fatedier/fft/pkg/io"
 	"github.com/fatedier/fft/pkg/msg"
 	"github.com/fatedier/fft/pkg/receiver"
@@ -17,11 +21,19 @@ import (
 	"github.com/cheggaaa/pb"
 )
 
+// a stream is redialed if nothing is read from it in this time
+const streamIdleTimeout = 60 * time.Second
+
 func (svc *Service) recvFile(id string, filePath string) error {
-	isDir := false
+	// "-" means writing to stdout
+	toStdout := filePath == "-"
+	isDir, exists := false, false
 	finfo, err := os.Stat(filePath)
-	if err == nil && finfo.IsDir() {
-		isDir = true
+	if err == nil {
+		isDir, exists = finfo.IsDir(), true
+	}
+	if exists && !isDir && svc.noClobber {
+		return fmt.Errorf("%s already exists", filePath)
 	}
 
 	conn, err := net.Dial("tcp", svc.serverAddr)
@@ -32,16 +44,24 @@ func (svc *Service) recvFile(id string, filePath string) error {
 	defer conn.Close()
 
 	msg.WriteMsg(conn, &msg.ReceiveFile{
-		ID:         id,
-		CacheCount: int64(svc.cacheCount),
+		ID:              id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.capabilities(),
+		CacheCount:      int64(svc.cacheCount),
+		WaitTimeout:     int64(svc.wait / time.Second),
 	})
 
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	raw, err := msg.ReadMsg(conn)
+	// keep stdout clean for file content
+	out := io.Writer(os.Stdout)
+	if toStdout {
+		out = os.Stderr
+	}
+
+	fmt.Fprintf(out, "Wait sender...\n")
+	raw, err := svc.readMatchResp(conn)
 	if err != nil {
 		return err
 	}
-	conn.SetReadDeadline(time.Time{})
 
 	m, ok := raw.(*msg.ReceiveFileResp)
 	if !ok {
@@ -50,31 +70,75 @@ func (svc *Service) recvFile(id string, filePath string) error {
 	if m.Error != "" {
 		return fmt.Errorf(m.Error)
 	}
+	if err = svc.checkCapabilities(m.ProtocolVersion, m.Capabilities); err != nil {
+		return err
+	}
 
 	if len(m.Workers) == 0 {
 		return fmt.Errorf("no available workers")
 	}
+	// offer comes from the remote sender, name is printed and used as a path
+	name, err := fname.CleanName(m.Name)
+	if err != nil {
+		return svc.reject(conn, id, m, fmt.Errorf("sender's %v", err))
+	}
+	m.Name = name
+	svc.printOffer(out, m)
+	if err = svc.checkOffer(out, id, m); err != nil {
+		return svc.reject(conn, id, m, err)
+	}
 
-	fmt.Printf("Recv filename: %s Size: %s\n", m.Name, pb.Format(m.Fsize).To(pb.U_BYTES).String())
+	if m.Sync {
+		if toStdout || (exists && !isDir) {
+			return svc.reject(conn, id, m, fmt.Errorf("sender syncs a directory, recv_file should be a directory"))
+		}
+		if err = svc.accept(conn, m); err != nil {
+			return err
+		}
+		return svc.recvSync(conn, id, m, filePath)
+	}
+	if svc.sync {
+		return svc.reject(conn, id, m, fmt.Errorf("sender doesn't sync a directory"))
+	}
+	if toStdout && m.Swarm {
+		return svc.reject(conn, id, m, fmt.Errorf("can't write to stdout in swarm mode since chunks are received out of order"))
+	}
 	if svc.debugMode {
-		fmt.Printf("Workers: %v\n", m.Workers)
+		fmt.Fprintf(out, "Workers: %v\n", m.Workers)
 	}
 
-	realPath := filePath
-	if isDir {
-		realPath = filepath.Join(filePath, m.Name)
+	var (
+		recv     *receiver.Receiver
+		df       *deltaFile
+		pf       *partFile
+		realPath string
+	)
+	if !toStdout {
+		realPath = filePath
+		if isDir {
+			realPath = filepath.Join(filePath, m.Name)
+			if finfo, err := os.Stat(realPath); err == nil && (finfo.IsDir() || svc.noClobber) {
+				return svc.reject(conn, id, m, fmt.Errorf("%s already exists", realPath))
+			}
+		}
 	}
-	f, err := os.Create(realPath)
-	if err != nil {
+	if !toStdout && !m.Delta {
+		// data is written to a part file, it replaces realPath only after it's received completely
+		pf, err = createPartFile(realPath, m.Fsize)
+		if err != nil {
+			return svc.reject(conn, id, m, err)
+		}
+		defer pf.Close()
+	}
+	if err = svc.accept(conn, m); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	var wait sync.WaitGroup
 	count := m.Fsize
 	bar := pb.New(int(count))
 	bar.ShowSpeed = true
 	bar.SetUnits(pb.U_BYTES)
+	bar.Output = out
 
 	if !svc.debugMode {
 		bar.Start()
@@ -84,87 +148,392 @@ func (svc *Service) recvFile(id string, filePath string) error {
 		bar.Add(n)
 	}
 
-	recv := receiver.NewReceiver(0, fio.NewCallbackWriter(f, callback))
-	for _, worker := range m.Workers {
-		wait.Add(1)
-		go func(addr string) {
-			newRecvStream(recv, id, addr, svc.debugMode)
-			wait.Done()
-		}(worker)
+	if m.Delta {
+		// sender only sends data our file at realPath doesn't have
+		recv, df, err = newDeltaReceiver(conn, realPath, os.Stdout, callback, svc.cacheCount)
+		if err != nil {
+			return err
+		}
+		defer df.Close()
+	} else if toStdout {
+		recv = receiver.NewReceiver(0, fio.NewCallbackWriter(os.Stdout, callback), svc.cacheCount)
+	} else {
+		if m.Swarm {
+			err = svc.recvSwarm(conn, id, m, pf, callback)
+			if !svc.debugMode {
+				bar.Finish()
+			}
+			if err != nil {
+				return err
+			}
+			return svc.commit(out, realPath, pf.Commit)
+		}
+		if m.Dedup {
+			cached, err := svc.recvDedup(conn, id, m, pf, callback)
+			if !svc.debugMode {
+				bar.Finish()
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Dedup: %s from cache, %s received\n", pb.Format(cached).To(pb.U_BYTES).String(),
+				pb.Format(m.Fsize-cached).To(pb.U_BYTES).String())
+			return svc.commit(out, realPath, pf.Commit)
+		}
+
+		if m.FrameSize > 0 {
+			recv = receiver.NewFileReceiver(0, fio.NewCallbackWriterAt(pf, callback), int(m.FrameSize), svc.cacheCount)
+		} else {
+			// sender doesn't tell us it's frame size, write frames in order
+			recv = receiver.NewReceiver(0, fio.NewCallbackWriter(pf, callback), svc.cacheCount)
+		}
 	}
+	if m.Mailbox {
+		err = svc.fetchMailbox(id, m, recv)
+	} else {
+		err = svc.recvStreams(conn, id, m, recv)
+	}
+	if !svc.debugMode {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+	if df != nil {
+		if err = recv.Verify(); err != nil {
+			return err
+		}
+		return svc.commit(out, realPath, df.Commit)
+	}
+	if pf != nil {
+		return svc.commit(out, realPath, pf.Commit)
+	}
+	return nil
+}
 
-	recvDoneCh := make(chan struct{})
-	streamCloseCh := make(chan struct{})
+// commit moves the received file to realPath by policy, the final path is printed if it's renamed.
+func (svc *Service) commit(out io.Writer, realPath string, commit func(noClobber, rename bool) (string, error)) error {
+	path, err := commit(svc.noClobber, svc.rename)
+	if err != nil {
+		return err
+	}
+	if path != realPath {
+		fmt.Fprintf(out, "%s already exists, saved as %s\n", realPath, path)
+	}
+	return nil
+}
+
+// recvStreams receives frames to recv through all workers in m until recv is finished or aborted.
+// Broken streams are redialed, and workers are refreshed through conn if some of them can't be reached.
+func (svc *Service) recvStreams(conn net.Conn, id string, m *msg.ReceiveFileResp, recv *receiver.Receiver) error {
+	cfg, err := svc.recvStreamConfig(id, m)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt32(&svc.streaming, 1)
+	defer atomic.AddInt32(&svc.streaming, -1)
+
+	doneCh := make(chan struct{})
+	pm := newPathManager(conn, m.ProtocolVersion, msg.HasCapability(m.Capabilities, msg.CapResume), func(addr string, retireCh <-chan struct{}) error {
+		return newRecvStream(recv, addr, cfg, retireCh)
+	}, doneCh, svc.debugMode)
+	pathErrCh := make(chan error, 1)
 	go func() {
-		recv.Run()
-		close(recvDoneCh)
+		pathErrCh <- pm.run(m.Workers)
 	}()
+	recvErrCh := make(chan error, 1)
 	go func() {
-		wait.Wait()
-		close(streamCloseCh)
+		recvErrCh <- recv.Run()
 	}()
 
-	select {
-	case <-recvDoneCh:
-	case <-streamCloseCh:
+	start := time.Now()
+	cancelCh := svc.cancelCh
+	ticker := time.NewTicker(time.Second)
+	for finished := false; !finished; {
 		select {
-		case <-recvDoneCh:
-		case <-time.After(2 * time.Second):
+		case err = <-recvErrCh:
+			finished = true
+		case err = <-pathErrCh:
+			recv.Abort(err)
+			finished = true
+		case <-cancelCh:
+			recv.Abort(svc.cancelErr)
+			cancelCh = nil
+		case <-ticker.C:
+			if stalled(start, recv.LastProgress(), svc.stallTimeout) {
+				recv.Abort(&cancelError{code: stream.CodeTimeout, err: fmt.Errorf("no progress in %s", svc.stallTimeout)})
+			}
 		}
 	}
+	ticker.Stop()
+	close(doneCh)
 
-	if !svc.debugMode {
-		bar.Finish()
+	// streams are telling sender why we abort, or waiting for sender to close them after the last ack
+	pm.wait(2 * time.Second)
+	if rerr, ok := err.(*stream.RemoteError); ok {
+		return fmt.Errorf("sender aborted: %v", rerr)
+	}
+	return err
+}
+
+func (svc *Service) recvStreamConfig(id string, m *msg.ReceiveFileResp) (*streamConfig, error) {
+	cfg := newStreamConfig(id, svc.key, m.Receivers, svc.debugMode)
+	cfg.index = m.ReceiverIndex
+	if m.Receivers > 1 && len(svc.key) > 0 {
+		sealer, err := e2e.NewSealer(svc.key, id)
+		if err != nil {
+			return nil, err
+		}
+		cfg.sealer = sealer
+	}
+	return cfg, nil
+}
+
+// rejectError is why we don't receive the file, it's told to sender with CodeRejected.
+type rejectError struct {
+	error
+}
+
+// abortCode returns the code telling sender what kind of err we abort with.
+func abortCode(err error) uint8 {
+	switch e := err.(type) {
+	case *cancelError:
+		return e.code
+	case *rejectError:
+		return stream.CodeRejected
+	}
+	return stream.CodeWriteFailed
+}
+
+// printOffer prints what sender offers, sender's address is observed by server.
+func (svc *Service) printOffer(out io.Writer, m *msg.ReceiveFileResp) {
+	size := pb.Format(m.Fsize).To(pb.U_BYTES).String()
+	if m.Sync {
+		fmt.Fprintf(out, "Offer directory: %s Files: %d Size: %s\n", m.Name, m.Files, size)
+	} else {
+		fmt.Fprintf(out, "Recv filename: %s Size: %s\n", m.Name, size)
+	}
+	if m.SenderAddr != "" {
+		from := fmt.Sprintf("From: %s", m.SenderAddr)
+		if m.Fingerprint != "" {
+			from += fmt.Sprintf(" Key fingerprint: %s", m.Fingerprint)
+		}
+		fmt.Fprintln(out, from)
+	}
+}
+
+// checkOffer returns why we don't accept the offer, user is asked if confirm is required.
+func (svc *Service) checkOffer(out io.Writer, id string, m *msg.ReceiveFileResp) error {
+	if m.Fingerprint != "" && len(svc.key) > 0 && m.Fingerprint != svc.fingerprint(id) {
+		return fmt.Errorf("sender's key fingerprint %s doesn't match ours %s", m.Fingerprint, svc.fingerprint(id))
+	}
+	// each file in a directory is checked after we get the manifest
+	if !m.Sync {
+		if err := svc.policy.check(m.Name, m.Fsize); err != nil {
+			return err
+		}
+	}
+	if !svc.policy.confirm {
+		return nil
+	}
+	question := fmt.Sprintf("Receive %s?", m.Name)
+	if m.Sync {
+		question = fmt.Sprintf("Receive directory %s with %d files?", m.Name, m.Files)
+	}
+	ok, err := svc.policy.ask(out, question)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("receiver declined %s", m.Name)
 	}
 	return nil
 }
 
-func newRecvStream(recv *receiver.Receiver, id string, addr string, debugMode bool) {
-	conn, err := net.Dial("tcp", addr)
+// accept tells sender to start sending if it's waiting for our answer.
+func (svc *Service) accept(conn net.Conn, m *msg.ReceiveFileResp) error {
+	if !m.Consent {
+		return nil
+	}
+	return msg.WriteMsg(conn, &msg.OfferAnswer{Accept: true})
+}
+
+// reject tells sender why we don't receive the file, it returns reason.
+// If sender doesn't wait for our answer, it's told through streams.
+func (svc *Service) reject(conn net.Conn, id string, m *msg.ReceiveFileResp, reason error) error {
+	if m.Consent {
+		msg.WriteMsg(conn, &msg.OfferAnswer{Reason: reason.Error()})
+	} else if !m.Swarm && !m.Dedup && !m.Mailbox && !m.Sync {
+		svc.abortStreams(id, m, reason)
+	}
+	return reason
+}
+
+// abortStreams connects to workers only to tell sender why we can't receive the file, like disk full.
+func (svc *Service) abortStreams(id string, m *msg.ReceiveFileResp, reason error) {
+	recv := receiver.NewFilesReceiver(func(fileID uint32) (io.WriterAt, error) {
+		return nil, &rejectError{reason}
+	}, svc.cacheCount)
+	cfg, err := svc.recvStreamConfig(id, m)
 	if err != nil {
-		log(debugMode, "[%s] %v", addr, err)
 		return
 	}
-	conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	// streams are closed after the first frame, or if sender doesn't come in time
+	var wait sync.WaitGroup
+	for _, worker := range m.Workers {
+		wait.Add(1)
+		go func(addr string) {
+			newRecvStream(recv, addr, cfg, nil)
+			wait.Done()
+		}(worker)
+	}
+	wait.Wait()
+}
+
+// newRecvStream receives frames to recv through worker at addr until the stream is closed,
+// it returns an error if the stream can't be set up.
+// After retireCh is closed, sender closes the stream after frames through it are acked, or we close it after retireTimeout.
+func newRecvStream(recv *receiver.Receiver, addr string, cfg *streamConfig, retireCh <-chan struct{}) error {
+	debugMode := cfg.debugMode
+	conn, err := dialWorker(addr, cfg.key)
+	if err != nil {
+		return err
+	}
 
 	msg.WriteMsg(conn, &msg.NewReceiveFileStream{
-		ID: id,
+		ID:              cfg.id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    cfg.caps,
+		Fanout:          cfg.receivers > 1,
+		Auth:            cfg.auth(),
 	})
 
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	raw, err := msg.ReadMsg(conn)
 	if err != nil {
 		conn.Close()
-		log(debugMode, "[%s] %v", addr, err)
-		return
+		return err
 	}
 	conn.SetReadDeadline(time.Time{})
 	m, ok := raw.(*msg.NewReceiveFileStreamResp)
 	if !ok {
 		conn.Close()
-		log(debugMode, "[%s] read NewReceiveFileStreamResp format error", addr)
-		return
+		return fmt.Errorf("read NewReceiveFileStreamResp format error")
 	}
 
 	if m.Error != "" {
 		conn.Close()
-		log(debugMode, "[%s] new recv file stream error: %s", addr, m.Error)
-		return
+		return fmt.Errorf("new recv file stream error: %s", m.Error)
+	}
+	if err = cfg.checkWorker(m.ProtocolVersion, m.Capabilities); err != nil {
+		conn.Close()
+		return err
+	}
+
+	rwc, err := wrapWorkerConn(conn, cfg, false)
+	if err != nil {
+		conn.Close()
+		return err
 	}
 
-	s := stream.NewFrameStream(conn)
+	s := stream.NewFrameStream(rwc)
+
+	// tell sender why we abort if it can read error acks, writing is locked since acks are written concurrently
+	var (
+		writeMu   sync.Mutex
+		version   uint8
+		abortOnce sync.Once
+	)
+	abort := func(err error) {
+		abortOnce.Do(func() {
+			writeMu.Lock()
+			// sender knows why if it aborts first
+			if _, ok := err.(*stream.RemoteError); !ok && version >= stream.Version1 {
+				s.WriteAckError(abortCode(err), err.Error())
+			}
+			writeMu.Unlock()
+			s.Close()
+		})
+	}
+	closeCh := make(chan struct{})
+	defer close(closeCh)
+	go func() {
+		select {
+		case <-recv.Failed():
+			abort(recv.Err())
+		case <-closeCh:
+		}
+	}()
+	go func() {
+		select {
+		case <-retireCh:
+		case <-closeCh:
+			return
+		}
+		select {
+		case <-time.After(retireTimeout):
+			s.Close()
+		case <-closeCh:
+		}
+	}()
+
 	for {
+		// a stream which stalls without being closed is redialed
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
 		frame, err := s.ReadFrame()
 		if err != nil {
-			return
+			log(debugMode, "[%s] read frame error: %v", addr, err)
+			s.Close()
+			return nil
 		}
-		recv.RecvFrame(frame)
-		err = s.WriteAck(&stream.Ack{
-			FileID:  frame.FileID,
-			FrameID: frame.FrameID,
-		})
+
+		switch frame.Type {
+		case stream.TypeData:
+		case stream.TypeClose:
+			s.Close()
+			return nil
+		case stream.TypeError:
+			rerr := frame.Err()
+			log(debugMode, "[%s] sender error: %v", addr, rerr)
+			recv.Abort(rerr)
+			abort(rerr)
+			return nil
+		default:
+			// unknown control frames are ignored
+			continue
+		}
+		if frame.Flags&stream.FlagEncrypted != 0 {
+			if cfg.sealer == nil {
+				s.Close()
+				return fmt.Errorf("frame is encrypted, key is required")
+			}
+			frame.Buf, err = cfg.sealer.Open(nil, frame.FrameID, frame.Buf)
+			if err != nil {
+				s.Close()
+				return err
+			}
+			frame.Flags &^= stream.FlagEncrypted
+		}
+		writeMu.Lock()
+		version = frame.Version
+		writeMu.Unlock()
+		err = recv.RecvFrame(frame)
 		if err != nil {
-			return
+			log(debugMode, "[%s] save frame error: %v", addr, err)
+			abort(err)
+			return nil
+		}
+		// reply in the same version so sender can always parse it
+		ack := stream.NewAck(frame.FileID, frame.FrameID, recv.Window())
+		ack.Version = frame.Version
+		ack.Receiver = uint32(cfg.index)
+		writeMu.Lock()
+		err = s.WriteAck(ack)
+		writeMu.Unlock()
+		if err != nil {
+			s.Close()
+			return nil
 		}
 	}
 }
@@ -3,11 +3,15 @@ package client
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fatedier/fft/pkg/delta"
+	"github.com/fatedier/fft/pkg/e2e"
+	"github.com/fatedier/fft/pkg/fname"
 	fio "github.com/fatedier/fft/pkg/io"
 	"github.com/fatedier/fft/pkg/msg"
 	"github.com/fatedier/fft/pkg/sender"
@@ -37,21 +41,50 @@ func (svc *Service) sendFile(id string, filePath string) error {
 	if finfo.IsDir() {
 		return fmt.Errorf("send file can't be a directory")
 	}
+	// receiver rejects names which are not safe, find it before waiting for receiver
+	name, err := fname.CleanName(finfo.Name())
+	if err != nil {
+		return err
+	}
 
+	var chunks []dedupChunk
+	if svc.dedup {
+		fmt.Printf("Chunking...\n")
+		if chunks, err = splitChunks(io.NewSectionReader(f, 0, finfo.Size())); err != nil {
+			return err
+		}
+	}
+
+	maxReceivers := int64(svc.receivers)
+	if maxReceivers == 0 {
+		maxReceivers = -1
+	}
+	frameSize := int64(svc.frameSize)
+	if svc.swarm {
+		frameSize = swarmChunkSize
+	}
 	msg.WriteMsg(conn, &msg.SendFile{
-		ID:         id,
-		Name:       finfo.Name(),
-		Fsize:      finfo.Size(),
-		CacheCount: int64(svc.cacheCount),
+		ID:              id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.capabilities(),
+		Name:            name,
+		Fsize:           finfo.Size(),
+		FrameSize:       frameSize,
+		CacheCount:      int64(svc.cacheCount),
+		WaitTimeout:     int64(svc.wait / time.Second),
+		MaxReceivers:    maxReceivers,
+		Swarm:           svc.swarm,
+		Delta:           svc.delta,
+		Dedup:           svc.dedup,
+		Files:           1,
+		Fingerprint:     svc.fingerprint(id),
 	})
 
 	fmt.Printf("Wait receiver...\n")
-	conn.SetReadDeadline(time.Now().Add(120 * time.Second))
-	raw, err := msg.ReadMsg(conn)
+	raw, err := svc.readMatchResp(conn)
 	if err != nil {
 		return err
 	}
-	conn.SetReadDeadline(time.Time{})
 
 	m, ok := raw.(*msg.SendFileResp)
 	if !ok {
@@ -60,17 +93,36 @@ func (svc *Service) sendFile(id string, filePath string) error {
 	if m.Error != "" {
 		return fmt.Errorf(m.Error)
 	}
+	if err = svc.checkCapabilities(m.ProtocolVersion, m.Capabilities); err != nil {
+		return err
+	}
 
 	if len(m.Workers) == 0 {
 		return fmt.Errorf("no available workers")
 	}
+	if m.Consent {
+		if err = svc.waitAnswer(conn); err != nil {
+			return err
+		}
+	}
 	svc.cacheCount = int(m.CacheCount)
 	fmt.Printf("ID: %s\n", m.ID)
+	if m.Receivers > 1 {
+		fmt.Printf("Receivers: %d\n", m.Receivers)
+	}
 	if svc.debugMode {
 		fmt.Printf("Workers: %v\n", m.Workers)
 	}
+	if m.Swarm {
+		return svc.seedSwarm(conn, m, f, finfo.Size())
+	}
+	if m.Dedup {
+		return svc.sendDedup(conn, m, f, chunks)
+	}
+	if svc.dedup {
+		fmt.Printf("Receiver has no chunk cache, send the whole file\n")
+	}
 
-	var wait sync.WaitGroup
 	count := finfo.Size()
 	bar := pb.New(int(count))
 	bar.ShowSpeed = true
@@ -83,59 +135,169 @@ func (svc *Service) sendFile(id string, filePath string) error {
 		bar.Add(n)
 	}
 
-	s, err := sender.NewSender(0, fio.NewCallbackReader(f, callback), svc.frameSize, svc.cacheCount)
+	var (
+		s            *sender.Sender
+		deltaStatsCh <-chan *delta.Stats
+	)
+	if m.Delta {
+		sig, err := readDeltaSignature(conn)
+		if err != nil {
+			return err
+		}
+		// delta is generated while it's sent, frames are not at offsets of the file
+		var src io.ReadCloser
+		src, deltaStatsCh = newDeltaSource(fio.NewCallbackReader(f, callback), sig)
+		defer src.Close()
+		s, err = sender.NewSender(0, src, svc.frameSize, svc.cacheCount)
+		if err != nil {
+			return err
+		}
+	} else {
+		s, err = sender.NewReaderAtSender(0, fio.NewCallbackReaderAt(f, callback), finfo.Size(),
+			svc.frameSize, svc.cacheCount, svc.readers)
+		if err != nil {
+			return err
+		}
+	}
+	err = svc.sendStreams(conn, m, s)
+	if !svc.debugMode {
+		bar.Finish()
+	}
 	if err != nil {
 		return err
 	}
+	if deltaStatsCh != nil {
+		select {
+		case stats := <-deltaStatsCh:
+			if stats != nil {
+				fmt.Printf("Delta: sent %s of %s, %s reused from receiver's file\n",
+					pb.Format(stats.Literal).To(pb.U_BYTES).String(),
+					pb.Format(stats.Size).To(pb.U_BYTES).String(),
+					pb.Format(stats.Copied).To(pb.U_BYTES).String())
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// sendStreams sends frames of s through all workers in m and blocks until all frames are acked or sender is aborted.
+// Broken streams are redialed, and workers are refreshed through conn if some of them can't be reached.
+func (svc *Service) sendStreams(conn net.Conn, m *msg.SendFileResp, s *sender.Sender) error {
+	var err error
+	// use legacy frame format if receiver doesn't support new one
+	if err = s.SetFrameVersion(frameVersion(m.Capabilities)); err != nil {
+		return err
+	}
+	if s.FrameVersion() >= stream.Version1 && svc.codec != nil && msg.HasCapability(m.Capabilities, msg.CapCompression) {
+		if err = s.SetCompression(svc.codec); err != nil {
+			return err
+		}
+	}
 
-	for _, worker := range m.Workers {
-		wait.Add(1)
-		go func(addr string) {
-			newSendStream(s, m.ID, addr, svc.debugMode)
-			wait.Done()
-		}(worker)
+	cfg := newStreamConfig(m.ID, svc.key, m.Receivers, svc.debugMode)
+	if m.Receivers > 1 {
+		if err = s.SetReceivers(int(m.Receivers)); err != nil {
+			return err
+		}
+		if len(svc.key) > 0 {
+			sealer, err := e2e.NewSealer(svc.key, m.ID)
+			if err != nil {
+				return err
+			}
+			if err = s.SetSealer(sealer); err != nil {
+				return err
+			}
+		}
 	}
+
+	atomic.AddInt32(&svc.streaming, 1)
+	defer atomic.AddInt32(&svc.streaming, -1)
+
+	pm := newPathManager(conn, m.ProtocolVersion, msg.HasCapability(m.Capabilities, msg.CapResume), func(addr string, retireCh <-chan struct{}) error {
+		return newSendStream(s, addr, cfg, retireCh)
+	}, s.Done(), svc.debugMode)
+	pathErrCh := make(chan error, 1)
+	go func() {
+		pathErrCh <- pm.run(m.Workers)
+	}()
 	go s.Run()
-	wait.Wait()
 
-	if !svc.debugMode {
-		bar.Finish()
+	// sender is finished after all frames are acked, or canceled by user, watchdog or receiver
+	start := time.Now()
+	cancelCh := svc.cancelCh
+	ticker := time.NewTicker(time.Second)
+	for finished := false; !finished; {
+		select {
+		case <-s.Done():
+			finished = true
+		case err = <-pathErrCh:
+			s.Cancel(stream.CodeUnknown, err)
+		case <-cancelCh:
+			s.Cancel(svc.cancelErr.code, svc.cancelErr)
+			cancelCh = nil
+		case <-ticker.C:
+			if stalled(start, s.LastProgress(), svc.stallTimeout) {
+				s.Cancel(stream.CodeTimeout, fmt.Errorf("no progress in %s", svc.stallTimeout))
+			}
+		}
+	}
+	ticker.Stop()
+	// streams are telling receivers why we abort
+	pm.wait(5 * time.Second)
+
+	if err = s.Err(); err != nil {
+		return err
+	}
+	if failed := s.FailedReceivers(); failed > 0 {
+		return fmt.Errorf("%d of %d receivers failed to receive the file", failed, m.Receivers)
 	}
 	return nil
 }
 
-func newSendStream(s *sender.Sender, id string, addr string, debugMode bool) {
-	conn, err := net.Dial("tcp", addr)
+// newSendStream sends frames of s through worker at addr until the stream is closed or retired,
+// it returns an error if the stream can't be set up.
+func newSendStream(s *sender.Sender, addr string, cfg *streamConfig, retireCh <-chan struct{}) error {
+	conn, err := dialWorker(addr, cfg.key)
 	if err != nil {
-		log(debugMode, "[%s] %v", addr, err)
-		return
+		return err
 	}
-	conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
 
 	msg.WriteMsg(conn, &msg.NewSendFileStream{
-		ID: id,
+		ID:              cfg.id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    cfg.caps,
+		Receivers:       cfg.receivers,
+		Auth:            cfg.auth(),
 	})
 
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	raw, err := msg.ReadMsg(conn)
 	if err != nil {
 		conn.Close()
-		log(debugMode, "[%s] %v", addr, err)
-		return
+		return err
 	}
 	conn.SetReadDeadline(time.Time{})
 	m, ok := raw.(*msg.NewSendFileStreamResp)
 	if !ok {
 		conn.Close()
-		log(debugMode, "[%s] read NewSendFileStreamResp format error", addr)
-		return
+		return fmt.Errorf("read NewSendFileStreamResp format error")
 	}
 
 	if m.Error != "" {
 		conn.Close()
-		log(debugMode, "[%s] new send file stream error: %s", addr, m.Error)
-		return
+		return fmt.Errorf("new send file stream error: %s", m.Error)
+	}
+	if err = cfg.checkWorker(m.ProtocolVersion, m.Capabilities); err != nil {
+		conn.Close()
+		return err
 	}
 
-	s.HandleStream(stream.NewFrameStream(conn))
+	rwc, err := wrapWorkerConn(conn, cfg, true)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.HandleStreamUntil(stream.NewFrameStream(rwc), retireCh)
+	return nil
 }
@@ -1,17 +1,79 @@
 package client
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/dedup"
+	"github.com/fatedier/fft/pkg/e2e"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+const (
+	// how long to wait for the peer to be told after user interrupts us
+	cancelTimeout = 3 * time.Second
 )
 
+// cancelError is why we stop the transfer by ourselves, code is told to the peer.
+type cancelError struct {
+	code uint8
+	err  error
+}
+
+func (e *cancelError) Error() string {
+	return e.err.Error()
+}
+
+var errCanceled = &cancelError{code: stream.CodeCanceled, err: errors.New("interrupted by user")}
+
 type Options struct {
 	ServerAddr string
 	ID         string
 	SendFile   string
 	FrameSize  int
 	CacheCount int
+	Readers    int
 	RecvFile   string
-	DebugMode  bool
+	Key        string
+	Compress   string
+	Mailbox    bool
+	Replicas   int
+	Receivers  int
+	Swarm      bool
+	Delta      bool
+	Sync       bool
+	Delete     bool
+	Dedup      bool
+	ChunkCache string
+	NoClobber  bool
+	Rename     bool
+	Overwrite  bool
+	AllowExt   string
+	Confirm    bool
+
+	// MB
+	MaxSize int64
+
+	// MB
+	ChunkCacheSize int
+	WaitSecond     int
+
+	// seconds, the whole transfer fails if it's not finished in Timeout or there is no progress in StallTimeout,
+	// 0 means no limit
+	Timeout      int
+	StallTimeout int
+
+	DebugMode bool
 }
 
 func (op *Options) Check() error {
@@ -25,9 +87,84 @@ func (op *Options) Check() error {
 		}
 	}
 
+	if op.Mailbox {
+		if op.SendFile == "" {
+			return fmt.Errorf("mailbox is only for sender, receiver gets the file from mailbox automatically")
+		}
+		if op.Key == "" {
+			return fmt.Errorf("key is required in mailbox mode since file is stored on workers")
+		}
+		if op.Replicas <= 0 {
+			return fmt.Errorf("replicas should be greater than 0")
+		}
+	}
+
+	if op.Receivers < 0 {
+		return fmt.Errorf("receivers should not be negative")
+	}
+	if op.Receivers != 1 && (op.SendFile == "" || op.Mailbox) {
+		return fmt.Errorf("receivers is only for sender in relay mode")
+	}
+	if op.Swarm && (op.SendFile == "" || op.Mailbox) {
+		return fmt.Errorf("swarm is only for sender in relay mode")
+	}
+	if op.Delta && (op.SendFile == "" || op.Mailbox || op.Swarm || op.Receivers != 1) {
+		return fmt.Errorf("delta is only for sender in relay mode with one receiver")
+	}
+
+	if op.Sync && (op.Mailbox || op.Swarm || op.Delta || op.Receivers != 1) {
+		return fmt.Errorf("sync can't be used with mailbox, swarm, delta or multiple receivers")
+	}
+	if op.Sync && (op.SendFile == "-" || op.RecvFile == "-") {
+		return fmt.Errorf("sync is only for directories")
+	}
+	if op.Delete && (!op.Sync || op.RecvFile == "") {
+		return fmt.Errorf("delete is only for receiver of sync")
+	}
+
+	if op.Dedup && (op.SendFile == "" || op.Mailbox || op.Swarm || op.Delta || op.Sync || op.Receivers != 1) {
+		return fmt.Errorf("dedup is only for sender in relay mode with one receiver")
+	}
+	if op.ChunkCache != "" && op.ChunkCacheSize <= 0 {
+		return fmt.Errorf("chunk_cache_size should be greater than 0")
+	}
+
+	policies := 0
+	for _, p := range []bool{op.NoClobber, op.Rename, op.Overwrite} {
+		if p {
+			policies++
+		}
+	}
+	if policies > 1 {
+		return fmt.Errorf("only one of no-clobber, rename and overwrite can be used")
+	}
+	if policies > 0 && (op.RecvFile == "" || op.RecvFile == "-" || op.Sync) {
+		return fmt.Errorf("no-clobber, rename and overwrite are only for receiver of a file")
+	}
+
+	if op.MaxSize < 0 {
+		return fmt.Errorf("max-size should not be negative")
+	}
+	if (op.MaxSize > 0 || op.AllowExt != "" || op.Confirm) && op.RecvFile == "" {
+		return fmt.Errorf("max-size, allow-ext and confirm are only for receiver")
+	}
+
 	if op.CacheCount <= 0 {
 		return fmt.Errorf("cache_count should be greater than 0")
 	}
+
+	if op.WaitSecond <= 0 {
+		return fmt.Errorf("wait should be greater than 0")
+	}
+	if op.Timeout < 0 || op.StallTimeout < 0 {
+		return fmt.Errorf("timeout and stall_timeout should not be negative")
+	}
+
+	if op.Compress != "" && op.Compress != "none" {
+		if _, err := codec.Get(op.Compress); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -36,6 +173,50 @@ type Service struct {
 	serverAddr string
 	frameSize  int
 	cacheCount int
+	readers    int
+	replicas   int
+
+	// 0 means any number of receivers until wait timeout
+	receivers int
+	swarm     bool
+
+	// send only data receiver's existing file doesn't have
+	delta bool
+
+	// sync a directory, files not in sender's directory are deleted by receiver if syncDelete is true
+	sync       bool
+	syncDelete bool
+
+	// sender splits file into chunks by content, receiver only gets chunks not in it's chunkCache
+	dedup      bool
+	chunkCache *dedup.Cache
+
+	// how to deal with an existing file at receiver, it's overwritten by default
+	noClobber bool
+	rename    bool
+
+	// which files receiver accepts
+	policy *recvPolicy
+
+	// how long to wait for peer
+	wait time.Duration
+
+	// transfer fails if it's not finished in timeout or there is no progress in stallTimeout, 0 means no limit
+	timeout      time.Duration
+	stallTimeout time.Duration
+
+	// key for end-to-end encryption between sender and receiver
+	key []byte
+
+	// nil means sender doesn't compress frames
+	codec codec.Codec
+
+	// closed when user interrupts us or timeout, transfers in progress tell the peer cancelErr before exiting
+	cancelCh  chan struct{}
+	cancelErr *cancelError
+
+	// count of sendStreams and recvStreams in progress
+	streaming int32
 
 	runHandler func() error
 }
@@ -46,13 +227,51 @@ func NewService(options Options) (*Service, error) {
 	}
 
 	svc := &Service{
-		debugMode:  options.DebugMode,
-		serverAddr: options.ServerAddr,
-		frameSize:  options.FrameSize,
-		cacheCount: options.CacheCount,
+		debugMode:    options.DebugMode,
+		serverAddr:   options.ServerAddr,
+		frameSize:    options.FrameSize,
+		cacheCount:   options.CacheCount,
+		readers:      options.Readers,
+		replicas:     options.Replicas,
+		receivers:    options.Receivers,
+		swarm:        options.Swarm,
+		delta:        options.Delta,
+		sync:         options.Sync,
+		syncDelete:   options.Delete,
+		dedup:        options.Dedup,
+		noClobber:    options.NoClobber,
+		rename:       options.Rename,
+		policy:       newRecvPolicy(options.MaxSize, options.AllowExt, options.Confirm),
+		wait:         time.Duration(options.WaitSecond) * time.Second,
+		timeout:      time.Duration(options.Timeout) * time.Second,
+		stallTimeout: time.Duration(options.StallTimeout) * time.Second,
+		cancelCh:     make(chan struct{}),
+	}
+	if options.Key != "" {
+		svc.key = []byte(options.Key)
+	}
+	if options.Compress != "" && options.Compress != "none" {
+		svc.codec, _ = codec.Get(options.Compress)
+	}
+
+	// chunks can't be copied from cache to stdout out of order
+	if options.ChunkCache != "" && options.RecvFile != "" && options.RecvFile != "-" {
+		cache, err := dedup.OpenCache(options.ChunkCache, int64(options.ChunkCacheSize)*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		svc.chunkCache = cache
 	}
 
-	if options.SendFile != "" {
+	if options.SendFile != "" && options.Mailbox {
+		svc.runHandler = func() error {
+			return svc.sendMailbox(options.ID, options.SendFile)
+		}
+	} else if options.SendFile != "" && options.Sync {
+		svc.runHandler = func() error {
+			return svc.sendSync(options.ID, options.SendFile)
+		}
+	} else if options.SendFile != "" {
 		svc.runHandler = func() error {
 			return svc.sendFile(options.ID, options.SendFile)
 		}
@@ -65,15 +284,231 @@ func NewService(options Options) (*Service, error) {
 }
 
 func (svc *Service) Run() error {
-	err := svc.runHandler()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- svc.runHandler()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	var timeoutCh <-chan time.Time
+	if svc.timeout > 0 {
+		timeoutCh = time.After(svc.timeout)
+	}
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-sigCh:
+		err = svc.cancel(errCanceled, errCh, sigCh)
+	case <-timeoutCh:
+		err = svc.cancel(&cancelError{
+			code: stream.CodeTimeout,
+			err:  fmt.Errorf("transfer is not finished in %s", svc.timeout),
+		}, errCh, sigCh)
+	}
 	if err != nil && svc.debugMode {
 		fmt.Println(err)
 	}
 	return err
 }
 
+// cancel tells the peer why we stop if frames are being transferred and waits a moment for it,
+// interrupting again exits at once.
+func (svc *Service) cancel(reason *cancelError, errCh <-chan error, sigCh <-chan os.Signal) error {
+	svc.cancelErr = reason
+	close(svc.cancelCh)
+	if atomic.LoadInt32(&svc.streaming) == 0 {
+		return reason
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-sigCh:
+	case <-time.After(cancelTimeout):
+	}
+	return reason
+}
+
+// stalled returns true if there is no progress in stallTimeout since start.
+func stalled(start time.Time, lastProgress time.Time, stallTimeout time.Duration) bool {
+	if stallTimeout <= 0 {
+		return false
+	}
+	if lastProgress.Before(start) {
+		lastProgress = start
+	}
+	return time.Since(lastProgress) > stallTimeout
+}
+
 func log(debugMode bool, foramt string, v ...interface{}) {
 	if debugMode {
 		fmt.Printf(foramt+"\n", v...)
 	}
 }
+
+// capabilities returns features this client supports and enables.
+func (svc *Service) capabilities() []string {
+	// receiver can always decompress frames, fetch files from mailbox, receive with others and answer offers,
+	// sender decides whether to use them
+	caps := []string{msg.CapFrameV1, msg.CapResume, msg.CapMultiplexing, msg.CapCompression, msg.CapMailbox, msg.CapFanout,
+		msg.CapSwarm, msg.CapDelta, msg.CapSync, msg.CapConsent, msg.CapMembership}
+	if len(svc.key) > 0 {
+		caps = append(caps, msg.CapEncryption)
+	}
+	if svc.dedup || svc.chunkCache != nil {
+		caps = append(caps, msg.CapDedup)
+	}
+	return caps
+}
+
+// frameVersion returns the frame format both ends agree with.
+func frameVersion(agreed []string) uint8 {
+	if msg.HasCapability(agreed, msg.CapFrameV1) {
+		return stream.Version1
+	}
+	return stream.Version0
+}
+
+// checkCapabilities makes sure the peer agrees with features we must use.
+func (svc *Service) checkCapabilities(protocolVersion int64, agreed []string) error {
+	if err := msg.CheckProtocolVersion(protocolVersion); err != nil {
+		return fmt.Errorf("ffts %v", err)
+	}
+	if len(svc.key) > 0 && !msg.HasCapability(agreed, msg.CapEncryption) {
+		return fmt.Errorf("peer doesn't enable end-to-end encryption, sender and receiver should use the same key")
+	}
+	if len(svc.key) == 0 && msg.HasCapability(agreed, msg.CapEncryption) {
+		return fmt.Errorf("peer enables end-to-end encryption, key is required")
+	}
+	return nil
+}
+
+// readMatchResp reads server's response after peer comes.
+// Server pings us while waiting, pongs are replied so the connection won't be killed as idle.
+// fingerprint returns the fingerprint of our key for id, it's empty if end-to-end encryption is disabled.
+func (svc *Service) fingerprint(id string) string {
+	if len(svc.key) == 0 {
+		return ""
+	}
+	return e2e.Fingerprint(svc.key, id)
+}
+
+// waitAnswer waits for receiver's answer to our offer, it returns the reason if receiver rejects it.
+func (svc *Service) waitAnswer(conn net.Conn) error {
+	fmt.Printf("Wait receiver to accept...\n")
+	raw, err := svc.readMatchResp(conn)
+	if err != nil {
+		return fmt.Errorf("wait for receiver's answer error: %v", err)
+	}
+	m, ok := raw.(*msg.OfferAnswer)
+	if !ok {
+		return fmt.Errorf("read offer answer format error")
+	}
+	if !m.Accept {
+		return fmt.Errorf("receiver rejected: %s", m.Reason)
+	}
+	return nil
+}
+
+func (svc *Service) readMatchResp(conn net.Conn) (msg.Message, error) {
+	for {
+		// in case server is too old to ping
+		conn.SetReadDeadline(time.Now().Add(svc.wait + 30*time.Second))
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := raw.(*msg.Ping); ok {
+			msg.WriteMsg(conn, &msg.Pong{})
+			continue
+		}
+		conn.SetReadDeadline(time.Time{})
+		return raw, nil
+	}
+}
+
+// dialWorker connects to worker with TLS. If key is set, frames will be encrypted end to end,
+// so TLS is skipped and worker can relay data in kernel.
+func dialWorker(addr string, key []byte) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	return conn, nil
+}
+
+// streamConfig is shared by all streams of a transfer.
+type streamConfig struct {
+	id        string
+	key       []byte
+	receivers int64
+	debugMode bool
+
+	// derived from key, nil if end-to-end encryption is disabled
+	streamKey *e2e.StreamKey
+
+	// features of workers streams use, workers reply what they agree with
+	caps []string
+
+	// receiver's index in acks and sealer to open frames, only used with multiple receivers
+	index  int64
+	sealer *e2e.Sealer
+}
+
+// newStreamConfig derives keys of streams from key if it's not empty.
+func newStreamConfig(id string, key []byte, receivers int64, debugMode bool) *streamConfig {
+	cfg := &streamConfig{
+		id:        id,
+		key:       key,
+		receivers: receivers,
+		debugMode: debugMode,
+	}
+	cfg.caps = make([]string, 0)
+	if len(key) > 0 {
+		cfg.streamKey = e2e.NewStreamKey(key, id)
+		cfg.caps = append(cfg.caps, msg.CapEncryption)
+	}
+	if receivers > 1 {
+		cfg.caps = append(cfg.caps, msg.CapFanout)
+	}
+	return cfg
+}
+
+// checkWorker makes sure the worker agrees with all features streams use.
+func (cfg *streamConfig) checkWorker(protocolVersion int64, agreed []string) error {
+	if err := msg.CheckProtocolVersion(protocolVersion); err != nil {
+		return fmt.Errorf("fftw %v", err)
+	}
+	for _, c := range cfg.caps {
+		if !msg.HasCapability(agreed, c) {
+			return fmt.Errorf("fftw doesn't support %s, please upgrade it", c)
+		}
+	}
+	return nil
+}
+
+// auth returns what worker pairs streams of this transfer by besides the ID, it's empty without key.
+func (cfg *streamConfig) auth() string {
+	if cfg.streamKey == nil {
+		return ""
+	}
+	return cfg.streamKey.Auth()
+}
+
+// wrapWorkerConn authenticates the peer and encrypts the whole stream if key is set.
+// Frames are sealed one by one instead if there are multiple receivers, since workers need to read them.
+func wrapWorkerConn(conn net.Conn, cfg *streamConfig, isSender bool) (io.ReadWriteCloser, error) {
+	if cfg.streamKey == nil || cfg.receivers > 1 {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	rwc, err := cfg.streamKey.WrapConn(conn, isSender)
+	conn.SetReadDeadline(time.Time{})
+	return rwc, err
+}
@@ -0,0 +1,17 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+func TestFrameVersion(t *testing.T) {
+	if v := frameVersion(nil); v != stream.Version0 {
+		t.Fatalf("legacy peer gets frame version %d", v)
+	}
+	if v := frameVersion([]string{msg.CapCompression, msg.CapFrameV1}); v != stream.Version1 {
+		t.Fatalf("new peer gets frame version %d", v)
+	}
+}
@@ -0,0 +1,390 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/e2e"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+const (
+	// files are split into chunks in swarm mode, each one is fetched from the peer server assigns
+	swarmChunkSize = 4 * 1024 * 1024
+
+	// how many chunks a receiver fetches in parallel
+	swarmConcurrency = 4
+)
+
+// chunkFile is the file of a swarm peer, sender only reads from it.
+type chunkFile interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// swarmPeer is a participant of a swarm, it serves chunks it has to others through all workers.
+// Sender is peer 0, receiver i is peer i+1.
+type swarmPeer struct {
+	svc       *Service
+	id        string
+	peer      int64
+	workers   []string
+	sealer    *e2e.Sealer
+	f         chunkFile
+	fsize     int64
+	chunkSize int64
+	chunks    int
+
+	have  []bool
+	seeds []net.Conn
+	mu    sync.Mutex
+
+	// requests and responses to server are serialized
+	ctrl   net.Conn
+	ctrlMu sync.Mutex
+}
+
+func (svc *Service) newSwarmPeer(ctrl net.Conn, id string, peer int64, workers []string,
+	f chunkFile, fsize int64, chunkSize int64) (*swarmPeer, error) {
+
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size")
+	}
+	sp := &swarmPeer{
+		svc:       svc,
+		id:        id,
+		peer:      peer,
+		workers:   workers,
+		f:         f,
+		fsize:     fsize,
+		chunkSize: chunkSize,
+		chunks:    int((fsize + chunkSize - 1) / chunkSize),
+		seeds:     make([]net.Conn, 0),
+		ctrl:      ctrl,
+	}
+	sp.have = make([]bool, sp.chunks)
+	if len(svc.key) > 0 {
+		sealer, err := e2e.NewSealer(svc.key, id)
+		if err != nil {
+			return nil, err
+		}
+		sp.sealer = sealer
+	}
+	return sp, nil
+}
+
+// chunkRange returns offset and size of chunk in file.
+func (sp *swarmPeer) chunkRange(chunkID uint64) (int64, int) {
+	offset := int64(chunkID) * sp.chunkSize
+	size := sp.fsize - offset
+	if size > sp.chunkSize {
+		size = sp.chunkSize
+	}
+	return offset, int(size)
+}
+
+func (sp *swarmPeer) hasChunk(chunkID uint64) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return chunkID < uint64(sp.chunks) && sp.have[chunkID]
+}
+
+// startSeeds connects to all workers and serves chunks requested by others.
+// Workers can't be connected are skipped, server will give up us as a source if others can't fetch from us.
+func (sp *swarmPeer) startSeeds() {
+	for _, addr := range sp.workers {
+		conn, err := dialChunkWorker(addr, sp.svc.key, &msg.NewSeedStream{
+			ID:              sp.id,
+			ProtocolVersion: msg.ProtocolVersion,
+			Peer:            sp.peer,
+		})
+		if err != nil {
+			log(sp.svc.debugMode, "[%s] new seed stream error: %v", addr, err)
+			continue
+		}
+		sp.mu.Lock()
+		sp.seeds = append(sp.seeds, conn)
+		sp.mu.Unlock()
+		go sp.serve(addr, conn)
+	}
+}
+
+func (sp *swarmPeer) closeSeeds() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, conn := range sp.seeds {
+		conn.Close()
+	}
+	sp.seeds = sp.seeds[:0]
+}
+
+// serve replies a chunk for each FetchChunk forwarded by worker.
+func (sp *swarmPeer) serve(addr string, conn net.Conn) {
+	defer conn.Close()
+	s := stream.NewFrameStream(conn)
+	buf := make([]byte, sp.chunkSize)
+	for {
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			return
+		}
+		m, ok := raw.(*msg.FetchChunk)
+		if !ok || m.ChunkID < 0 {
+			return
+		}
+
+		chunkID := uint64(m.ChunkID)
+		frame, err := sp.readChunk(chunkID, buf)
+		if err != nil {
+			log(sp.svc.debugMode, "[%s] serve chunk %d error: %v", addr, chunkID, err)
+			frame = &stream.Frame{
+				Version: stream.Version1,
+				Type:    stream.TypeError,
+				FrameID: chunkID,
+				Buf:     []byte(err.Error()),
+			}
+		}
+		frame.FileID = uint32(m.Tag)
+		if err = s.WriteFrame(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (sp *swarmPeer) readChunk(chunkID uint64, buf []byte) (*stream.Frame, error) {
+	if !sp.hasChunk(chunkID) {
+		return nil, fmt.Errorf("chunk not found")
+	}
+	offset, size := sp.chunkRange(chunkID)
+	if _, err := sp.f.ReadAt(buf[:size], offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return sp.svc.sealChunk(sp.sealer, chunkID, buf[:size])
+}
+
+// next reports the last chunk and asks server for a new one.
+func (sp *swarmPeer) next(last *msg.SwarmNext) (*msg.SwarmNextResp, error) {
+	sp.ctrlMu.Lock()
+	defer sp.ctrlMu.Unlock()
+
+	if err := msg.WriteMsg(sp.ctrl, last); err != nil {
+		return nil, err
+	}
+	sp.ctrl.SetReadDeadline(time.Now().Add(30 * time.Second))
+	raw, err := msg.ReadMsg(sp.ctrl)
+	sp.ctrl.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	m, ok := raw.(*msg.SwarmNextResp)
+	if !ok {
+		return nil, fmt.Errorf("read swarm response format error")
+	}
+	if m.Error != "" {
+		return nil, fmt.Errorf(m.Error)
+	}
+	return m, nil
+}
+
+// wait tells server we have all chunks and keeps serving others until all receivers finish.
+func (sp *swarmPeer) wait() (*msg.SwarmWaitResp, error) {
+	if err := msg.WriteMsg(sp.ctrl, &msg.SwarmWait{}); err != nil {
+		return nil, err
+	}
+	raw, err := msg.ReadMsg(sp.ctrl)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := raw.(*msg.SwarmWaitResp)
+	if !ok {
+		return nil, fmt.Errorf("read swarm response format error")
+	}
+	return m, nil
+}
+
+// fetchLoop fetches chunks server assigns until we have all of them.
+func (sp *swarmPeer) fetchLoop(idx int, callback func(int)) error {
+	var (
+		conn net.Conn
+		s    *stream.FrameStream
+		addr string
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	last := &msg.SwarmNext{ChunkID: -1}
+	for {
+		resp, err := sp.next(last)
+		if err != nil {
+			return err
+		}
+		if resp.Finished {
+			return nil
+		}
+		last = &msg.SwarmNext{ChunkID: -1}
+		if resp.Wait {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+
+		// each chunk goes through another worker if the last one fails
+		if conn == nil {
+			addr = sp.workers[idx%len(sp.workers)]
+			idx++
+			conn, err = dialChunkWorker(addr, sp.svc.key, &msg.NewFetchStream{
+				ID:              sp.id,
+				ProtocolVersion: msg.ProtocolVersion,
+				Swarm:           true,
+			})
+			if err != nil {
+				log(sp.svc.debugMode, "[%s] new fetch stream error: %v", addr, err)
+				conn = nil
+			} else {
+				s = stream.NewFrameStream(conn)
+			}
+		}
+
+		last.ChunkID, last.Peer = resp.ChunkID, resp.Peer
+		if conn == nil {
+			last.Failed = true
+			continue
+		}
+		n, fatal, err := sp.fetchChunk(conn, s, uint64(resp.ChunkID), resp.Peer)
+		if fatal != nil {
+			return fatal
+		}
+		if err != nil {
+			log(sp.svc.debugMode, "[%s] fetch chunk %d from peer %d error: %v", addr, resp.ChunkID, resp.Peer, err)
+			last.Failed = true
+			conn.Close()
+			conn = nil
+			continue
+		}
+		callback(n)
+	}
+}
+
+// fetchChunk saves chunk from peer to file. Errors of peer or network can be retried, fatal errors can't.
+func (sp *swarmPeer) fetchChunk(conn net.Conn, s *stream.FrameStream, chunkID uint64, peer int64) (n int, fatal error, err error) {
+	if chunkID >= uint64(sp.chunks) {
+		return 0, fmt.Errorf("invalid chunk %d", chunkID), nil
+	}
+	err = msg.WriteMsg(conn, &msg.FetchChunk{
+		ChunkID: int64(chunkID),
+		Peer:    peer,
+	})
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	frame, err := s.ReadFrame()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	if frame.Type == stream.TypeError {
+		return 0, nil, fmt.Errorf("%s", string(frame.Buf))
+	}
+	if frame.Type != stream.TypeData || frame.FrameID != chunkID {
+		return 0, nil, fmt.Errorf("unexpected frame")
+	}
+
+	data := frame.Buf
+	if frame.Flags&stream.FlagEncrypted != 0 {
+		if sp.sealer == nil {
+			return 0, fmt.Errorf("chunk is encrypted, key is required"), nil
+		}
+		if data, err = sp.sealer.Open(nil, chunkID, data); err != nil {
+			return 0, err, nil
+		}
+	} else if sp.sealer != nil {
+		return 0, fmt.Errorf("chunk is not encrypted, peer doesn't use the same key"), nil
+	}
+	if frame.Flags&stream.FlagCompressed != 0 {
+		if data, err = codec.Decompress(data, int(sp.chunkSize)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	offset, size := sp.chunkRange(chunkID)
+	if len(data) != size {
+		return 0, nil, fmt.Errorf("chunk size %d is not %d", len(data), size)
+	}
+	if _, err = sp.f.WriteAt(data, offset); err != nil {
+		return 0, err, nil
+	}
+
+	sp.mu.Lock()
+	sp.have[chunkID] = true
+	sp.mu.Unlock()
+	return size, nil, nil
+}
+
+// seedSwarm serves the file to receivers until all of them finish.
+func (svc *Service) seedSwarm(conn net.Conn, m *msg.SendFileResp, f *os.File, fsize int64) error {
+	sp, err := svc.newSwarmPeer(conn, m.ID, 0, m.Workers, f, fsize, swarmChunkSize)
+	if err != nil {
+		return err
+	}
+	for i := range sp.have {
+		sp.have[i] = true
+	}
+	sp.startSeeds()
+	defer sp.closeSeeds()
+
+	fmt.Printf("Serving %d receivers in swarm mode...\n", m.Receivers)
+	resp, err := sp.wait()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Receivers finished: %d/%d\n", resp.Finished, resp.Receivers)
+	if resp.Finished < resp.Receivers {
+		return fmt.Errorf("%d of %d receivers failed to receive the file", resp.Receivers-resp.Finished, resp.Receivers)
+	}
+	return nil
+}
+
+// recvSwarm fetches chunks from sender and other receivers, and serves chunks we have to them.
+// It returns after all receivers finish, so later receivers can still get chunks from us.
+func (svc *Service) recvSwarm(conn net.Conn, id string, m *msg.ReceiveFileResp, f *partFile, callback func(int)) error {
+	if err := f.Truncate(m.Fsize); err != nil {
+		return err
+	}
+	sp, err := svc.newSwarmPeer(conn, id, m.ReceiverIndex+1, m.Workers, f, m.Fsize, m.FrameSize)
+	if err != nil {
+		return err
+	}
+	sp.startSeeds()
+	defer sp.closeSeeds()
+
+	var wait sync.WaitGroup
+	errCh := make(chan error, swarmConcurrency)
+	for i := 0; i < swarmConcurrency; i++ {
+		wait.Add(1)
+		go func(idx int) {
+			defer wait.Done()
+			if err := sp.fetchLoop(idx, callback); err != nil {
+				errCh <- err
+			}
+		}(i)
+	}
+	wait.Wait()
+	select {
+	case err = <-errCh:
+		return err
+	default:
+	}
+
+	_, err = sp.wait()
+	return err
+}
@@ -0,0 +1,587 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/fname"
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/receiver"
+	"github.com/fatedier/fft/pkg/sender"
+
+	"github.com/cheggaaa/pb"
+)
+
+const (
+	// files in each SyncManifest and indexes in each SyncRequest, so messages are not too large
+	syncManifestBatch = 2000
+	syncRequestBatch  = 50000
+
+	// files are received to temporary files and renamed after all data is written
+	syncTempSuffix = ".fft-sync"
+)
+
+// buildManifest returns all directories and regular files under root in lexical order.
+// Symbolic links and other files are skipped.
+func buildManifest(root string) ([]msg.SyncFile, int64, error) {
+	files := make([]msg.SyncFile, 0)
+	var total int64
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		f := msg.SyncFile{
+			Path: filepath.ToSlash(rel),
+			Mode: uint32(info.Mode().Perm()),
+		}
+		// receiver rejects the whole manifest if any path is not safe
+		if err = fname.CheckPath(f.Path); err != nil {
+			fmt.Printf("Skip: %v\n", err)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case info.IsDir():
+			f.Dir = true
+		case info.Mode().IsRegular():
+			if f.Hash, err = fileHash(p); err != nil {
+				return err
+			}
+			f.Size = info.Size()
+			f.ModTime = info.ModTime().UnixNano()
+			total += f.Size
+		default:
+			fmt.Printf("Skip %s: not a regular file\n", f.Path)
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, total, err
+}
+
+func fileHash(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncLocalPath returns where a file in manifest is under root, path can't go out of root.
+func syncLocalPath(root string, p string) (string, error) {
+	if err := fname.CheckPath(p); err != nil {
+		return "", fmt.Errorf("%v in manifest", err)
+	}
+	if strings.HasSuffix(p, syncTempSuffix) {
+		return "", fmt.Errorf("invalid path %q in manifest", p)
+	}
+	return filepath.Join(root, filepath.FromSlash(p)), nil
+}
+
+// sendSync sends files in dir which receiver doesn't have or are changed.
+func (svc *Service) sendSync(id string, dir string) error {
+	finfo, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !finfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	// name of "." is not a valid name for receiver
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	name, err := fname.CleanName(filepath.Base(abs))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Scanning %s...\n", dir)
+	files, total, err := buildManifest(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Files: %d Size: %s\n", len(files), pb.Format(total).To(pb.U_BYTES).String())
+	var count int64
+	for _, f := range files {
+		if !f.Dir {
+			count++
+		}
+	}
+
+	conn, err := net.Dial("tcp", svc.serverAddr)
+	if err != nil {
+		return err
+	}
+	conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer conn.Close()
+
+	msg.WriteMsg(conn, &msg.SendFile{
+		ID:              id,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.capabilities(),
+		Name:            name,
+		Fsize:           total,
+		FrameSize:       int64(svc.frameSize),
+		CacheCount:      int64(svc.cacheCount),
+		WaitTimeout:     int64(svc.wait / time.Second),
+		Sync:            true,
+		Files:           count,
+		Fingerprint:     svc.fingerprint(id),
+	})
+
+	fmt.Printf("Wait receiver...\n")
+	raw, err := svc.readMatchResp(conn)
+	if err != nil {
+		return err
+	}
+	m, ok := raw.(*msg.SendFileResp)
+	if !ok {
+		return fmt.Errorf("get send file response format error")
+	}
+	if m.Error != "" {
+		return fmt.Errorf(m.Error)
+	}
+	if err = svc.checkCapabilities(m.ProtocolVersion, m.Capabilities); err != nil {
+		return err
+	}
+	if !m.Sync {
+		return fmt.Errorf("server doesn't support sync, please upgrade ffts")
+	}
+	if len(m.Workers) == 0 {
+		return fmt.Errorf("no available workers")
+	}
+	if m.Consent {
+		if err = svc.waitAnswer(conn); err != nil {
+			return err
+		}
+	}
+	svc.cacheCount = int(m.CacheCount)
+	fmt.Printf("ID: %s\n", m.ID)
+
+	for i := 0; i < len(files); i += syncManifestBatch {
+		end := i + syncManifestBatch
+		if end > len(files) {
+			end = len(files)
+		}
+		if err = msg.WriteMsg(conn, &msg.SyncManifest{Files: files[i:end]}); err != nil {
+			return err
+		}
+	}
+	if err = msg.WriteMsg(conn, &msg.SyncManifest{Last: true}); err != nil {
+		return err
+	}
+
+	wanted, err := readSyncRequest(conn, len(files))
+	if err != nil {
+		return err
+	}
+	if len(wanted) == 0 {
+		fmt.Printf("Receiver is up to date\n")
+		return nil
+	}
+
+	var size int64
+	for _, idx := range wanted {
+		size += files[idx].Size
+	}
+	fmt.Printf("Send files: %d Size: %s\n", len(wanted), pb.Format(size).To(pb.U_BYTES).String())
+
+	bar := pb.New(int(size))
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	if !svc.debugMode {
+		bar.Start()
+	}
+	callback := func(n int) {
+		bar.Add(n)
+	}
+
+	sendFiles := make([]sender.File, 0, len(wanted))
+	for _, idx := range wanted {
+		p := filepath.Join(dir, filepath.FromSlash(files[idx].Path))
+		sendFiles = append(sendFiles, sender.File{
+			ID:   uint32(idx),
+			Size: files[idx].Size,
+			Open: func() (io.ReadCloser, error) {
+				f, err := os.Open(p)
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{fio.NewCallbackReader(f, callback), f}, nil
+			},
+		})
+	}
+	s, err := sender.NewFilesSender(sendFiles, svc.frameSize, svc.cacheCount)
+	if err != nil {
+		return err
+	}
+	err = svc.sendStreams(conn, m, s)
+	if !svc.debugMode {
+		bar.Finish()
+	}
+	return err
+}
+
+// readSyncRequest returns indexes of files receiver needs.
+func readSyncRequest(conn net.Conn, count int) ([]int, error) {
+	wanted := make([]int, 0)
+	for {
+		// receiver may take a while to compare large files
+		conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read sync request error: %v", err)
+		}
+		m, ok := raw.(*msg.SyncRequest)
+		if !ok {
+			return nil, fmt.Errorf("read sync request format error")
+		}
+		for _, idx := range m.Files {
+			if idx < 0 || idx >= int64(count) {
+				return nil, fmt.Errorf("invalid file index %d in sync request", idx)
+			}
+			wanted = append(wanted, int(idx))
+		}
+		if m.Last {
+			return wanted, nil
+		}
+	}
+}
+
+// syncFile is a file being received, it's renamed to the target path after all data is written.
+type syncFile struct {
+	path    string
+	size    int64
+	modTime int64
+	mode    os.FileMode
+
+	f       *os.File
+	written int64
+	offsets map[int64]bool
+	done    bool
+	err     error
+	mu      sync.Mutex
+}
+
+func (sf *syncFile) WriteAt(p []byte, off int64) (int, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.err != nil {
+		return 0, sf.err
+	}
+	// frames sent again after the file is done are ignored
+	if sf.done || sf.offsets[off] {
+		return len(p), nil
+	}
+	if off < 0 || off+int64(len(p)) > sf.size {
+		return 0, fmt.Errorf("write out of range of %s", sf.path)
+	}
+	if sf.f == nil {
+		if sf.f, sf.err = os.OpenFile(sf.path+syncTempSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); sf.err != nil {
+			return 0, sf.err
+		}
+	}
+	if _, sf.err = sf.f.WriteAt(p, off); sf.err != nil {
+		return 0, sf.err
+	}
+	sf.offsets[off] = true
+	sf.written += int64(len(p))
+	if sf.written == sf.size {
+		sf.err = sf.finish()
+	}
+	return len(p), sf.err
+}
+
+// finish should be called with lock held.
+func (sf *syncFile) finish() error {
+	tmp := sf.path + syncTempSuffix
+	if sf.f == nil {
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		sf.f = f
+	}
+	err := sf.f.Close()
+	sf.f = nil
+	if err == nil {
+		err = os.Chmod(tmp, sf.mode)
+	}
+	if err == nil {
+		t := time.Unix(0, sf.modTime)
+		err = os.Chtimes(tmp, t, t)
+	}
+	if err == nil {
+		err = os.Rename(tmp, sf.path)
+	}
+	sf.done = true
+	sf.offsets = nil
+	return err
+}
+
+// abort removes the temporary file if the file is not done.
+func (sf *syncFile) abort() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.f != nil {
+		sf.f.Close()
+		sf.f = nil
+		os.Remove(sf.path + syncTempSuffix)
+	}
+}
+
+// readManifest reads all files in sender's manifest.
+func readManifest(conn net.Conn) ([]msg.SyncFile, error) {
+	files := make([]msg.SyncFile, 0)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read sync manifest error: %v", err)
+		}
+		m, ok := raw.(*msg.SyncManifest)
+		if !ok {
+			return nil, fmt.Errorf("read sync manifest format error")
+		}
+		files = append(files, m.Files...)
+		if m.Last {
+			return files, nil
+		}
+	}
+}
+
+// diffManifest creates directories in manifest and returns files we need.
+// An existing file with the same size and modification time is not changed,
+// otherwise it's hash is compared to avoid sending it again.
+func (svc *Service) diffManifest(root string, files []msg.SyncFile) (map[int]*syncFile, error) {
+	wanted := make(map[int]*syncFile)
+	for i, f := range files {
+		local, err := syncLocalPath(root, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(local)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// replace files of another type only if deleting is allowed
+		if err == nil && (info.IsDir() != f.Dir || (!info.IsDir() && !info.Mode().IsRegular())) {
+			if !svc.syncDelete {
+				return nil, fmt.Errorf("%s has different type with sender's, use --delete to replace it", f.Path)
+			}
+			if err = os.RemoveAll(local); err != nil {
+				return nil, err
+			}
+			info = nil
+		}
+
+		if f.Dir {
+			if info == nil {
+				if err = os.MkdirAll(local, os.FileMode(f.Mode)|0700); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if info != nil && info.Size() == f.Size {
+			mtime := time.Unix(0, f.ModTime)
+			if info.ModTime().Unix() == mtime.Unix() {
+				continue
+			}
+			if hash, err := fileHash(local); err == nil && hash == f.Hash {
+				os.Chtimes(local, mtime, mtime)
+				continue
+			}
+		}
+		if err = os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return nil, err
+		}
+		wanted[i] = &syncFile{
+			path:    local,
+			size:    f.Size,
+			modTime: f.ModTime,
+			mode:    os.FileMode(f.Mode).Perm(),
+			offsets: make(map[int64]bool),
+		}
+	}
+	return wanted, nil
+}
+
+// deleteExtra removes files and directories under root which are not in manifest.
+func deleteExtra(root string, files []msg.SyncFile) (int, error) {
+	keep := make(map[string]bool, len(files))
+	for _, f := range files {
+		keep[f.Path] = true
+	}
+	count := 0
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." || keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+		fmt.Printf("Delete %s\n", filepath.ToSlash(rel))
+		if err = os.RemoveAll(p); err != nil {
+			return err
+		}
+		count++
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return count, err
+}
+
+// recvSync makes dir the same as sender's directory, only new or changed files are received.
+func (svc *Service) recvSync(conn net.Conn, id string, m *msg.ReceiveFileResp, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := readManifest(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sync directory: %s Files: %d Size: %s\n", m.Name, len(files), pb.Format(m.Fsize).To(pb.U_BYTES).String())
+
+	wanted, err := svc.diffManifest(dir, files)
+	if err != nil {
+		return err
+	}
+
+	indexes := make([]int64, 0, len(wanted))
+	var size int64
+	for i := range files {
+		sf, ok := wanted[i]
+		if !ok {
+			continue
+		}
+		if err = svc.policy.check(files[i].Path, sf.size); err != nil {
+			fmt.Printf("Skip %s: %v\n", files[i].Path, err)
+			delete(wanted, i)
+			continue
+		}
+		indexes = append(indexes, int64(i))
+		size += sf.size
+	}
+	for i := 0; i < len(indexes); i += syncRequestBatch {
+		end := i + syncRequestBatch
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		if err = msg.WriteMsg(conn, &msg.SyncRequest{Files: indexes[i:end]}); err != nil {
+			return err
+		}
+	}
+	if err = msg.WriteMsg(conn, &msg.SyncRequest{Last: true}); err != nil {
+		return err
+	}
+
+	if len(wanted) > 0 {
+		fmt.Printf("Recv files: %d Size: %s\n", len(wanted), pb.Format(size).To(pb.U_BYTES).String())
+		if err = svc.recvSyncFiles(conn, id, m, wanted, size); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Already up to date\n")
+	}
+
+	if svc.syncDelete {
+		count, err := deleteExtra(dir, files)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			fmt.Printf("Deleted: %d\n", count)
+		}
+	}
+	return nil
+}
+
+func (svc *Service) recvSyncFiles(conn net.Conn, id string, m *msg.ReceiveFileResp, wanted map[int]*syncFile, size int64) error {
+	bar := pb.New(int(size))
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	if !svc.debugMode {
+		bar.Start()
+	}
+
+	// empty files have no frames
+	for _, sf := range wanted {
+		if sf.size == 0 {
+			if err := sf.finish(); err != nil {
+				return err
+			}
+		}
+	}
+
+	recv := receiver.NewFilesReceiver(func(fileID uint32) (io.WriterAt, error) {
+		sf, ok := wanted[int(fileID)]
+		if !ok {
+			return nil, fmt.Errorf("file %d is not requested", fileID)
+		}
+		return fio.NewCallbackWriterAt(sf, func(n int) {
+			bar.Add(n)
+		}), nil
+	}, svc.cacheCount)
+	err := svc.recvStreams(conn, id, m, recv)
+	if !svc.debugMode {
+		bar.Finish()
+	}
+
+	failed := 0
+	for _, sf := range wanted {
+		sf.abort()
+		sf.mu.Lock()
+		if !sf.done || sf.err != nil {
+			failed++
+			if sf.err != nil {
+				log(svc.debugMode, "%s: %v", sf.path, sf.err)
+			}
+		}
+		sf.mu.Unlock()
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d files are not received", failed, len(wanted))
+	}
+	return err
+}
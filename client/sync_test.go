@@ -0,0 +1,179 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, p string, content string, mtime time.Time) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncManifestDiff(t *testing.T) {
+	src, err := ioutil.TempDir("", "fft-sync-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "fft-sync-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestFile(t, filepath.Join(src, "same"), "same", mtime)
+	writeTestFile(t, filepath.Join(src, "touched"), "touched", mtime)
+	writeTestFile(t, filepath.Join(src, "changed"), "changed", mtime)
+	writeTestFile(t, filepath.Join(src, "sub", "new"), "new", mtime)
+	if err = os.Mkdir(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(dst, "same"), "same", mtime)
+	// the same content with another modification time is not sent again
+	writeTestFile(t, filepath.Join(dst, "touched"), "touched", mtime.Add(time.Hour))
+	writeTestFile(t, filepath.Join(dst, "changed"), "CHANGED", mtime.Add(time.Hour))
+	writeTestFile(t, filepath.Join(dst, "extra", "old"), "old", mtime)
+
+	files, total, err := buildManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	if len(files) != 6 || total != int64(len("same")+len("touched")+len("changed")+len("new")) {
+		t.Fatalf("manifest has %v, %d bytes", paths, total)
+	}
+
+	svc := &Service{}
+	wanted, err := svc.diffManifest(dst, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]*syncFile)
+	for i, sf := range wanted {
+		names[files[i].Path] = sf
+	}
+	if len(names) != 2 || names["changed"] == nil || names["sub/new"] == nil {
+		t.Fatalf("files %v are wanted, expect changed and sub/new", names)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "touched")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("modification time of the same content is not updated: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("directory in manifest is not created: %v", err)
+	}
+
+	// file is renamed to the target after all data is written, frames sent again are ignored
+	sf := names["changed"]
+	if _, err = sf.WriteAt([]byte("ged"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sf.WriteAt([]byte("xxx"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sf.WriteAt([]byte("chan"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dst, "changed")); err != nil || string(content) != "changed" {
+		t.Fatalf("file content is %q, error %v", content, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "changed")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("modification time is not sender's: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "changed"+syncTempSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("temporary file is left: %v", err)
+	}
+	if _, err = sf.WriteAt([]byte("x"), 10); err != nil {
+		t.Fatalf("frame sent again after the file is done is not ignored: %v", err)
+	}
+
+	// a write out of range fails and the temporary file is removed by abort
+	sf = names["sub/new"]
+	if _, err = sf.WriteAt([]byte("newer"), 0); err == nil {
+		t.Fatalf("write out of range succeeds")
+	}
+	if _, err = sf.WriteAt([]byte("ne"), 0); err != nil {
+		t.Fatal(err)
+	}
+	sf.abort()
+	if _, err = os.Stat(filepath.Join(dst, "sub", "new"+syncTempSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("temporary file is left after abort: %v", err)
+	}
+
+	count, err := deleteExtra(dst, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d files are deleted, expect extra directory only", count)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "extra")); !os.IsNotExist(err) {
+		t.Fatalf("extra directory is not deleted: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "same")); err != nil {
+		t.Fatalf("file in manifest is deleted: %v", err)
+	}
+}
+
+func TestSyncReplaceType(t *testing.T) {
+	dst, err := ioutil.TempDir("", "fft-sync-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	writeTestFile(t, filepath.Join(dst, "a", "b"), "b", time.Now())
+
+	files, _, err := buildManifest(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sender has a file where receiver has a directory
+	files[0].Dir = false
+	files[0].Size = 1
+
+	svc := &Service{}
+	if _, err = svc.diffManifest(dst, files[:1]); err == nil {
+		t.Fatalf("directory is replaced by a file without delete")
+	}
+	svc.syncDelete = true
+	wanted, err := svc.diffManifest(dst, files[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wanted) != 1 {
+		t.Fatalf("%d files are wanted after the directory is removed", len(wanted))
+	}
+	if _, err = os.Stat(filepath.Join(dst, "a")); !os.IsNotExist(err) {
+		t.Fatalf("directory of another type is not removed: %v", err)
+	}
+}
+
+func TestSyncLocalPath(t *testing.T) {
+	for _, p := range []string{"", "/etc/passwd", "..", "../a", "a/../../b", "a//b", "a\\b", "a" + syncTempSuffix} {
+		if _, err := syncLocalPath("root", p); err == nil {
+			t.Fatalf("%q is accepted", p)
+		}
+	}
+	local, err := syncLocalPath("root", "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local != filepath.Join("root", "a", "b") {
+		t.Fatalf("local path is %s", local)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package client
+
+import "os"
+
+// syncDir flushes entries of dir to disk, so a file renamed into it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package client
+
+// syncDir does nothing on windows, where directories can't be opened and flushed like files.
+func syncDir(dir string) error {
+	return nil
+}
@@ -20,9 +20,29 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&options.ServerAddr, "server_addr", "s", version.DefaultServerAddr(), "remote fft server address")
 	rootCmd.PersistentFlags().StringVarP(&options.ID, "id", "i", "", "specify a special id to transfer file")
 	rootCmd.PersistentFlags().StringVarP(&options.SendFile, "send_file", "l", "", "specify which file to send to another client")
-	rootCmd.PersistentFlags().IntVarP(&options.FrameSize, "frame_size", "n", 5*1024, "each frame size, it's only for sender, default(5*1024 B)")
+	rootCmd.PersistentFlags().IntVarP(&options.FrameSize, "frame_size", "n", 5*1024, "each frame size, it's only for sender, default(5*1024 B), max(16*1024*1024 B)")
 	rootCmd.PersistentFlags().IntVarP(&options.CacheCount, "cache_count", "c", 512, "how many frames be cached, it will be set to the min value between sender and receiver")
+	rootCmd.PersistentFlags().IntVarP(&options.Readers, "readers", "", 4, "how many goroutines read the file to send in parallel")
 	rootCmd.PersistentFlags().StringVarP(&options.RecvFile, "recv_file", "t", "", "specify local file path to store received file")
+	rootCmd.PersistentFlags().StringVarP(&options.Key, "key", "k", "", "key to encrypt data end to end, sender and receiver should use the same one, workers can relay data faster without TLS")
+	rootCmd.PersistentFlags().StringVarP(&options.Compress, "compress", "", "lz4", "compress frames if receiver supports it, lz4, zstd or none, incompressible frames are sent as is")
+	rootCmd.PersistentFlags().IntVarP(&options.WaitSecond, "wait", "w", 120, "seconds to wait for peer, either sender or receiver can start first, limited by server")
+	rootCmd.PersistentFlags().BoolVarP(&options.Mailbox, "mailbox", "m", false, "upload file to storage workers and exit, receiver can get it by id later, key is required")
+	rootCmd.PersistentFlags().IntVarP(&options.Replicas, "replicas", "", 2, "how many storage workers each chunk is uploaded to in mailbox mode")
+	rootCmd.PersistentFlags().IntVarP(&options.Receivers, "receivers", "", 1, "how many receivers get the file, 0 means any number of receivers come before wait timeout")
+	rootCmd.PersistentFlags().BoolVarP(&options.Swarm, "swarm", "", false, "receivers also serve chunks they have to each other, so sender uploads less")
+	rootCmd.PersistentFlags().BoolVarP(&options.Delta, "delta", "", false, "only send data receiver's existing file at recv_file doesn't have, like rsync")
+	rootCmd.PersistentFlags().BoolVarP(&options.Dedup, "dedup", "", false, "split file into chunks by content and only send chunks not in receiver's chunk cache")
+	rootCmd.PersistentFlags().StringVarP(&options.ChunkCache, "chunk_cache", "", "", "directory to cache received chunks, so later files with the same chunks can be received faster, it's only for receiver")
+	rootCmd.PersistentFlags().IntVarP(&options.ChunkCacheSize, "chunk_cache_size", "", 10240, "max size of chunk cache in MB, the least recently used chunks are removed")
+	rootCmd.PersistentFlags().BoolVarP(&options.NoClobber, "no-clobber", "", false, "don't replace existing file at recv_file, receiver exits before receiving")
+	rootCmd.PersistentFlags().BoolVarP(&options.Rename, "rename", "", false, "save as a new name like name_1.ext if file at recv_file exists")
+	rootCmd.PersistentFlags().BoolVarP(&options.Overwrite, "overwrite", "", false, "replace existing file at recv_file after the new one is received completely, it's the default")
+	rootCmd.PersistentFlags().Int64VarP(&options.MaxSize, "max-size", "", 0, "max size of file to receive in MB, 0 means no limit, it's for each file in a directory")
+	rootCmd.PersistentFlags().StringVarP(&options.AllowExt, "allow-ext", "", "", "only receive files with these extensions, separated by comma, like \".txt,.zip\"")
+	rootCmd.PersistentFlags().BoolVarP(&options.Confirm, "confirm", "", false, "ask before receiving")
+	rootCmd.PersistentFlags().IntVarP(&options.Timeout, "timeout", "", 0, "seconds the whole transfer should be finished in, including waiting for peer, 0 means no limit")
+	rootCmd.PersistentFlags().IntVarP(&options.StallTimeout, "stall_timeout", "", 120, "transfer fails if there is no progress in these seconds, 0 means no limit")
 	rootCmd.PersistentFlags().BoolVarP(&options.DebugMode, "debug", "g", false, "print more debug info")
 }
 
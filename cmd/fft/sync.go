@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	syncCmd.Flags().BoolVarP(&options.Delete, "delete", "", false, "delete files not in sender's directory, it's only for receiver")
+	rootCmd.AddCommand(syncCmd)
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Sync a directory, only new or changed files are sent",
+	Long: "Sync a directory from sender (-l dir) to receiver (-t dir). Sender's manifest is compared with receiver's files\n" +
+		"by size, modification time and hash, only new or changed files are sent.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options.Sync = true
+		return rootCmd.RunE(cmd, args)
+	},
+}
@@ -18,6 +18,14 @@ var (
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&showVersion, "version", "v", false, "version of fft server")
 	rootCmd.PersistentFlags().StringVarP(&options.BindAddr, "bind_addr", "b", "0.0.0.0:7777", "bind address")
+	rootCmd.PersistentFlags().IntVarP(&options.MailboxRetentionHours, "mailbox_retention", "", 24, "how long files uploaded in mailbox mode are kept, unit is hour")
+	rootCmd.PersistentFlags().StringVarP(&options.MailboxFile, "mailbox_file", "", "", "file to keep uploaded mailboxes across restarts, empty means they are lost after restarting")
+	rootCmd.PersistentFlags().IntVarP(&options.MaxWaitSeconds, "max_wait", "", 3600, "max seconds sender or receiver can wait for each other, unit is second")
+	rootCmd.PersistentFlags().StringVarP(&options.AdminAddr, "admin_addr", "", "", "address to accept admin commands managing workers, empty means disabled")
+	rootCmd.PersistentFlags().StringVarP(&options.AdminToken, "admin_token", "", "", "token admin commands must carry, it's required if admin_addr is not a loopback address")
+	rootCmd.PersistentFlags().StringVarP(&options.PriorityRules, "priority_rules", "", "", "rules deciding priority classes of transfers like \"10.0.0.0/8=high;id:backup-*=low\", the first matched one is used, default is normal")
+	rootCmd.PersistentFlags().StringVarP(&options.ReversePorts, "reverse_ports", "", "", "port range like \"7800-7899\" for workers behind NAT, clients connect to them through these ports, empty means disabled")
+	rootCmd.PersistentFlags().StringVarP(&options.ReverseHost, "reverse_host", "", "", "host clients use to connect to reverse_ports, default is the host of bind_addr")
 	rootCmd.PersistentFlags().StringVarP(&options.LogFile, "log_file", "", "console", "log file path")
 	rootCmd.PersistentFlags().StringVarP(&options.LogLevel, "log_level", "", "info", "log level")
 	rootCmd.PersistentFlags().Int64VarP(&options.LogMaxDays, "log_max_days", "", 3, "log file reserved max days")
@@ -38,7 +46,11 @@ var rootCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		svc.Run()
+		err = svc.Run()
+		if err != nil {
+			fmt.Printf("fft server runner exit: %v\n", err)
+			os.Exit(1)
+		}
 		return nil
 	},
 }
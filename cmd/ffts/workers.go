@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/server"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	allWorkers bool
+
+	drainTimeout int
+
+	configRateKB               int64
+	configRateSchedule         string
+	configMaxTrafficMBPerDay   int64
+	configMaxTrafficMBPerWeek  int64
+	configMaxTrafficMBPerMonth int64
+	configDrainTimeoutSeconds  int64
+)
+
+func init() {
+	workerCmd.PersistentFlags().BoolVarP(&allWorkers, "all", "", false, "send the command to all workers")
+	workerDrainCmd.Flags().IntVarP(&drainTimeout, "timeout", "", 0, "seconds existing transfers can last, 0 means fftw's drain_timeout")
+	workerConfigCmd.Flags().Int64VarP(&configRateKB, "rate", "", 0, "max bandwidth fftw will provide, unit is KB, min value is 50KB")
+	workerConfigCmd.Flags().Int64VarP(&configMaxTrafficMBPerDay, "max_traffic_per_day", "", 0, "max traffic fftw can use every day, 0 means no limit, unit is MB, min value is 128MB")
+	workerConfigCmd.Flags().Int64VarP(&configMaxTrafficMBPerWeek, "max_traffic_per_week", "", 0, "max traffic fftw can use every week, 0 means no limit, unit is MB, min value is 128MB")
+	workerConfigCmd.Flags().Int64VarP(&configMaxTrafficMBPerMonth, "max_traffic_per_month", "", 0, "max traffic fftw can use every month, 0 means no limit, unit is MB, min value is 128MB")
+	workerConfigCmd.Flags().StringVarP(&configRateSchedule, "rate_schedule", "", "", "rate in time windows like \"mon-fri 09:00-18:00=1024;22:00-08:00=8192\", empty means --rate is always used")
+	workerConfigCmd.Flags().Int64VarP(&configDrainTimeoutSeconds, "drain_timeout", "", 0, "seconds existing transfers can last after fftw starts draining")
+
+	workerCmd.AddCommand(workerDrainCmd, workerUndrainCmd, workerResetQuotaCmd, workerConfigCmd)
+	rootCmd.AddCommand(workersCmd, workerCmd)
+}
+
+var workersCmd = &cobra.Command{
+	Use:   "workers",
+	Short: "List workers registered to a running ffts through it's admin_addr",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if options.AdminAddr == "" {
+			return fmt.Errorf("admin_addr is required")
+		}
+		workers, err := server.RequestListWorkers(options.AdminAddr, options.AdminToken)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDR\tVERSION\tSTATE\tTRANSFERS\tSPEED\tRATE\tTODAY\tREMAINING\tIN/OUT\tUPDATED")
+		for _, w := range workers {
+			state := "active"
+			if w.Draining {
+				state = "draining"
+			}
+			if w.StatsAt == 0 {
+				// old fftw doesn't report stats
+				fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\t-\t-\t-\t-\n", w.Addr, w.Version, state)
+				continue
+			}
+			remaining := "no limit"
+			if w.Stats.RemainingTraffic >= 0 {
+				remaining = fmt.Sprintf("%dMB", w.Stats.RemainingTraffic/1024/1024)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%dKB/s\t%dKB/s\t%dMB\t%s\t%dMB/%dMB\t%s ago\n", w.Addr, w.Version, state,
+				w.Stats.Sessions, w.Stats.BytesPerSecond/1024, w.Stats.RateKB, w.Stats.TrafficToday/1024/1024,
+				remaining, w.Stats.TrafficInToday/1024/1024, w.Stats.TrafficOutToday/1024/1024,
+				time.Since(time.Unix(w.StatsAt, 0)).Truncate(time.Second))
+		}
+		return tw.Flush()
+	},
+}
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Send commands to workers registered to a running ffts through it's admin_addr",
+}
+
+var workerDrainCmd = &cobra.Command{
+	Use:          "drain [worker address]...",
+	Short:        "Stop assigning new transfers to workers, existing ones can finish or move to other workers until timeout",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return manageWorkers(args, msg.WorkerCommand{
+			Action:  msg.WorkerActionDrain,
+			Timeout: int64(drainTimeout),
+		})
+	},
+}
+
+var workerUndrainCmd = &cobra.Command{
+	Use:          "undrain [worker address]...",
+	Short:        "Let draining or drained workers take new transfers again",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return manageWorkers(args, msg.WorkerCommand{Action: msg.WorkerActionUndrain})
+	},
+}
+
+var workerResetQuotaCmd = &cobra.Command{
+	Use:          "reset_quota [worker address]...",
+	Short:        "Reset traffic counts of this day, week and month, workers drained because of traffic limits take new transfers again",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return manageWorkers(args, msg.WorkerCommand{Action: msg.WorkerActionResetQuota})
+	},
+}
+
+var workerConfigCmd = &cobra.Command{
+	Use:          "config [worker address]...",
+	Short:        "Change rate, rate_schedule, traffic limits or drain_timeout of running workers, only flags set are changed",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var c msg.WorkerConfig
+		if cmd.Flags().Changed("rate") {
+			c.RateKB = &configRateKB
+		}
+		if cmd.Flags().Changed("max_traffic_per_day") {
+			c.MaxTrafficMBPerDay = &configMaxTrafficMBPerDay
+		}
+		if cmd.Flags().Changed("rate_schedule") {
+			c.RateSchedule = &configRateSchedule
+		}
+		if cmd.Flags().Changed("max_traffic_per_week") {
+			c.MaxTrafficMBPerWeek = &configMaxTrafficMBPerWeek
+		}
+		if cmd.Flags().Changed("max_traffic_per_month") {
+			c.MaxTrafficMBPerMonth = &configMaxTrafficMBPerMonth
+		}
+		if cmd.Flags().Changed("drain_timeout") {
+			c.DrainTimeoutSeconds = &configDrainTimeoutSeconds
+		}
+		if c == (msg.WorkerConfig{}) {
+			return fmt.Errorf("nothing to change")
+		}
+		return manageWorkers(args, msg.WorkerCommand{
+			Action: msg.WorkerActionConfig,
+			Config: c,
+		})
+	},
+}
+
+// manageWorkers sends the command to workers in addrs, or all workers if --all is set.
+func manageWorkers(addrs []string, command msg.WorkerCommand) error {
+	if options.AdminAddr == "" {
+		return fmt.Errorf("admin_addr is required")
+	}
+	if len(addrs) == 0 && !allWorkers {
+		return fmt.Errorf("worker addresses or --all is required")
+	}
+	if allWorkers {
+		addrs = nil
+	}
+
+	results, err := server.RequestManageWorkers(options.AdminAddr, options.AdminToken, addrs, command)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Printf("%s: %s\n", r.Addr, r.Error)
+		} else {
+			fmt.Printf("%s: ok\n", r.Addr)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d workers failed", failed, len(results))
+	}
+	return nil
+}
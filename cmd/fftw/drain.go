@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fatedier/fft/worker"
+
+	"github.com/spf13/cobra"
+)
+
+var drainTimeout int
+
+func init() {
+	drainCmd.Flags().IntVarP(&drainTimeout, "timeout", "", 0, "seconds existing transfers can last, 0 means fftw's drain_timeout")
+	rootCmd.AddCommand(drainCmd)
+}
+
+var drainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Drain a running fftw through it's admin_addr",
+	Long: "Tell a running fftw to stop taking new transfers. Existing transfers can finish or move to other workers\n" +
+		"until timeout, then fftw unregisters from ffts, or keeps registered as drained if ffts can manage workers.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if options.AdminAddr == "" {
+			return fmt.Errorf("admin_addr is required")
+		}
+		sessions, err := worker.RequestDrain(options.AdminAddr, options.AdminToken, drainTimeout)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("fftw is draining, %d transfers left\n", sessions)
+		return nil
+	},
+}
@@ -21,7 +21,26 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&options.BindAddr, "bind_addr", "b", "0.0.0.0:7778", "bind address")
 	rootCmd.PersistentFlags().StringVarP(&options.AdvicePublicIP, "advice_public_ip", "p", "", "fft worker's advice public ip")
 	rootCmd.PersistentFlags().IntVarP(&options.RateKB, "rate", "", 4096, "max bandwidth fftw will provide, unit is KB, default is 4096KB and min value is 50KB")
+	rootCmd.PersistentFlags().IntVarP(&options.RatePerIPKB, "rate_per_ip", "", 0, "max bandwidth each client IP can use, 0 means no limit, unit is KB, min value is 50KB")
+	rootCmd.PersistentFlags().IntVarP(&options.MaxSessionsPerIP, "max_sessions_per_ip", "", 0, "max concurrent sessions of each client IP, 0 means no limit")
 	rootCmd.PersistentFlags().IntVarP(&options.MaxTrafficMBPerDay, "max_traffic_per_day", "", 0, "max traffic fftw can use every day, 0 means no limit, unit is MB, default is 0MB and min value is 128MB")
+	rootCmd.PersistentFlags().IntVarP(&options.MaxTrafficMBPerWeek, "max_traffic_per_week", "", 0, "max traffic fftw can use every week, 0 means no limit, unit is MB, min value is 128MB")
+	rootCmd.PersistentFlags().IntVarP(&options.MaxTrafficMBPerMonth, "max_traffic_per_month", "", 0, "max traffic fftw can use every month, 0 means no limit, unit is MB, min value is 128MB")
+	rootCmd.PersistentFlags().StringVarP(&options.QuotaResetWeekday, "quota_reset_weekday", "", "mon", "weekday max_traffic_per_week is reset on, like mon or sun")
+	rootCmd.PersistentFlags().IntVarP(&options.QuotaResetDay, "quota_reset_day", "", 1, "day of month max_traffic_per_month is reset on, the last day is used if a month is shorter")
+	rootCmd.PersistentFlags().StringVarP(&options.QuotaFile, "quota_file", "", "", "file to keep traffic counts across restarts, empty means counts are reset after restarting")
+	rootCmd.PersistentFlags().StringVarP(&options.QuotaDirection, "quota_direction", "", "out", "traffic counted in traffic limits, in, out or both, protocol overhead is included")
+	rootCmd.PersistentFlags().StringVarP(&options.LedgerFile, "ledger_file", "", "", "file to save traffic in and out of each day as JSON lines, empty means disabled")
+	rootCmd.PersistentFlags().StringVarP(&options.RateSchedule, "rate_schedule", "", "", "rate in time windows like \"mon-fri 09:00-18:00=1024;22:00-08:00=8192\", unit is KB, --rate is used out of windows")
+	rootCmd.PersistentFlags().StringVarP(&options.Timezone, "timezone", "", "", "time zone of rate_schedule and traffic limits like Asia/Shanghai, empty means local time zone")
+	rootCmd.PersistentFlags().StringVarP(&options.StorageDir, "storage_dir", "", "", "directory to store files uploaded in mailbox mode, empty means mailbox mode is disabled")
+	rootCmd.PersistentFlags().IntVarP(&options.StorageQuotaMB, "storage_quota", "", 0, "max disk space used by storage_dir, 0 means no limit, unit is MB")
+	rootCmd.PersistentFlags().IntVarP(&options.StorageMaxRetentionHours, "storage_max_retention", "", 72, "max hours files are kept in storage_dir, expired files are removed")
+	rootCmd.PersistentFlags().IntVarP(&options.DrainTimeoutSeconds, "drain_timeout", "", 60, "seconds existing transfers can last after fftw starts draining on SIGTERM, traffic limit or admin command")
+	rootCmd.PersistentFlags().StringVarP(&options.AdminAddr, "admin_addr", "", "", "address to accept admin commands like drain, empty means disabled")
+	rootCmd.PersistentFlags().StringVarP(&options.AdminToken, "admin_token", "", "", "token admin commands must carry, it's required if admin_addr is not a loopback address")
+	rootCmd.PersistentFlags().BoolVarP(&options.Reverse, "reverse", "", false, "work behind NAT, clients are relayed by ffts through connections this worker dials")
+	rootCmd.PersistentFlags().IntVarP(&options.ReversePoolCount, "reverse_pool", "", 5, "idle connections kept to ffts for relaying clients in reverse mode")
 
 	rootCmd.PersistentFlags().StringVarP(&options.LogFile, "log_file", "", "console", "log file path")
 	rootCmd.PersistentFlags().StringVarP(&options.LogLevel, "log_level", "", "info", "log level")
@@ -8,10 +8,13 @@ require (
 	github.com/fatedier/golib v0.1.1-0.20190318030453-e78944029985
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/klauspost/compress v1.10.10
 	github.com/mattn/go-colorable v0.1.1 // indirect
 	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/pflag v1.0.3 // indirect
+	golang.org/x/crypto v0.0.0-20190228161510-8dd112bcdc25
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
 )
@@ -0,0 +1,167 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Codec ID is written as the first byte of each compressed payload,
+// so receiver can decompress frames without knowing which codec sender chooses.
+const (
+	IDLZ4  uint8 = 1
+	IDZstd uint8 = 2
+)
+
+var (
+	ErrIncompressible = errors.New("data is incompressible")
+	ErrUnknownCodec   = errors.New("unknown codec")
+	ErrCorrupted      = errors.New("compressed data is corrupted")
+)
+
+type Codec interface {
+	ID() uint8
+	Name() string
+
+	// compressBlock appends compressed src to dst. It returns ErrIncompressible
+	// if the result can't be less than max bytes.
+	compressBlock(dst []byte, src []byte, max int) ([]byte, error)
+	decompressBlock(dst []byte, src []byte) error
+}
+
+var codecs = map[uint8]Codec{
+	IDLZ4:  lz4Codec{},
+	IDZstd: &zstdCodec{},
+}
+
+// Get returns codec by name, "lz4" or "zstd".
+func Get(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %s", name)
+}
+
+// Compress appends compressed src to dst[:0] with codec header.
+// Payloads which don't shrink to less than ratio of their size return ErrIncompressible.
+func Compress(c Codec, dst []byte, src []byte, ratio float64) ([]byte, error) {
+	var header [1 + binary.MaxVarintLen64]byte
+	header[0] = c.ID()
+	n := 1 + binary.PutUvarint(header[1:], uint64(len(src)))
+
+	max := int(float64(len(src))*ratio) - n
+	if max <= 0 {
+		return nil, ErrIncompressible
+	}
+	dst = append(dst[:0], header[:n]...)
+	return c.compressBlock(dst, src, max)
+}
+
+// Decompress returns the original payload of data compressed by Compress.
+func Decompress(data []byte, maxSize int) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrCorrupted
+	}
+	c, ok := codecs[data[0]]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	size, n := binary.Uvarint(data[1:])
+	if n <= 0 || size > uint64(maxSize) {
+		return nil, ErrCorrupted
+	}
+
+	dst := make([]byte, size)
+	if err := c.decompressBlock(dst, data[1+n:]); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() uint8 {
+	return IDLZ4
+}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) compressBlock(dst []byte, src []byte, max int) ([]byte, error) {
+	start := len(dst)
+	if cap(dst)-start < max {
+		newDst := make([]byte, start, start+max)
+		copy(newDst, dst)
+		dst = newDst
+	}
+	n, err := lz4.CompressBlock(src, dst[start:start+max], nil)
+	if err != nil || n == 0 {
+		return nil, ErrIncompressible
+	}
+	return dst[:start+n], nil
+}
+
+func (lz4Codec) decompressBlock(dst []byte, src []byte) error {
+	n, err := lz4.UncompressBlock(src, dst)
+	if err != nil || n != len(dst) {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// zstdCodec shares one encoder and decoder, EncodeAll and DecodeAll can be called concurrently.
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCodec) ID() uint8 {
+	return IDZstd
+}
+
+func (c *zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) compressBlock(dst []byte, src []byte, max int) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	dst = c.encoder.EncodeAll(src, dst)
+	if len(dst)-start >= max {
+		return nil, ErrIncompressible
+	}
+	return dst, nil
+}
+
+func (c *zstdCodec) decompressBlock(dst []byte, src []byte) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+	out, err := c.decoder.DecodeAll(src, dst[:0])
+	if err != nil || len(out) != len(dst) {
+		return ErrCorrupted
+	}
+	return nil
+}
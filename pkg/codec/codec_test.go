@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func compressible(size int) []byte {
+	line := []byte("2019/01/02 15:04:05 [I] [service.go:120] new transfer, id [abc]\n")
+	buf := bytes.Repeat(line, size/len(line)+1)
+	return buf[:size]
+}
+
+func random(size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(buf)
+	return buf
+}
+
+func TestGet(t *testing.T) {
+	for _, name := range []string{"lz4", "zstd"} {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		if c.Name() != name {
+			t.Fatalf("get %s: got %s", name, c.Name())
+		}
+	}
+	if _, err := Get("gzip"); err == nil {
+		t.Fatalf("get gzip: expect error")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"lz4", "zstd"} {
+		c, _ := Get(name)
+		for _, size := range []int{256, 4096, 65536, 1 << 20} {
+			src := compressible(size)
+			// dst has garbage which should be overwritten
+			dst := []byte("garbage")
+			out, err := Compress(c, dst, src, 0.9)
+			if err != nil {
+				t.Fatalf("%s size %d: compress: %v", name, size, err)
+			}
+			if out[0] != c.ID() {
+				t.Fatalf("%s size %d: codec id %d", name, size, out[0])
+			}
+			if len(out) >= len(src) {
+				t.Fatalf("%s size %d: compressed to %d bytes", name, size, len(out))
+			}
+
+			got, err := Decompress(out, len(src))
+			if err != nil {
+				t.Fatalf("%s size %d: decompress: %v", name, size, err)
+			}
+			if !bytes.Equal(got, src) {
+				t.Fatalf("%s size %d: payload mismatch", name, size)
+			}
+		}
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	for _, name := range []string{"lz4", "zstd"} {
+		c, _ := Get(name)
+		if _, err := Compress(c, nil, random(65536), 0.9); err != ErrIncompressible {
+			t.Fatalf("%s random data: expect ErrIncompressible, got %v", name, err)
+		}
+		// too small to save the header
+		if _, err := Compress(c, nil, []byte("a"), 0.9); err != ErrIncompressible {
+			t.Fatalf("%s one byte: expect ErrIncompressible, got %v", name, err)
+		}
+		// it shrinks, but not enough
+		if _, err := Compress(c, nil, compressible(4096), 0.01); err != ErrIncompressible {
+			t.Fatalf("%s low ratio: expect ErrIncompressible, got %v", name, err)
+		}
+	}
+}
+
+func TestDecompressMalformed(t *testing.T) {
+	c, _ := Get("lz4")
+	src := compressible(4096)
+	data, err := Compress(c, nil, src, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decompress(data, len(src)-1); err != ErrCorrupted {
+		t.Fatalf("size over max: expect ErrCorrupted, got %v", err)
+	}
+	if _, err := Decompress([]byte{IDLZ4}, len(src)); err != ErrCorrupted {
+		t.Fatalf("short data: expect ErrCorrupted, got %v", err)
+	}
+	if _, err := Decompress(append([]byte{99}, data[1:]...), len(src)); err != ErrUnknownCodec {
+		t.Fatalf("unknown codec: expect ErrUnknownCodec, got %v", err)
+	}
+	if _, err := Decompress(data[:len(data)/2], len(src)); err != ErrCorrupted {
+		t.Fatalf("truncated lz4: expect ErrCorrupted, got %v", err)
+	}
+
+	z, _ := Get("zstd")
+	data, err = Compress(z, nil, src, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress(data[:len(data)/2], len(src)); err != ErrCorrupted {
+		t.Fatalf("truncated zstd: expect ErrCorrupted, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Cache keeps chunks received before in a directory, each chunk is a file named by it's hash.
+// The least recently used chunks are removed when the total size exceeds maxSize.
+type Cache struct {
+	dir     string
+	maxSize int64
+}
+
+func OpenCache(dir string, maxSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("chunk cache size should be greater than 0")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+func (c *Cache) path(h Hash) string {
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// Get returns the chunk with hash h. Chunks broken on disk are removed and treated as missing.
+func (c *Cache) Get(h Hash) ([]byte, bool) {
+	p := c.path(h)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	if Sum(data) != h {
+		os.Remove(p)
+		return nil, false
+	}
+	// mark it recently used
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// Put saves a chunk, data should match h.
+func (c *Cache) Put(h Hash, data []byte) error {
+	p := c.path(h)
+	if _, err := os.Stat(p); err == nil {
+		now := time.Now()
+		return os.Chtimes(p, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Evict removes the least recently used chunks until the total size is not more than maxSize.
+func (c *Cache) Evict() error {
+	entries := make([]cacheEntry, 0)
+	var total int64
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			entries = append(entries, cacheEntry{path: p, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err = os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
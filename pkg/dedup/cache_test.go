@@ -0,0 +1,98 @@
+package dedup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestCache(t *testing.T, maxSize int64) (*Cache, func()) {
+	dir, err := ioutil.TempDir("", "fft-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenCache(dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestCacheGetPut(t *testing.T) {
+	if _, err := OpenCache(os.TempDir(), 0); err == nil {
+		t.Fatalf("cache size 0: expect error")
+	}
+	c, clean := openTestCache(t, 1024)
+	defer clean()
+
+	data := []byte("chunk data")
+	h := Sum(data)
+	if _, ok := c.Get(h); ok {
+		t.Fatalf("get chunk before put")
+	}
+	if err := c.Put(h, data); err != nil {
+		t.Fatal(err)
+	}
+	// put again only refreshes it
+	if err := c.Put(h, data); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.Get(h)
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatalf("get %q, %v", got, ok)
+	}
+
+	// broken chunk on disk is removed
+	if err := ioutil.WriteFile(c.path(h), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = c.Get(h); ok {
+		t.Fatalf("get broken chunk")
+	}
+	if _, err := os.Stat(c.path(h)); !os.IsNotExist(err) {
+		t.Fatalf("broken chunk is not removed")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c, clean := openTestCache(t, 250)
+	defer clean()
+
+	chunks := make([][]byte, 3)
+	for i := range chunks {
+		chunks[i] = bytes.Repeat([]byte{byte(i)}, 100)
+		h := Sum(chunks[i])
+		if err := c.Put(h, chunks[i]); err != nil {
+			t.Fatal(err)
+		}
+		// chunk 0 is the oldest
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(c.path(h), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chunk 0 is used recently, chunk 1 is the least recently used one now
+	if _, ok := c.Get(Sum(chunks[0])); !ok {
+		t.Fatalf("chunk 0 is missing")
+	}
+
+	if err := c.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range []bool{true, false, true} {
+		if _, ok := c.Get(Sum(chunks[i])); ok != expect {
+			t.Fatalf("chunk %d in cache is %v after evicting, expect %v", i, ok, expect)
+		}
+	}
+
+	// nothing is removed if the cache is not full
+	if err := c.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(Sum(chunks[2])); !ok {
+		t.Fatalf("chunk 2 is removed when the cache is not full")
+	}
+}
@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"io"
+)
+
+// Content-defined chunking, boundaries are decided by a rolling gear hash of the data,
+// so an insertion or deletion only changes chunks around it.
+const (
+	MinChunkSize = 16 * 1024
+	AvgChunkSize = 64 * 1024
+	MaxChunkSize = 256 * 1024
+
+	chunkMask = AvgChunkSize - 1
+)
+
+type Hash [sha256.Size]byte
+
+func Sum(data []byte) Hash {
+	return sha256.Sum256(data)
+}
+
+// gear is fixed, so the same data is always split into the same chunks by different senders.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// cut returns length of the first chunk in p, p should have MaxChunkSize bytes unless it's the end of data.
+func cut(p []byte) int {
+	if len(p) <= MinChunkSize {
+		return len(p)
+	}
+	n := len(p)
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	var h uint64
+	for i := MinChunkSize; i < n; i++ {
+		h = (h << 1) + gear[p[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Split reads all data from r and calls fn with each chunk, data is only valid during the call.
+func Split(r io.Reader, fn func(data []byte) error) error {
+	buf := make([]byte, 2*MaxChunkSize)
+	start, end := 0, 0
+	eof := false
+	for {
+		if !eof && end-start < MaxChunkSize {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+
+		n := cut(buf[start:end])
+		if err := fn(buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
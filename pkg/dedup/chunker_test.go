@@ -0,0 +1,98 @@
+package dedup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func randomBytes(seed int64, size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+func split(t *testing.T, data []byte) [][]byte {
+	chunks := make([][]byte, 0)
+	err := Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte{}, chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestSplitLimits(t *testing.T) {
+	data := randomBytes(1, 16*1024*1024)
+	chunks := split(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("chunks don't make up the data")
+	}
+	for i, c := range chunks {
+		if len(c) > MaxChunkSize || (i < len(chunks)-1 && len(c) < MinChunkSize) {
+			t.Fatalf("chunk %d has %d bytes", i, len(c))
+		}
+	}
+	// boundaries are found by the mask after MinChunkSize
+	avg := len(data) / len(chunks)
+	if avg < AvgChunkSize/2 || avg > 2*AvgChunkSize {
+		t.Fatalf("average chunk size is %d", avg)
+	}
+
+	// no boundary in data without variety, chunks are cut at MaxChunkSize
+	zeros := make([]byte, 3*MaxChunkSize+10)
+	chunks = split(t, zeros)
+	if len(chunks) != 4 || len(chunks[0]) != MaxChunkSize || len(chunks[3]) != 10 {
+		t.Fatalf("zeros are split into %d chunks", len(chunks))
+	}
+
+	if chunks = split(t, data[:MinChunkSize-1]); len(chunks) != 1 || len(chunks[0]) != MinChunkSize-1 {
+		t.Fatalf("data shorter than min chunk size is split into %d chunks", len(chunks))
+	}
+	if chunks = split(t, nil); len(chunks) != 0 {
+		t.Fatalf("empty data is split into %d chunks", len(chunks))
+	}
+}
+
+func TestSplitShortReads(t *testing.T) {
+	data := randomBytes(2, 2*1024*1024)
+	expect := split(t, data)
+
+	chunks := make([][]byte, 0)
+	err := Split(iotest.HalfReader(bytes.NewReader(data)), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte{}, chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != len(expect) {
+		t.Fatalf("%d chunks from short reads, expect %d", len(chunks), len(expect))
+	}
+	for i := range chunks {
+		if !bytes.Equal(chunks[i], expect[i]) {
+			t.Fatalf("chunk %d is different with short reads", i)
+		}
+	}
+}
+
+func TestSplitInsertAtFront(t *testing.T) {
+	data := randomBytes(3, 8*1024*1024)
+	old := split(t, data)
+	changed := split(t, append(randomBytes(4, 100), data...))
+
+	if len(changed) != len(old) {
+		t.Fatalf("%d chunks after inserting, expect %d", len(changed), len(old))
+	}
+	if len(changed[0]) != len(old[0])+100 {
+		t.Fatalf("first chunk has %d bytes, expect %d", len(changed[0]), len(old[0])+100)
+	}
+	for i := 1; i < len(old); i++ {
+		if Sum(changed[i]) != Sum(old[i]) {
+			t.Fatalf("chunk %d is changed by inserting at the front", i)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const testBlockSize = MinBlockSize
+
+func randomBytes(seed int64, size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func signatureOf(t *testing.T, old []byte) *Signature {
+	sig, err := ComputeSignature(bytes.NewReader(old), testBlockSize, 16, func(*Signature, int) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// roundTrip encodes new against old and patches old with the delta written in pieces of step bytes.
+func roundTrip(t *testing.T, old []byte, new []byte, step int) *Stats {
+	sig := signatureOf(t, old)
+
+	// receiver only sends the marshaled signature
+	remote := NewSignature(sig.BlockSize)
+	if err := remote.UnmarshalBlocks(sig.MarshalBlocks(0, sig.Len())); err != nil {
+		t.Fatal(err)
+	}
+
+	var delta bytes.Buffer
+	stats, err := Encode(&delta, bytes.NewReader(new), remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != int64(len(new)) || stats.Literal+stats.Copied != stats.Size {
+		t.Fatalf("stats %+v of %d bytes", stats, len(new))
+	}
+
+	var out bytes.Buffer
+	p := NewPatcher(bytes.NewReader(old), sig.BlockSize, sig.Len(), &out)
+	data := delta.Bytes()
+	for len(data) > 0 {
+		n := step
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err = p.Write(data[:n]); err != nil {
+			t.Fatalf("patch: %v", err)
+		}
+		data = data[n:]
+	}
+	if err = p.Close(); err != nil {
+		t.Fatalf("close patcher: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Fatalf("rebuilt file is different, %d bytes, expect %d bytes", out.Len(), len(new))
+	}
+	return stats
+}
+
+func TestRoundTrip(t *testing.T) {
+	old := randomBytes(1, 20*testBlockSize+100)
+	insert := randomBytes(2, 300)
+
+	tests := []struct {
+		name string
+		old  []byte
+		new  []byte
+
+		// literal bytes can't be more than this
+		maxLiteral int64
+	}{
+		{"same", old, old, 100},
+		{"insert in the middle", old, concat(old[:5*testBlockSize+10], insert, old[5*testBlockSize+10:]), 2*testBlockSize + 300},
+		{"insert at the front", old, concat(insert, old), 300 + 100},
+		{"append", old, concat(old, insert), 400},
+		{"delete in the middle", old, concat(old[:3*testBlockSize], old[7*testBlockSize+5:]), 2 * testBlockSize},
+		{"delete at the front", old, old[testBlockSize/2:], 2 * testBlockSize},
+		{"truncate", old, old[:10*testBlockSize+1], testBlockSize},
+		{"replace a block", old, concat(old[:4*testBlockSize], randomBytes(3, testBlockSize), old[5*testBlockSize:]), testBlockSize + 100},
+		{"old file shorter than one block", old[:testBlockSize-1], old[:testBlockSize-1], testBlockSize},
+		{"new file shorter than one block", old, old[:100], 100},
+		{"no old file", nil, old, int64(len(old))},
+		{"empty new file", old, nil, 0},
+	}
+	for _, test := range tests {
+		for _, step := range []int{1, 7, 1 << 20} {
+			stats := roundTrip(t, test.old, test.new, step)
+			if stats.Literal > test.maxLiteral {
+				t.Fatalf("%s: %d literal bytes, expect at most %d", test.name, stats.Literal, test.maxLiteral)
+			}
+		}
+	}
+}
+
+func TestPatchBrokenDelta(t *testing.T) {
+	old := randomBytes(1, 4*testBlockSize)
+	new := concat(old[:2*testBlockSize], []byte("changed"), old[2*testBlockSize:])
+	sig := signatureOf(t, old)
+
+	var delta bytes.Buffer
+	if _, err := Encode(&delta, bytes.NewReader(new), sig); err != nil {
+		t.Fatal(err)
+	}
+	data := delta.Bytes()
+
+	patch := func(data []byte, old []byte) error {
+		var out bytes.Buffer
+		p := NewPatcher(bytes.NewReader(old), sig.BlockSize, sig.Len(), &out)
+		if _, err := p.Write(data); err != nil {
+			return err
+		}
+		return p.Close()
+	}
+	if err := patch(data, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := patch(data[:len(data)-1], old); err == nil {
+		t.Fatalf("incomplete delta: expect error")
+	}
+	if err := patch(append(append([]byte{}, data...), opEnd), old); err == nil {
+		t.Fatalf("data after end: expect error")
+	}
+
+	// old file is changed after it's signature is sent
+	changed := append([]byte{}, old...)
+	changed[0]++
+	if err := patch(data, changed); err == nil {
+		t.Fatalf("changed old file: expect hash mismatch")
+	}
+
+	invalid := [][]byte{
+		{'X'},
+		{opCopy, 4, 1},
+		{opCopy, 0, 0},
+		{opLiteral, 0},
+	}
+	for _, d := range invalid {
+		if err := patch(d, old); err == nil {
+			t.Fatalf("invalid op %v: expect error", d)
+		}
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := map[int64]int{
+		0:                             MinBlockSize,
+		MinBlockSize * MinBlockSize:   MinBlockSize,
+		MinBlockSize*MinBlockSize + 1: 2 * MinBlockSize,
+		1 << 50:                       MaxBlockSize,
+	}
+	for size, expect := range tests {
+		if bs := BlockSize(size); bs != expect {
+			t.Fatalf("block size of %d bytes is %d, expect %d", size, bs, expect)
+		}
+	}
+}
+
+func TestUnmarshalInvalidSignature(t *testing.T) {
+	sig := NewSignature(testBlockSize)
+	if err := sig.UnmarshalBlocks(make([]byte, blockSigLength+1)); err == nil {
+		t.Fatalf("invalid signature length: expect error")
+	}
+}
@@ -0,0 +1,208 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// Delta is a stream of ops:
+//
+//	'C' uvarint(index) uvarint(count): copy count blocks of the old file starting from block index
+//	'L' uvarint(length) data: literal data
+//	'E' sha256 of the new file: end of delta
+const (
+	opCopy    = 'C'
+	opLiteral = 'L'
+	opEnd     = 'E'
+
+	hashSize = sha256.Size
+
+	// literal data is written in pieces so receiver doesn't buffer too much
+	maxLiteralLength = 1024 * 1024
+)
+
+type Stats struct {
+	// bytes of the new file
+	Size int64
+
+	// bytes sent as literal data and bytes copied from the old file
+	Literal int64
+	Copied  int64
+}
+
+type encoder struct {
+	w     *bufio.Writer
+	sig   *Signature
+	stats Stats
+
+	// consecutive blocks not written yet
+	copyIndex int
+	copyCount int
+
+	tmp [2 * binary.MaxVarintLen64]byte
+}
+
+// Encode writes delta of src against the old file whose signature is sig to dst.
+func Encode(dst io.Writer, src io.Reader, sig *Signature) (*Stats, error) {
+	e := &encoder{
+		w:   bufio.NewWriterSize(dst, 64*1024),
+		sig: sig,
+	}
+	h := sha256.New()
+	if err := e.encode(io.TeeReader(src, h), h); err != nil {
+		return nil, err
+	}
+	return &e.stats, nil
+}
+
+func (e *encoder) encode(src io.Reader, h hash.Hash) error {
+	bs := e.sig.BlockSize
+	if e.sig.Len() == 0 || bs <= 0 {
+		// nothing to match, all data is literal
+		buf := make([]byte, maxLiteralLength)
+		for {
+			n, err := io.ReadFull(src, buf)
+			if n > 0 {
+				if werr := e.writeLiteral(buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return e.finish(h)
+	}
+
+	bufSize := 4 * bs
+	if bufSize < maxLiteralLength {
+		bufSize = maxLiteralLength
+	}
+	var (
+		buf  = make([]byte, bufSize)
+		lit  int // start of literal data not written
+		pos  int // start of the window
+		end  int
+		eof  bool
+		roll *rolling
+	)
+	for {
+		// the window and the byte after it are needed to slide
+		if end-pos <= bs && !eof {
+			if lit < pos || end == len(buf) {
+				if err := e.writeLiteral(buf[lit:pos]); err != nil {
+					return err
+				}
+				copy(buf, buf[pos:end])
+				end -= pos
+				pos, lit = 0, 0
+			}
+			n, err := io.ReadFull(src, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+		if end-pos < bs {
+			break
+		}
+
+		if roll == nil {
+			roll = newRolling(buf[pos : pos+bs])
+		}
+		if idx := e.sig.find(roll.sum(), buf[pos:pos+bs]); idx >= 0 {
+			if err := e.writeLiteral(buf[lit:pos]); err != nil {
+				return err
+			}
+			if err := e.writeCopy(idx); err != nil {
+				return err
+			}
+			pos += bs
+			lit = pos
+			roll = nil
+			continue
+		}
+
+		if pos+bs < end {
+			roll.roll(buf[pos], buf[pos+bs])
+		} else {
+			roll = nil
+		}
+		pos++
+	}
+
+	if err := e.writeLiteral(buf[lit:end]); err != nil {
+		return err
+	}
+	return e.finish(h)
+}
+
+func (e *encoder) writeLiteral(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxLiteralLength {
+			n = maxLiteralLength
+		}
+		e.w.WriteByte(opLiteral)
+		e.w.Write(e.tmp[:binary.PutUvarint(e.tmp[:], uint64(n))])
+		if _, err := e.w.Write(p[:n]); err != nil {
+			return err
+		}
+		e.stats.Size += int64(n)
+		e.stats.Literal += int64(n)
+		p = p[n:]
+	}
+	return nil
+}
+
+func (e *encoder) writeCopy(idx int) error {
+	if e.copyCount > 0 && e.copyIndex+e.copyCount == idx {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyIndex, e.copyCount = idx, 1
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	n := binary.PutUvarint(e.tmp[:], uint64(e.copyIndex))
+	n += binary.PutUvarint(e.tmp[n:], uint64(e.copyCount))
+	e.w.WriteByte(opCopy)
+	_, err := e.w.Write(e.tmp[:n])
+
+	size := int64(e.copyCount) * int64(e.sig.BlockSize)
+	e.stats.Size += size
+	e.stats.Copied += size
+	e.copyCount = 0
+	return err
+}
+
+func (e *encoder) finish(h hash.Hash) error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.w.WriteByte(opEnd)
+	e.w.Write(h.Sum(nil))
+	return e.w.Flush()
+}
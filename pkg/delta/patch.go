@@ -0,0 +1,151 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// longest op header, an end op with the file hash
+const maxOpHeader = 1 + hashSize
+
+// Patcher rebuilds the new file from delta written to it and the old file.
+// Delta can be written in pieces of any size.
+type Patcher struct {
+	old       io.ReaderAt
+	blockSize int
+	blocks    int
+	dst       io.Writer
+	h         hash.Hash
+
+	hdr        []byte
+	literalLen uint64
+	ended      bool
+	err        error
+	buf        []byte
+}
+
+// NewPatcher returns a Patcher which copies blocks from old, blockSize and blocks are from the signature sent to sender.
+// old can be nil if there is no old file.
+func NewPatcher(old io.ReaderAt, blockSize int, blocks int, dst io.Writer) *Patcher {
+	return &Patcher{
+		old:       old,
+		blockSize: blockSize,
+		blocks:    blocks,
+		dst:       dst,
+		h:         sha256.New(),
+		hdr:       make([]byte, 0, maxOpHeader),
+	}
+}
+
+func (p *Patcher) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n := len(b)
+	for len(b) > 0 {
+		if p.ended {
+			p.err = fmt.Errorf("unexpected data after end of delta")
+			return 0, p.err
+		}
+		if p.literalLen > 0 {
+			size := uint64(len(b))
+			if size > p.literalLen {
+				size = p.literalLen
+			}
+			if p.err = p.write(b[:size]); p.err != nil {
+				return 0, p.err
+			}
+			p.literalLen -= size
+			b = b[size:]
+			continue
+		}
+
+		p.hdr = append(p.hdr, b[0])
+		b = b[1:]
+		if p.err = p.parseOp(); p.err != nil {
+			return 0, p.err
+		}
+	}
+	return n, nil
+}
+
+// parseOp runs the op in hdr if it's complete.
+func (p *Patcher) parseOp() error {
+	switch p.hdr[0] {
+	case opLiteral:
+		length, n := binary.Uvarint(p.hdr[1:])
+		if n == 0 {
+			return nil
+		}
+		if n < 0 || length == 0 || length > maxLiteralLength {
+			return fmt.Errorf("invalid literal length")
+		}
+		p.literalLen = length
+	case opCopy:
+		index, n := binary.Uvarint(p.hdr[1:])
+		if n == 0 {
+			return nil
+		}
+		count, m := binary.Uvarint(p.hdr[1+n:])
+		if m == 0 {
+			return nil
+		}
+		if n < 0 || m < 0 || index+count > uint64(p.blocks) || count == 0 {
+			return fmt.Errorf("invalid block range")
+		}
+		if err := p.copyBlocks(int64(index), int64(count)); err != nil {
+			return err
+		}
+	case opEnd:
+		if len(p.hdr) < 1+hashSize {
+			return nil
+		}
+		if !bytes.Equal(p.hdr[1:], p.h.Sum(nil)) {
+			return fmt.Errorf("hash of the rebuilt file doesn't match")
+		}
+		p.ended = true
+	default:
+		return fmt.Errorf("unknown delta op %d", p.hdr[0])
+	}
+	p.hdr = p.hdr[:0]
+	return nil
+}
+
+func (p *Patcher) copyBlocks(index int64, count int64) error {
+	if p.old == nil {
+		return fmt.Errorf("no old file to copy blocks from")
+	}
+	if p.buf == nil {
+		p.buf = make([]byte, p.blockSize)
+	}
+	for i := index; i < index+count; i++ {
+		if _, err := p.old.ReadAt(p.buf, i*int64(p.blockSize)); err != nil {
+			return err
+		}
+		if err := p.write(p.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Patcher) write(b []byte) error {
+	p.h.Write(b)
+	_, err := p.dst.Write(b)
+	return err
+}
+
+// Close returns an error if delta is broken, incomplete or the rebuilt file doesn't match sender's hash.
+func (p *Patcher) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if !p.ended {
+		return fmt.Errorf("delta is incomplete")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	MinBlockSize = 4 * 1024
+	MaxBlockSize = 1024 * 1024
+
+	// bytes of each block in marshaled signature, weak sum and truncated strong sum
+	strongSize     = 16
+	blockSigLength = 4 + strongSize
+)
+
+// BlockSize returns block size for a file of size bytes, it's about square root of size like rsync.
+func BlockSize(size int64) int {
+	bs := MinBlockSize
+	for int64(bs)*int64(bs) < size && bs < MaxBlockSize {
+		bs *= 2
+	}
+	return bs
+}
+
+// Signature has weak and strong checksums of each full block in the receiver's old file.
+type Signature struct {
+	BlockSize int
+
+	weak   []uint32
+	strong [][strongSize]byte
+
+	// weak sum => block indexes, built when it's first used
+	index map[uint32][]int
+}
+
+func NewSignature(blockSize int) *Signature {
+	return &Signature{
+		BlockSize: blockSize,
+		weak:      make([]uint32, 0),
+		strong:    make([][strongSize]byte, 0),
+	}
+}
+
+// ComputeSignature reads all full blocks from r, fn is called after each batch blocks are added.
+func ComputeSignature(r io.Reader, blockSize int, batch int, fn func(sig *Signature, from int) error) (*Signature, error) {
+	sig := NewSignature(blockSize)
+	buf := make([]byte, blockSize)
+	from := 0
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sig.Add(buf)
+
+		if sig.Len()-from >= batch {
+			if err = fn(sig, from); err != nil {
+				return nil, err
+			}
+			from = sig.Len()
+		}
+	}
+	if err := fn(sig, from); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Add appends checksums of a full block.
+func (s *Signature) Add(block []byte) {
+	s.weak = append(s.weak, weakSum(block))
+	s.strong = append(s.strong, strongSum(block))
+	s.index = nil
+}
+
+// Len returns count of blocks.
+func (s *Signature) Len() int {
+	return len(s.weak)
+}
+
+// MarshalBlocks returns checksums of blocks in [from, to).
+func (s *Signature) MarshalBlocks(from int, to int) []byte {
+	buf := make([]byte, 0, (to-from)*blockSigLength)
+	var tmp [4]byte
+	for i := from; i < to; i++ {
+		binary.BigEndian.PutUint32(tmp[:], s.weak[i])
+		buf = append(buf, tmp[:]...)
+		buf = append(buf, s.strong[i][:]...)
+	}
+	return buf
+}
+
+// UnmarshalBlocks appends checksums returned by MarshalBlocks.
+func (s *Signature) UnmarshalBlocks(data []byte) error {
+	if len(data)%blockSigLength != 0 {
+		return fmt.Errorf("signature length %d is invalid", len(data))
+	}
+	for len(data) > 0 {
+		var strong [strongSize]byte
+		s.weak = append(s.weak, binary.BigEndian.Uint32(data[:4]))
+		copy(strong[:], data[4:blockSigLength])
+		s.strong = append(s.strong, strong)
+		data = data[blockSigLength:]
+	}
+	s.index = nil
+	return nil
+}
+
+// find returns index of the block same as p with weak sum, or -1 if not found.
+func (s *Signature) find(weak uint32, p []byte) int {
+	if s.index == nil {
+		s.index = make(map[uint32][]int, len(s.weak))
+		for i, w := range s.weak {
+			s.index[w] = append(s.index[w], i)
+		}
+	}
+	blocks, ok := s.index[weak]
+	if !ok {
+		return -1
+	}
+	strong := strongSum(p)
+	for _, i := range blocks {
+		if s.strong[i] == strong {
+			return i
+		}
+	}
+	return -1
+}
+
+func strongSum(p []byte) (sum [strongSize]byte) {
+	h := sha256.Sum256(p)
+	copy(sum[:], h[:strongSize])
+	return
+}
+
+// rolling is the weak checksum from rsync, it can be updated in O(1) when the window slides one byte.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(p []byte) *rolling {
+	r := &rolling{n: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) roll(out byte, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+func weakSum(p []byte) uint32 {
+	return newRolling(p).sum()
+}
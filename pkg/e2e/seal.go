@@ -0,0 +1,86 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	ErrOpen = errors.New("decrypt data error, key may be wrong")
+)
+
+// Sealer encrypts and authenticates each chunk independently with AES-256-GCM,
+// so chunks can be stored and fetched in any order.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer derives a key from the user's key and the transfer ID.
+// Sender and receiver should use the same key and ID.
+func NewSealer(key []byte, id string) (*Sealer, error) {
+	k := pbkdf2.Key(key, []byte("fft-e2e:"+id), 4096, 32, sha256.New)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{
+		aead: aead,
+	}, nil
+}
+
+// Fingerprint is derived from key and id, it's the same for peers with the same key.
+// It lets receiver find out a wrong key before receiving, the key can't be got from it.
+func Fingerprint(key []byte, id string) string {
+	k := pbkdf2.Key(key, []byte("fft-fingerprint:"+id), 4096, 32, sha256.New)
+	return hex.EncodeToString(k[:8])
+}
+
+// Overhead is the extra bytes Seal adds to each chunk.
+func (s *Sealer) Overhead() int {
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+// Seal appends random nonce and encrypted plain to dst.
+// The chunk id is authenticated so chunks can't be swapped.
+func (s *Sealer) Seal(dst []byte, chunkID uint64, plain []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	start := len(dst)
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[start : start+nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(dst, nonce, plain, additionalData(chunkID)), nil
+}
+
+// Open appends decrypted sealed to dst.
+func (s *Sealer) Open(dst []byte, chunkID uint64, sealed []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrOpen
+	}
+	out, err := s.aead.Open(dst, sealed[:nonceSize], sealed[nonceSize:], additionalData(chunkID))
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return out, nil
+}
+
+func additionalData(chunkID uint64) []byte {
+	var buf [8]byte
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(chunkID >> (56 - 8*uint(i)))
+	}
+	return buf[:]
+}
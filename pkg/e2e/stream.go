@@ -0,0 +1,204 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// random bytes each end sends before records, keys of a stream are derived from both
+	streamNonceSize = 16
+
+	// max plain bytes in a record, larger writes are split
+	maxRecordSize = 64 * 1024
+)
+
+var (
+	ErrAuth = errors.New("peer authentication failed, key may be wrong")
+)
+
+// StreamKey is derived from the user's key and the transfer ID once for all streams of a transfer.
+type StreamKey struct {
+	secret []byte
+}
+
+func NewStreamKey(key []byte, id string) *StreamKey {
+	return &StreamKey{
+		secret: pbkdf2.Key(key, []byte("fft-stream:"+id), 4096, 32, sha256.New),
+	}
+}
+
+// Auth is sent to workers with the transfer ID, streams are paired only if they have the same one.
+// It's the same for peers with the same key, the key can't be got from it.
+func (k *StreamKey) Auth() string {
+	return hex.EncodeToString(k.mac([]byte("pair"))[:16])
+}
+
+func (k *StreamKey) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, k.secret)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// WrapConn authenticates the peer of conn and encrypts the stream with AES-256-GCM.
+// Both ends send random nonces, keys of each direction are derived from them, so records can't be
+// replayed from other streams. Records are numbered, so they can't be dropped or reordered either.
+func (k *StreamKey) WrapConn(conn io.ReadWriteCloser, isSender bool) (io.ReadWriteCloser, error) {
+	local := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(rand.Reader, local); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(local); err != nil {
+		return nil, err
+	}
+	remote := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, err
+	}
+
+	senderNonce, receiverNonce := local, remote
+	if !isSender {
+		senderNonce, receiverNonce = remote, local
+	}
+	toReceiver, err := newGCM(k.mac([]byte("data"), senderNonce, receiverNonce))
+	if err != nil {
+		return nil, err
+	}
+	toSender, err := newGCM(k.mac([]byte("ack"), senderNonce, receiverNonce))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sealedConn{
+		conn:  conn,
+		write: toReceiver,
+		read:  toSender,
+	}
+	if !isSender {
+		c.write, c.read = toSender, toReceiver
+	}
+
+	// an empty record proves the peer has the key before any data is sent
+	if _, err = c.writeRecord(nil); err != nil {
+		return nil, err
+	}
+	if _, err = c.readRecord(); err != nil {
+		if err == ErrOpen {
+			err = ErrAuth
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedConn writes records as length(uint32) and sealed data, the nonce of each record is it's number.
+type sealedConn struct {
+	conn io.ReadWriteCloser
+
+	write      cipher.AEAD
+	writeSeq   uint64
+	writeNonce [12]byte
+	writeBuf   []byte
+	writeMu    sync.Mutex
+
+	read      cipher.AEAD
+	readSeq   uint64
+	readNonce [12]byte
+	readBuf   []byte
+	// plain bytes of the last record not read yet
+	plain []byte
+}
+
+func (c *sealedConn) Write(p []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for len(p) > 0 {
+		size := len(p)
+		if size > maxRecordSize {
+			size = maxRecordSize
+		}
+		if _, err = c.writeRecord(p[:size]); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+func (c *sealedConn) writeRecord(plain []byte) (int, error) {
+	if cap(c.writeBuf) < 4+len(plain)+c.write.Overhead() {
+		c.writeBuf = make([]byte, 0, 4+maxRecordSize+c.write.Overhead())
+	}
+	buf := c.writeBuf[:4]
+	buf = c.write.Seal(buf, nonce(&c.writeNonce, c.writeSeq), plain, nil)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-4))
+	c.writeSeq++
+	return c.conn.Write(buf)
+}
+
+func (c *sealedConn) Read(p []byte) (n int, err error) {
+	for len(c.plain) == 0 {
+		if c.plain, err = c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+func (c *sealedConn) readRecord() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:]))
+	if length < c.read.Overhead() || length > maxRecordSize+c.read.Overhead() {
+		return nil, fmt.Errorf("error record length %d", length)
+	}
+	if cap(c.readBuf) < length {
+		c.readBuf = make([]byte, maxRecordSize+c.read.Overhead())
+	}
+	buf := c.readBuf[:length]
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return nil, err
+	}
+	plain, err := c.read.Open(buf[:0], nonce(&c.readNonce, c.readSeq), buf, nil)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	c.readSeq++
+	return plain, nil
+}
+
+// nonce puts seq to buf, keys are never reused by streams so the number is unique.
+func nonce(buf *[12]byte, seq uint64) []byte {
+	binary.BigEndian.PutUint64(buf[4:], seq)
+	return buf[:]
+}
+
+func (c *sealedConn) Close() error {
+	return c.conn.Close()
+}
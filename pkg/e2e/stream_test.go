@@ -0,0 +1,152 @@
+package e2e
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		ch <- conn
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatal("accept error")
+	}
+	return c1, c2
+}
+
+type wrapResult struct {
+	rwc io.ReadWriteCloser
+	err error
+}
+
+func wrapPair(t *testing.T, senderKey *StreamKey, receiverKey *StreamKey) (wrapResult, wrapResult) {
+	c1, c2 := tcpPair(t)
+	ch := make(chan wrapResult, 1)
+	go func() {
+		rwc, err := receiverKey.WrapConn(c2, false)
+		if err != nil {
+			c2.Close()
+		}
+		ch <- wrapResult{rwc, err}
+	}()
+	rwc, err := senderKey.WrapConn(c1, true)
+	if err != nil {
+		c1.Close()
+	}
+	return wrapResult{rwc, err}, <-ch
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := NewStreamKey([]byte("secret"), "abc")
+	s, r := wrapPair(t, key, key)
+	if s.err != nil || r.err != nil {
+		t.Fatalf("wrap error: %v, %v", s.err, r.err)
+	}
+	defer s.rwc.Close()
+	defer r.rwc.Close()
+
+	data := make([]byte, 3*maxRecordSize+123)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		s.rwc.Write(data)
+		s.rwc.Write([]byte("end"))
+	}()
+	buf := make([]byte, len(data)+3)
+	if _, err := io.ReadFull(r.rwc, buf); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if !bytes.Equal(buf[:len(data)], data) || string(buf[len(data):]) != "end" {
+		t.Fatalf("data is changed")
+	}
+
+	// acks in the other direction
+	go r.rwc.Write([]byte("ack"))
+	ack := make([]byte, 3)
+	if _, err := io.ReadFull(s.rwc, ack); err != nil || string(ack) != "ack" {
+		t.Fatalf("read ack %q error: %v", ack, err)
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	s, r := wrapPair(t, NewStreamKey([]byte("secret"), "abc"), NewStreamKey([]byte("other"), "abc"))
+	if s.err != ErrAuth || r.err != ErrAuth {
+		t.Fatalf("wrap with wrong key returns %v, %v", s.err, r.err)
+	}
+
+	// the same key of another transfer doesn't work either
+	s, r = wrapPair(t, NewStreamKey([]byte("secret"), "abc"), NewStreamKey([]byte("secret"), "abd"))
+	if s.err != ErrAuth || r.err != ErrAuth {
+		t.Fatalf("wrap with key of another id returns %v, %v", s.err, r.err)
+	}
+}
+
+func TestStreamAuth(t *testing.T) {
+	a := NewStreamKey([]byte("secret"), "abc").Auth()
+	if a != NewStreamKey([]byte("secret"), "abc").Auth() {
+		t.Fatalf("auth is not stable")
+	}
+	if a == NewStreamKey([]byte("other"), "abc").Auth() || a == NewStreamKey([]byte("secret"), "abd").Auth() {
+		t.Fatalf("auth is the same for different keys or ids")
+	}
+}
+
+// tamperConn flips a bit of the n-th byte written.
+type tamperConn struct {
+	net.Conn
+	n       int
+	written int
+}
+
+func (c *tamperConn) Write(p []byte) (int, error) {
+	if c.n >= c.written && c.n < c.written+len(p) {
+		p = append([]byte{}, p...)
+		p[c.n-c.written] ^= 1
+	}
+	c.written += len(p)
+	return c.Conn.Write(p)
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := NewStreamKey([]byte("secret"), "abc")
+	c1, c2 := tcpPair(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	// the byte is in the first data record, after nonce and the empty record
+	tc := &tamperConn{Conn: c1, n: streamNonceSize + 4 + 16 + 4 + 2}
+	ch := make(chan wrapResult, 1)
+	go func() {
+		rwc, err := key.WrapConn(c2, false)
+		ch <- wrapResult{rwc, err}
+	}()
+	s, err := key.WrapConn(tc, true)
+	if err != nil {
+		t.Fatalf("wrap error: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("wrap error: %v", r.err)
+	}
+	go s.Write([]byte("hello"))
+	if _, err = io.ReadFull(r.rwc, make([]byte, 5)); err != ErrOpen {
+		t.Fatalf("read tampered record returns %v", err)
+	}
+}
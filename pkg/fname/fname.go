@@ -0,0 +1,79 @@
+package fname
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxNameLen is the max bytes of a file name on most filesystems.
+const MaxNameLen = 255
+
+// CleanName normalizes a file name from the remote peer and checks it's safe to be created in any directory.
+// Names with path separators, control characters or invisible direction marks which can spoof
+// the extension on terminal are rejected. Names which can't be created on windows are rewritten:
+// ':' is replaced by '_', trailing dots and spaces are removed and reserved device names like
+// "CON" or "nul.txt" get a '_' prefix.
+func CleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	// "", "." and ".." are all empty without trailing dots
+	if strings.TrimRight(name, ". ") == "" {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	name = strings.TrimRight(strings.Replace(name, ":", "_", -1), ". ")
+	if isReservedName(name) {
+		name = "_" + name
+	}
+	if len(name) > MaxNameLen {
+		return "", fmt.Errorf("file name is longer than %d bytes", MaxNameLen)
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("file name %q is not valid utf-8", name)
+	}
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			return "", fmt.Errorf("file name %q contains path separator", name)
+		case unicode.IsControl(r):
+			return "", fmt.Errorf("file name %q contains control character", name)
+		case unicode.Is(unicode.Bidi_Control, r):
+			return "", fmt.Errorf("file name %q contains direction mark", name)
+		}
+	}
+	return name, nil
+}
+
+// isReservedName returns true if name is a device name on windows, the extension doesn't matter.
+func isReservedName(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.ToUpper(strings.TrimRight(name, " "))
+	switch name {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(name) == 4 && (strings.HasPrefix(name, "COM") || strings.HasPrefix(name, "LPT")) {
+		return name[3] >= '1' && name[3] <= '9'
+	}
+	return false
+}
+
+// CheckPath checks a relative path separated by "/" in a directory transfer,
+// each element should be a clean name so the path can't go out of the directory.
+func CheckPath(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty path")
+	}
+	for _, elem := range strings.Split(p, "/") {
+		name, err := CleanName(elem)
+		if err != nil {
+			return fmt.Errorf("invalid path %q: %v", p, err)
+		}
+		if name != elem {
+			return fmt.Errorf("invalid path %q: it's not normalized", p)
+		}
+	}
+	return nil
+}
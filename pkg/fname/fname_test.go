@@ -0,0 +1,91 @@
+package fname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect string // empty if name is rejected
+	}{
+		{"file.txt", "file.txt"},
+		{"  file.txt ", "file.txt"},
+		{".hidden", ".hidden"},
+		{"文件.txt", "文件.txt"},
+		{"", ""},
+		{" ", ""},
+		{".", ""},
+		{"..", ""},
+		{"...", ""},
+		{"../file", ""},
+		{"dir/file", ""},
+		{"/etc/passwd", ""},
+		{`dir\file`, ""},
+		{`C:\file`, ""},
+		{"file\x00.txt", ""},
+		{"file\n.txt", ""},
+		{"file\u202etxt.exe", ""},
+		{strings.Repeat("a", MaxNameLen+1), ""},
+		{"\xff", ""},
+
+		// rewritten to be created on windows
+		{"12:30.log", "12_30.log"},
+		{"C:", "C_"},
+		{"file.", "file"},
+		{"file. . ", "file"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Nul.tar.gz", "_Nul.tar.gz"},
+		{"aux .txt", "_aux .txt"},
+		{"COM1", "_COM1"},
+		{"lpt9.log", "_lpt9.log"},
+		{"COM0", "COM0"},
+		{"LPT10", "LPT10"},
+		{"CONSOLE", "CONSOLE"},
+		{"file.con", "file.con"},
+	}
+	for _, test := range tests {
+		name, err := CleanName(test.name)
+		if test.expect == "" {
+			if err == nil {
+				t.Fatalf("%q: expect error, got %q", test.name, name)
+			}
+			continue
+		}
+		if err != nil || name != test.expect {
+			t.Fatalf("%q: got %q, %v, expect %q", test.name, name, err, test.expect)
+		}
+		// cleaned name is clean
+		if again, err := CleanName(name); err != nil || again != name {
+			t.Fatalf("%q: clean %q again: %q, %v", test.name, name, again, err)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := map[string]bool{
+		"file":         true,
+		"dir/file":     true,
+		"a/b/c.txt":    true,
+		"":             false,
+		"/file":        false,
+		"dir/":         false,
+		"dir//file":    false,
+		"../file":      false,
+		"dir/../file":  false,
+		"dir/./file":   false,
+		`dir\file`:     false,
+		"dir /file":    false,
+		"dir/a:b":      false,
+		"dir/con":      false,
+		"dir/file.":    false,
+		"dir/\x01file": false,
+	}
+	for p, ok := range tests {
+		if err := CheckPath(p); (err == nil) != ok {
+			t.Fatalf("%q: got %v, expect ok %v", p, err, ok)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package io
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// PrefixConn returns prefix bytes first and then reads from the underlying net.Conn.
+// It's used for connections which have been peeked some bytes.
+type PrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func NewPrefixConn(conn net.Conn, prefix []byte) *PrefixConn {
+	return &PrefixConn{
+		Conn:   conn,
+		prefix: prefix,
+	}
+}
+
+func (pc *PrefixConn) Read(p []byte) (n int, err error) {
+	if len(pc.prefix) > 0 {
+		n = copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return
+	}
+	return pc.Conn.Read(p)
+}
+
+// CountConn counts bytes read from and written to the underlying net.Conn,
+// so TLS records and protocol messages above it are all counted.
+type CountConn struct {
+	net.Conn
+	in  uint64
+	out uint64
+
+	// called with bytes read and written each time
+	callback func(in int, out int)
+}
+
+func NewCountConn(conn net.Conn, callback func(in int, out int)) *CountConn {
+	return &CountConn{
+		Conn:     conn,
+		callback: callback,
+	}
+}
+
+func (cc *CountConn) Read(p []byte) (n int, err error) {
+	n, err = cc.Conn.Read(p)
+	if n > 0 {
+		cc.Add(n, 0)
+	}
+	return
+}
+
+func (cc *CountConn) Write(p []byte) (n int, err error) {
+	n, err = cc.Conn.Write(p)
+	if n > 0 {
+		cc.Add(0, n)
+	}
+	return
+}
+
+// Add counts bytes moved without Read and Write, like by Splice.
+func (cc *CountConn) Add(in int, out int) {
+	atomic.AddUint64(&cc.in, uint64(in))
+	atomic.AddUint64(&cc.out, uint64(out))
+	if cc.callback != nil {
+		cc.callback(in, out)
+	}
+}
+
+// Counts returns bytes read and written until now.
+func (cc *CountConn) Counts() (in uint64, out uint64) {
+	return atomic.LoadUint64(&cc.in), atomic.LoadUint64(&cc.out)
+}
@@ -39,3 +39,39 @@ func (cw *CallbackWriter) Write(p []byte) (n int, err error) {
 	cw.callback(n)
 	return
 }
+
+type CallbackWriterAt struct {
+	w        io.WriterAt
+	callback func(n int)
+}
+
+func NewCallbackWriterAt(w io.WriterAt, callback func(n int)) *CallbackWriterAt {
+	return &CallbackWriterAt{
+		w:        w,
+		callback: callback,
+	}
+}
+
+func (cw *CallbackWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	n, err = cw.w.WriteAt(p, off)
+	cw.callback(n)
+	return
+}
+
+type CallbackReaderAt struct {
+	r        io.ReaderAt
+	callback func(n int)
+}
+
+func NewCallbackReaderAt(r io.ReaderAt, callback func(n int)) *CallbackReaderAt {
+	return &CallbackReaderAt{
+		r:        r,
+		callback: callback,
+	}
+}
+
+func (cr *CallbackReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = cr.r.ReadAt(p, off)
+	cr.callback(n)
+	return
+}
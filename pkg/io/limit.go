@@ -3,23 +3,32 @@ package io
 import (
 	"context"
 	"io"
-
-	"golang.org/x/time/rate"
 )
 
+// Limiter waits until n bytes can be transferred, n is never greater than Burst.
+// *rate.Limiter is a Limiter.
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
+	Burst() int
+}
+
 type RateReader struct {
 	underlying io.Reader
-	limiter    *rate.Limiter
+	limiter    Limiter
 }
 
-func NewRateReader(r io.Reader, limiter *rate.Limiter) *RateReader {
+func NewRateReader(r io.Reader, limiter Limiter) *RateReader {
 	return &RateReader{
 		underlying: r,
 		limiter:    limiter,
 	}
 }
 
+// Read reads no more than limiter's burst at a time, so it can always get enough tokens.
 func (rr *RateReader) Read(p []byte) (n int, err error) {
+	if burst := rr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
 	n, err = rr.underlying.Read(p)
 	if err != nil {
 		return
@@ -31,3 +40,38 @@ func (rr *RateReader) Read(p []byte) (n int, err error) {
 	}
 	return
 }
+
+// RateWriter splits large writes into pieces no larger than limiter's burst,
+// each piece waits for enough tokens before it is written.
+type RateWriter struct {
+	underlying io.Writer
+	limiter    Limiter
+}
+
+func NewRateWriter(w io.Writer, limiter Limiter) *RateWriter {
+	return &RateWriter{
+		underlying: w,
+		limiter:    limiter,
+	}
+}
+
+func (rw *RateWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if burst := rw.limiter.Burst(); size > burst {
+			size = burst
+		}
+		if err = rw.limiter.WaitN(context.Background(), size); err != nil {
+			return
+		}
+
+		var nw int
+		nw, err = rw.underlying.Write(p[:size])
+		n += nw
+		if err != nil {
+			return
+		}
+		p = p[size:]
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package io
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+
+	// max bytes moved by one splice, same as default pipe size
+	maxSpliceSize = 64 * 1024
+)
+
+// SpliceSupported means Splice moves data in kernel without copying it to userspace.
+const SpliceSupported = true
+
+// Splice copies data from src to dst through a pipe until EOF or an error occurs.
+// If limiter is not nil, each chunk waits for enough tokens before it is written to dst.
+// Callback is called with the size of each chunk after it has been written.
+func Splice(dst *net.TCPConn, src *net.TCPConn, limiter Limiter, callback func(n int)) (written int64, err error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var p [2]int
+	if err = syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return
+	}
+	pr, pw := p[0], p[1]
+	defer syscall.Close(pr)
+	defer syscall.Close(pw)
+
+	chunkSize := maxSpliceSize
+	if limiter != nil && limiter.Burst() < chunkSize {
+		chunkSize = limiter.Burst()
+	}
+
+	for {
+		// move data which is available now from src to pipe
+		var n int64
+		var serr error
+		err = srcRaw.Read(func(fd uintptr) bool {
+			n, serr = syscall.Splice(int(fd), nil, pw, nil, chunkSize, spliceMove|spliceNonblock)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return
+		}
+		// EOF
+		if n == 0 {
+			return
+		}
+
+		if limiter != nil {
+			if err = limiter.WaitN(context.Background(), int(n)); err != nil {
+				return
+			}
+		}
+
+		// move all data in pipe to dst
+		remain := n
+		err = dstRaw.Write(func(fd uintptr) bool {
+			for remain > 0 {
+				m, werr := syscall.Splice(pr, nil, int(fd), nil, int(remain), spliceMove|spliceNonblock)
+				if werr == syscall.EAGAIN {
+					return false
+				}
+				if werr != nil {
+					serr = werr
+					return true
+				}
+				remain -= m
+			}
+			return true
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return
+		}
+
+		written += n
+		if callback != nil {
+			callback(int(n))
+		}
+	}
+}
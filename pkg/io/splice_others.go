@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package io
+
+import (
+	"io"
+	"net"
+)
+
+// SpliceSupported means Splice moves data in kernel without copying it to userspace.
+const SpliceSupported = false
+
+// Splice copies data from src to dst in userspace on platforms without splice.
+// If limiter is not nil, each chunk waits for enough tokens before it is written to dst.
+// Callback is called with the size of each chunk after it has been written.
+func Splice(dst *net.TCPConn, src *net.TCPConn, limiter Limiter, callback func(n int)) (written int64, err error) {
+	var r io.Reader = src
+	if limiter != nil {
+		r = NewRateReader(r, limiter)
+	}
+	if callback != nil {
+		r = NewCallbackReader(r, callback)
+	}
+	return io.Copy(dst, r)
+}
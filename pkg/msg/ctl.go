@@ -8,12 +8,16 @@ import (
 
 type Message = jsonMsg.Message
 
+const maxMsgLength = 1024 * 1024
+
 var (
 	msgCtl *jsonMsg.MsgCtl
 )
 
 func init() {
 	msgCtl = jsonMsg.NewMsgCtl()
+	// chunk locations of large files in mailbox mode and delta signatures don't fit in the default limit
+	msgCtl.SetMaxMsgLength(maxMsgLength)
 	for typeByte, msg := range msgTypeMap {
 		msgCtl.RegisterMsg(typeByte, msg)
 	}
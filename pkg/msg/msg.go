@@ -11,6 +11,43 @@ const (
 	TypeNewSendFileStreamResp    = 'h'
 	TypeNewReceiveFileStream     = 'i'
 	TypeNewReceiveFileStreamResp = 'j'
+	TypePutMailbox               = 'k'
+	TypePutMailboxResp           = 'l'
+	TypeCommitMailbox            = 'm'
+	TypeCommitMailboxResp        = 'n'
+	TypeNewStoreStream           = 'o'
+	TypeNewStoreStreamResp       = 'p'
+	TypeNewFetchStream           = 'q'
+	TypeNewFetchStreamResp       = 'r'
+	TypeFetchChunk               = 's'
+	TypeNewSeedStream            = 't'
+	TypeNewSeedStreamResp        = 'u'
+	TypeSwarmNext                = 'v'
+	TypeSwarmNextResp            = 'w'
+	TypeSwarmWait                = 'x'
+	TypeSwarmWaitResp            = 'A'
+	TypeDeltaSignature           = 'B'
+	TypeSyncManifest             = 'C'
+	TypeSyncRequest              = 'D'
+	TypeDedupChunks              = 'E'
+	TypeDedupRequest             = 'F'
+	TypeOfferAnswer              = 'G'
+	TypeGetWorkers               = 'H'
+	TypeGetWorkersResp           = 'I'
+	TypeWorkerEvent              = 'J'
+	TypeWorkerDraining           = 'K'
+	TypeDrainWorker              = 'L'
+	TypeDrainWorkerResp          = 'M'
+	TypeWorkerStats              = 'N'
+	TypeWorkerCommand            = 'O'
+	TypeWorkerCommandResp        = 'P'
+	TypeListWorkers              = 'Q'
+	TypeListWorkersResp          = 'R'
+	TypeManageWorkers            = 'S'
+	TypeManageWorkersResp        = 'T'
+	TypeNewWorkConn              = 'U'
+	TypeStartWorkConn            = 'V'
+	TypeReqWorkConn              = 'W'
 
 	TypePing = 'y'
 	TypePong = 'z'
@@ -28,65 +65,539 @@ var (
 		TypeNewSendFileStreamResp:    NewSendFileStreamResp{},
 		TypeNewReceiveFileStream:     NewReceiveFileStream{},
 		TypeNewReceiveFileStreamResp: NewReceiveFileStreamResp{},
+		TypePutMailbox:               PutMailbox{},
+		TypePutMailboxResp:           PutMailboxResp{},
+		TypeCommitMailbox:            CommitMailbox{},
+		TypeCommitMailboxResp:        CommitMailboxResp{},
+		TypeNewStoreStream:           NewStoreStream{},
+		TypeNewStoreStreamResp:       NewStoreStreamResp{},
+		TypeNewFetchStream:           NewFetchStream{},
+		TypeNewFetchStreamResp:       NewFetchStreamResp{},
+		TypeFetchChunk:               FetchChunk{},
+		TypeNewSeedStream:            NewSeedStream{},
+		TypeNewSeedStreamResp:        NewSeedStreamResp{},
+		TypeSwarmNext:                SwarmNext{},
+		TypeSwarmNextResp:            SwarmNextResp{},
+		TypeSwarmWait:                SwarmWait{},
+		TypeSwarmWaitResp:            SwarmWaitResp{},
+		TypeDeltaSignature:           DeltaSignature{},
+		TypeSyncManifest:             SyncManifest{},
+		TypeSyncRequest:              SyncRequest{},
+		TypeDedupChunks:              DedupChunks{},
+		TypeDedupRequest:             DedupRequest{},
+		TypeOfferAnswer:              OfferAnswer{},
+		TypeGetWorkers:               GetWorkers{},
+		TypeGetWorkersResp:           GetWorkersResp{},
+		TypeWorkerEvent:              WorkerEvent{},
+		TypeWorkerDraining:           WorkerDraining{},
+		TypeDrainWorker:              DrainWorker{},
+		TypeDrainWorkerResp:          DrainWorkerResp{},
+		TypeWorkerStats:              WorkerStats{},
+		TypeWorkerCommand:            WorkerCommand{},
+		TypeWorkerCommandResp:        WorkerCommandResp{},
+		TypeListWorkers:              ListWorkers{},
+		TypeListWorkersResp:          ListWorkersResp{},
+		TypeManageWorkers:            ManageWorkers{},
+		TypeManageWorkersResp:        ManageWorkersResp{},
+		TypeNewWorkConn:              NewWorkConn{},
+		TypeStartWorkConn:            StartWorkConn{},
+		TypeReqWorkConn:              ReqWorkConn{},
 
 		TypePing: Ping{},
 		TypePong: Pong{},
 	}
 )
 
+// A reverse worker can't be connected by others, clients connect to a port of server instead
+// and their connections are relayed through work connections the worker dials to server.
 type RegisterWorker struct {
-	Version  string `json:"version"`
-	BindPort int64  `json:"bind_port"`
-	PublicIP string `json:"public_ip"`
+	Version         string   `json:"version"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	BindPort        int64    `json:"bind_port"`
+	PublicIP        string   `json:"public_ip"`
+	Reverse         bool     `json:"reverse,omitempty"`
 }
 
+// RunID identifies work connections of a reverse worker, PublicAddr is the address clients connect to.
 type RegisterWorkerResp struct {
-	Error string `json:"error"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
+	RunID           string   `json:"run_id,omitempty"`
+	PublicAddr      string   `json:"public_addr,omitempty"`
+}
+
+// NewWorkConn is sent by a reverse worker on a work connection it dials to server, then it waits for StartWorkConn.
+type NewWorkConn struct {
+	RunID string `json:"run_id"`
+}
+
+// StartWorkConn tells a reverse worker to serve the client connection relayed through the work connection.
+type StartWorkConn struct {
+	ClientAddr string `json:"client_addr"`
 }
 
+// ReqWorkConn is sent by server to a reverse worker after one of it's work connections is used.
+type ReqWorkConn struct{}
+
 type SendFile struct {
-	ID         string `json:"id"`
-	Fsize      int64  `json:"fsize"`
-	Name       string `json:"name"`
-	CacheCount int64  `json:"cache_count"`
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Fsize           int64    `json:"fsize"`
+	Name            string   `json:"name"`
+	FrameSize       int64    `json:"frame_size"`
+	CacheCount      int64    `json:"cache_count"`
+
+	// seconds to wait for receiver, 0 means server's default
+	WaitTimeout int64 `json:"wait_timeout"`
+
+	// 0 or 1 means only one receiver, -1 means any number of receivers until WaitTimeout
+	MaxReceivers int64 `json:"max_receivers"`
+
+	// Swarm means receivers also serve chunks they have to each other, FrameSize is the chunk size
+	Swarm bool `json:"swarm"`
+
+	// Delta asks receiver for signature of it's existing file, so only changed data is sent
+	Delta bool `json:"delta"`
+
+	// Sync means Name is a directory, it's manifest is sent to receiver after SendFileResp
+	// and only files receiver asks for by SyncRequest are sent
+	Sync bool `json:"sync"`
+
+	// Dedup means the file is split into chunks by content, hashes of chunks are sent to receiver
+	// and only chunks not in receiver's cache are sent
+	Dedup bool `json:"dedup"`
+
+	// Files is how many files are sent, it's more than one if Sync is true
+	Files int64 `json:"files"`
+
+	// Fingerprint is derived from the end-to-end key, receiver can check it has the same key before receiving
+	Fingerprint string `json:"fingerprint"`
 }
 
+// Capabilities in SendFileResp and ReceiveFileResp are agreed by both sender and receiver.
 type SendFileResp struct {
-	ID         string   `json:"id"`
-	Workers    []string `json:"workers"`
-	CacheCount int64    `json:"cache_count"`
-	Error      string   `json:"error"`
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Workers         []string `json:"workers"`
+	CacheCount      int64    `json:"cache_count"`
+
+	// frames should be fanned out by workers if there are more than one receivers
+	Receivers int64 `json:"receivers"`
+
+	// sender is peer 0 in swarm mode, it keeps this connection until SwarmWaitResp
+	Swarm bool `json:"swarm"`
+
+	// sender should read DeltaSignature from this connection until Last and send delta of the file
+	Delta bool `json:"delta"`
+
+	// sender should send SyncManifest and read SyncRequest until Last in this connection
+	Sync bool `json:"sync"`
+
+	// sender should send DedupChunks and read DedupRequest until Last in this connection
+	Dedup bool `json:"dedup"`
+
+	// sender should wait for OfferAnswer from receiver in this connection before sending anything
+	Consent bool   `json:"consent"`
+	Error   string `json:"error"`
 }
 
 type ReceiveFile struct {
-	ID         string `json:"id"`
-	CacheCount int64  `json:"cache_count"`
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	CacheCount      int64    `json:"cache_count"`
+
+	// seconds to wait for sender, 0 means server's default
+	WaitTimeout int64 `json:"wait_timeout"`
 }
 
 type ReceiveFileResp struct {
-	Name       string   `json:"name"`
-	Fsize      int64    `json:"fsize"`
-	Workers    []string `json:"workers"`
-	CacheCount int64    `json:"cache_count"`
-	Error      string   `json:"error"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Name            string   `json:"name"`
+	Fsize           int64    `json:"fsize"`
+	FrameSize       int64    `json:"frame_size"`
+	Workers         []string `json:"workers"`
+	CacheCount      int64    `json:"cache_count"`
+
+	// Mailbox means the file has been uploaded to workers by sender,
+	// receiver should fetch each chunk from workers in Locations.
+	Mailbox   bool    `json:"mailbox"`
+	Locations [][]int `json:"locations"`
+
+	// receiver should put ReceiverIndex in acks if Receivers is more than one
+	Receivers     int64 `json:"receivers"`
+	ReceiverIndex int64 `json:"receiver_index"`
+
+	// in swarm mode, receiver is peer ReceiverIndex+1, it asks server which chunk to fetch
+	// from which peer by SwarmNext in this connection
+	Swarm bool `json:"swarm"`
+
+	// receiver should send signature of it's existing file by DeltaSignature in this connection,
+	// frames are delta against it
+	Delta bool `json:"delta"`
+
+	// receiver should read SyncManifest and reply SyncRequest until Last in this connection,
+	// FileID of frames is the index of file in manifest
+	Sync bool `json:"sync"`
+
+	// receiver should read DedupChunks and reply DedupRequest until Last in this connection,
+	// FileID of frames is the index of chunk
+	Dedup bool `json:"dedup"`
+
+	// offer of sender, SenderAddr is observed by server
+	Files       int64  `json:"files"`
+	Fingerprint string `json:"fingerprint"`
+	SenderAddr  string `json:"sender_addr"`
+
+	// receiver should send OfferAnswer in this connection first, sender is waiting for it
+	Consent bool   `json:"consent"`
+	Error   string `json:"error"`
 }
 
 type NewSendFileStream struct {
-	ID string `json:"id"`
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+
+	// more than one means worker should fan out frames to receivers
+	Receivers int64 `json:"receivers"`
+
+	// derived from the end-to-end key, worker pairs streams only if they have the same one
+	Auth string `json:"auth,omitempty"`
 }
 
 type NewSendFileStreamResp struct {
-	Error string `json:"error"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
 }
 
 type NewReceiveFileStream struct {
-	ID string `json:"id"`
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+
+	// receiver gets frames from a fanout group instead of a paired sender
+	Fanout bool `json:"fanout"`
+
+	// derived from the end-to-end key, worker pairs streams only if they have the same one
+	Auth string `json:"auth,omitempty"`
 }
 
 type NewReceiveFileStreamResp struct {
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
+}
+
+// PutMailbox asks server to reserve an ID and storage workers for a file which
+// will be uploaded before receiver comes.
+type PutMailbox struct {
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Name            string   `json:"name"`
+	Fsize           int64    `json:"fsize"`
+	ChunkSize       int64    `json:"chunk_size"`
+	Replicas        int64    `json:"replicas"`
+}
+
+// Chunk i should be stored on Workers[(i+r)%len(Workers)] for r in [0, Replicas).
+// Workers only accept store streams with UploadToken, it's known by sender only.
+type PutMailboxResp struct {
+	ID              string   `json:"id"`
+	ProtocolVersion int64    `json:"protocol_version"`
+	Workers         []string `json:"workers"`
+	Replicas        int64    `json:"replicas"`
+	ExpireAt        int64    `json:"expire_at"`
+	UploadToken     string   `json:"upload_token"`
+	Error           string   `json:"error"`
+}
+
+// CommitMailbox makes the mailbox visible to receiver after all chunks are uploaded.
+// Locations[i] are indexes of workers in PutMailboxResp which have stored chunk i.
+type CommitMailbox struct {
+	ID        string  `json:"id"`
+	Locations [][]int `json:"locations"`
+}
+
+type CommitMailboxResp struct {
+	ExpireAt int64  `json:"expire_at"`
+	Error    string `json:"error"`
+}
+
+type NewStoreStream struct {
+	ID              string `json:"id"`
+	ProtocolVersion int64  `json:"protocol_version"`
+	UploadToken     string `json:"upload_token"`
+}
+
+type NewStoreStreamResp struct {
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
+}
+
+type NewFetchStream struct {
+	ID              string `json:"id"`
+	ProtocolVersion int64  `json:"protocol_version"`
+
+	// fetch chunks from other swarm participants instead of storage
+	Swarm bool `json:"swarm"`
+}
+
+type NewFetchStreamResp struct {
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
+}
+
+type FetchChunk struct {
+	ChunkID int64 `json:"chunk_id"`
+
+	// in swarm mode, fetcher asks chunk from Peer, worker forwards it to Peer's seed stream with Tag
+	Peer int64 `json:"peer,omitempty"`
+	Tag  int64 `json:"tag,omitempty"`
+}
+
+// NewSeedStream is sent by a swarm participant to serve chunks it has to other receivers.
+type NewSeedStream struct {
+	ID              string `json:"id"`
+	ProtocolVersion int64  `json:"protocol_version"`
+	Peer            int64  `json:"peer"`
+}
+
+type NewSeedStreamResp struct {
+	ProtocolVersion int64    `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+	Error           string   `json:"error"`
+}
+
+// SwarmNext reports result of the last assigned chunk and asks server for a new one.
+type SwarmNext struct {
+	// -1 if there is no last chunk
+	ChunkID int64 `json:"chunk_id"`
+	Peer    int64 `json:"peer"`
+	Failed  bool  `json:"failed"`
+}
+
+type SwarmNextResp struct {
+	ChunkID int64 `json:"chunk_id"`
+	Peer    int64 `json:"peer"`
+
+	// no chunk can be assigned now, ask again later
+	Wait bool `json:"wait"`
+
+	// all chunks have been received
+	Finished bool   `json:"finished"`
+	Error    string `json:"error"`
+}
+
+// SwarmWait is sent by participants who have all chunks, they keep serving others until SwarmWaitResp.
+type SwarmWait struct {
+}
+
+type SwarmWaitResp struct {
+	Receivers int64 `json:"receivers"`
+	Finished  int64 `json:"finished"`
+}
+
+// DeltaSignature has checksums of some blocks in receiver's existing file,
+// a large signature is sent by several messages. BlockSize is 0 if there is no such file.
+type DeltaSignature struct {
+	BlockSize int64  `json:"block_size"`
+	Blocks    []byte `json:"blocks"`
+	Last      bool   `json:"last"`
+}
+
+// SyncFile is a file or directory in sender's directory, Path is relative and separated by slash.
+type SyncFile struct {
+	Path    string `json:"path"`
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime int64  `json:"mod_time,omitempty"`
+	Mode    uint32 `json:"mode"`
+	Hash    string `json:"hash,omitempty"`
+}
+
+// SyncManifest has some files of sender's directory, a large manifest is sent by several messages.
+type SyncManifest struct {
+	Files []SyncFile `json:"files"`
+	Last  bool       `json:"last"`
+}
+
+// SyncRequest has indexes of files in manifest receiver needs, it may be sent by several messages.
+type SyncRequest struct {
+	Files []int64 `json:"files"`
+	Last  bool    `json:"last"`
+}
+
+// DedupChunks has sizes and sha256 hashes of some chunks of the file in order,
+// a large file is announced by several messages.
+type DedupChunks struct {
+	Sizes  []int64 `json:"sizes"`
+	Hashes []byte  `json:"hashes"`
+	Last   bool    `json:"last"`
+}
+
+// DedupRequest has indexes of chunks not in receiver's cache, it may be sent by several messages.
+type DedupRequest struct {
+	Chunks []int64 `json:"chunks"`
+	Last   bool    `json:"last"`
+}
+
+// OfferAnswer is receiver's answer to sender's offer, Reason tells sender why it's rejected.
+type OfferAnswer struct {
+	Accept bool   `json:"accept"`
+	Reason string `json:"reason"`
+}
+
+// GetWorkers asks server for workers in transfer after paths to Lost workers are broken.
+// Generation is of the list client knows, it's 0 for the list in SendFileResp or ReceiveFileResp.
+type GetWorkers struct {
+	Generation int64    `json:"generation"`
+	Lost       []string `json:"lost"`
+}
+
+// GetWorkersResp is the same list for sender and receivers, it's replaced only if client knows the latest one.
+type GetWorkersResp struct {
+	Workers    []string `json:"workers"`
+	Generation int64    `json:"generation"`
+	Error      string   `json:"error"`
+}
+
+// WorkerEvent is pushed by server to clients in transfer after workers of the transfer are changed,
+// Added workers should be used and Removed ones should be retired after frames through them are acked.
+type WorkerEvent struct {
+	Generation int64    `json:"generation"`
+	Added      []string `json:"added"`
+	Removed    []string `json:"removed"`
+}
+
+// WorkerDraining is sent by worker to server through it's registration, server doesn't assign new sessions to it
+// and clients in transfer move to other workers.
+type WorkerDraining struct {
+}
+
+// DrainWorker is sent by admin to worker's admin address. Timeout is seconds existing sessions can last,
+// 0 means worker's default. Token is the worker's admin token.
+type DrainWorker struct {
+	Timeout int64  `json:"timeout"`
+	Token   string `json:"token"`
+}
+
+type DrainWorkerResp struct {
+	Sessions int64  `json:"sessions"`
+	Error    string `json:"error"`
+}
+
+// WorkerStats is sent by worker to server as heartbeat instead of Ping, server replies Pong.
+// RemainingTraffic is -1 if traffic is not limited.
+type WorkerStats struct {
+	Sessions         int64 `json:"sessions"`
+	BytesPerSecond   int64 `json:"bytes_per_second"`
+	RateKB           int64 `json:"rate_kb"`
+	TrafficToday     int64 `json:"traffic_today"`
+	RemainingTraffic int64 `json:"remaining_traffic"`
+	Draining         bool  `json:"draining"`
+
+	// bytes worker read from and wrote to connections today, including protocol overhead
+	TrafficInToday  int64 `json:"traffic_in_today"`
+	TrafficOutToday int64 `json:"traffic_out_today"`
+}
+
+// Actions of WorkerCommand.
+const (
+	WorkerActionConfig     = "config"
+	WorkerActionDrain      = "drain"
+	WorkerActionUndrain    = "undrain"
+	WorkerActionResetQuota = "reset_quota"
+	WorkerActionPriority   = "priority"
+	WorkerActionMailbox    = "mailbox"
+)
+
+// Priority classes of transfers, workers give more bandwidth to higher ones when they are busy.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// WorkerConfig is changed by WorkerActionConfig, nil fields are not changed.
+type WorkerConfig struct {
+	RateKB              *int64 `json:"rate_kb,omitempty"`
+	MaxTrafficMBPerDay  *int64 `json:"max_traffic_mb_per_day,omitempty"`
+	DrainTimeoutSeconds *int64 `json:"drain_timeout_seconds,omitempty"`
+
+	// since ProtocolVersionSchedule
+	RateSchedule         *string `json:"rate_schedule,omitempty"`
+	MaxTrafficMBPerWeek  *int64  `json:"max_traffic_mb_per_week,omitempty"`
+	MaxTrafficMBPerMonth *int64  `json:"max_traffic_mb_per_month,omitempty"`
+}
+
+// WorkerCommand is pushed by server to worker through it's registration, worker replies WorkerCommandResp with the same ID.
+// Timeout is seconds existing sessions can last for WorkerActionDrain, 0 means worker's default.
+// Priority of Transfer is set by WorkerActionPriority.
+// WorkerActionMailbox opens Mailbox until ExpireAt, only store streams with UploadToken can upload chunks to it.
+type WorkerCommand struct {
+	ID          int64        `json:"id"`
+	Action      string       `json:"action"`
+	Config      WorkerConfig `json:"config"`
+	Timeout     int64        `json:"timeout"`
+	Transfer    string       `json:"transfer,omitempty"`
+	Priority    string       `json:"priority,omitempty"`
+	Mailbox     string       `json:"mailbox,omitempty"`
+	UploadToken string       `json:"upload_token,omitempty"`
+	ExpireAt    int64        `json:"expire_at,omitempty"`
+}
+
+type WorkerCommandResp struct {
+	ID    int64  `json:"id"`
+	Error string `json:"error"`
+}
+
+// ListWorkers is sent by admin to server's admin address, Token is the server's admin token.
+type ListWorkers struct {
+	Token string `json:"token"`
+}
+
+type WorkerInfo struct {
+	Addr            string      `json:"addr"`
+	Version         string      `json:"version"`
+	ProtocolVersion int64       `json:"protocol_version"`
+	Capabilities    []string    `json:"capabilities"`
+	Draining        bool        `json:"draining"`
+	Stats           WorkerStats `json:"stats"`
+	StatsAt         int64       `json:"stats_at"`
+}
+
+type ListWorkersResp struct {
+	Workers []WorkerInfo `json:"workers"`
+	Error   string       `json:"error"`
+}
+
+// ManageWorkers is sent by admin to server's admin address, Command is pushed to Workers or all workers if it's empty.
+type ManageWorkers struct {
+	Workers []string      `json:"workers"`
+	Command WorkerCommand `json:"command"`
+	Token   string        `json:"token"`
+}
+
+type WorkerResult struct {
+	Addr  string `json:"addr"`
 	Error string `json:"error"`
 }
 
+type ManageWorkersResp struct {
+	Results []WorkerResult `json:"results"`
+	Error   string         `json:"error"`
+}
+
 type Ping struct {
 }
 
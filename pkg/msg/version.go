@@ -0,0 +1,86 @@
+package msg
+
+import (
+	"fmt"
+)
+
+// ProtocolVersion should be increased when messages or streams are changed in an incompatible way.
+// Version 0 means the peer is too old to send it's protocol version, it has no capabilities
+// and talks in frame format v0.
+const (
+	ProtocolVersion    = 8
+	MinProtocolVersion = 0
+)
+
+// Since ProtocolVersionWaitPing, server pings clients waiting for their peers
+// and clients should reply pongs.
+const ProtocolVersionWaitPing = 2
+
+// Since ProtocolVersionGetWorkers, server answers GetWorkers from clients in transfer.
+const ProtocolVersionGetWorkers = 3
+
+// Since ProtocolVersionDrain, server stops assigning sessions to workers after they send WorkerDraining.
+const ProtocolVersionDrain = 4
+
+// Since ProtocolVersionWorkerControl, workers send WorkerStats as heartbeats and server can push WorkerCommand to them.
+// Server also opens mailboxes on storage workers by WorkerActionMailbox, store streams must carry the upload token.
+const ProtocolVersionWorkerControl = 5
+
+// Since ProtocolVersionSchedule, WorkerConfig can change rate schedule and weekly or monthly traffic limits.
+const ProtocolVersionSchedule = 6
+
+// Since ProtocolVersionPriority, server pushes priority classes of transfers to workers by WorkerActionPriority.
+const ProtocolVersionPriority = 7
+
+// Since ProtocolVersionReverse, workers behind NAT can register as reverse workers.
+const ProtocolVersionReverse = 8
+
+// Capabilities are optional features of the protocol.
+// A feature can be used only if both ends have it in their capabilities.
+const (
+	CapCompression = "compression"
+	CapEncryption  = "encryption"
+
+	// frames and acks are in format v1, peers without it only read and write format v0
+	CapFrameV1 = "frame_v1"
+	// broken streams are redialed and frames not acked are sent again
+	CapResume = "resume"
+	// frames of many files are carried by the same streams, receiver tells them apart by FileID
+	CapMultiplexing = "multiplexing"
+	CapMailbox      = "mailbox"
+	CapFanout       = "fanout"
+	CapSwarm        = "swarm"
+	CapDelta        = "delta"
+	CapSync         = "sync"
+	CapDedup        = "dedup"
+	CapConsent      = "consent"
+	CapMembership   = "membership"
+)
+
+// CheckProtocolVersion returns an error if we can't talk with a peer in version.
+func CheckProtocolVersion(version int64) error {
+	if version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is not supported, min supported version is %d, please upgrade", version, MinProtocolVersion)
+	}
+	return nil
+}
+
+func HasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// IntersectCapabilities returns capabilities both in a and b.
+func IntersectCapabilities(a []string, b []string) []string {
+	caps := make([]string, 0)
+	for _, c := range a {
+		if HasCapability(b, c) && !HasCapability(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
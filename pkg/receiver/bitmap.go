@@ -0,0 +1,56 @@
+package receiver
+
+// bitmap records which frames have been received.
+// Words before base are all set and have been dropped, so the memory used
+// is bounded by the distance between the first missing frame and the
+// largest received frame.
+type bitmap struct {
+	base  uint64 // frame id of the first bit in words
+	words []uint64
+}
+
+func newBitmap() *bitmap {
+	return &bitmap{
+		words: make([]uint64, 0),
+	}
+}
+
+// Set marks id as received and returns false if it has been set before.
+func (b *bitmap) Set(id uint64) bool {
+	if id < b.base {
+		return false
+	}
+	index := int((id - b.base) / 64)
+	for index >= len(b.words) {
+		b.words = append(b.words, 0)
+	}
+	mask := uint64(1) << ((id - b.base) % 64)
+	if b.words[index]&mask != 0 {
+		return false
+	}
+	b.words[index] |= mask
+	return true
+}
+
+func (b *bitmap) Has(id uint64) bool {
+	if id < b.base {
+		return true
+	}
+	index := int((id - b.base) / 64)
+	if index >= len(b.words) {
+		return false
+	}
+	return b.words[index]&(uint64(1)<<((id-b.base)%64)) != 0
+}
+
+// Trim drops all leading words which are full and before id.
+func (b *bitmap) Trim(id uint64) {
+	n := 0
+	for n < len(b.words) && b.words[n] == ^uint64(0) && b.base+uint64(n+1)*64 <= id {
+		n++
+	}
+	if n > 0 {
+		b.words = b.words[n:]
+		b.base += uint64(n) * 64
+	}
+}
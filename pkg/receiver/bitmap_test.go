@@ -0,0 +1,52 @@
+package receiver
+
+import (
+	"testing"
+)
+
+func TestBitmapSetAndHas(t *testing.T) {
+	b := newBitmap()
+	for _, id := range []uint64{3, 0, 130, 64} {
+		if !b.Set(id) {
+			t.Fatalf("set %d returns false at the first time", id)
+		}
+	}
+	if b.Set(130) {
+		t.Fatalf("set 130 again returns true")
+	}
+	for id := uint64(0); id < 200; id++ {
+		want := id == 0 || id == 3 || id == 64 || id == 130
+		if b.Has(id) != want {
+			t.Fatalf("has %d = %v, want %v", id, !want, want)
+		}
+	}
+}
+
+func TestBitmapTrim(t *testing.T) {
+	b := newBitmap()
+	for id := uint64(0); id < 130; id++ {
+		b.Set(id)
+	}
+	b.Set(200)
+
+	b.Trim(130)
+	if b.base != 128 {
+		t.Fatalf("base is %d after trim, want 128", b.base)
+	}
+	if len(b.words) != 2 {
+		t.Fatalf("%d words left after trim, want 2", len(b.words))
+	}
+	// dropped ids are still received and can't be set again
+	if !b.Has(5) || b.Set(5) {
+		t.Fatalf("dropped id 5 is not treated as received")
+	}
+	if !b.Has(129) || !b.Has(200) || b.Has(130) {
+		t.Fatalf("ids after base are changed by trim")
+	}
+
+	// words with a gap are kept
+	b.Trim(1000)
+	if b.base != 128 {
+		t.Fatalf("base is %d after trim with a gap, want 128", b.base)
+	}
+}
@@ -2,98 +2,364 @@ package receiver
 
 import (
 	"bytes"
+	"fmt"
 	"io"
-	"sort"
 	"sync"
+	"time"
 
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/delta"
 	"github.com/fatedier/fft/pkg/stream"
 )
 
 type Receiver struct {
 	fileID      uint32
-	nextFrameID uint32
-	dst         io.Writer
-	frames      []*stream.Frame
-	framesIDMap map[uint32]struct{}
-	notifyCh    chan struct{}
+	nextFrameID uint64
+
+	// max count of frames after nextFrameID we can accept
+	window uint64
+
+	// write frames in order, used for non-seekable dst like stdout.
+	// Frames from writeFrameID to nextFrameID are received but not written yet.
+	dst          io.Writer
+	frames       map[uint64]*stream.Frame
+	writeFrameID uint64
+
+	// write frames directly to their offset
+	dstAt       io.WriterAt
+	dstFor      func(fileID uint32) (io.WriterAt, error)
+	frameSize   int64
+	received    *bitmap
+	lastFrameID uint64
+	hasLast     bool
+
+	// rebuild the new file from delta in frames and the old file
+	patcher *delta.Patcher
+
+	notifyCh chan struct{}
+
+	// broadcast when the window moves or receiving is aborted
+	windowCond *sync.Cond
+
+	// when a new frame is received last time
+	lastProgress time.Time
+
+	// first error of writing frames, receiving is aborted and failCh is closed
+	err    error
+	failCh chan struct{}
 
 	mu sync.RWMutex
 }
 
-func NewReceiver(fileID uint32, dst io.Writer) *Receiver {
-	return &Receiver{
+// NewReceiver returns a Receiver which writes frames to dst in order.
+// Frames received early are kept in memory until the gap is filled.
+func NewReceiver(fileID uint32, dst io.Writer, window int) *Receiver {
+	if window <= 0 {
+		window = 100
+	}
+	r := &Receiver{
 		fileID:      fileID,
 		nextFrameID: 0,
+		window:      uint64(window),
 		dst:         dst,
-		frames:      make([]*stream.Frame, 0),
-		framesIDMap: make(map[uint32]struct{}),
+		frames:      make(map[uint64]*stream.Frame),
 		notifyCh:    make(chan struct{}, 1),
+		failCh:      make(chan struct{}),
+	}
+	r.windowCond = sync.NewCond(&r.mu)
+	return r
+}
+
+// NewFileReceiver returns a Receiver which writes each frame to it's offset in dst
+// as soon as it arrives. All frames except the last one must be frameSize bytes.
+func NewFileReceiver(fileID uint32, dst io.WriterAt, frameSize int, window int) *Receiver {
+	if window <= 0 {
+		window = 100
+	}
+	r := &Receiver{
+		fileID:      fileID,
+		nextFrameID: 0,
+		window:      uint64(window),
+		dstAt:       dst,
+		frameSize:   int64(frameSize),
+		received:    newBitmap(),
+		notifyCh:    make(chan struct{}, 1),
+		failCh:      make(chan struct{}),
+	}
+	r.windowCond = sync.NewCond(&r.mu)
+	return r
+}
+
+// NewFilesReceiver returns a Receiver of several files sent by one sender,
+// each frame is written to it's offset in the file dstFor returns by it's FileID.
+func NewFilesReceiver(dstFor func(fileID uint32) (io.WriterAt, error), window int) *Receiver {
+	if window <= 0 {
+		window = 100
+	}
+	r := &Receiver{
+		fileID:      0,
+		nextFrameID: 0,
+		window:      uint64(window),
+		dstFor:      dstFor,
+		received:    newBitmap(),
+		notifyCh:    make(chan struct{}, 1),
+		failCh:      make(chan struct{}),
+	}
+	r.windowCond = sync.NewCond(&r.mu)
+	return r
+}
+
+// NewDeltaReceiver returns a Receiver which writes frames in order to patcher,
+// frames are delta of the new file against receiver's old file.
+func NewDeltaReceiver(fileID uint32, patcher *delta.Patcher, window int) *Receiver {
+	r := NewReceiver(fileID, patcher, window)
+	r.patcher = patcher
+	return r
+}
+
+// Verify should be called after Run returns, it returns an error if the file rebuilt from delta
+// is incomplete or doesn't match sender's file. It always returns nil for other receivers.
+func (r *Receiver) Verify() error {
+	if r.patcher == nil {
+		return nil
+	}
+	return r.patcher.Close()
+}
+
+// Err returns the error which aborted receiving, like disk full.
+func (r *Receiver) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Failed returns a channel which is closed when receiving is aborted by an error.
+func (r *Receiver) Failed() <-chan struct{} {
+	return r.failCh
+}
+
+// Abort stops receiving, Run returns err.
+func (r *Receiver) Abort(err error) {
+	r.fail(err)
+}
+
+func (r *Receiver) fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+		close(r.failCh)
+		r.windowCond.Broadcast()
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// LastProgress returns when a new frame is received last time, it's zero if there is none.
+func (r *Receiver) LastProgress() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastProgress
+}
+
+// Window returns the frame id that sender should not reach.
+func (r *Receiver) Window() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nextFrameID + r.window
+}
+
+// WaitWindow blocks until frameID is in the window, so frames fetched concurrently are not rejected.
+// It returns the error if receiving is aborted.
+func (r *Receiver) WaitWindow(frameID uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.err == nil && frameID >= r.nextFrameID+r.window {
+		r.windowCond.Wait()
+	}
+	return r.err
+}
+
+// inWindow returns an error if sender has sent frame past the window it's told.
+// It should be called with lock held.
+func (r *Receiver) inWindow(frame *stream.Frame) error {
+	// senders of frame version 0 don't know the window
+	if frame.Version >= stream.Version1 && frame.FrameID >= r.nextFrameID+r.window {
+		return fmt.Errorf("frame %d is out of receive window %d", frame.FrameID, r.nextFrameID+r.window)
 	}
+	return nil
 }
 
-func (r *Receiver) RecvFrame(frame *stream.Frame) {
+// RecvFrame saves the frame. Ack should be sent only if error is nil.
+func (r *Receiver) RecvFrame(frame *stream.Frame) (err error) {
+	if err = r.Err(); err != nil {
+		return err
+	}
+	if frame.Flags&stream.FlagCompressed != 0 {
+		frame.Buf, err = codec.Decompress(frame.Buf, stream.MaxFrameSizeV1)
+		if err != nil {
+			return err
+		}
+		frame.Flags &^= stream.FlagCompressed
+	}
+
+	if r.writesAt() {
+		err = r.recvFrameAt(frame)
+	} else {
+		err = r.recvFrameInOrder(frame)
+	}
+
+	select {
+	case r.notifyCh <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// writesAt returns true if frames are written to their offsets instead of in order.
+func (r *Receiver) writesAt() bool {
+	return r.dstAt != nil || r.dstFor != nil
+}
+
+func (r *Receiver) recvFrameInOrder(frame *stream.Frame) error {
 	r.mu.Lock()
+	defer r.mu.Unlock()
 	if frame.FrameID < r.nextFrameID {
-		r.mu.Unlock()
-		return
+		return nil
+	}
+	if err := r.inWindow(frame); err != nil {
+		return err
 	}
 
-	if _, ok := r.framesIDMap[frame.FrameID]; ok {
-		r.mu.Unlock()
-		return
+	if _, ok := r.frames[frame.FrameID]; ok {
+		return nil
 	}
+	r.frames[frame.FrameID] = frame
+	r.lastProgress = time.Now()
 
-	r.frames = append(r.frames, frame)
-	r.framesIDMap[frame.FrameID] = struct{}{}
-	sort.Slice(r.frames, func(i, j int) bool {
-		return r.frames[i].FrameID < r.frames[j].FrameID
-	})
-	r.mu.Unlock()
+	// the window moves as soon as frames are in order, so the ack of this frame tells sender the new window
+	for {
+		f, ok := r.frames[r.nextFrameID]
+		if !ok || f.IsLast() {
+			break
+		}
+		r.nextFrameID++
+	}
+	if r.nextFrameID == r.writeFrameID {
+		return nil
+	}
 
+	// frames not written yet are limited by the window too, wait until Run writes them
 	select {
 	case r.notifyCh <- struct{}{}:
 	default:
 	}
+	for r.err == nil && r.nextFrameID-r.writeFrameID > r.window {
+		r.windowCond.Wait()
+	}
+	return nil
 }
 
-func (r *Receiver) Run() {
+func (r *Receiver) recvFrameAt(frame *stream.Frame) error {
+	r.mu.RLock()
+	has := r.received.Has(frame.FrameID)
+	err := r.inWindow(frame)
+	r.mu.RUnlock()
+	if has || err != nil {
+		return err
+	}
+
+	// write outside the lock so frames from different streams can be written concurrently
+	if len(frame.Buf) > 0 {
+		offset := int64(frame.Offset)
+		if frame.Version == stream.Version0 {
+			offset = int64(frame.FrameID) * r.frameSize
+		}
+		dst := r.dstAt
+		if r.dstFor != nil {
+			var err error
+			if dst, err = r.dstFor(frame.FileID); err != nil {
+				r.fail(err)
+				return err
+			}
+		}
+		_, err := dst.WriteAt(frame.Buf, offset)
+		if err != nil {
+			r.fail(err)
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received.Set(frame.FrameID)
+	r.lastProgress = time.Now()
+	if frame.IsLast() {
+		r.lastFrameID = frame.FrameID
+		r.hasLast = true
+	}
+	for r.received.Has(r.nextFrameID) {
+		r.nextFrameID++
+	}
+	r.received.Trim(r.nextFrameID)
+	r.windowCond.Broadcast()
+	return nil
+}
+
+// Run writes frames until the last one, it returns the error if writing frames failed.
+func (r *Receiver) Run() error {
 	for {
 		_, ok := <-r.notifyCh
 		if !ok {
-			return
+			return nil
+		}
+		if err := r.Err(); err != nil {
+			return err
+		}
+
+		if r.writesAt() {
+			r.mu.RLock()
+			finished := r.hasLast && r.nextFrameID > r.lastFrameID
+			r.mu.RUnlock()
+			if finished {
+				return nil
+			}
+			continue
 		}
 
 		buffer := bytes.NewBuffer(nil)
-		ii := 0
 		finished := false
 		r.mu.Lock()
-		for i, frame := range r.frames {
-			if r.nextFrameID == frame.FrameID {
-				ii = i + 1
-				delete(r.framesIDMap, frame.FrameID)
-				// it's last frame
-				if len(frame.Buf) == 0 {
-					finished = true
-					break
-				}
-
-				buffer.Write(frame.Buf)
-				r.nextFrameID++
-			} else {
-				ii = i
+		for {
+			frame, ok := r.frames[r.writeFrameID]
+			if !ok {
+				break
+			}
+			delete(r.frames, frame.FrameID)
+			buffer.Write(frame.Buf)
+			if frame.IsLast() {
+				finished = true
 				break
 			}
+
+			r.writeFrameID++
 		}
-		r.frames = r.frames[ii:]
+		r.windowCond.Broadcast()
 		r.mu.Unlock()
 
 		buf := buffer.Bytes()
 		if len(buf) != 0 {
-			r.dst.Write(buf)
+			if _, err := r.dst.Write(buf); err != nil {
+				r.fail(err)
+				return err
+			}
 		}
 
 		if finished {
-			break
+			return nil
 		}
 	}
 }
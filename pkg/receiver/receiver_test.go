@@ -0,0 +1,277 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+// memFile is an io.WriterAt in memory which counts writes.
+type memFile struct {
+	buf    []byte
+	writes int
+	mu     sync.Mutex
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := int(off) + len(p); end > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, end-len(f.buf))...)
+	}
+	copy(f.buf[off:], p)
+	f.writes++
+	return len(p), nil
+}
+
+func dataFrame(frameID uint64, frameSize int, buf []byte) *stream.Frame {
+	f := stream.NewFrame(1, frameID, buf)
+	f.Offset = frameID * uint64(frameSize)
+	return f
+}
+
+func runReceiver(t *testing.T, r *Receiver) chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.Run()
+	}()
+	return errCh
+}
+
+func waitRun(t *testing.T, errCh chan error) {
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("run error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("run doesn't return after the last frame")
+	}
+}
+
+func TestFileReceiverGaps(t *testing.T) {
+	dst := &memFile{}
+	r := NewFileReceiver(1, dst, 4, 8)
+	errCh := runReceiver(t, r)
+
+	frames := []*stream.Frame{
+		dataFrame(0, 4, []byte("aaaa")),
+		dataFrame(1, 4, []byte("bbbb")),
+		dataFrame(2, 4, []byte("cccc")),
+		stream.NewLastFrame(1, 3, 12),
+	}
+
+	// frames after a gap are written at their offsets, but the window doesn't move
+	for _, i := range []int{2, 1, 3} {
+		if err := r.RecvFrame(frames[i]); err != nil {
+			t.Fatalf("recv frame %d error: %v", i, err)
+		}
+	}
+	if w := r.Window(); w != 8 {
+		t.Fatalf("window is %d with frame 0 missing, want 8", w)
+	}
+	if dst.writes != 2 {
+		t.Fatalf("%d writes before the gap is filled, want 2", dst.writes)
+	}
+
+	if err := r.RecvFrame(frames[0]); err != nil {
+		t.Fatalf("recv frame 0 error: %v", err)
+	}
+	if w := r.Window(); w != 12 {
+		t.Fatalf("window is %d after the gap is filled, want 12", w)
+	}
+	waitRun(t, errCh)
+	if string(dst.buf) != "aaaabbbbcccc" {
+		t.Fatalf("file is %q", dst.buf)
+	}
+}
+
+func TestFileReceiverDuplicateFrames(t *testing.T) {
+	dst := &memFile{}
+	r := NewFileReceiver(1, dst, 4, 8)
+
+	for i := 0; i < 3; i++ {
+		if err := r.RecvFrame(dataFrame(0, 4, []byte("aaaa"))); err != nil {
+			t.Fatalf("recv frame error: %v", err)
+		}
+		if err := r.RecvFrame(dataFrame(5, 4, []byte("ffff"))); err != nil {
+			t.Fatalf("recv frame error: %v", err)
+		}
+	}
+	if dst.writes != 2 {
+		t.Fatalf("duplicate frames are written, %d writes", dst.writes)
+	}
+	if w := r.Window(); w != 9 {
+		t.Fatalf("window is %d, want 9", w)
+	}
+}
+
+func TestFileReceiverWindowExhausted(t *testing.T) {
+	dst := &memFile{}
+	r := NewFileReceiver(1, dst, 1, 4)
+
+	// sender is allowed to send frames up to the window, all of them are after the missing frame 0
+	for id := uint64(1); id < 4; id++ {
+		if err := r.RecvFrame(dataFrame(id, 1, []byte{byte(id)})); err != nil {
+			t.Fatalf("recv frame %d error: %v", id, err)
+		}
+		if w := r.Window(); w != 4 {
+			t.Fatalf("window is %d after frame %d, want 4", w, id)
+		}
+	}
+	if err := r.RecvFrame(dataFrame(4, 1, []byte{4})); err == nil {
+		t.Fatalf("frame 4 out of the window is received")
+	}
+
+	if err := r.RecvFrame(dataFrame(0, 1, []byte{0})); err != nil {
+		t.Fatalf("recv frame 0 error: %v", err)
+	}
+	if w := r.Window(); w != 8 {
+		t.Fatalf("window is %d after frame 0, want 8", w)
+	}
+}
+
+func TestFileReceiverWriteError(t *testing.T) {
+	r := NewFilesReceiver(func(fileID uint32) (io.WriterAt, error) {
+		return nil, fmt.Errorf("no space left")
+	}, 8)
+	errCh := runReceiver(t, r)
+	if err := r.RecvFrame(dataFrame(0, 4, []byte("aaaa"))); err == nil {
+		t.Fatalf("recv frame doesn't fail")
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("run returns nil after failure")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("run doesn't return after failure")
+	}
+}
+
+func TestReceiverInOrder(t *testing.T) {
+	dst := &bytes.Buffer{}
+	r := NewReceiver(1, dst, 8)
+	errCh := runReceiver(t, r)
+
+	// out of order and duplicate frames
+	for _, f := range []*stream.Frame{
+		dataFrame(2, 4, []byte("cccc")),
+		dataFrame(0, 4, []byte("aaaa")),
+		dataFrame(2, 4, []byte("cccc")),
+		stream.NewLastFrame(1, 3, 12),
+		dataFrame(0, 4, []byte("aaaa")),
+		dataFrame(1, 4, []byte("bbbb")),
+	} {
+		if err := r.RecvFrame(f); err != nil {
+			t.Fatalf("recv frame error: %v", err)
+		}
+	}
+	waitRun(t, errCh)
+	if dst.String() != "aaaabbbbcccc" {
+		t.Fatalf("output is %q", dst.String())
+	}
+}
+
+func TestReceiverInOrderWindow(t *testing.T) {
+	dst := &bytes.Buffer{}
+	r := NewReceiver(1, dst, 2)
+	if err := r.RecvFrame(dataFrame(1, 4, []byte("bbbb"))); err != nil {
+		t.Fatalf("recv frame error: %v", err)
+	}
+	// frames past the window are rejected instead of being kept in memory
+	if err := r.RecvFrame(dataFrame(2, 4, []byte("cccc"))); err == nil {
+		t.Fatalf("frame 2 out of the window is received")
+	}
+
+	// the window moves before frames are written, so the ack of frame 0 carries it
+	if err := r.RecvFrame(dataFrame(0, 4, []byte("aaaa"))); err != nil {
+		t.Fatalf("recv frame error: %v", err)
+	}
+	if w := r.Window(); w != 4 {
+		t.Fatalf("window is %d after frame 0, want 4", w)
+	}
+
+	// frames in the window are held back until earlier ones are written
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		r.RecvFrame(dataFrame(2, 4, []byte("cccc")))
+	}()
+	select {
+	case <-doneCh:
+		t.Fatalf("recv frame doesn't wait for frames to be written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	errCh := runReceiver(t, r)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("recv frame doesn't return after frames are written")
+	}
+
+	// legacy senders don't know the window
+	f := dataFrame(10, 4, []byte("kkkk"))
+	f.Version = stream.Version0
+	if err := r.RecvFrame(f); err != nil {
+		t.Fatalf("recv frame version 0 error: %v", err)
+	}
+	if err := r.RecvFrame(stream.NewLastFrame(1, 3, 12)); err != nil {
+		t.Fatalf("recv frame error: %v", err)
+	}
+	waitRun(t, errCh)
+	if dst.String() != "aaaabbbbcccc" {
+		t.Fatalf("output is %q", dst.String())
+	}
+}
+
+func TestReceiverWaitWindow(t *testing.T) {
+	r := NewReceiver(1, &bytes.Buffer{}, 2)
+	errCh := runReceiver(t, r)
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- r.WaitWindow(3)
+	}()
+	select {
+	case err := <-waitCh:
+		t.Fatalf("frame 3 isn't in the window, wait returns %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, f := range []*stream.Frame{
+		dataFrame(0, 4, []byte("aaaa")),
+		dataFrame(1, 4, []byte("bbbb")),
+	} {
+		if err := r.RecvFrame(f); err != nil {
+			t.Fatalf("recv frame error: %v", err)
+		}
+	}
+	select {
+	case err := <-waitCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait doesn't return after the window moves")
+	}
+
+	// waiters are woken up if receiving is aborted
+	go func() {
+		waitCh <- r.WaitWindow(100)
+	}()
+	r.Abort(fmt.Errorf("canceled"))
+	select {
+	case err := <-waitCh:
+		if err == nil {
+			t.Fatalf("wait returns nil after abort")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait doesn't return after abort")
+	}
+	<-errCh
+}
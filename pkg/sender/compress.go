@@ -0,0 +1,63 @@
+package sender
+
+import (
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+const (
+	// frames compressed to more than this ratio of their size are sent as is
+	compressRatio = 0.9
+
+	// after so many incompressible frames in a row, stop trying for compressSkipFrames frames,
+	// it saves CPU for already compressed data like media files
+	maxCompressMisses  = 4
+	compressSkipFrames = 64
+)
+
+// compressor compresses frames for one Transfer, it's not safe for concurrent use.
+type compressor struct {
+	codec codec.Codec
+
+	misses int
+	skip   int
+
+	// reused for each frame
+	buf   []byte
+	frame stream.Frame
+}
+
+func newCompressor(c codec.Codec) *compressor {
+	return &compressor{
+		codec: c,
+	}
+}
+
+// Compress returns a compressed copy of frame or frame itself if it's not worth compressing.
+// The returned frame is only valid before next call.
+func (c *compressor) Compress(frame *stream.Frame) *stream.Frame {
+	if frame.Version < stream.Version1 || frame.Type != stream.TypeData || len(frame.Buf) == 0 {
+		return frame
+	}
+	if c.skip > 0 {
+		c.skip--
+		return frame
+	}
+
+	buf, err := codec.Compress(c.codec, c.buf, frame.Buf, compressRatio)
+	if err != nil {
+		c.misses++
+		if c.misses >= maxCompressMisses {
+			c.misses = 0
+			c.skip = compressSkipFrames
+		}
+		return frame
+	}
+	c.misses = 0
+	c.buf = buf
+
+	c.frame = *frame
+	c.frame.Flags |= stream.FlagCompressed
+	c.frame.Buf = buf
+	return &c.frame
+}
@@ -0,0 +1,54 @@
+package sender
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+func TestCompressorFallback(t *testing.T) {
+	c, err := codec.Get("lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp := newCompressor(c)
+
+	text := bytes.Repeat([]byte("some repeated log line\n"), 1000)
+	noise := make([]byte, len(text))
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	f := &stream.Frame{Version: stream.Version1, Type: stream.TypeData, Buf: text}
+	out := comp.Compress(f)
+	if out.Flags&stream.FlagCompressed == 0 || len(out.Buf) >= len(text) {
+		t.Fatalf("compressible frame is not compressed")
+	}
+	if f.Flags&stream.FlagCompressed != 0 || !bytes.Equal(f.Buf, text) {
+		t.Fatalf("original frame is changed")
+	}
+
+	// incompressible frames are sent as is, and compression is skipped after maxCompressMisses of them
+	for i := 0; i < maxCompressMisses; i++ {
+		f := &stream.Frame{Version: stream.Version1, Type: stream.TypeData, Buf: noise}
+		if out := comp.Compress(f); out != f {
+			t.Fatalf("incompressible frame %d is not sent as is", i)
+		}
+	}
+	for i := 0; i < compressSkipFrames; i++ {
+		f := &stream.Frame{Version: stream.Version1, Type: stream.TypeData, Buf: text}
+		if out := comp.Compress(f); out != f {
+			t.Fatalf("frame %d is compressed while skipping", i)
+		}
+	}
+	if out := comp.Compress(f); out.Flags&stream.FlagCompressed == 0 {
+		t.Fatalf("compression is not resumed after skipping")
+	}
+
+	// v0 frames can't carry flags
+	v0 := &stream.Frame{Version: stream.Version0, Type: stream.TypeData, Buf: text}
+	if out := comp.Compress(v0); out != v0 {
+		t.Fatalf("v0 frame is compressed")
+	}
+}
@@ -2,24 +2,69 @@ package sender
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatedier/fft/pkg/stream"
 )
 
 type SendFrame struct {
-	frame      *stream.Frame
+	frame *stream.Frame
+
+	// pooled buffer of frame.Buf, it's given back by put after the frame is acked and no transfer uses it
+	buf  *[]byte
+	put  func(buf *[]byte)
+	refs int32
+
 	tr         *Transfer
 	sendTime   time.Time
 	retryTimes int
 	hasAck     bool
 
+	// receivers which have acked this frame, only used if there are many receivers
+	acked []bool
+
 	mu sync.Mutex
 }
 
+// NewSendFrame returns a frame referenced by sender until it's acked.
 func NewSendFrame(frame *stream.Frame) *SendFrame {
 	return &SendFrame{
 		frame: frame,
+		refs:  1,
+	}
+}
+
+// setBuf sets the pooled buffer of frame.Buf, it's given back by put after the last reference is released.
+func (sf *SendFrame) setBuf(buf *[]byte, put func(buf *[]byte)) {
+	sf.buf = buf
+	sf.put = put
+}
+
+// acquire references the frame before sending it, it returns false if the frame has been acked
+// and it's buffer may have been reused.
+func (sf *SendFrame) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&sf.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&sf.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference, the buffer is given back after the last one.
+func (sf *SendFrame) release() {
+	if atomic.AddInt32(&sf.refs, -1) != 0 {
+		return
+	}
+	buf := sf.buf
+	sf.buf = nil
+	sf.frame.Buf = nil
+	if sf.put != nil && buf != nil {
+		sf.put(buf)
 	}
 }
 
@@ -29,7 +74,7 @@ func (sf *SendFrame) UpdateSendTime() {
 	sf.mu.Unlock()
 }
 
-func (sf *SendFrame) FrameID() uint32 {
+func (sf *SendFrame) FrameID() uint64 {
 	return sf.frame.FrameID
 }
 
@@ -37,10 +82,38 @@ func (sf *SendFrame) Frame() *stream.Frame {
 	return sf.frame
 }
 
+func (sf *SendFrame) SendTime() time.Time {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.sendTime
+}
+
 func (sf *SendFrame) HasAck() bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
 	return sf.hasAck
 }
 
 func (sf *SendFrame) SetAck() {
+	sf.mu.Lock()
 	sf.hasAck = true
+	sf.mu.Unlock()
+}
+
+// SetReceiverAck records ack from receiver, it returns false if receiver has acked before.
+func (sf *SendFrame) SetReceiverAck(receiver uint32) bool {
+	if int(receiver) >= len(sf.acked) {
+		acked := make([]bool, receiver+1)
+		copy(acked, sf.acked)
+		sf.acked = acked
+	}
+	if sf.acked[receiver] {
+		return false
+	}
+	sf.acked[receiver] = true
+	return true
+}
+
+func (sf *SendFrame) HasReceiverAck(receiver uint32) bool {
+	return int(receiver) < len(sf.acked) && sf.acked[receiver]
 }
@@ -3,15 +3,26 @@ package sender
 import (
 	"fmt"
 	"io"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/fatedier/fft/pkg/codec"
+	"github.com/fatedier/fft/pkg/e2e"
 	"github.com/fatedier/fft/pkg/stream"
 
 	"github.com/fatedier/golib/control/shutdown"
 )
 
+const (
+	// frames not acked by all receivers in this time are sent again
+	retransmitTimeout = 10 * time.Second
+
+	// receivers which don't ack any frame in this time are given up
+	receiverTimeout = 60 * time.Second
+)
+
 type AckWaitingObj struct {
 	Frame        *stream.Frame
 	HasAck       bool
@@ -24,8 +35,27 @@ type Sender struct {
 	// each frame size
 	frameSize int
 
+	// frames are encoded by this version, it should be supported by receiver
+	frameVersion uint8
+
+	// compress frames by this codec if it's not nil
+	codec codec.Codec
+
+	// encrypt each frame if it's not nil, workers can read frame headers to fan out them
+	sealer *e2e.Sealer
+
+	// frames are fanned out to receivers by workers if there are more than one receivers,
+	// each one should ack all frames
+	receivers       int
+	receiverWindows []uint64
+	lastAckTimes    []time.Time
+	failedReceivers []bool
+
 	// send src to remote Receiver
-	src io.Reader
+	src frameSource
+
+	// src.Put, kept so each frame doesn't allocate a method value
+	putBuf func(buf *[]byte)
 
 	frameCh chan *SendFrame
 
@@ -36,11 +66,27 @@ type Sender struct {
 
 	maxBufferCount int
 	limiter        chan struct{}
-	waitAcks       map[uint32]*SendFrame
+	waitAcks       map[uint64]*SendFrame
 	bufferFrames   []*SendFrame
 
+	// frames with FrameID greater than or equal to recvWindow can't be sent
+	recvWindow     uint64
+	windowNotifyCh chan struct{}
+
 	// 1 means all frames has been sent
-	sendAll      bool
+	sendAll bool
+
+	// closed when all frames are acked or sender is aborted
+	finishCh chan struct{}
+	finished bool
+	err      error
+
+	// tells receivers why sender is canceled, nil if it's not canceled
+	errFrame *stream.Frame
+
+	// when a frame is acked by all receivers last time
+	lastProgress time.Time
+
 	mu           sync.Mutex
 	sendShutdown *shutdown.Shutdown
 	ackShutdown  *shutdown.Shutdown
@@ -48,37 +94,195 @@ type Sender struct {
 	count uint32
 }
 
+// NewSender returns a Sender which reads src serially.
 func NewSender(id uint32, src io.Reader, frameSize int, maxBufferCount int) (*Sender, error) {
+	if !stream.IsValidFrameSize(frameSize) {
+		return nil, fmt.Errorf("invalid frameSize")
+	}
+	return newSender(id, newReaderSource(src, frameSize), frameSize, maxBufferCount), nil
+}
+
+// NewReaderAtSender returns a Sender which reads src by readers goroutines in parallel.
+// It's better for files on disk.
+func NewReaderAtSender(id uint32, src io.ReaderAt, size int64, frameSize int, maxBufferCount int, readers int) (*Sender, error) {
 	if !stream.IsValidFrameSize(frameSize) {
 		return nil, fmt.Errorf("invalid frameSize")
 	}
 	if maxBufferCount <= 0 {
 		maxBufferCount = 100
 	}
+	return newSender(id, newReaderAtSource(src, size, frameSize, readers, maxBufferCount), frameSize, maxBufferCount), nil
+}
+
+// NewFilesSender returns a Sender which sends files one after another.
+// FileID and Offset of each frame tell receiver which file and where it belongs to, so frame version 1 is required.
+func NewFilesSender(files []File, frameSize int, maxBufferCount int) (*Sender, error) {
+	if !stream.IsValidFrameSize(frameSize) {
+		return nil, fmt.Errorf("invalid frameSize")
+	}
+	return newSender(0, newFilesSource(files, frameSize), frameSize, maxBufferCount), nil
+}
+
+func newSender(id uint32, src frameSource, frameSize int, maxBufferCount int) *Sender {
+	if maxBufferCount <= 0 {
+		maxBufferCount = 100
+	}
 
 	s := &Sender{
 		id:             id,
 		frameSize:      frameSize,
+		frameVersion:   stream.MaxVersion,
 		src:            src,
+		putBuf:         src.Put,
 		frameCh:        make(chan *SendFrame),
 		ackCh:          make(chan *stream.Ack),
 		maxBufferCount: maxBufferCount,
 		retryFrames:    make([]*SendFrame, 0),
 		limiter:        make(chan struct{}, maxBufferCount),
-		waitAcks:       make(map[uint32]*SendFrame),
-		bufferFrames:   make([]*SendFrame, 0),
+		waitAcks:       make(map[uint64]*SendFrame),
+		bufferFrames:   make([]*SendFrame, 0, maxBufferCount),
+		recvWindow:     uint64(maxBufferCount),
+		windowNotifyCh: make(chan struct{}, 1),
+		receivers:      1,
+		finishCh:       make(chan struct{}),
 		sendShutdown:   shutdown.New(),
 		ackShutdown:    shutdown.New(),
 	}
 	for i := 0; i < maxBufferCount; i++ {
 		s.limiter <- struct{}{}
 	}
-	return s, nil
+	return s
+}
+
+// SetFrameVersion sets the frame encoding version supported by receiver.
+// It should be called before Run.
+func (sender *Sender) SetFrameVersion(version uint8) error {
+	if _, ok := sender.src.(positionSource); ok && version < stream.Version1 {
+		return fmt.Errorf("sending files requires frame version %d", stream.Version1)
+	}
+	if err := stream.CheckFrameSize(version, sender.frameSize); err != nil {
+		return err
+	}
+	sender.frameVersion = version
+	return nil
+}
+
+// FrameVersion returns the frame encoding version frames are sent in.
+func (sender *Sender) FrameVersion() uint8 {
+	return sender.frameVersion
+}
+
+// SetCompression enables compression for frames, receiver should support it.
+// It should be called before Run.
+func (sender *Sender) SetCompression(c codec.Codec) error {
+	if sender.frameVersion < stream.Version1 {
+		return fmt.Errorf("compression requires frame version %d", stream.Version1)
+	}
+	sender.codec = c
+	return nil
+}
+
+// SetSealer encrypts each frame by sealer instead of the whole stream.
+// It should be called before Run.
+func (sender *Sender) SetSealer(sealer *e2e.Sealer) error {
+	if sender.frameVersion < stream.Version1 {
+		return fmt.Errorf("encrypting frames requires frame version %d", stream.Version1)
+	}
+	sender.sealer = sealer
+	return nil
+}
+
+// SetReceivers sets how many receivers get frames from workers.
+// A frame is completed only after all receivers ack it or they are given up.
+// It should be called before Run.
+func (sender *Sender) SetReceivers(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("receivers should be greater than 0")
+	}
+	if n > 1 && sender.frameVersion < stream.Version1 {
+		return fmt.Errorf("multiple receivers requires frame version %d", stream.Version1)
+	}
+	sender.receivers = n
+	sender.receiverWindows = make([]uint64, n)
+	sender.lastAckTimes = make([]time.Time, n)
+	sender.failedReceivers = make([]bool, n)
+	for i := 0; i < n; i++ {
+		sender.receiverWindows[i] = uint64(sender.maxBufferCount)
+	}
+	return nil
+}
+
+// FailedReceivers returns how many receivers are given up since they don't ack frames.
+func (sender *Sender) FailedReceivers() int {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	count := 0
+	for _, failed := range sender.failedReceivers {
+		if failed {
+			count++
+		}
+	}
+	return count
+}
+
+// Err returns the error the transfer is aborted with, it's from Cancel or receiver.
+func (sender *Sender) Err() error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return sender.err
+}
+
+// Cancel stops sending because of err, receivers are told code and err before streams are closed.
+func (sender *Sender) Cancel(code uint8, err error) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.err == nil && !sender.finished {
+		sender.err = err
+		if sender.frameVersion >= stream.Version1 {
+			sender.errFrame = stream.NewErrorFrame(code, err.Error())
+		}
+	}
+	sender.finish()
 }
 
+func (sender *Sender) abort(err error) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.err == nil && !sender.finished {
+		sender.err = fmt.Errorf("receiver aborted: %v", err)
+	}
+	sender.finish()
+}
+
+// Done returns a channel which is closed when all frames are acked or sender is aborted.
+func (sender *Sender) Done() <-chan struct{} {
+	return sender.finishCh
+}
+
+// LastProgress returns when a frame is acked by all receivers last time, it's zero if there is none.
+func (sender *Sender) LastProgress() time.Time {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return sender.lastProgress
+}
+
+func (sender *Sender) getErrFrame() *stream.Frame {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return sender.errFrame
+}
+
+// HandleStream sends frames through s until sender is finished or s is closed,
+// frames not acked through s are sent again through other streams.
 func (sender *Sender) HandleStream(s *stream.FrameStream) {
+	sender.HandleStreamUntil(s, nil)
+}
+
+// HandleStreamUntil is like HandleStream, but no more frames are sent through s after retireCh is closed,
+// s is closed after frames sent through it are acked.
+func (sender *Sender) HandleStreamUntil(s *stream.FrameStream, retireCh <-chan struct{}) {
 	sender.mu.Lock()
-	if sender.sendAll {
+	if sender.finished {
 		sender.mu.Unlock()
 		s.Close()
 		return
@@ -90,16 +294,35 @@ func (sender *Sender) HandleStream(s *stream.FrameStream) {
 	if trBufferCount <= 0 {
 		trBufferCount = 1
 	}
-	tr := NewTransfer(int(id), trBufferCount, s, sender.frameCh, sender.ackCh)
+	tr := NewTransfer(int(id), trBufferCount, s, sender.frameCh, sender.ackCh, sender.finishCh)
+	if sender.codec != nil {
+		tr.compressor = newCompressor(sender.codec)
+	}
+	tr.sealer = sender.sealer
+	tr.errFrame = sender.getErrFrame
+	tr.retireCh = retireCh
+	// a receiver aborts only it's own copy if there are others
+	if sender.receivers <= 1 {
+		tr.abort = sender.abort
+	}
 
-	// block until transfer exit
+	// block until transfer exit, frames acked through other streams meanwhile are not sent again
 	noAckFrames := tr.Run()
-	if len(noAckFrames) > 0 {
-		sender.mu.Lock()
-		sender.retryFrames = append(sender.retryFrames, noAckFrames...)
-		sender.mu.Unlock()
-		for i := 0; i < len(noAckFrames); i++ {
-			sender.limiter <- struct{}{}
+	retries := 0
+	sender.mu.Lock()
+	for _, sf := range noAckFrames {
+		if !sf.HasAck() {
+			sender.retryFrames = append(sender.retryFrames, sf)
+			retries++
+		}
+	}
+	sender.mu.Unlock()
+	if retries > 0 {
+		for i := 0; i < retries; i++ {
+			select {
+			case sender.limiter <- struct{}{}:
+			default:
+			}
 		}
 	}
 }
@@ -107,6 +330,15 @@ func (sender *Sender) HandleStream(s *stream.FrameStream) {
 func (sender *Sender) Run() {
 	go sender.ackHandler()
 	go sender.loopSend()
+	if sender.receivers > 1 {
+		now := time.Now()
+		sender.mu.Lock()
+		for i := range sender.lastAckTimes {
+			sender.lastAckTimes[i] = now
+		}
+		sender.mu.Unlock()
+		go sender.retransmitLoop()
+	}
 
 	sender.sendShutdown.WaitDone()
 	sender.ackShutdown.WaitDone()
@@ -115,21 +347,31 @@ func (sender *Sender) Run() {
 func (sender *Sender) loopSend() {
 	defer sender.sendShutdown.Done()
 
-	var count uint32
+	var count uint64
 	for {
-		<-sender.limiter
+		select {
+		case <-sender.limiter:
+		case <-sender.finishCh:
+			return
+		}
 
-		// retry first
+		// retry first, skip frames which have been acked since they were queued
 		var retryFrame *SendFrame
 		sender.mu.Lock()
-		if len(sender.retryFrames) > 0 {
-			retryFrame = sender.retryFrames[0]
+		for len(sender.retryFrames) > 0 && retryFrame == nil {
+			if !sender.retryFrames[0].HasAck() {
+				retryFrame = sender.retryFrames[0]
+			}
 			sender.retryFrames = sender.retryFrames[1:]
 		}
 		sender.mu.Unlock()
 
 		if retryFrame != nil {
-			sender.frameCh <- retryFrame
+			select {
+			case sender.frameCh <- retryFrame:
+			case <-sender.finishCh:
+				return
+			}
 			continue
 		}
 
@@ -138,12 +380,18 @@ func (sender *Sender) loopSend() {
 			continue
 		}
 
+		// wait until receiver has enough space for the new frame
+		if err := sender.waitRecvWindow(count); err != nil {
+			return
+		}
+
 		// no retry frames, get a new frame from src
-		buf := make([]byte, sender.frameSize)
-		n, err := sender.src.Read(buf)
+		// all frames except the last one should be full, so receiver can compute offset by FrameID
+		buf, n, err := sender.src.Next()
 		if err == io.EOF {
 			// send last frame and it's buffer is nil
-			f := stream.NewFrame(sender.id, count, nil)
+			f := stream.NewLastFrame(sender.id, count, count*uint64(sender.frameSize))
+			f.Version = sender.frameVersion
 			sf := NewSendFrame(f)
 
 			sender.mu.Lock()
@@ -152,68 +400,263 @@ func (sender *Sender) loopSend() {
 			sender.bufferFrames = append(sender.bufferFrames, sf)
 			sender.mu.Unlock()
 
-			sender.frameCh <- sf
-			return
+			// keep running to send retry frames until all frames are acked
+			select {
+			case sender.frameCh <- sf:
+			case <-sender.finishCh:
+				return
+			}
+			continue
 		}
 		if err != nil {
-			close(sender.frameCh)
+			sender.Cancel(stream.CodeReadFailed, err)
 			return
 		}
-		buf = buf[:n]
 
 		// send frames to transfers
-		f := stream.NewFrame(0, count, buf)
+		f := stream.NewFrame(sender.id, count, (*buf)[:n])
+		f.Version = sender.frameVersion
+		f.Offset = count * uint64(sender.frameSize)
+		if ps, ok := sender.src.(positionSource); ok {
+			fileID, offset := ps.Pos()
+			f.FileID, f.Offset = fileID, uint64(offset)
+		}
 		sf := NewSendFrame(f)
+		sf.setBuf(buf, sender.putBuf)
 		sender.mu.Lock()
 		sender.waitAcks[sf.FrameID()] = sf
 		sender.bufferFrames = append(sender.bufferFrames, sf)
 		sender.mu.Unlock()
 
-		sender.frameCh <- sf
+		select {
+		case sender.frameCh <- sf:
+		case <-sender.finishCh:
+			return
+		}
 		count++
 	}
 }
 
+// waitRecvWindow returns an error if sender is canceled or aborted while waiting.
+// If all streams are broken, sender is canceled by it's caller.
+func (sender *Sender) waitRecvWindow(frameID uint64) error {
+	for {
+		sender.mu.Lock()
+		window := sender.recvWindow
+		sender.mu.Unlock()
+		if frameID < window {
+			return nil
+		}
+		select {
+		case <-sender.windowNotifyCh:
+		case <-sender.finishCh:
+			if err := sender.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("sender is finished before frame %d is in receive window", frameID)
+		}
+	}
+}
+
+func (sender *Sender) updateRecvWindow(ack *stream.Ack) {
+	window := ack.Window
+	// receiver doesn't advertise it's window
+	if ack.Version < 1 {
+		window = math.MaxUint64
+	}
+
+	sender.mu.Lock()
+	if sender.receivers > 1 {
+		if int(ack.Receiver) < sender.receivers && window > sender.receiverWindows[ack.Receiver] {
+			sender.receiverWindows[ack.Receiver] = window
+		}
+		window = sender.minReceiverWindow()
+	}
+	if window > sender.recvWindow {
+		sender.recvWindow = window
+	}
+	sender.mu.Unlock()
+
+	select {
+	case sender.windowNotifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// minReceiverWindow returns window of the slowest receiver which is not given up.
+// It should be called with lock held.
+func (sender *Sender) minReceiverWindow() uint64 {
+	window := uint64(math.MaxUint64)
+	for i, w := range sender.receiverWindows {
+		if !sender.failedReceivers[i] && w < window {
+			window = w
+		}
+	}
+	return window
+}
+
 func (sender *Sender) ackHandler() {
 	defer sender.ackShutdown.Done()
 
 	for {
-		ack, ok := <-sender.ackCh
-		if !ok {
+		select {
+		case ack := <-sender.ackCh:
+			sender.updateRecvWindow(ack)
+			sender.mu.Lock()
+			sender.handleAck(ack)
+			sender.mu.Unlock()
+			continue
+		case <-sender.finishCh:
+		}
+
+		// wait loopSend exit before closing frameCh, transfers will close their streams then
+		sender.sendShutdown.WaitDone()
+		sender.src.Close()
+		close(sender.frameCh)
+		return
+	}
+}
+
+// handleAck should be called with lock held.
+func (sender *Sender) handleAck(ack *stream.Ack) {
+	if sender.receivers > 1 {
+		if int(ack.Receiver) >= sender.receivers {
+			return
+		}
+		sender.lastAckTimes[ack.Receiver] = time.Now()
+	}
+
+	sf, ok := sender.waitAcks[ack.FrameID]
+	if !ok {
+		return
+	}
+	if sender.receivers > 1 {
+		if !sf.SetReceiverAck(ack.Receiver) || !sender.allReceiversAcked(sf) {
+			return
+		}
+	}
+	sender.completeFrame(sf)
+}
+
+// allReceiversAcked should be called with lock held.
+func (sender *Sender) allReceiversAcked(sf *SendFrame) bool {
+	for i, failed := range sender.failedReceivers {
+		if !failed && !sf.HasReceiverAck(uint32(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// completeFrame removes the frame acked by all receivers, sender is finished if there is no frames left.
+// It should be called with lock held.
+func (sender *Sender) completeFrame(sf *SendFrame) {
+	sf.SetAck()
+	delete(sender.waitAcks, sf.FrameID())
+	sender.lastProgress = time.Now()
+	for i, f := range sender.retryFrames {
+		if f == sf {
+			sender.retryFrames = append(sender.retryFrames[:i], sender.retryFrames[i+1:]...)
+			break
+		}
+	}
+	// frame will never be sent again, it's buffer is reused after transfers sending it release it
+	sf.release()
+
+	removeCount := 0
+	// remove all continuous buffer frames with ack
+	for _, f := range sender.bufferFrames {
+		if f.HasAck() {
+			removeCount++
+			select {
+			case sender.limiter <- struct{}{}:
+			default:
+			}
+		} else {
+			break
+		}
+	}
+	if removeCount > 0 {
+		// move the rest to the front, so the slice is reused instead of growing
+		n := copy(sender.bufferFrames, sender.bufferFrames[removeCount:])
+		for i := n; i < len(sender.bufferFrames); i++ {
+			sender.bufferFrames[i] = nil
+		}
+		sender.bufferFrames = sender.bufferFrames[:n]
+	}
+
+	// if all frames has been sent and no waiting acks, we are success
+	if sender.sendAll && len(sender.waitAcks) == 0 {
+		sender.finish()
+	}
+}
+
+// finish should be called with lock held.
+func (sender *Sender) finish() {
+	if !sender.finished {
+		sender.finished = true
+		close(sender.finishCh)
+	}
+}
+
+// retransmitLoop sends frames again if some receivers don't ack them in time,
+// receivers which don't ack anything for a long time are given up.
+func (sender *Sender) retransmitLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sender.finishCh:
 			return
 		}
 
-		finished := false
+		now := time.Now()
 		sender.mu.Lock()
-		waitSendFrame, ok := sender.waitAcks[ack.FrameID]
-		if ok {
-			waitSendFrame.SetAck()
-			delete(sender.waitAcks, ack.FrameID)
-
-			// if all frames has been sent and no waiting acks, we are success
-			if sender.sendAll && len(sender.waitAcks) == 0 {
-				finished = true
+		if len(sender.waitAcks) > 0 {
+			active := 0
+			givenUp := false
+			for i, t := range sender.lastAckTimes {
+				if !sender.failedReceivers[i] && now.Sub(t) > receiverTimeout {
+					sender.failedReceivers[i] = true
+					givenUp = true
+				}
+				if !sender.failedReceivers[i] {
+					active++
+				}
+			}
+			if active == 0 {
+				sender.finish()
+				sender.mu.Unlock()
+				return
+			}
+			// window of the slowest receiver doesn't limit us any more
+			if givenUp {
+				if window := sender.minReceiverWindow(); window > sender.recvWindow {
+					sender.recvWindow = window
+				}
+				select {
+				case sender.windowNotifyCh <- struct{}{}:
+				default:
+				}
 			}
 
-			removeCount := 0
-			// remove all continuous buffer frames with ack
-			for _, sf := range sender.bufferFrames {
-				if sf.HasAck() {
-					removeCount++
-					sender.limiter <- struct{}{}
-				} else {
-					break
+			for _, sf := range sender.waitAcks {
+				if sender.allReceiversAcked(sf) {
+					sender.completeFrame(sf)
+					continue
+				}
+				if sendTime := sf.SendTime(); !sendTime.IsZero() && now.Sub(sendTime) > retransmitTimeout {
+					sf.UpdateSendTime()
+					sender.retryFrames = append(sender.retryFrames, sf)
+					select {
+					case sender.limiter <- struct{}{}:
+					default:
+					}
 				}
 			}
-			sender.bufferFrames = sender.bufferFrames[removeCount:]
 		}
 		sender.mu.Unlock()
-
-		if finished {
-			close(sender.ackCh)
-			close(sender.frameCh)
-			close(sender.limiter)
-			return
-		}
 	}
 }
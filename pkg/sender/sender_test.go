@@ -0,0 +1,382 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/stream"
+)
+
+// readFrames reads frames from fs to ch until it's closed.
+func readFrames(fs *stream.FrameStream, ch chan *stream.Frame) {
+	defer close(ch)
+	for {
+		f, err := fs.ReadFrame()
+		if err != nil {
+			return
+		}
+		ch <- f
+	}
+}
+
+func TestSenderWaitsForRecvWindow(t *testing.T) {
+	data := bytes.Repeat([]byte("abcd"), 10)
+	s, err := NewSender(1, bytes.NewReader(data), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.HandleStream(stream.NewFrameStream(c1))
+	go s.Run()
+
+	fs := stream.NewFrameStream(c2)
+	frameCh := make(chan *stream.Frame, 100)
+	go readFrames(fs, frameCh)
+
+	recv := func() *stream.Frame {
+		select {
+		case f := <-frameCh:
+			return f
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no frame is sent")
+		}
+		return nil
+	}
+
+	// frames are acked but receiver's window stays at 4, sender should stop at frame 3
+	for id := uint64(0); id < 4; id++ {
+		f := recv()
+		if f.FrameID != id {
+			t.Fatalf("get frame %d, want %d", f.FrameID, id)
+		}
+		if err = fs.WriteAck(stream.NewAck(1, id, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case f := <-frameCh:
+		t.Fatalf("frame %d is sent out of receiver's window", f.FrameID)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// window is opened by a later ack
+	if err = fs.WriteAck(stream.NewAck(1, 3, 100)); err != nil {
+		t.Fatal(err)
+	}
+	var buf []byte
+	for id := uint64(4); ; id++ {
+		f := recv()
+		if f.FrameID != id {
+			t.Fatalf("get frame %d, want %d", f.FrameID, id)
+		}
+		if err = fs.WriteAck(stream.NewAck(1, id, 100)); err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, f.Buf...)
+		if f.IsLast() {
+			break
+		}
+	}
+	if !bytes.Equal(buf, data[16:]) {
+		t.Fatalf("get data %q", buf)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sender doesn't finish after all frames are acked")
+	}
+	if err = s.Err(); err != nil {
+		t.Fatalf("sender error: %v", err)
+	}
+}
+
+// ackAll acks every frame read from conn until the last one. Frames are decoded without ReadFrame
+// and payloads are discarded, so allocations of the benchmark are made by sender.
+func ackAll(conn net.Conn) error {
+	r := bufio.NewReaderSize(conn, 64*1024)
+	fs := stream.NewFrameStream(conn)
+	var header [3]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		var fields [4]uint64 // fileID, frameID, offset, length
+		for i := range fields {
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			fields[i] = v
+		}
+		if _, err := r.Discard(int(fields[3])); err != nil {
+			return err
+		}
+		if err := fs.WriteAck(stream.NewAck(uint32(fields[0]), fields[1], fields[1]+1024)); err != nil {
+			return err
+		}
+		if header[2]&stream.FlagLast != 0 {
+			return nil
+		}
+	}
+}
+
+func benchmarkSender(b *testing.B, streams int) {
+	const (
+		size      = 64 * 1024 * 1024
+		frameSize = 64 * 1024
+	)
+	data := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s, err := NewReaderAtSender(1, bytes.NewReader(data), size, frameSize, 256, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < streams; j++ {
+			c1, c2 := net.Pipe()
+			go s.HandleStream(stream.NewFrameStream(c1))
+			go func() {
+				ackAll(c2)
+				c2.Close()
+			}()
+		}
+		s.Run()
+		if err = s.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSender(b *testing.B) {
+	benchmarkSender(b, 1)
+}
+
+func BenchmarkSender4Streams(b *testing.B) {
+	benchmarkSender(b, 4)
+}
+
+func BenchmarkReaderAtSource(b *testing.B) {
+	const (
+		size      = 64 * 1024 * 1024
+		frameSize = 64 * 1024
+	)
+	data := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rs := newReaderAtSource(bytes.NewReader(data), size, frameSize, 4, 64)
+		for {
+			buf, _, err := rs.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			rs.Put(buf)
+		}
+		rs.Close()
+	}
+}
+
+func TestSenderWaitRecvWindowCanceled(t *testing.T) {
+	s, err := NewSender(1, bytes.NewReader(nil), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.waitRecvWindow(4)
+	}()
+	s.Cancel(stream.CodeCanceled, fmt.Errorf("all streams are broken"))
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("wait returns nil after sender is canceled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait doesn't return after sender is canceled")
+	}
+}
+
+func TestSenderFrameVersion0(t *testing.T) {
+	data := bytes.Repeat([]byte("abcd"), 10)
+	s, err := NewSender(1, bytes.NewReader(data), 8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetFrameVersion(stream.Version0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetCompression(nil); err == nil {
+		t.Fatalf("compression with frame version 0: expect error")
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.HandleStream(stream.NewFrameStream(c1))
+	go s.Run()
+
+	// legacy receiver acks in version 0 without window
+	fs := stream.NewFrameStream(c2)
+	var buf []byte
+	for {
+		f, err := fs.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Version != stream.Version0 {
+			t.Fatalf("frame %d in version %d", f.FrameID, f.Version)
+		}
+		if err = fs.WriteAck(&stream.Ack{Version: stream.Version0, FileID: f.FileID, FrameID: f.FrameID}); err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, f.Buf...)
+		if f.IsLast() {
+			break
+		}
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("get data %q", buf)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sender doesn't finish after all frames are acked")
+	}
+	if err = s.Err(); err != nil {
+		t.Fatalf("sender error: %v", err)
+	}
+}
+
+// readUntilError reads frames and acks them with window 100 until an error frame, it returns the error in it.
+func readUntilError(t *testing.T, fs *stream.FrameStream) *stream.RemoteError {
+	for {
+		f, err := fs.ReadFrame()
+		if err != nil {
+			t.Fatalf("stream is closed without error frame: %v", err)
+		}
+		if f.Type == stream.TypeError {
+			return f.Err()
+		}
+		if err = fs.WriteAck(stream.NewAck(f.FileID, f.FrameID, f.FrameID+100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSenderCancel(t *testing.T) {
+	s, err := NewSender(1, bytes.NewReader(bytes.Repeat([]byte("abcd"), 1000)), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.HandleStream(stream.NewFrameStream(c1))
+	go s.Run()
+
+	fs := stream.NewFrameStream(c2)
+	if _, err = fs.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	cancelErr := fmt.Errorf("interrupted")
+	s.Cancel(stream.CodeCanceled, cancelErr)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("sender isn't done after it's canceled")
+	}
+	if s.Err() != cancelErr {
+		t.Fatalf("sender error is %v", s.Err())
+	}
+
+	// receiver is told why sender is canceled
+	rerr := readUntilError(t, fs)
+	if rerr.Code != stream.CodeCanceled || rerr.Reason != "interrupted" {
+		t.Fatalf("receiver gets error %v", rerr)
+	}
+	c2.Close()
+
+	// a later cancel doesn't replace the first error
+	s.Cancel(stream.CodeReadFailed, fmt.Errorf("read failed"))
+	if s.Err() != cancelErr {
+		t.Fatalf("sender error is replaced by %v", s.Err())
+	}
+}
+
+type failReaderAt struct {
+	size int64
+}
+
+func (r *failReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size/2 {
+		return 0, fmt.Errorf("bad sector")
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestSenderReadError(t *testing.T) {
+	s, err := NewReaderAtSender(1, &failReaderAt{size: 64}, 64, 4, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.HandleStream(stream.NewFrameStream(c1))
+	go s.Run()
+
+	rerr := readUntilError(t, stream.NewFrameStream(c2))
+	if rerr.Code != stream.CodeReadFailed || rerr.Reason != "bad sector" {
+		t.Fatalf("receiver gets error %v", rerr)
+	}
+	if s.Err() == nil {
+		t.Fatalf("sender has no error after reading failed")
+	}
+}
+
+func TestSenderReceiverAborts(t *testing.T) {
+	s, err := NewSender(1, bytes.NewReader(bytes.Repeat([]byte("abcd"), 1000)), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.HandleStream(stream.NewFrameStream(c1))
+	go s.Run()
+
+	fs := stream.NewFrameStream(c2)
+	go func() {
+		for {
+			if _, err := fs.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	if err = fs.WriteAckError(stream.CodeWriteFailed, "disk full"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("sender isn't done after the only receiver aborts")
+	}
+	if err = s.Err(); err == nil || !strings.Contains(err.Error(), "write failed: disk full") {
+		t.Fatalf("sender error is %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package sender
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// frameSource provides payloads of new frames in order.
+type frameSource interface {
+	// Next returns the next payload. Only the last payload may be less than frameSize,
+	// except that the last payload of each file may be less for a positionSource.
+	// It returns io.EOF if there is no more data.
+	Next() (buf *[]byte, n int, err error)
+
+	// Put gives the buffer back after the frame has been acked.
+	Put(buf *[]byte)
+
+	Close()
+}
+
+// positionSource is a frameSource of several files, payloads are not at FrameID*frameSize of one file.
+type positionSource interface {
+	// Pos returns FileID and offset of the payload returned by the last Next.
+	Pos() (fileID uint32, offset int64)
+}
+
+type bufferPool struct {
+	frameSize int
+	pool      *sync.Pool
+}
+
+// buffers are shared by all senders with the same frame size, so a new sender doesn't allocate all of them again
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = make(map[int]*sync.Pool)
+)
+
+func newBufferPool(frameSize int) *bufferPool {
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	pool, ok := bufferPools[frameSize]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, frameSize)
+				return &buf
+			},
+		}
+		bufferPools[frameSize] = pool
+	}
+	return &bufferPool{
+		frameSize: frameSize,
+		pool:      pool,
+	}
+}
+
+func (p *bufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(buf *[]byte) {
+	if buf == nil || cap(*buf) < p.frameSize {
+		return
+	}
+	*buf = (*buf)[:p.frameSize]
+	p.pool.Put(buf)
+}
+
+// readerSource reads frames from src serially.
+type readerSource struct {
+	src io.Reader
+	*bufferPool
+}
+
+func newReaderSource(src io.Reader, frameSize int) *readerSource {
+	return &readerSource{
+		src:        src,
+		bufferPool: newBufferPool(frameSize),
+	}
+}
+
+func (rs *readerSource) Next() (buf *[]byte, n int, err error) {
+	buf = rs.Get()
+	n, err = io.ReadFull(rs.src, *buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		rs.Put(buf)
+		return nil, 0, err
+	}
+	return
+}
+
+func (rs *readerSource) Close() {
+}
+
+type readSlot struct {
+	buf   *[]byte
+	n     int
+	err   error
+	ready chan struct{}
+}
+
+// readerAtSource reads frames from src by multiple goroutines concurrently.
+// At most len(slots) frames are read ahead of the consumer.
+type readerAtSource struct {
+	src   io.ReaderAt
+	size  int64
+	slots []*readSlot
+
+	// the index of next frame returned by Next
+	next   int64
+	freeCh chan struct{}
+	jobCh  chan int64
+	stopCh chan struct{}
+
+	closeOnce sync.Once
+	*bufferPool
+}
+
+func newReaderAtSource(src io.ReaderAt, size int64, frameSize int, readers int, readAhead int) *readerAtSource {
+	if readers <= 0 {
+		readers = 4
+	}
+	if readAhead < readers {
+		readAhead = readers
+	}
+
+	rs := &readerAtSource{
+		src:        src,
+		size:       size,
+		slots:      make([]*readSlot, readAhead),
+		freeCh:     make(chan struct{}, readAhead),
+		jobCh:      make(chan int64, readAhead),
+		stopCh:     make(chan struct{}),
+		bufferPool: newBufferPool(frameSize),
+	}
+	for i := 0; i < readAhead; i++ {
+		rs.slots[i] = &readSlot{
+			ready: make(chan struct{}, 1),
+		}
+		rs.freeCh <- struct{}{}
+	}
+
+	go rs.dispatcher()
+	for i := 0; i < readers; i++ {
+		go rs.reader()
+	}
+	return rs
+}
+
+func (rs *readerAtSource) frameCount() int64 {
+	frameSize := int64(rs.frameSize)
+	return (rs.size + frameSize - 1) / frameSize
+}
+
+func (rs *readerAtSource) dispatcher() {
+	defer close(rs.jobCh)
+
+	count := rs.frameCount()
+	for index := int64(0); index < count; index++ {
+		select {
+		case <-rs.freeCh:
+		case <-rs.stopCh:
+			return
+		}
+		rs.jobCh <- index
+	}
+}
+
+func (rs *readerAtSource) reader() {
+	for index := range rs.jobCh {
+		slot := rs.slots[index%int64(len(rs.slots))]
+		buf := rs.Get()
+		offset := index * int64(rs.frameSize)
+		n, err := rs.src.ReadAt(*buf, offset)
+		if err == io.EOF {
+			if offset+int64(n) == rs.size {
+				err = nil
+			} else {
+				// file is truncated while it's sent, it must not look like the end
+				err = fmt.Errorf("file is shorter than %d bytes", rs.size)
+			}
+		}
+		slot.buf, slot.n, slot.err = buf, n, err
+		slot.ready <- struct{}{}
+	}
+}
+
+func (rs *readerAtSource) Next() (buf *[]byte, n int, err error) {
+	if rs.next >= rs.frameCount() {
+		return nil, 0, io.EOF
+	}
+
+	slot := rs.slots[rs.next%int64(len(rs.slots))]
+	select {
+	case <-slot.ready:
+	case <-rs.stopCh:
+		return nil, 0, io.ErrClosedPipe
+	}
+	buf, n, err = slot.buf, slot.n, slot.err
+	slot.buf = nil
+	rs.next++
+	rs.freeCh <- struct{}{}
+
+	if err != nil {
+		rs.Put(buf)
+		return nil, 0, err
+	}
+	return
+}
+
+func (rs *readerAtSource) Close() {
+	rs.closeOnce.Do(func() {
+		close(rs.stopCh)
+	})
+}
+
+// File is one of the files sent by a Sender from NewFilesSender.
+type File struct {
+	ID   uint32
+	Size int64
+
+	// Open is called when the file is going to be sent
+	Open func() (io.ReadCloser, error)
+}
+
+// filesSource reads files one after another, a frame never crosses two files.
+// Position of each payload is returned by Pos, receiver writes it to the file by FileID and Offset.
+type filesSource struct {
+	files []File
+
+	// current file, it's offset and the position of the last payload
+	index   int
+	cur     io.ReadCloser
+	offset  int64
+	lastID  uint32
+	lastPos int64
+
+	*bufferPool
+}
+
+func newFilesSource(files []File, frameSize int) *filesSource {
+	return &filesSource{
+		files:      files,
+		bufferPool: newBufferPool(frameSize),
+	}
+}
+
+func (fs *filesSource) Next() (buf *[]byte, n int, err error) {
+	for fs.index < len(fs.files) {
+		f := fs.files[fs.index]
+		if fs.offset >= f.Size {
+			fs.closeCurrent()
+			fs.index++
+			fs.offset = 0
+			continue
+		}
+		if fs.cur == nil {
+			if fs.cur, err = f.Open(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		buf = fs.Get()
+		n = len(*buf)
+		if int64(n) > f.Size-fs.offset {
+			n = int(f.Size - fs.offset)
+		}
+		if _, err = io.ReadFull(fs.cur, (*buf)[:n]); err != nil {
+			fs.Put(buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("file %d is shorter than %d bytes", f.ID, f.Size)
+			}
+			return nil, 0, err
+		}
+		fs.lastID, fs.lastPos = f.ID, fs.offset
+		fs.offset += int64(n)
+		return buf, n, nil
+	}
+	return nil, 0, io.EOF
+}
+
+// Pos returns FileID and offset of the payload returned by the last Next.
+func (fs *filesSource) Pos() (uint32, int64) {
+	return fs.lastID, fs.lastPos
+}
+
+func (fs *filesSource) closeCurrent() {
+	if fs.cur != nil {
+		fs.cur.Close()
+		fs.cur = nil
+	}
+}
+
+func (fs *filesSource) Close() {
+	fs.closeCurrent()
+}
@@ -5,29 +5,59 @@ import (
 	"sync"
 	"time"
 
+	"github.com/fatedier/fft/pkg/e2e"
 	"github.com/fatedier/fft/pkg/stream"
 
-	"github.com/fatedier/golib/control/limit"
 	"github.com/fatedier/golib/control/shutdown"
 )
 
+const (
+	// how long to wait for receiver to close the stream after it's told why sender is canceled
+	errFrameTimeout = 2 * time.Second
+
+	// stream is closed if frames are sent through it but nothing is acked in this time
+	streamStallTimeout = 30 * time.Second
+
+	// how often a retired stream checks whether all frames sent through it are acked
+	retireCheckInterval = 100 * time.Millisecond
+)
+
 type Transfer struct {
 	id             int
 	maxBufferCount int
 	inSlowStart    bool
-	waitAcks       map[uint32]*SendFrame
+	waitAcks       map[uint64]*SendFrame
+
+	// when an ack is received last time, or frames begin to wait for acks
+	lastAck time.Time
 
 	s            *stream.FrameStream
-	limiter      *limit.Limiter
+	compressor   *compressor // nil if compression is disabled
+	sealer       *e2e.Sealer // nil if frames are not encrypted one by one
+	window       *window
 	frameCh      chan *SendFrame
 	ackCh        chan *stream.Ack
+	doneCh       <-chan struct{}
 	mu           sync.Mutex
 	sendShutdown *shutdown.Shutdown
 	recvShutdown *shutdown.Shutdown
+
+	// closed when no more acks can be read
+	ackCloseCh chan struct{}
+
+	// called if receiver aborts the stream with an error
+	abort func(err error)
+
+	// returns the frame sent before closing the stream if sender is canceled
+	errFrame func() *stream.Frame
+
+	// no more frames are sent after it's closed, the stream is closed after frames sent are acked
+	retireCh <-chan struct{}
 }
 
+// NewTransfer sends frames from frameCh to s and puts acks to ackCh until doneCh is closed.
 func NewTransfer(id int, maxBufferCount int, s *stream.FrameStream,
-	frameCh chan *SendFrame, ackCh chan *stream.Ack) *Transfer {
+	frameCh chan *SendFrame, ackCh chan *stream.Ack, doneCh <-chan struct{}) *Transfer {
 
 	if maxBufferCount <= 0 {
 		maxBufferCount = 10
@@ -36,13 +66,15 @@ func NewTransfer(id int, maxBufferCount int, s *stream.FrameStream,
 		id:             id,
 		maxBufferCount: maxBufferCount,
 		inSlowStart:    true,
-		waitAcks:       make(map[uint32]*SendFrame),
+		waitAcks:       make(map[uint64]*SendFrame),
 		s:              s,
-		limiter:        limit.NewLimiter(int64(1)),
+		window:         newWindow(1),
 		frameCh:        frameCh,
 		ackCh:          ackCh,
+		doneCh:         doneCh,
 		sendShutdown:   shutdown.New(),
 		recvShutdown:   shutdown.New(),
+		ackCloseCh:     make(chan struct{}),
 	}
 	return t
 }
@@ -51,9 +83,12 @@ func NewTransfer(id int, maxBufferCount int, s *stream.FrameStream,
 func (t *Transfer) Run() (noAckFrames []*SendFrame) {
 	go t.ackReceiver()
 	go t.frameSender()
+	stopCh := make(chan struct{})
+	go t.watchStall(stopCh)
 
 	t.recvShutdown.WaitDone()
 	t.sendShutdown.WaitDone()
+	close(stopCh)
 
 	for _, f := range t.waitAcks {
 		noAckFrames = append(noAckFrames, f)
@@ -64,7 +99,7 @@ func (t *Transfer) Run() (noAckFrames []*SendFrame) {
 		})
 	}
 
-	t.limiter.Close()
+	t.window.Close()
 	return
 }
 
@@ -72,15 +107,22 @@ func (t *Transfer) frameSender() {
 	defer t.sendShutdown.Done()
 
 	for {
-		// block by limiter
-		n := int(t.limiter.LimitNum())
-		err := t.limiter.Acquire(time.Second)
+		// block by window
+		n := t.window.Limit()
+		err := t.window.Acquire(time.Second)
 		if err != nil {
-			if err == limit.ErrTimeout {
+			if err == errWindowTimeout {
+				// no acks come back and sender has given up
+				select {
+				case <-t.doneCh:
+					t.closeStream()
+					return
+				default:
+				}
 				if n/2 == 0 {
 					n = 1
 				}
-				t.limiter.SetLimit(int64(n))
+				t.window.SetLimit(n)
 				continue
 			} else {
 				return
@@ -98,46 +140,179 @@ func (t *Transfer) frameSender() {
 				t.inSlowStart = false
 				n = t.maxBufferCount
 			}
-			t.limiter.SetLimit(int64(n))
+			t.window.SetLimit(n)
 		}
 
-		sf, ok := <-t.frameCh
-		if !ok {
+		// frames may be ready all the time, don't take them after the stream is retired
+		select {
+		case <-t.retireCh:
+			t.drain()
+			return
+		default:
+		}
+
+		var (
+			sf *SendFrame
+			ok bool
+		)
+		select {
+		case sf, ok = <-t.frameCh:
+		case <-t.ackCloseCh:
+			// stream is broken, frames waiting for acks are sent again through other streams
 			t.s.Close()
 			return
+		case <-t.retireCh:
+			t.drain()
+			return
+		}
+		if !ok {
+			t.closeStream()
+			return
+		}
+
+		// the frame may be acked through another stream after it's queued, then it's buffer may be reused
+		if sf.HasAck() || !sf.acquire() {
+			t.window.Release()
+			continue
 		}
 
 		t.mu.Lock()
+		if len(t.waitAcks) == 0 {
+			t.lastAck = time.Now()
+		}
 		t.waitAcks[sf.FrameID()] = sf
 		t.mu.Unlock()
 
-		err = t.s.WriteFrame(sf.Frame())
+		err = t.sendFrame(sf)
+		sf.release()
 		if err != nil {
 			return
 		}
 	}
 }
 
+// sendFrame writes the frame, it should be referenced by the caller until it returns.
+func (t *Transfer) sendFrame(sf *SendFrame) (err error) {
+	frame := sf.Frame()
+	if t.compressor != nil {
+		frame = t.compressor.Compress(frame)
+	}
+	if t.sealer != nil {
+		if frame, err = sealFrame(t.sealer, frame); err != nil {
+			return err
+		}
+	}
+	sf.UpdateSendTime()
+	return t.s.WriteFrame(frame)
+}
+
+// watchStall closes the stream if it stalls without being closed, so frames waiting for acks
+// are sent again through other streams.
+func (t *Transfer) watchStall(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		t.mu.Lock()
+		stalled := len(t.waitAcks) > 0 && time.Since(t.lastAck) > streamStallTimeout
+		t.mu.Unlock()
+		if stalled {
+			t.s.Close()
+			return
+		}
+	}
+}
+
+// drain closes the stream after all frames sent through it are acked, or it's broken or stalled.
+func (t *Transfer) drain() {
+	ticker := time.NewTicker(retireCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		waiting := len(t.waitAcks)
+		t.mu.Unlock()
+		if waiting == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-t.ackCloseCh:
+			return
+		case <-t.doneCh:
+			t.closeStream()
+			return
+		}
+	}
+	t.s.Close()
+}
+
+// closeStream tells receiver why sender is canceled if it is, then closes the stream.
+func (t *Transfer) closeStream() {
+	if t.errFrame != nil {
+		if frame := t.errFrame(); frame != nil && t.s.WriteFrame(frame) == nil {
+			// closing with unread acks resets the connection and the frame may be dropped,
+			// so wait for receiver to close it first
+			select {
+			case <-t.ackCloseCh:
+			case <-time.After(errFrameTimeout):
+			}
+		}
+	}
+	t.s.Close()
+}
+
 func (t *Transfer) ackReceiver() {
 	defer t.recvShutdown.Done()
+	defer close(t.ackCloseCh)
 
 	for {
 		ack, err := t.s.ReadAck()
 		if err != nil {
-			t.limiter.Close()
+			if rerr, ok := err.(*stream.RemoteError); ok {
+				t.s.Close()
+				if t.abort != nil {
+					t.abort(rerr)
+				}
+			}
+			t.window.Close()
 			return
 		}
 
 		t.mu.Lock()
+		t.lastAck = time.Now()
 		_, ok := t.waitAcks[ack.FrameID]
 		if ok {
 			delete(t.waitAcks, ack.FrameID)
 		}
 		t.mu.Unlock()
 		if ok {
-			t.limiter.Release()
+			t.window.Release()
 		}
 
-		t.ackCh <- ack
+		// acks after sender is done are dropped, keep reading until the stream is closed
+		select {
+		case t.ackCh <- ack:
+		case <-t.doneCh:
+		}
+	}
+}
+
+// sealFrame returns an encrypted copy of frame, so workers can read frame headers but not data.
+func sealFrame(sealer *e2e.Sealer, frame *stream.Frame) (*stream.Frame, error) {
+	if frame.Type != stream.TypeData || len(frame.Buf) == 0 {
+		return frame, nil
+	}
+	buf, err := sealer.Seal(make([]byte, 0, len(frame.Buf)+sealer.Overhead()), frame.FrameID, frame.Buf)
+	if err != nil {
+		return nil, err
 	}
+	sealed := *frame
+	sealed.Flags |= stream.FlagEncrypted
+	sealed.Buf = buf
+	return &sealed, nil
 }
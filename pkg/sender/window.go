@@ -0,0 +1,113 @@
+package sender
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errWindowTimeout = errors.New("window acquire timeout")
+	errWindowClosed  = errors.New("window closed")
+)
+
+// window limits how many frames are sent through a stream without being acked.
+// It can be closed while others are waiting on it, unlike limit.Limiter which races on Close.
+type window struct {
+	mu      sync.Mutex
+	current int
+	limit   int
+	closed  bool
+
+	// closed when current, limit or closed changes, nil if nobody is waiting
+	changeCh chan struct{}
+}
+
+func newWindow(limit int) *window {
+	return &window{
+		limit: limit,
+	}
+}
+
+// notify wakes up waiters, it should be called with mu held.
+func (w *window) notify() {
+	if w.changeCh != nil {
+		close(w.changeCh)
+		w.changeCh = nil
+	}
+}
+
+// tryAcquire returns a channel to wait on if the window is full.
+func (w *window) tryAcquire() (<-chan struct{}, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, errWindowClosed
+	}
+	if w.current < w.limit {
+		w.current++
+		return nil, nil
+	}
+	if w.changeCh == nil {
+		w.changeCh = make(chan struct{})
+	}
+	return w.changeCh, nil
+}
+
+func (w *window) Limit() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.limit
+}
+
+func (w *window) SetLimit(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limit = n
+	w.notify()
+}
+
+// Acquire waits until less than limit frames are not acked, timeout eq 0 means no timeout limit.
+func (w *window) Acquire(timeout time.Duration) error {
+	changeCh, err := w.tryAcquire()
+	if changeCh == nil {
+		return err
+	}
+
+	// the timer is only needed if the window is full
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	for {
+		select {
+		case <-changeCh:
+		case <-timeoutCh:
+			return errWindowTimeout
+		}
+		if changeCh, err = w.tryAcquire(); changeCh == nil {
+			return err
+		}
+	}
+}
+
+func (w *window) Release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current > 0 {
+		w.current--
+		w.notify()
+	}
+}
+
+// Close makes Acquire fail, it's safe to call it more than once.
+func (w *window) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		w.notify()
+	}
+}
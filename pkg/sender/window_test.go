@@ -0,0 +1,40 @@
+package sender
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	w := newWindow(1)
+	if err := w.Acquire(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Acquire(10 * time.Millisecond); err != errWindowTimeout {
+		t.Fatalf("window is full: got %v, expect timeout", err)
+	}
+
+	// growing the window or releasing a frame wakes up the waiter
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Acquire(time.Second) }()
+	w.SetLimit(2)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	go func() { errCh <- w.Acquire(time.Second) }()
+	w.Release()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// closing fails waiters and later calls
+	go func() { errCh <- w.Acquire(0) }()
+	w.Close()
+	w.Close()
+	if err := <-errCh; err != errWindowClosed {
+		t.Fatalf("got %v, expect closed", err)
+	}
+	if err := w.Acquire(0); err != errWindowClosed {
+		t.Fatalf("got %v, expect closed", err)
+	}
+}
@@ -1,38 +1,148 @@
 package stream
 
+import (
+	"fmt"
+)
+
+const (
+	// Version0 is the legacy encoding: uint32 FrameID, uint16 length and an empty frame means last frame.
+	Version0 uint8 = 0
+	// Version1 uses varint fields, 64-bit offsets, frame types and flags.
+	Version1 uint8 = 1
+
+	// MaxVersion is the newest frame encoding we support.
+	MaxVersion = Version1
+)
+
+const (
+	MaxFrameSizeV0 = 65535
+	MaxFrameSizeV1 = 16 * 1024 * 1024
+)
+
+// Frame types, only valid in Version1.
+const (
+	TypeData    uint8 = 0
+	TypeAck     uint8 = 1
+	TypeControl uint8 = 2
+	TypeClose   uint8 = 3
+	TypeError   uint8 = 4
+)
+
+// Frame flags, only valid in Version1.
+const (
+	FlagLast       uint8 = 1 << 0
+	FlagCompressed uint8 = 1 << 1
+	FlagEncrypted  uint8 = 1 << 2
+
+	// FlagReceiver means the ack has a receiver index after window,
+	// it's used when one sender sends frames to many receivers.
+	FlagReceiver uint8 = 1 << 3
+)
+
+func IsValidVersion(version uint8) bool {
+	return version <= MaxVersion
+}
+
 func IsValidFrameSize(frameSize int) bool {
-	if frameSize <= 0 || frameSize > 65535 {
+	if frameSize <= 0 || frameSize > MaxFrameSizeV1 {
 		return false
 	}
 	return true
 }
 
+// CheckFrameSize returns an error if frameSize can't be encoded by version.
+func CheckFrameSize(version uint8, frameSize int) error {
+	if !IsValidVersion(version) {
+		return fmt.Errorf("unsupported frame version %d", version)
+	}
+	max := MaxFrameSizeV1
+	if version == Version0 {
+		max = MaxFrameSizeV0
+	}
+	if frameSize <= 0 || frameSize > max {
+		return fmt.Errorf("frame size %d is not supported by frame version %d, max is %d", frameSize, version, max)
+	}
+	return nil
+}
+
 type Frame struct {
 	Version uint8
+	Type    uint8
+	Flags   uint8
 	FileID  uint32
-	FrameID uint32
-	Buf     []byte // if len(Buf) == 0 , is last frame
+	FrameID uint64
+	Offset  uint64
+	Buf     []byte // in Version0, if len(Buf) == 0 , is last frame
 }
 
-func NewFrame(fileID uint32, frameID uint32, buf []byte) *Frame {
+func NewFrame(fileID uint32, frameID uint64, buf []byte) *Frame {
 	return &Frame{
-		Version: 0,
+		Version: Version1,
+		Type:    TypeData,
 		FileID:  fileID,
 		FrameID: frameID,
 		Buf:     buf,
 	}
 }
 
+// NewLastFrame returns an empty data frame which means all data before it has been sent.
+func NewLastFrame(fileID uint32, frameID uint64, offset uint64) *Frame {
+	return &Frame{
+		Version: Version1,
+		Type:    TypeData,
+		Flags:   FlagLast,
+		FileID:  fileID,
+		FrameID: frameID,
+		Offset:  offset,
+	}
+}
+
+// NewErrorFrame returns a frame which tells receiver why sender aborts the stream.
+func NewErrorFrame(code uint8, reason string) *Frame {
+	if len(reason) > maxErrorReasonLen {
+		reason = reason[:maxErrorReasonLen]
+	}
+	return &Frame{
+		Version: Version1,
+		Type:    TypeError,
+		Offset:  uint64(code),
+		Buf:     []byte(reason),
+	}
+}
+
+// Err returns the code and reason in an error frame.
+func (f *Frame) Err() *RemoteError {
+	return &RemoteError{
+		Code:   uint8(f.Offset),
+		Reason: string(f.Buf),
+	}
+}
+
+func (f *Frame) IsLast() bool {
+	if f.Version == Version0 {
+		return len(f.Buf) == 0
+	}
+	return f.Type == TypeData && f.Flags&FlagLast != 0
+}
+
 type Ack struct {
 	Version uint8
 	FileID  uint32
-	FrameID uint32
+	FrameID uint64
+
+	// Window is only valid when Version >= 1.
+	// Receiver can accept frames whose FrameID is less than Window.
+	Window uint64
+
+	// Receiver is the index of receiver which sends this ack, only valid when Version >= 1.
+	Receiver uint32
 }
 
-func NewAck(fileID uint32, frameID uint32) *Ack {
+func NewAck(fileID uint32, frameID uint64, window uint64) *Ack {
 	return &Ack{
-		Version: 0,
+		Version: Version1,
 		FileID:  fileID,
 		FrameID: frameID,
+		Window:  window,
 	}
 }
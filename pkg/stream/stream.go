@@ -1,116 +1,369 @@
 package stream
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
 )
 
 /*
 	Sender -> Frame -> Receiver
 	Sender <- Ack <- Receiver
+
+	Version0:
+		Frame: version(uint8) fileID(uint32) frameID(uint32) length(uint16) payload
+		Ack:   version(uint8) fileID(uint32) frameID(uint32)
+
+	Version1:
+		Frame: version(uint8) type(uint8) flags(uint8) fileID(uvarint) frameID(uvarint) offset(uvarint) length(uvarint) payload
+		Ack:   version(uint8) type(uint8) flags(uint8) fileID(uvarint) frameID(uvarint) window(uvarint) [receiver(uvarint)]
+		       receiver is only present if flags has FlagReceiver. This is the only Version1 ack layout,
+		       fields can only be added behind new flags.
+		Error ack:   version(uint8) type(uint8) flags(uint8) code(uint8) length(uvarint) reason, receiver aborts the stream
+		Error frame: a frame with error type, offset is the code and payload is the reason, sender aborts the stream
+
+	Each frame or ack is encoded by it's own Version, so both encodings can be read from the same stream.
 */
 
+const (
+	maxFrameHeaderLen = 3 + 4*binary.MaxVarintLen64
+	maxAckLen         = 3 + 4*binary.MaxVarintLen64
+
+	maxErrorReasonLen = 1024
+
+	// payload is read in steps of this size, so a bad length doesn't allocate a large buffer at once
+	readFrameStep = 64 * 1024
+)
+
+// Error codes tell the peer why the transfer is aborted.
+const (
+	CodeUnknown     uint8 = 0
+	CodeCanceled    uint8 = 1
+	CodeReadFailed  uint8 = 2
+	CodeWriteFailed uint8 = 3
+	CodeRejected    uint8 = 4
+	CodeTimeout     uint8 = 5
+)
+
+var codeTexts = map[uint8]string{
+	CodeCanceled:    "canceled",
+	CodeReadFailed:  "read failed",
+	CodeWriteFailed: "write failed",
+	CodeRejected:    "rejected",
+	CodeTimeout:     "timeout",
+}
+
+// RemoteError is the reason the peer sends before aborting the stream, like disk full or canceled by user.
+type RemoteError struct {
+	Code   uint8
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	if text, ok := codeTexts[e.Code]; ok {
+		return text + ": " + e.Reason
+	}
+	return e.Reason
+}
+
 type FrameStream struct {
-	conn net.Conn
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+
+	// only used by WriteFrame, avoid allocations for each frame
+	frameHeader [maxFrameHeaderLen]byte
+	bufs        net.Buffers
+	writeBufs   net.Buffers
+
+	// only used by ReadAck
+	ackHeader [8]byte
 }
 
-func NewFrameStream(conn net.Conn) *FrameStream {
+// acks may be written by several goroutines, so their buffers come from a pool
+var ackBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([maxAckLen]byte)
+	},
+}
+
+func NewFrameStream(conn io.ReadWriteCloser) *FrameStream {
 	return &FrameStream{
 		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (fs *FrameStream) encodeFrameHeader(frame *Frame) ([]byte, error) {
+	header := fs.frameHeader[:]
+	switch frame.Version {
+	case Version0:
+		if frame.Type != TypeData || frame.Flags&^FlagLast != 0 {
+			return nil, fmt.Errorf("frame type or flags is not supported by frame version 0")
+		}
+		if frame.FrameID > math.MaxUint32 || len(frame.Buf) > MaxFrameSizeV0 {
+			return nil, fmt.Errorf("frame id or length is too large for frame version 0")
+		}
+		header[0] = frame.Version
+		binary.BigEndian.PutUint32(header[1:5], frame.FileID)
+		binary.BigEndian.PutUint32(header[5:9], uint32(frame.FrameID))
+		binary.BigEndian.PutUint16(header[9:11], uint16(len(frame.Buf)))
+		return header[:11], nil
+	case Version1:
+		header[0] = frame.Version
+		header[1] = frame.Type
+		header[2] = frame.Flags
+		n := 3
+		n += binary.PutUvarint(header[n:], uint64(frame.FileID))
+		n += binary.PutUvarint(header[n:], frame.FrameID)
+		n += binary.PutUvarint(header[n:], frame.Offset)
+		n += binary.PutUvarint(header[n:], uint64(len(frame.Buf)))
+		return header[:n], nil
+	default:
+		return nil, fmt.Errorf("unsupported frame version %d", frame.Version)
 	}
 }
 
+// WriteFrame writes header and payload by one vectored write without copying payload.
+// It should not be called concurrently.
 func (fs *FrameStream) WriteFrame(frame *Frame) error {
-	buffer := bytes.NewBuffer(nil)
-	binary.Write(buffer, binary.BigEndian, uint8(frame.Version))
-	binary.Write(buffer, binary.BigEndian, uint32(frame.FileID))
-	binary.Write(buffer, binary.BigEndian, uint32(frame.FrameID))
-	binary.Write(buffer, binary.BigEndian, uint16(len(frame.Buf)))
-	_, err := fs.conn.Write(buffer.Bytes())
+	header, err := fs.encodeFrameHeader(frame)
 	if err != nil {
 		return err
 	}
 
+	fs.bufs = append(fs.bufs[:0], header)
 	if len(frame.Buf) > 0 {
-		_, err = io.Copy(fs.conn, bytes.NewBuffer(frame.Buf))
-		if err != nil {
-			return err
-		}
+		fs.bufs = append(fs.bufs, frame.Buf)
 	}
-	return nil
+
+	// WriteTo consumes the slice, so use a copy of it which doesn't escape
+	fs.writeBufs = fs.bufs
+	_, err = fs.writeBufs.WriteTo(fs.conn)
+	fs.writeBufs = nil
+
+	// don't hold payload which may be reused by others
+	for i := range fs.bufs {
+		fs.bufs[i] = nil
+	}
+	return err
 }
 
+// ReadFrame reads a frame in any supported version.
+// It returns io.EOF only if the stream ends between frames.
 func (fs *FrameStream) ReadFrame() (*Frame, error) {
 	f := &Frame{}
-	err := binary.Read(fs.conn, binary.BigEndian, &f.Version)
-	if err != nil {
+	var err error
+	if f.Version, err = fs.r.ReadByte(); err != nil {
 		return nil, err
 	}
-
-	err = binary.Read(fs.conn, binary.BigEndian, &f.FileID)
-	if err != nil {
+	if err = fs.readFrame(f); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
+	return f, nil
+}
 
-	err = binary.Read(fs.conn, binary.BigEndian, &f.FrameID)
-	if err != nil {
-		return nil, err
+// readFrame reads the rest of frame f after it's version.
+func (fs *FrameStream) readFrame(f *Frame) error {
+	var (
+		length uint64
+		err    error
+	)
+	switch f.Version {
+	case Version0:
+		var header [10]byte
+		if _, err = io.ReadFull(fs.r, header[:]); err != nil {
+			return err
+		}
+		f.Type = TypeData
+		f.FileID = binary.BigEndian.Uint32(header[0:4])
+		f.FrameID = uint64(binary.BigEndian.Uint32(header[4:8]))
+		length = uint64(binary.BigEndian.Uint16(header[8:10]))
+		if length == 0 {
+			f.Flags |= FlagLast
+		}
+	case Version1:
+		if f.Type, err = fs.r.ReadByte(); err != nil {
+			return err
+		}
+		if f.Flags, err = fs.r.ReadByte(); err != nil {
+			return err
+		}
+		fileID, err := binary.ReadUvarint(fs.r)
+		if err != nil {
+			return err
+		}
+		if fileID > math.MaxUint32 {
+			return fmt.Errorf("error frame file id")
+		}
+		f.FileID = uint32(fileID)
+		if f.FrameID, err = binary.ReadUvarint(fs.r); err != nil {
+			return err
+		}
+		if f.Offset, err = binary.ReadUvarint(fs.r); err != nil {
+			return err
+		}
+		if length, err = binary.ReadUvarint(fs.r); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported frame version %d", f.Version)
 	}
 
-	var length uint16
-	err = binary.Read(fs.conn, binary.BigEndian, &length)
-	if err != nil {
-		return nil, err
+	if length > MaxFrameSizeV1 {
+		return fmt.Errorf("error frame length")
 	}
-
-	// last frame
 	if length == 0 {
-		return f, nil
+		return nil
 	}
 
-	f.Buf = make([]byte, length)
-	n, err := io.ReadFull(fs.conn, f.Buf)
-	if err != nil {
-		return nil, err
+	// the buffer grows while payload arrives
+	size := int(length)
+	step := size
+	if step > readFrameStep {
+		step = readFrameStep
 	}
-	f.Buf = f.Buf[:n]
-
-	if uint16(n) != length {
-		return nil, fmt.Errorf("error frame length")
+	f.Buf = make([]byte, 0, step)
+	for len(f.Buf) < size {
+		n := size - len(f.Buf)
+		if n > readFrameStep {
+			n = readFrameStep
+		}
+		start := len(f.Buf)
+		f.Buf = append(f.Buf, make([]byte, n)...)
+		if _, err = io.ReadFull(fs.r, f.Buf[start:]); err != nil {
+			return err
+		}
 	}
-	return f, nil
+	return nil
 }
 
 func (fs *FrameStream) WriteAck(ack *Ack) error {
-	buffer := bytes.NewBuffer(nil)
-	binary.Write(buffer, binary.BigEndian, uint8(ack.Version))
-	binary.Write(buffer, binary.BigEndian, uint32(ack.FileID))
-	binary.Write(buffer, binary.BigEndian, uint32(ack.FrameID))
-	_, err := fs.conn.Write(buffer.Bytes())
-	if err != nil {
-		return err
+	buf := ackBufPool.Get().(*[maxAckLen]byte)
+	defer ackBufPool.Put(buf)
+	n := 0
+	switch ack.Version {
+	case Version0:
+		if ack.FrameID > math.MaxUint32 {
+			return fmt.Errorf("frame id is too large for frame version 0")
+		}
+		buf[0] = ack.Version
+		binary.BigEndian.PutUint32(buf[1:5], ack.FileID)
+		binary.BigEndian.PutUint32(buf[5:9], uint32(ack.FrameID))
+		n = 9
+	case Version1:
+		buf[0] = ack.Version
+		buf[1] = TypeAck
+		buf[2] = 0
+		if ack.Receiver != 0 {
+			buf[2] |= FlagReceiver
+		}
+		n = 3
+		n += binary.PutUvarint(buf[n:], uint64(ack.FileID))
+		n += binary.PutUvarint(buf[n:], ack.FrameID)
+		n += binary.PutUvarint(buf[n:], ack.Window)
+		if ack.Receiver != 0 {
+			n += binary.PutUvarint(buf[n:], uint64(ack.Receiver))
+		}
+	default:
+		return fmt.Errorf("unsupported frame version %d", ack.Version)
 	}
-	return nil
+
+	_, err := fs.conn.Write(buf[:n])
+	return err
 }
 
-func (fs *FrameStream) ReadAck() (*Ack, error) {
-	ack := &Ack{}
-	err := binary.Read(fs.conn, binary.BigEndian, &ack.Version)
-	if err != nil {
-		return nil, err
+// WriteAckError tells sender why we abort receiving, it requires frame version 1.
+func (fs *FrameStream) WriteAckError(code uint8, reason string) error {
+	if len(reason) > maxErrorReasonLen {
+		reason = reason[:maxErrorReasonLen]
 	}
+	buf := make([]byte, 4+binary.MaxVarintLen64+len(reason))
+	buf[0] = Version1
+	buf[1] = TypeError
+	buf[2] = 0
+	buf[3] = code
+	n := 4
+	n += binary.PutUvarint(buf[n:], uint64(len(reason)))
+	n += copy(buf[n:], reason)
+	_, err := fs.conn.Write(buf[:n])
+	return err
+}
 
-	err = binary.Read(fs.conn, binary.BigEndian, &ack.FileID)
-	if err != nil {
+// ReadAck returns a *RemoteError if receiver aborts the stream.
+func (fs *FrameStream) ReadAck() (*Ack, error) {
+	ack := &Ack{}
+	var err error
+	if ack.Version, err = fs.r.ReadByte(); err != nil {
 		return nil, err
 	}
 
-	err = binary.Read(fs.conn, binary.BigEndian, &ack.FrameID)
-	if err != nil {
-		return nil, err
+	switch ack.Version {
+	case Version0:
+		buf := fs.ackHeader[:8]
+		if _, err = io.ReadFull(fs.r, buf); err != nil {
+			return nil, err
+		}
+		ack.FileID = binary.BigEndian.Uint32(buf[0:4])
+		ack.FrameID = uint64(binary.BigEndian.Uint32(buf[4:8]))
+	case Version1:
+		buf := fs.ackHeader[:2]
+		if _, err = io.ReadFull(fs.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[0] == TypeError {
+			code, err := fs.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length, err := binary.ReadUvarint(fs.r)
+			if err != nil {
+				return nil, err
+			}
+			if length > maxErrorReasonLen {
+				return nil, fmt.Errorf("error reason is too long")
+			}
+			reason := make([]byte, length)
+			if _, err = io.ReadFull(fs.r, reason); err != nil {
+				return nil, err
+			}
+			return nil, &RemoteError{Code: code, Reason: string(reason)}
+		}
+		if buf[0] != TypeAck {
+			return nil, fmt.Errorf("unexpected frame type %d, want ack", buf[0])
+		}
+		fileID, err := binary.ReadUvarint(fs.r)
+		if err != nil {
+			return nil, err
+		}
+		if fileID > math.MaxUint32 {
+			return nil, fmt.Errorf("error ack file id")
+		}
+		ack.FileID = uint32(fileID)
+		if ack.FrameID, err = binary.ReadUvarint(fs.r); err != nil {
+			return nil, err
+		}
+		if ack.Window, err = binary.ReadUvarint(fs.r); err != nil {
+			return nil, err
+		}
+		if buf[1]&FlagReceiver != 0 {
+			receiver, err := binary.ReadUvarint(fs.r)
+			if err != nil {
+				return nil, err
+			}
+			if receiver > math.MaxUint32 {
+				return nil, fmt.Errorf("error ack receiver")
+			}
+			ack.Receiver = uint32(receiver)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported frame version %d", ack.Version)
 	}
 	return ack, nil
 }
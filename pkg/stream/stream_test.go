@@ -0,0 +1,200 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// bufConn is a connection which reads what has been written to it.
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (c *bufConn) Close() error {
+	return nil
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	conn := &bufConn{}
+	fs := NewFrameStream(conn)
+
+	acks := []*Ack{
+		{Version: Version0, FileID: 7, FrameID: 100},
+		NewAck(7, 100, 164),
+		NewAck(1<<32-1, 1<<40, 1<<40+64),
+		{Version: Version1, FileID: 3, FrameID: 9, Window: 20, Receiver: 2},
+	}
+	for _, ack := range acks {
+		if err := fs.WriteAck(ack); err != nil {
+			t.Fatalf("write ack %+v error: %v", ack, err)
+		}
+	}
+	for _, want := range acks {
+		got, err := fs.ReadAck()
+		if err != nil {
+			t.Fatalf("read ack error: %v", err)
+		}
+		if *got != *want {
+			t.Fatalf("read ack %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestAckVersion0TooLarge(t *testing.T) {
+	fs := NewFrameStream(&bufConn{})
+	if err := fs.WriteAck(&Ack{Version: Version0, FrameID: 1 << 32}); err == nil {
+		t.Fatalf("frame id larger than uint32 is written in version 0")
+	}
+}
+
+func TestAckError(t *testing.T) {
+	conn := &bufConn{}
+	fs := NewFrameStream(conn)
+	if err := fs.WriteAckError(CodeWriteFailed, "disk full"); err != nil {
+		t.Fatalf("write ack error: %v", err)
+	}
+	_, err := fs.ReadAck()
+	rerr, ok := err.(*RemoteError)
+	if !ok {
+		t.Fatalf("read ack returns %v, want a remote error", err)
+	}
+	if rerr.Code != CodeWriteFailed || rerr.Reason != "disk full" {
+		t.Fatalf("remote error is %+v", rerr)
+	}
+}
+
+func TestAckVersion1Layout(t *testing.T) {
+	conn := &bufConn{}
+	fs := NewFrameStream(conn)
+	if err := fs.WriteAck(&Ack{Version: Version1, FileID: 1, FrameID: 300, Window: 2, Receiver: 5}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{Version1, TypeAck, FlagReceiver, 1, 0xac, 0x02, 2, 5}
+	if !bytes.Equal(conn.Bytes(), want) {
+		t.Fatalf("ack is encoded as %x, want %x", conn.Bytes(), want)
+	}
+}
+
+func frameEqual(a *Frame, b *Frame) bool {
+	return a.Version == b.Version && a.Type == b.Type && a.Flags == b.Flags && a.FileID == b.FileID &&
+		a.FrameID == b.FrameID && a.Offset == b.Offset && bytes.Equal(a.Buf, b.Buf)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	large := make([]byte, 3*readFrameStep+1)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	v0 := &Frame{Version: Version0, Type: TypeData, FileID: 2, FrameID: 1<<32 - 1, Buf: []byte("v0 data")}
+	v0Last := &Frame{Version: Version0, Type: TypeData, Flags: FlagLast, FileID: 2, FrameID: 3}
+	v1 := NewFrame(1<<32-1, 1<<40, large)
+	v1.Offset = 1 << 50
+	v1.Flags = FlagCompressed | FlagEncrypted
+	frames := []*Frame{
+		v0,
+		v0Last,
+		v1,
+		NewLastFrame(1, 5, 1000),
+		NewErrorFrame(CodeCanceled, "canceled by user"),
+		{Version: Version1, Type: TypeControl, Buf: []byte("control")},
+	}
+
+	conn := &bufConn{}
+	fs := NewFrameStream(conn)
+	for _, f := range frames {
+		if err := fs.WriteFrame(f); err != nil {
+			t.Fatalf("write frame error: %v", err)
+		}
+	}
+	for i, want := range frames {
+		got, err := fs.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame %d error: %v", i, err)
+		}
+		if !frameEqual(got, want) {
+			t.Fatalf("frame %d is changed: %+v, want %+v", i, got, want)
+		}
+	}
+	if !v0Last.IsLast() || !frames[3].IsLast() || v0.IsLast() || v1.IsLast() {
+		t.Fatalf("last frames are not recognized")
+	}
+	if rerr := frames[4].Err(); rerr.Code != CodeCanceled || rerr.Reason != "canceled by user" {
+		t.Fatalf("error frame is %+v", rerr)
+	}
+	if _, err := fs.ReadFrame(); err != io.EOF {
+		t.Fatalf("read after all frames returns %v, want EOF", err)
+	}
+}
+
+func TestWriteFrameVersion0Limits(t *testing.T) {
+	fs := NewFrameStream(&bufConn{})
+	for _, f := range []*Frame{
+		{Version: Version0, FrameID: 1 << 32},
+		{Version: Version0, Buf: make([]byte, MaxFrameSizeV0+1)},
+		{Version: Version0, Type: TypeAck},
+		{Version: Version0, Flags: FlagCompressed},
+		{Version: MaxVersion + 1},
+	} {
+		if err := fs.WriteFrame(f); err == nil {
+			t.Fatalf("frame %+v is written", f)
+		}
+	}
+}
+
+func uvarints(values ...uint64) []byte {
+	buf := make([]byte, 0)
+	for _, v := range values {
+		var tmp [binary.MaxVarintLen64]byte
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	return buf
+}
+
+func TestReadMalformedFrame(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		eof  bool
+	}{
+		{"unknown version", []byte{MaxVersion + 1, 0, 0}, false},
+		{"v0 short header", []byte{Version0, 0, 0, 0, 1, 0}, true},
+		{"v0 short payload", []byte{Version0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 4, 'a', 'b'}, true},
+		{"v1 short header", []byte{Version1, TypeData}, true},
+		{"v1 bad varint", append([]byte{Version1, TypeData, 0}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), false},
+		{"v1 large file id", append([]byte{Version1, TypeData, 0}, uvarints(1<<32, 0, 0, 0)...), false},
+		{"v1 too long", append([]byte{Version1, TypeData, 0}, uvarints(1, 0, 0, MaxFrameSizeV1+1)...), false},
+		{"v1 short payload", append(append([]byte{Version1, TypeData, 0}, uvarints(1, 0, 0, MaxFrameSizeV1)...), 'a'), true},
+	}
+	for _, c := range cases {
+		conn := &bufConn{}
+		conn.Write(c.data)
+		_, err := NewFrameStream(conn).ReadFrame()
+		if err == nil {
+			t.Fatalf("%s: malformed frame is read", c.name)
+		}
+		if c.eof && err != io.ErrUnexpectedEOF {
+			t.Fatalf("%s: read returns %v, want unexpected EOF", c.name, err)
+		}
+	}
+}
+
+func TestReadMalformedAck(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"unknown version":  {MaxVersion + 1, 0, 0},
+		"not ack":          append([]byte{Version1, TypeData, 0}, uvarints(1, 1, 1)...),
+		"large file id":    append([]byte{Version1, TypeAck, 0}, uvarints(1<<32, 1, 1)...),
+		"no receiver":      append([]byte{Version1, TypeAck, FlagReceiver}, uvarints(1, 1, 1)...),
+		"long error":       append([]byte{Version1, TypeError, 0, CodeUnknown}, uvarints(maxErrorReasonLen+1)...),
+		"short v0 ack":     {Version0, 0, 0},
+		"short error text": append([]byte{Version1, TypeError, 0, CodeUnknown}, uvarints(10)...),
+	} {
+		conn := &bufConn{}
+		conn.Write(data)
+		if _, err := NewFrameStream(conn).ReadAck(); err == nil {
+			t.Fatalf("%s: malformed ack is read", name)
+		}
+	}
+}
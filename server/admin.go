@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// how long to wait for workers' answers of commands
+const workerCommandTimeout = 10 * time.Second
+
+// runAdmin accepts admin commands, each connection carries one command.
+func (svc *Service) runAdmin(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Warn("admin listener exit: %v", err)
+			return
+		}
+		go svc.handleAdminConn(conn)
+	}
+}
+
+// isLoopbackAddr returns true if only local processes can connect to addr.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAdminToken returns true if token of the admin command is the one we are configured with.
+func (svc *Service) checkAdminToken(conn net.Conn, token string) bool {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(svc.adminToken)) == 1 {
+		return true
+	}
+	log.Warn("[%s] admin command with invalid token", conn.RemoteAddr().String())
+	return false
+}
+
+func (svc *Service) handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rawMsg, err := msg.ReadMsg(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch m := rawMsg.(type) {
+	case *msg.ListWorkers:
+		if !svc.checkAdminToken(conn, m.Token) {
+			msg.WriteMsg(conn, &msg.ListWorkersResp{Error: "invalid admin token"})
+			return
+		}
+		msg.WriteMsg(conn, &msg.ListWorkersResp{
+			Workers: svc.workerGroup.ListWorkers(),
+		})
+	case *msg.ManageWorkers:
+		if !svc.checkAdminToken(conn, m.Token) {
+			msg.WriteMsg(conn, &msg.ManageWorkersResp{Error: "invalid admin token"})
+			return
+		}
+		log.Info("[%s] admin asks workers %v to [%s]", conn.RemoteAddr().String(), m.Workers, m.Command.Action)
+		msg.WriteMsg(conn, &msg.ManageWorkersResp{
+			Results: svc.manageWorkers(m),
+		})
+	}
+}
+
+// manageWorkers pushes the command to workers at the same time and collects their answers.
+func (svc *Service) manageWorkers(m *msg.ManageWorkers) []msg.WorkerResult {
+	workers, notFound := svc.workerGroup.GetWorkers(m.Workers)
+
+	results := make([]msg.WorkerResult, len(workers))
+	var wait sync.WaitGroup
+	for i, w := range workers {
+		wait.Add(1)
+		go func(i int, w *Worker) {
+			defer wait.Done()
+			results[i].Addr = w.PublicAddr()
+			if err := w.SendCommand(m.Command, workerCommandTimeout); err != nil {
+				log.Warn("[%s] command [%s] error: %v", w.PublicAddr(), m.Command.Action, err)
+				results[i].Error = err.Error()
+			}
+		}(i, w)
+	}
+	wait.Wait()
+
+	for _, addr := range notFound {
+		results = append(results, msg.WorkerResult{
+			Addr:  addr,
+			Error: "worker not found",
+		})
+	}
+	return results
+}
+
+func requestAdmin(adminAddr string, m msg.Message) (msg.Message, error) {
+	conn, err := net.DialTimeout("tcp", adminAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = msg.WriteMsg(conn, m); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(workerCommandTimeout + 5*time.Second))
+	return msg.ReadMsg(conn)
+}
+
+// RequestListWorkers asks the server listening admin commands on adminAddr for all workers.
+func RequestListWorkers(adminAddr string, token string) ([]msg.WorkerInfo, error) {
+	raw, err := requestAdmin(adminAddr, &msg.ListWorkers{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	m, ok := raw.(*msg.ListWorkersResp)
+	if !ok {
+		return nil, fmt.Errorf("read ListWorkersResp format error")
+	}
+	if m.Error != "" {
+		return nil, fmt.Errorf(m.Error)
+	}
+	return m.Workers, nil
+}
+
+// RequestManageWorkers asks the server listening admin commands on adminAddr to push the command to workers,
+// or all workers if workers is empty. It returns the result of each worker.
+func RequestManageWorkers(adminAddr string, token string, workers []string, command msg.WorkerCommand) ([]msg.WorkerResult, error) {
+	raw, err := requestAdmin(adminAddr, &msg.ManageWorkers{
+		Workers: workers,
+		Command: command,
+		Token:   token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m, ok := raw.(*msg.ManageWorkersResp)
+	if !ok {
+		return nil, fmt.Errorf("read ManageWorkersResp format error")
+	}
+	if m.Error != "" {
+		return nil, fmt.Errorf(m.Error)
+	}
+	return m.Results, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:7000": true,
+		"127.1.2.3:7000": true,
+		"[::1]:7000":     true,
+		"localhost:7000": true,
+		":7000":          false,
+		"0.0.0.0:7000":   false,
+		"[::]:7000":      false,
+		"10.0.0.1:7000":  false,
+		"example.com:70": false,
+		"127.0.0.1":      false,
+	}
+	for addr, expect := range tests {
+		if isLoopbackAddr(addr) != expect {
+			t.Fatalf("%s: expect loopback %v", addr, expect)
+		}
+	}
+}
+
+func TestCheckAdminOptions(t *testing.T) {
+	op := Options{
+		MailboxRetentionHours: 1,
+		MaxWaitSeconds:        1,
+		AdminAddr:             "0.0.0.0:7000",
+	}
+	if err := op.Check(); err == nil {
+		t.Fatalf("public admin_addr without admin_token: expect error")
+	}
+	op.AdminToken = "token"
+	if err := op.Check(); err != nil {
+		t.Fatal(err)
+	}
+	op.AdminAddr, op.AdminToken = "127.0.0.1:7000", ""
+	if err := op.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminInvalidToken(t *testing.T) {
+	svc := &Service{adminToken: "token"}
+	for _, m := range []msg.Message{
+		&msg.ListWorkers{},
+		&msg.ListWorkers{Token: "wrong"},
+		&msg.ManageWorkers{Token: "toke"},
+	} {
+		server, client := net.Pipe()
+		go svc.handleAdminConn(server)
+		go msg.WriteMsg(client, m)
+		raw, err := msg.ReadMsg(client)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch resp := raw.(type) {
+		case *msg.ListWorkersResp:
+			if resp.Error == "" {
+				t.Fatalf("list workers with invalid token")
+			}
+		case *msg.ManageWorkersResp:
+			if resp.Error == "" {
+				t.Fatalf("manage workers with invalid token")
+			}
+		default:
+			t.Fatalf("unexpected response %T", raw)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// Mailbox is a file uploaded to storage workers, receiver can get it by ID before it expires.
+type Mailbox struct {
+	id           string
+	capabilities []string
+	filename     string
+	fsize        int64
+	chunkSize    int64
+	workers      []string
+	locations    [][]int
+	expireAt     time.Time
+
+	// mailbox is invisible to receivers until sender uploads all chunks
+	committed bool
+}
+
+func NewMailbox(id string, capabilities []string, filename string, fsize int64, chunkSize int64,
+	workers []string, expireAt time.Time) *Mailbox {
+
+	return &Mailbox{
+		id:           id,
+		capabilities: capabilities,
+		filename:     filename,
+		fsize:        fsize,
+		chunkSize:    chunkSize,
+		workers:      workers,
+		expireAt:     expireAt,
+	}
+}
+
+// Locations returns worker addresses of each chunk.
+func (mb *Mailbox) Locations() ([]string, [][]int) {
+	return mb.workers, mb.locations
+}
+
+// newUploadToken returns a random token, only store streams with it can upload chunks of a mailbox.
+func newUploadToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// openMailbox asks workers to accept chunks of mailbox id uploaded with token,
+// addresses of workers which have opened it are returned.
+func openMailbox(workers []*Worker, id string, token string, expireAt time.Time) []string {
+	opened := make([]bool, len(workers))
+	var wait sync.WaitGroup
+	for i, w := range workers {
+		wait.Add(1)
+		go func(i int, w *Worker) {
+			defer wait.Done()
+			err := w.SendCommand(msg.WorkerCommand{
+				Action:      msg.WorkerActionMailbox,
+				Mailbox:     id,
+				UploadToken: token,
+				ExpireAt:    expireAt.Unix(),
+			}, workerCommandTimeout)
+			if err != nil {
+				log.Warn("[%s] open mailbox [%s] error: %v", w.PublicAddr(), id, err)
+				return
+			}
+			opened[i] = true
+		}(i, w)
+	}
+	wait.Wait()
+
+	addrs := make([]string, 0, len(workers))
+	for i, w := range workers {
+		if opened[i] {
+			addrs = append(addrs, w.PublicAddr())
+		}
+	}
+	return addrs
+}
+
+// savedMailbox is a committed mailbox in the file of MailboxStore.
+type savedMailbox struct {
+	ID           string   `json:"id"`
+	Capabilities []string `json:"capabilities"`
+	Filename     string   `json:"filename"`
+	Fsize        int64    `json:"fsize"`
+	ChunkSize    int64    `json:"chunk_size"`
+	Workers      []string `json:"workers"`
+	Locations    [][]int  `json:"locations"`
+	ExpireAt     int64    `json:"expire_at"`
+}
+
+type MailboxStore struct {
+	mailboxes map[string]*Mailbox
+
+	// committed mailboxes are saved in file if it's not empty, so they are kept across restarts
+	file   string
+	saveMu sync.Mutex
+
+	mu sync.RWMutex
+}
+
+func NewMailboxStore(file string) (*MailboxStore, error) {
+	ms := &MailboxStore{
+		mailboxes: make(map[string]*Mailbox),
+		file:      file,
+	}
+	if file != "" {
+		if err := ms.load(); err != nil {
+			return nil, fmt.Errorf("load mailboxes from [%s] error: %v", file, err)
+		}
+	}
+	return ms, nil
+}
+
+// Reserve occupies ID for mb until it is committed or removed.
+func (ms *MailboxStore) Reserve(mb *Mailbox) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if old, ok := ms.mailboxes[mb.id]; ok && time.Now().Before(old.expireAt) {
+		return fmt.Errorf("id [%s] is already used by another mailbox", mb.id)
+	}
+	ms.mailboxes[mb.id] = mb
+	return nil
+}
+
+func (ms *MailboxStore) Commit(mb *Mailbox, locations [][]int) error {
+	chunks := int((mb.fsize + mb.chunkSize - 1) / mb.chunkSize)
+	if len(locations) != chunks {
+		return fmt.Errorf("mailbox should have %d chunks, got %d", chunks, len(locations))
+	}
+	for i, locs := range locations {
+		if len(locs) == 0 {
+			return fmt.Errorf("chunk %d isn't stored on any worker", i)
+		}
+		for _, idx := range locs {
+			if idx < 0 || idx >= len(mb.workers) {
+				return fmt.Errorf("chunk %d has invalid worker index %d", i, idx)
+			}
+		}
+	}
+
+	ms.mu.Lock()
+	if ms.mailboxes[mb.id] != mb {
+		ms.mu.Unlock()
+		return fmt.Errorf("mailbox [%s] is expired", mb.id)
+	}
+	mb.locations = locations
+	mb.committed = true
+	ms.mu.Unlock()
+
+	// receiver can still get it before ffts restarts, so it's not an error
+	if err := ms.Save(); err != nil {
+		log.Warn("save mailboxes to [%s] error: %v", ms.file, err)
+	}
+	return nil
+}
+
+func (ms *MailboxStore) Remove(mb *Mailbox) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.mailboxes[mb.id] == mb {
+		delete(ms.mailboxes, mb.id)
+	}
+}
+
+// Get returns a committed mailbox which is not expired.
+func (ms *MailboxStore) Get(id string) (*Mailbox, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	mb, ok := ms.mailboxes[id]
+	if !ok || !mb.committed || time.Now().After(mb.expireAt) {
+		return nil, false
+	}
+	return mb, true
+}
+
+// Run removes expired mailboxes periodically, their chunks are deleted by workers.
+func (ms *MailboxStore) Run() {
+	for {
+		time.Sleep(time.Minute)
+
+		now := time.Now()
+		changed := false
+		ms.mu.Lock()
+		for id, mb := range ms.mailboxes {
+			if now.After(mb.expireAt) {
+				delete(ms.mailboxes, id)
+				changed = changed || mb.committed
+				log.Info("mailbox [%s] expired", id)
+			}
+		}
+		ms.mu.Unlock()
+
+		if changed {
+			if err := ms.Save(); err != nil {
+				log.Warn("save mailboxes to [%s] error: %v", ms.file, err)
+			}
+		}
+	}
+}
+
+// Save writes committed mailboxes to file, they are loaded after restarting if not expired.
+func (ms *MailboxStore) Save() error {
+	if ms.file == "" {
+		return nil
+	}
+	ms.saveMu.Lock()
+	defer ms.saveMu.Unlock()
+
+	saved := make([]savedMailbox, 0)
+	ms.mu.RLock()
+	for _, mb := range ms.mailboxes {
+		if !mb.committed {
+			continue
+		}
+		saved = append(saved, savedMailbox{
+			ID:           mb.id,
+			Capabilities: mb.capabilities,
+			Filename:     mb.filename,
+			Fsize:        mb.fsize,
+			ChunkSize:    mb.chunkSize,
+			Workers:      mb.workers,
+			Locations:    mb.locations,
+			ExpireAt:     mb.expireAt.Unix(),
+		})
+	}
+	ms.mu.RUnlock()
+
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// a half written file is never loaded
+	tmpFile := ms.file + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, ms.file)
+}
+
+func (ms *MailboxStore) load() error {
+	buf, err := ioutil.ReadFile(ms.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := make([]savedMailbox, 0)
+	if err = json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("parse error: %v", err)
+	}
+
+	now := time.Now()
+	for _, s := range saved {
+		mb := NewMailbox(s.ID, s.Capabilities, s.Filename, s.Fsize, s.ChunkSize, s.Workers, time.Unix(s.ExpireAt, 0))
+		if s.ChunkSize <= 0 || !now.Before(mb.expireAt) {
+			continue
+		}
+		mb.locations = s.Locations
+		mb.committed = true
+		ms.mailboxes[mb.id] = mb
+	}
+	log.Info("load %d mailboxes from [%s]", len(ms.mailboxes), ms.file)
+	return nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMailboxStoreSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffts-mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mailboxes.json")
+
+	ms, err := NewMailboxStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := []string{"1.1.1.1:7778", "2.2.2.2:7778"}
+	committed := NewMailbox("committed", []string{"encryption"}, "a.txt", 10, 4, workers, time.Now().Add(time.Hour))
+	uploading := NewMailbox("uploading", nil, "b.txt", 10, 4, workers, time.Now().Add(time.Hour))
+	for _, mb := range []*Mailbox{committed, uploading} {
+		if err = ms.Reserve(mb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locations := [][]int{{0}, {1}, {0, 1}}
+	if err = ms.Commit(committed, locations); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewMailboxStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, ok := loaded.Get("committed")
+	if !ok {
+		t.Fatalf("committed mailbox is not loaded")
+	}
+	if mb.filename != "a.txt" || mb.fsize != 10 || mb.chunkSize != 4 || mb.expireAt.Unix() != committed.expireAt.Unix() ||
+		!reflect.DeepEqual(mb.capabilities, committed.capabilities) {
+		t.Fatalf("loaded mailbox %+v is different from %+v", mb, committed)
+	}
+	if addrs, locs := mb.Locations(); !reflect.DeepEqual(addrs, workers) || !reflect.DeepEqual(locs, locations) {
+		t.Fatalf("loaded locations %v %v", addrs, locs)
+	}
+	// uploading mailbox is lost with the sender's connection
+	if _, ok = loaded.mailboxes["uploading"]; ok {
+		t.Fatalf("uncommitted mailbox is loaded")
+	}
+	// ID is still used after restarting
+	if err = loaded.Reserve(NewMailbox("committed", nil, "c.txt", 1, 1, workers, time.Now().Add(time.Hour))); err == nil {
+		t.Fatalf("ID of loaded mailbox is reserved again")
+	}
+}
+
+func TestMailboxStoreLoadExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffts-mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mailboxes.json")
+
+	content := `[{"id":"old","filename":"a.txt","fsize":1,"chunk_size":1,"workers":["1.1.1.1:7778"],"locations":[[0]],"expire_at":1}]`
+	if err = ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := NewMailboxStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.mailboxes) != 0 {
+		t.Fatalf("expired mailbox is loaded")
+	}
+
+	if err = ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewMailboxStore(file); err == nil {
+		t.Fatalf("broken file: expect error")
+	}
+}
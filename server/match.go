@@ -5,102 +5,511 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// vars instead of consts so tests don't wait that long
+var (
+	keepAliveInterval = 10 * time.Second
+
+	// how long to wait for the pong of the last ping after KeepAlive is stopped
+	keepAliveStopTimeout = 10 * time.Second
 )
 
 type SendConn struct {
-	id         string
-	conn       net.Conn
-	filename   string
-	fsize      int64
-	cacheCount int64
+	id           string
+	conn         net.Conn
+	capabilities []string
+	filename     string
+	fsize        int64
+	frameSize    int64
+	cacheCount   int64
+
+	// -1 means any number of receivers until timeout
+	maxReceivers int64
+	matched      []*RecvConn
+	fullCh       chan struct{}
+
+	// no more receivers can be matched after started
+	started bool
+
+	// receivers serve chunks to each other, session is created after they are matched
+	swarm   bool
+	session *SwarmSession
+
+	// receiver's signature is relayed to sender after respCh is closed, when sender has got SendFileResp
+	delta  bool
+	respCh chan struct{}
+
+	// sender's manifest or chunk hashes are relayed to receiver and receiver's requests are relayed back
+	sync  bool
+	dedup bool
 
-	recvConnCh chan *RecvConn
+	// offer shown to receiver
+	files       int64
+	fingerprint string
+
+	// receiver's answer to the offer is relayed to sender before anything else, accepted is set before answerCh is closed
+	consent         bool
+	accepted        bool
+	answerCh        chan struct{}
+	protocolVersion int64
+
+	// decided by sender's handler before receivers are notified
+	agreed   []string
+	required []string
+
+	// workers are replaced if clients lose paths to some of them in transfer,
+	// or follow workers registering and leaving if clients support membership events.
+	// Lost workers are not used again until they leave.
+	workers         []string
+	lost            []string
+	generation      int64
+	workersMu       sync.Mutex
+	workersNotifier *notifier
 }
 
-func NewSendConn(id string, conn net.Conn, filename string, fsize int64, cacheCount int64) *SendConn {
+func NewSendConn(id string, conn net.Conn, capabilities []string, filename string,
+	fsize int64, frameSize int64, cacheCount int64, maxReceivers int64) *SendConn {
+
+	if maxReceivers == 0 {
+		maxReceivers = 1
+	}
 	return &SendConn{
-		id:         id,
-		conn:       conn,
-		filename:   filename,
-		fsize:      fsize,
-		cacheCount: cacheCount,
-		recvConnCh: make(chan *RecvConn),
+		id:           id,
+		conn:         conn,
+		capabilities: capabilities,
+		filename:     filename,
+		fsize:        fsize,
+		frameSize:    frameSize,
+		cacheCount:   cacheCount,
+		maxReceivers: maxReceivers,
+		matched:      make([]*RecvConn, 0),
+		fullCh:       make(chan struct{}),
+		respCh:       make(chan struct{}),
+		answerCh:     make(chan struct{}),
+
+		workersNotifier: newNotifier(),
+	}
+}
+
+func (sc *SendConn) isFull() bool {
+	return sc.maxReceivers > 0 && int64(len(sc.matched)) >= sc.maxReceivers
+}
+
+// Notify tells all matched receivers that sender is ready, or the error if it fails.
+func (sc *SendConn) Notify(err error) {
+	for i, rc := range sc.matched {
+		rc.index = i
+		if err != nil {
+			rc.err = err
+			rc.sendConnCh <- nil
+		} else {
+			rc.sendConnCh <- sc
+		}
+	}
+}
+
+func (sc *SendConn) getWorkers() ([]string, int64) {
+	sc.workersMu.Lock()
+	defer sc.workersMu.Unlock()
+	return sc.workers, sc.generation
+}
+
+// refreshWorkers replaces workers by available ones except lost if the client knows the latest generation,
+// otherwise the latest list is returned, so sender and receivers asking one after another get the same list.
+func (sc *SendConn) refreshWorkers(generation int64, lost []string, available []string) ([]string, int64) {
+	sc.workersMu.Lock()
+	defer sc.workersMu.Unlock()
+	if generation == sc.generation {
+		for _, addr := range lost {
+			if !containsString(sc.lost, addr) {
+				sc.lost = append(sc.lost, addr)
+			}
+		}
+		workers := make([]string, 0, len(available))
+		for _, addr := range available {
+			if !containsString(sc.lost, addr) {
+				workers = append(workers, addr)
+			}
+		}
+		sc.workers = workers
+		sc.generation++
+		sc.workersNotifier.Notify()
+	}
+	return sc.workers, sc.generation
+}
+
+// syncWorkers drops workers which have left and adds new available ones, generation is increased if it's changed.
+func (sc *SendConn) syncWorkers(available []string) {
+	sc.workersMu.Lock()
+	defer sc.workersMu.Unlock()
+
+	// a lost worker can be used again after it registers again
+	lost := make([]string, 0, len(sc.lost))
+	for _, addr := range sc.lost {
+		if containsString(available, addr) {
+			lost = append(lost, addr)
+		}
 	}
+	sc.lost = lost
+
+	workers := make([]string, 0, len(available))
+	for _, addr := range sc.workers {
+		if containsString(available, addr) {
+			workers = append(workers, addr)
+		}
+	}
+	changed := len(workers) != len(sc.workers)
+	for _, addr := range available {
+		if !containsString(workers, addr) && !containsString(sc.lost, addr) {
+			workers = append(workers, addr)
+			changed = true
+		}
+	}
+	if changed {
+		sc.workers = workers
+		sc.generation++
+		sc.workersNotifier.Notify()
+	}
+}
+
+// diffWorkers returns workers in new but not in old, and workers in old but not in new.
+func diffWorkers(old []string, new []string) (added []string, removed []string) {
+	added, removed = make([]string, 0), make([]string, 0)
+	for _, addr := range new {
+		if !containsString(old, addr) {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range old {
+		if !containsString(new, addr) {
+			removed = append(removed, addr)
+		}
+	}
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, tmp := range list {
+		if tmp == s {
+			return true
+		}
+	}
+	return false
 }
 
 type RecvConn struct {
-	id         string
-	conn       net.Conn
-	cacheCount int64
+	id           string
+	conn         net.Conn
+	capabilities []string
+	cacheCount   int64
+
+	// set if matched by a sender which is not started
+	offer *SendConn
+	index int
+	err   error
+
+	// sender or nil with err is sent only once
+	sendConnCh chan *SendConn
+
+	// closed after receiver has got ReceiveFileResp, so sender's messages can be relayed to it
+	respCh chan struct{}
+
+	// closed after receiver's messages are relayed to sender, so server can push messages to sender
+	relayedCh chan struct{}
 }
 
-func NewRecvConn(id string, conn net.Conn, cacheCount int64) *RecvConn {
+func NewRecvConn(id string, conn net.Conn, capabilities []string, cacheCount int64) *RecvConn {
 	return &RecvConn{
-		id:         id,
-		conn:       conn,
-		cacheCount: cacheCount,
+		id:           id,
+		conn:         conn,
+		capabilities: capabilities,
+		cacheCount:   cacheCount,
+		sendConnCh:   make(chan *SendConn, 1),
+		respCh:       make(chan struct{}),
+		relayedCh:    make(chan struct{}),
 	}
 }
 
+// checkReceiver returns an error if rc can't receive file from sc.
+// Some features must be enabled by both ends, otherwise they can't understand each other.
+func checkReceiver(sc *SendConn, rc *RecvConn) error {
+	if msg.HasCapability(sc.capabilities, msg.CapEncryption) != msg.HasCapability(rc.capabilities, msg.CapEncryption) {
+		return fmt.Errorf("end-to-end encryption should be enabled by both sender and receiver with the same key")
+	}
+	if sc.swarm {
+		if !msg.HasCapability(rc.capabilities, msg.CapSwarm) {
+			return fmt.Errorf("sender sends file in swarm mode, please upgrade fft")
+		}
+	} else if sc.maxReceivers != 1 && !msg.HasCapability(rc.capabilities, msg.CapFanout) {
+		return fmt.Errorf("sender sends file to multiple receivers, please upgrade fft")
+	}
+	if sc.sync && !(msg.HasCapability(rc.capabilities, msg.CapSync) && msg.HasCapability(rc.capabilities, msg.CapMultiplexing)) {
+		return fmt.Errorf("sender syncs a directory, please upgrade fft")
+	}
+	return nil
+}
+
+// MatchController pairs sender and receivers with the same ID, whichever comes first waits for the other one.
 type MatchController struct {
-	senders map[string]*SendConn
+	senders   map[string]*SendConn
+	receivers map[string][]*RecvConn
 
 	mu sync.Mutex
 }
 
 func NewMatchController() *MatchController {
 	return &MatchController{
-		senders: make(map[string]*SendConn),
+		senders:   make(map[string]*SendConn),
+		receivers: make(map[string][]*RecvConn),
+	}
+}
+
+// attach should be called with lock held.
+func (mc *MatchController) attach(sc *SendConn, rc *RecvConn) {
+	if err := checkReceiver(sc, rc); err != nil {
+		rc.err = err
+		rc.sendConnCh <- nil
+		return
+	}
+	rc.offer = sc
+	sc.matched = append(sc.matched, rc)
+	if sc.isFull() {
+		close(sc.fullCh)
 	}
 }
 
-// block until there is a same ID recv conn or timeout
-func (mc *MatchController) DealSendConn(sc *SendConn, timeout time.Duration) (cacheCount int64, err error) {
+// DealSendConn returns receivers matched with sc. It returns as soon as sc.maxReceivers receivers come,
+// otherwise it waits until timeout and returns all receivers come before.
+// Waiting is canceled if cancelCh is closed.
+// Caller should call sc.Notify after it's ready for receivers.
+func (mc *MatchController) DealSendConn(sc *SendConn, timeout time.Duration, cancelCh <-chan struct{}) (rcs []*RecvConn, err error) {
 	mc.mu.Lock()
 	if _, ok := mc.senders[sc.id]; ok {
 		mc.mu.Unlock()
 		err = fmt.Errorf("id is repeated")
 		return
 	}
-	mc.senders[sc.id] = sc
-	mc.mu.Unlock()
+	waiting := mc.receivers[sc.id]
+	delete(mc.receivers, sc.id)
+	for _, rc := range waiting {
+		if sc.isFull() {
+			mc.receivers[sc.id] = append(mc.receivers[sc.id], rc)
+			continue
+		}
+		mc.attach(sc, rc)
+	}
+	if !sc.isFull() {
+		mc.senders[sc.id] = sc
+		mc.mu.Unlock()
 
-	select {
-	case rc := <-sc.recvConnCh:
-		cacheCount = rc.cacheCount
-	case <-time.After(timeout):
+		select {
+		case <-sc.fullCh:
+		case <-time.After(timeout):
+		case <-cancelCh:
+			err = fmt.Errorf("sender is closed")
+		}
 		mc.mu.Lock()
-		if tmp, ok := mc.senders[sc.id]; ok && tmp == sc {
+		if mc.senders[sc.id] == sc {
 			delete(mc.senders, sc.id)
 		}
-		mc.mu.Unlock()
-		err = fmt.Errorf("timeout waiting recv conn")
-		return
 	}
-	return
+	sc.started = true
+	rcs = sc.matched
+	mc.mu.Unlock()
+
+	if err == nil && len(rcs) == 0 {
+		err = fmt.Errorf("timeout waiting receiver")
+	}
+	if err != nil {
+		sc.Notify(err)
+		return nil, err
+	}
+	return rcs, nil
 }
 
-func (mc *MatchController) DealRecvConn(rc *RecvConn) (filename string, fsize int64, cacheCount int64, err error) {
+// DealRecvConn returns the sender after it's started, or blocks until a same ID sender comes.
+// Waiting is canceled after timeout or cancelCh is closed.
+func (mc *MatchController) DealRecvConn(rc *RecvConn, timeout time.Duration, cancelCh <-chan struct{}) (sc *SendConn, err error) {
+	mc.mu.Lock()
+	if sc, ok := mc.senders[rc.id]; ok {
+		mc.attach(sc, rc)
+		// following receivers wait for next sender
+		if sc.isFull() {
+			delete(mc.senders, rc.id)
+		}
+	} else {
+		mc.receivers[rc.id] = append(mc.receivers[rc.id], rc)
+	}
+	mc.mu.Unlock()
+
+	select {
+	case sc = <-rc.sendConnCh:
+		if sc == nil {
+			return nil, rc.err
+		}
+		return sc, nil
+	case <-time.After(timeout):
+		err = fmt.Errorf("timeout waiting sender")
+	case <-cancelCh:
+		err = fmt.Errorf("receiver is closed")
+	}
+
 	mc.mu.Lock()
-	sc, ok := mc.senders[rc.id]
-	if ok {
-		delete(mc.senders, rc.id)
+	if rc.offer == nil {
+		if removeRecvConn(mc.receivers, rc) {
+			mc.mu.Unlock()
+			return nil, err
+		}
+	} else if !rc.offer.started {
+		rc.offer.matched = removeFromList(rc.offer.matched, rc)
+		mc.mu.Unlock()
+		return nil, err
 	}
 	mc.mu.Unlock()
 
+	// sender has taken it just now
+	sc = <-rc.sendConnCh
+	if sc == nil {
+		return nil, rc.err
+	}
+	return sc, nil
+}
+
+func removeRecvConn(receivers map[string][]*RecvConn, rc *RecvConn) bool {
+	list, ok := receivers[rc.id]
 	if !ok {
-		err = fmt.Errorf("no target sender")
-		return
+		return false
+	}
+	newList := removeFromList(list, rc)
+	if len(newList) == len(list) {
+		return false
 	}
-	filename = sc.filename
-	fsize = sc.fsize
-	cacheCount = sc.cacheCount
+	if len(newList) == 0 {
+		delete(receivers, rc.id)
+	} else {
+		receivers[rc.id] = newList
+	}
+	return true
+}
+
+func removeFromList(list []*RecvConn, rc *RecvConn) []*RecvConn {
+	newList := make([]*RecvConn, 0, len(list))
+	for _, tmp := range list {
+		if tmp != rc {
+			newList = append(newList, tmp)
+		}
+	}
+	return newList
+}
+
+// KeepAlive pings a client waiting for it's peer, so idle connections won't be killed by middleboxes.
+// It also reads from the client to find out if the client has gone.
+type KeepAlive struct {
+	conn    net.Conn
+	ping    bool
+	stopped bool
+	stopCh  chan struct{}
+	closeCh chan struct{}
+
+	// client answers each ping with a pong, reading stops after pongs of all pings are read
+	pings int64
+	pongs int64
+
+	// closed after readLoop exits
+	readDoneCh chan struct{}
+
+	mu sync.Mutex
+}
+
+// NewKeepAlive starts pinging conn if the client understands pings in waiting.
+// Clients which don't understand pings send nothing in waiting, we don't read from them,
+// so reading can always be stopped by a ping.
+func NewKeepAlive(conn net.Conn, protocolVersion int64) *KeepAlive {
+	ka := &KeepAlive{
+		conn:       conn,
+		ping:       protocolVersion >= msg.ProtocolVersionWaitPing,
+		stopCh:     make(chan struct{}),
+		closeCh:    make(chan struct{}),
+		readDoneCh: make(chan struct{}),
+	}
+	if ka.ping {
+		go ka.readLoop()
+		go ka.pingLoop(keepAliveInterval)
+	} else {
+		close(ka.readDoneCh)
+	}
+	return ka
+}
+
+func (ka *KeepAlive) readLoop() {
+	defer close(ka.readDoneCh)
+	for {
+		m, err := msg.ReadMsg(ka.conn)
+		if err != nil {
+			close(ka.closeCh)
+			return
+		}
+		if _, ok := m.(*msg.Pong); !ok {
+			ka.conn.Close()
+			continue
+		}
+
+		ka.mu.Lock()
+		ka.pongs++
+		done := ka.stopped && ka.pongs >= ka.pings
+		ka.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (ka *KeepAlive) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ka.stopCh:
+			return
+		}
+
+		ka.mu.Lock()
+		if !ka.stopped {
+			ka.pings++
+			msg.WriteMsg(ka.conn, &msg.Ping{})
+		}
+		ka.mu.Unlock()
+	}
+}
+
+// ClosedCh is closed if the client has gone.
+func (ka *KeepAlive) ClosedCh() <-chan struct{} {
+	return ka.closeCh
+}
+
+// Stop stops pinging and reading, it's safe to read from and write to conn after Stop returns.
+// A last ping is sent, reading stops after it's pong, so no message is cut in the middle.
+// Conn is closed if the client doesn't answer in time.
+func (ka *KeepAlive) Stop() {
+	ka.mu.Lock()
+	if !ka.stopped {
+		ka.stopped = true
+		close(ka.stopCh)
+		if ka.ping {
+			ka.pings++
+			msg.WriteMsg(ka.conn, &msg.Ping{})
+		}
+	}
+	ka.mu.Unlock()
 
 	select {
-	case sc.recvConnCh <- rc:
-	default:
-		err = fmt.Errorf("no target sender")
-		return
+	case <-ka.readDoneCh:
+	case <-time.After(keepAliveStopTimeout):
+		ka.conn.Close()
+		<-ka.readDoneCh
 	}
-	return
 }
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// answerPings replies pongs like a waiting client until it gets a message other than ping.
+func answerPings(conn net.Conn, ch chan<- msg.Message) {
+	for {
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			close(ch)
+			return
+		}
+		if _, ok := raw.(*msg.Ping); ok {
+			msg.WriteMsg(conn, &msg.Pong{})
+			continue
+		}
+		ch <- raw
+		return
+	}
+}
+
+func TestKeepAliveStop(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	ch := make(chan msg.Message, 1)
+	go answerPings(client, ch)
+
+	ka := NewKeepAlive(server, msg.ProtocolVersion)
+	stopped := make(chan struct{})
+	go func() {
+		ka.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop doesn't return after the last pong")
+	}
+
+	// conn is owned by the caller again, nothing is left unread by KeepAlive
+	go msg.WriteMsg(server, &msg.SendFileResp{ID: "abc"})
+	m, ok := (<-ch).(*msg.SendFileResp)
+	if !ok || m.ID != "abc" {
+		t.Fatalf("client gets %v after keepalive is stopped", m)
+	}
+	go msg.WriteMsg(client, &msg.ReceiveFile{ID: "abc"})
+	raw, err := msg.ReadMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf, ok := raw.(*msg.ReceiveFile); !ok || rf.ID != "abc" {
+		t.Fatalf("server reads %v after keepalive is stopped", raw)
+	}
+
+	select {
+	case <-ka.ClosedCh():
+		t.Fatalf("client is reported as gone")
+	default:
+	}
+}
+
+func TestKeepAliveClientGone(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	ka := NewKeepAlive(server, msg.ProtocolVersion)
+	client.Close()
+	select {
+	case <-ka.ClosedCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client has gone, but ClosedCh is not closed")
+	}
+	ka.Stop()
+}
+
+func TestKeepAlivePings(t *testing.T) {
+	defer func(d time.Duration) { keepAliveInterval = d }(keepAliveInterval)
+	keepAliveInterval = 20 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	pings := make(chan struct{}, 100)
+	go func() {
+		for {
+			raw, err := msg.ReadMsg(client)
+			if err != nil {
+				return
+			}
+			if _, ok := raw.(*msg.Ping); ok {
+				pings <- struct{}{}
+				msg.WriteMsg(client, &msg.Pong{})
+			}
+		}
+	}()
+
+	ka := NewKeepAlive(server, msg.ProtocolVersion)
+	time.Sleep(110 * time.Millisecond)
+	ka.Stop()
+	if n := len(pings); n < 3 {
+		t.Fatalf("client gets %d pings in 5 intervals", n)
+	}
+}
+
+func TestKeepAliveStopTimeout(t *testing.T) {
+	defer func(d time.Duration) { keepAliveStopTimeout = d }(keepAliveStopTimeout)
+	keepAliveStopTimeout = 100 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer server.Close()
+
+	// client reads pings but never answers
+	closedCh := make(chan struct{})
+	go func() {
+		defer close(closedCh)
+		for {
+			if _, err := msg.ReadMsg(client); err != nil {
+				return
+			}
+		}
+	}()
+
+	ka := NewKeepAlive(server, msg.ProtocolVersion)
+	start := time.Now()
+	ka.Stop()
+	if elapsed := time.Since(start); elapsed < keepAliveStopTimeout {
+		t.Fatalf("Stop returns in %s without the last pong", elapsed)
+	}
+	select {
+	case <-closedCh:
+	case <-time.After(time.Second):
+		t.Fatalf("conn is not closed after client doesn't answer the last ping")
+	}
+}
+
+func TestKeepAliveUnexpectedMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ka := NewKeepAlive(server, msg.ProtocolVersion)
+	go msg.WriteMsg(client, &msg.ReceiveFile{ID: "abc"})
+	select {
+	case <-ka.ClosedCh():
+	case <-time.After(time.Second):
+		t.Fatalf("conn is not closed after client sends a message other than pong")
+	}
+	ka.Stop()
+}
+
+func TestKeepAliveLegacyClient(t *testing.T) {
+	defer func(d time.Duration) { keepAliveInterval = d }(keepAliveInterval)
+	keepAliveInterval = 10 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// clients which don't understand pings get nothing, and nothing is read from them
+	ka := NewKeepAlive(server, msg.ProtocolVersionWaitPing-1)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("legacy client gets a ping: %v", err)
+	}
+	ka.Stop()
+
+	go msg.WriteMsg(client, &msg.ReceiveFile{ID: "abc"})
+	raw, err := msg.ReadMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw.(*msg.ReceiveFile); !ok {
+		t.Fatalf("server reads %T after keepalive is stopped", raw)
+	}
+}
+
+// waitReceivers waits until n receivers of id are waiting for a sender.
+func waitReceivers(t *testing.T, mc *MatchController, id string, n int) {
+	for i := 0; i < 100; i++ {
+		mc.mu.Lock()
+		waiting := len(mc.receivers[id])
+		mc.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d receivers are not waiting", n)
+}
+
+type dealResult struct {
+	sc  *SendConn
+	err error
+}
+
+func dealRecv(mc *MatchController, rc *RecvConn, timeout time.Duration) <-chan dealResult {
+	ch := make(chan dealResult, 1)
+	go func() {
+		sc, err := mc.DealRecvConn(rc, timeout, nil)
+		ch <- dealResult{sc, err}
+	}()
+	return ch
+}
+
+func TestMatchMultipleReceivers(t *testing.T) {
+	mc := NewMatchController()
+	caps := []string{msg.CapFanout}
+
+	// one receiver comes before sender and one after
+	r1 := NewRecvConn("abc", nil, caps, 10)
+	ch1 := dealRecv(mc, r1, 5*time.Second)
+	waitReceivers(t, mc, "abc", 1)
+
+	sc := NewSendConn("abc", nil, caps, "a.txt", 100, 10, 10, 2)
+	type sendResult struct {
+		rcs []*RecvConn
+		err error
+	}
+	sendCh := make(chan sendResult, 1)
+	start := time.Now()
+	go func() {
+		rcs, err := mc.DealSendConn(sc, 5*time.Second, nil)
+		sendCh <- sendResult{rcs, err}
+	}()
+	r2 := NewRecvConn("abc", nil, caps, 10)
+	ch2 := dealRecv(mc, r2, 5*time.Second)
+
+	// sender doesn't wait for timeout after all receivers come
+	res := <-sendCh
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.rcs) != 2 || time.Since(start) > time.Second {
+		t.Fatalf("sender gets %d receivers in %s, expect 2 at once", len(res.rcs), time.Since(start))
+	}
+
+	// a receiver after sender is full waits for the next sender
+	r3 := NewRecvConn("abc", nil, caps, 10)
+	ch3 := dealRecv(mc, r3, 100*time.Millisecond)
+
+	sc.Notify(nil)
+	for _, ch := range []<-chan dealResult{ch1, ch2} {
+		if res := <-ch; res.err != nil || res.sc != sc {
+			t.Fatalf("receiver gets sender %v, error %v", res.sc, res.err)
+		}
+	}
+	if r1.index == r2.index {
+		t.Fatalf("receivers have the same index %d", r1.index)
+	}
+	if res := <-ch3; res.err == nil {
+		t.Fatalf("receiver after sender is full is matched")
+	}
+	mc.mu.Lock()
+	waiting := len(mc.receivers["abc"])
+	mc.mu.Unlock()
+	if waiting != 0 {
+		t.Fatalf("%d receivers are still waiting after timeout", waiting)
+	}
+}
+
+func TestMatchReceiverWithoutFanout(t *testing.T) {
+	mc := NewMatchController()
+	sc := NewSendConn("abc", nil, []string{msg.CapFanout}, "a.txt", 100, 10, 10, 2)
+	sendCh := make(chan error, 1)
+	go func() {
+		_, err := mc.DealSendConn(sc, 200*time.Millisecond, nil)
+		sendCh <- err
+	}()
+
+	// receivers which can't receive from fanout workers are refused at once
+	rc := NewRecvConn("abc", nil, nil, 10)
+	for i := 0; i < 100; i++ {
+		mc.mu.Lock()
+		_, ok := mc.senders["abc"]
+		mc.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res := <-dealRecv(mc, rc, 5*time.Second); res.err == nil {
+		t.Fatalf("receiver without fanout capability is matched")
+	}
+	if err := <-sendCh; err == nil {
+		t.Fatalf("sender gets no error without receivers")
+	}
+}
+
+func TestMatchReceiversUntilTimeout(t *testing.T) {
+	mc := NewMatchController()
+	caps := []string{msg.CapFanout}
+
+	chs := make([]<-chan dealResult, 0)
+	for i := 0; i < 3; i++ {
+		chs = append(chs, dealRecv(mc, NewRecvConn("abc", nil, caps, 10), 5*time.Second))
+	}
+	waitReceivers(t, mc, "abc", 3)
+
+	// any number of receivers are matched until timeout
+	sc := NewSendConn("abc", nil, caps, "a.txt", 100, 10, 10, -1)
+	start := time.Now()
+	rcs, err := mc.DealSendConn(sc, 200*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcs) != 3 || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("sender gets %d receivers in %s, expect 3 after timeout", len(rcs), time.Since(start))
+	}
+	sc.Notify(nil)
+	for _, ch := range chs {
+		if res := <-ch; res.err != nil || res.sc != sc {
+			t.Fatalf("receiver gets sender %v, error %v", res.sc, res.err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// priorityRule matches a transfer by the client's network or a pattern of it's ID.
+type priorityRule struct {
+	network   *net.IPNet
+	idPattern string
+	priority  string
+}
+
+func (r *priorityRule) match(ip net.IP, id string) bool {
+	if r.network != nil {
+		return ip != nil && r.network.Contains(ip)
+	}
+	ok, _ := path.Match(r.idPattern, id)
+	return ok
+}
+
+// PriorityRules decides priority classes of transfers, the first matched rule is used.
+type PriorityRules []priorityRule
+
+// ParsePriorityRules parses rules separated by ';', each one is like "10.0.0.0/8=high" or "id:backup-*=low".
+// IDs are matched by shell patterns.
+func ParsePriorityRules(s string) (PriorityRules, error) {
+	rules := make(PriorityRules, 0)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.LastIndex(item, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid priority rule [%s]: priority is required", item)
+		}
+		r := priorityRule{
+			priority: strings.TrimSpace(item[eq+1:]),
+		}
+		switch r.priority {
+		case msg.PriorityHigh, msg.PriorityNormal, msg.PriorityLow:
+		default:
+			return nil, fmt.Errorf("invalid priority rule [%s]: unknown priority [%s]", item, r.priority)
+		}
+
+		cond := strings.TrimSpace(item[:eq])
+		if strings.HasPrefix(cond, "id:") {
+			r.idPattern = cond[len("id:"):]
+			if _, err := path.Match(r.idPattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid priority rule [%s]: %v", item, err)
+			}
+		} else {
+			if !strings.Contains(cond, "/") {
+				if strings.Contains(cond, ":") {
+					cond += "/128"
+				} else {
+					cond += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(cond)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority rule [%s]: invalid network", item)
+			}
+			r.network = network
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Priority returns the priority class of a transfer sent from conn.
+func (rules PriorityRules) Priority(conn net.Conn, id string) string {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+	for i := range rules {
+		if rules[i].match(ip, id) {
+			return rules[i].priority
+		}
+	}
+	return msg.PriorityNormal
+}
+
+// pushPriority tells all workers the priority class of a transfer, workers use normal one by default.
+// Transfers don't wait for it, flows get the priority after workers receive it.
+func (svc *Service) pushPriority(conn net.Conn, id string) {
+	priority := svc.priorityRules.Priority(conn, id)
+	if priority == msg.PriorityNormal {
+		return
+	}
+	log.Debug("transfer [%s] priority [%s]", id, priority)
+
+	workers, _ := svc.workerGroup.GetWorkers(nil)
+	for _, w := range workers {
+		if w.protocolVersion < msg.ProtocolVersionPriority {
+			continue
+		}
+		go func(w *Worker) {
+			err := w.SendCommand(msg.WorkerCommand{
+				Action:   msg.WorkerActionPriority,
+				Transfer: id,
+				Priority: priority,
+			}, workerCommandTimeout)
+			if err != nil {
+				log.Warn("[%s] set priority of transfer [%s] error: %v", w.PublicAddr(), id, err)
+			}
+		}(w)
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+
+	gio "github.com/fatedier/golib/io"
+)
+
+const (
+	// idle work connections kept for each reverse worker, more are closed
+	maxPoolWorkConns = 64
+
+	// how long a client connection waits for a work connection
+	workConnTimeout = 10 * time.Second
+)
+
+// ReverseManager serves workers behind NAT. Each of them gets a port in range, client connections to the port
+// are relayed through work connections the worker dials to server.
+type ReverseManager struct {
+	bindHost   string
+	publicHost string
+	minPort    int
+	maxPort    int
+
+	// endpoints by run ID, ports in use
+	endpoints map[string]*ReverseEndpoint
+	ports     map[int]struct{}
+	mu        sync.Mutex
+}
+
+// NewReverseManager listens on ports like "7800-7899" of bindHost, clients connect to them through publicHost.
+func NewReverseManager(bindHost string, publicHost string, ports string) (*ReverseManager, error) {
+	rm := &ReverseManager{
+		bindHost:   bindHost,
+		publicHost: publicHost,
+		endpoints:  make(map[string]*ReverseEndpoint),
+		ports:      make(map[int]struct{}),
+	}
+	var err error
+	items := strings.Split(ports, "-")
+	if rm.minPort, err = strconv.Atoi(strings.TrimSpace(items[0])); err != nil {
+		return nil, fmt.Errorf("invalid port range [%s]", ports)
+	}
+	rm.maxPort = rm.minPort
+	if len(items) == 2 {
+		if rm.maxPort, err = strconv.Atoi(strings.TrimSpace(items[1])); err != nil {
+			return nil, fmt.Errorf("invalid port range [%s]", ports)
+		}
+	}
+	if len(items) > 2 || rm.minPort <= 0 || rm.maxPort > 65535 || rm.minPort > rm.maxPort {
+		return nil, fmt.Errorf("invalid port range [%s]", ports)
+	}
+	return rm, nil
+}
+
+// Listen gives worker a free port, it's closed after the worker is disconnected.
+func (rm *ReverseManager) Listen(w *Worker) (*ReverseEndpoint, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for port := rm.minPort; port <= rm.maxPort; port++ {
+		if _, ok := rm.ports[port]; ok {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(rm.bindHost, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		ep := &ReverseEndpoint{
+			rm:         rm,
+			runID:      hex.EncodeToString(buf),
+			port:       port,
+			publicAddr: net.JoinHostPort(rm.publicHost, strconv.Itoa(port)),
+			l:          l,
+			worker:     w,
+			workConnCh: make(chan net.Conn, maxPoolWorkConns),
+			closeCh:    make(chan struct{}),
+		}
+		rm.ports[port] = struct{}{}
+		rm.endpoints[ep.runID] = ep
+		go ep.run()
+		return ep, nil
+	}
+	return nil, fmt.Errorf("no available reverse ports")
+}
+
+// PutWorkConn adds a work connection to the pool of the worker with runID.
+func (rm *ReverseManager) PutWorkConn(runID string, conn net.Conn) error {
+	rm.mu.Lock()
+	ep, ok := rm.endpoints[runID]
+	rm.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown run id")
+	}
+	return ep.putWorkConn(conn)
+}
+
+func (rm *ReverseManager) remove(ep *ReverseEndpoint) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.endpoints[ep.runID] == ep {
+		delete(rm.endpoints, ep.runID)
+		delete(rm.ports, ep.port)
+	}
+}
+
+// ReverseEndpoint is the port of a reverse worker and it's idle work connections.
+type ReverseEndpoint struct {
+	rm         *ReverseManager
+	runID      string
+	port       int
+	publicAddr string
+	l          net.Listener
+	worker     *Worker
+
+	workConnCh chan net.Conn
+	closeCh    chan struct{}
+	closed     bool
+	mu         sync.Mutex
+}
+
+func (ep *ReverseEndpoint) run() {
+	for {
+		conn, err := ep.l.Accept()
+		if err != nil {
+			return
+		}
+		go ep.relay(conn)
+	}
+}
+
+// relay joins a client connection with a work connection, the worker serves it as if the client connected to it.
+func (ep *ReverseEndpoint) relay(conn net.Conn) {
+	defer conn.Close()
+	for {
+		workConn, err := ep.getWorkConn()
+		if err != nil {
+			log.Warn("[%s] get work connection error: %v", ep.publicAddr, err)
+			return
+		}
+		// idle work connections may have been broken
+		if err = msg.WriteMsg(workConn, &msg.StartWorkConn{ClientAddr: conn.RemoteAddr().String()}); err != nil {
+			workConn.Close()
+			continue
+		}
+		gio.Join(conn, workConn)
+		return
+	}
+}
+
+// getWorkConn takes an idle work connection and asks worker for a new one.
+func (ep *ReverseEndpoint) getWorkConn() (net.Conn, error) {
+	var conn net.Conn
+	select {
+	case conn = <-ep.workConnCh:
+	default:
+		msg.WriteMsg(ep.worker.conn, &msg.ReqWorkConn{})
+		select {
+		case conn = <-ep.workConnCh:
+		case <-ep.closeCh:
+			return nil, fmt.Errorf("worker is disconnected")
+		case <-time.After(workConnTimeout):
+			return nil, fmt.Errorf("timeout")
+		}
+	}
+	msg.WriteMsg(ep.worker.conn, &msg.ReqWorkConn{})
+	return conn, nil
+}
+
+func (ep *ReverseEndpoint) putWorkConn(conn net.Conn) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.closed {
+		return fmt.Errorf("worker is disconnected")
+	}
+	select {
+	case ep.workConnCh <- conn:
+		return nil
+	default:
+		return fmt.Errorf("too many work connections")
+	}
+}
+
+// Close stops accepting clients and closes idle work connections.
+func (ep *ReverseEndpoint) Close() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.closed {
+		return
+	}
+	ep.closed = true
+	close(ep.closeCh)
+	ep.l.Close()
+	ep.rm.remove(ep)
+	for {
+		select {
+		case conn := <-ep.workConnCh:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// freePort returns a port nobody listens on now.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// serveReverseWorker answers each ReqWorkConn with a work connection like a reverse worker,
+// work connections echo what clients send after StartWorkConn. Client addresses are sent to addrCh.
+func serveReverseWorker(rm *ReverseManager, runID func() string, conn net.Conn, addrCh chan<- string) {
+	for {
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			return
+		}
+		if _, ok := raw.(*msg.ReqWorkConn); !ok {
+			continue
+		}
+		server, client := net.Pipe()
+		if err = rm.PutWorkConn(runID(), server); err != nil {
+			server.Close()
+			client.Close()
+			continue
+		}
+		go func() {
+			defer client.Close()
+			raw, err := msg.ReadMsg(client)
+			if err != nil {
+				return
+			}
+			m, ok := raw.(*msg.StartWorkConn)
+			if !ok {
+				return
+			}
+			addrCh <- m.ClientAddr
+			io.Copy(client, client)
+		}()
+	}
+}
+
+func TestNewReverseManager(t *testing.T) {
+	for _, ports := range []string{"", "abc", "0-10", "7800-", "7800-7700", "7800-70000", "1-2-3"} {
+		if _, err := NewReverseManager("127.0.0.1", "127.0.0.1", ports); err == nil {
+			t.Fatalf("port range %q is accepted", ports)
+		}
+	}
+	rm, err := NewReverseManager("127.0.0.1", "127.0.0.1", " 7800 - 7899 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm.minPort != 7800 || rm.maxPort != 7899 {
+		t.Fatalf("port range is %d-%d", rm.minPort, rm.maxPort)
+	}
+}
+
+func TestReverseRelay(t *testing.T) {
+	port := freePort(t)
+	rm, err := NewReverseManager("127.0.0.1", "1.2.3.4", fmt.Sprintf("%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	w := NewWorker(0, "", "", msg.ProtocolVersion, nil, server)
+	ep, err := rm.Listen(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.publicAddr != fmt.Sprintf("1.2.3.4:%d", port) {
+		t.Fatalf("public address is %s", ep.publicAddr)
+	}
+	if _, err = rm.Listen(w); err == nil {
+		t.Fatalf("a port in use is given to another worker")
+	}
+
+	// an idle work connection broken before it's used is skipped
+	broken, brokenPeer := net.Pipe()
+	brokenPeer.Close()
+	if err = rm.PutWorkConn(ep.runID, broken); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.PutWorkConn("unknown", broken); err == nil {
+		t.Fatalf("work connection of an unknown run id is accepted")
+	}
+
+	addrCh := make(chan string, 10)
+	go serveReverseWorker(rm, func() string { return ep.runID }, client, addrCh)
+
+	// client talks to the worker through the endpoint
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("client gets %q", buf)
+		}
+		if addr := <-addrCh; addr != conn.LocalAddr().String() {
+			t.Fatalf("worker is told client address %s, expect %s", addr, conn.LocalAddr())
+		}
+		conn.Close()
+	}
+
+	// port is given back after the worker is disconnected
+	ep.Close()
+	ep.Close()
+	if err = rm.PutWorkConn(ep.runID, broken); err == nil {
+		t.Fatalf("work connection is accepted after the worker is disconnected")
+	}
+	ep2, err := rm.Listen(w)
+	if err != nil {
+		t.Fatalf("port is not given back: %v", err)
+	}
+	if ep2.runID == ep.runID {
+		t.Fatalf("run id is the same after listening again")
+	}
+	ep2.Close()
+}
+
+func TestReverseRelayWorkerGone(t *testing.T) {
+	port := freePort(t)
+	rm, err := NewReverseManager("127.0.0.1", "127.0.0.1", fmt.Sprintf("%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	ep, err := rm.Listen(NewWorker(0, "", "", msg.ProtocolVersion, nil, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// worker doesn't answer ReqWorkConn, client is closed after the worker is disconnected
+	go func() {
+		if _, err := msg.ReadMsg(client); err == nil {
+			ep.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("client reads data without a work connection")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("client is not closed after the worker is disconnected")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/fatedier/fft/pkg/fname"
 	"github.com/fatedier/fft/pkg/log"
 	"github.com/fatedier/fft/pkg/msg"
 )
@@ -18,6 +19,28 @@ import (
 type Options struct {
 	BindAddr string
 
+	// how long files uploaded in mailbox mode are kept
+	MailboxRetentionHours int
+
+	// mailboxes are kept in MailboxFile across restarts if it's not empty
+	MailboxFile string
+
+	// max seconds sender or receiver can wait for each other
+	MaxWaitSeconds int
+
+	// admin commands managing workers are accepted on AdminAddr if it's not empty,
+	// they must carry AdminToken which is required if AdminAddr is not a loopback address
+	AdminAddr  string
+	AdminToken string
+
+	// rules deciding priority classes of transfers like "10.0.0.0/8=high;id:backup-*=low"
+	PriorityRules string
+
+	// workers behind NAT can register as reverse workers if ReversePorts like "7800-7899" is not empty,
+	// clients connect to them through ports of ReverseHost, it's the host of BindAddr by default
+	ReversePorts string
+	ReverseHost  string
+
 	LogFile    string
 	LogLevel   string
 	LogMaxDays int64
@@ -27,6 +50,25 @@ func (op *Options) Check() error {
 	if op.LogMaxDays <= 0 {
 		op.LogMaxDays = 3
 	}
+	if op.MailboxRetentionHours <= 0 {
+		return fmt.Errorf("mailbox_retention should be greater than 0")
+	}
+	if op.MaxWaitSeconds <= 0 {
+		return fmt.Errorf("max_wait should be greater than 0")
+	}
+	if op.ReversePorts != "" && op.ReverseHost == "" {
+		host, _, err := net.SplitHostPort(op.BindAddr)
+		if err != nil {
+			return fmt.Errorf("invalid bind_addr: %v", err)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			return fmt.Errorf("reverse_host is required if bind_addr is not a specified address")
+		}
+		op.ReverseHost = host
+	}
+	if op.AdminAddr != "" && op.AdminToken == "" && !isLoopbackAddr(op.AdminAddr) {
+		return fmt.Errorf("admin_token is required if admin_addr is not a loopback address")
+	}
 	return nil
 }
 
@@ -34,8 +76,17 @@ type Service struct {
 	l               net.Listener
 	workerGroup     *WorkerGroup
 	matchController *MatchController
+	mailboxStore    *MailboxStore
+
+	mailboxRetention time.Duration
+	maxWait          time.Duration
+	tlsConfig        *tls.Config
+	adminAddr        string
+	adminToken       string
+	priorityRules    PriorityRules
 
-	tlsConfig *tls.Config
+	// nil if reverse workers are not accepted
+	reverseManager *ReverseManager
 }
 
 func NewService(options Options) (*Service, error) {
@@ -49,6 +100,24 @@ func NewService(options Options) (*Service, error) {
 	}
 	log.InitLog(logway, options.LogFile, options.LogLevel, options.LogMaxDays)
 
+	priorityRules, err := ParsePriorityRules(options.PriorityRules)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverseManager *ReverseManager
+	if options.ReversePorts != "" {
+		bindHost, _, _ := net.SplitHostPort(options.BindAddr)
+		if reverseManager, err = NewReverseManager(bindHost, options.ReverseHost, options.ReversePorts); err != nil {
+			return nil, err
+		}
+	}
+
+	mailboxStore, err := NewMailboxStore(options.MailboxFile)
+	if err != nil {
+		return nil, err
+	}
+
 	l, err := net.Listen("tcp", options.BindAddr)
 	if err != nil {
 		return nil, err
@@ -59,19 +128,29 @@ func NewService(options Options) (*Service, error) {
 		l:               l,
 		workerGroup:     NewWorkerGroup(),
 		matchController: NewMatchController(),
-		tlsConfig:       generateTLSConfig(),
+		mailboxStore:    mailboxStore,
+
+		mailboxRetention: time.Duration(options.MailboxRetentionHours) * time.Hour,
+		maxWait:          time.Duration(options.MaxWaitSeconds) * time.Second,
+		tlsConfig:        generateTLSConfig(),
+		adminAddr:        options.AdminAddr,
+		adminToken:       options.AdminToken,
+		priorityRules:    priorityRules,
+		reverseManager:   reverseManager,
 	}, nil
 }
 
 func (svc *Service) Run() error {
-	// Debug ========
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			log.Info("worker addrs: %v", svc.workerGroup.GetAvailableWorkerAddrs())
+	go svc.mailboxStore.Run()
+
+	if svc.adminAddr != "" {
+		l, err := net.Listen("tcp", svc.adminAddr)
+		if err != nil {
+			return fmt.Errorf("listen admin address error: %v", err)
 		}
-	}()
-	// Debug ========
+		log.Info("ffts admin listen on: %s", l.Addr().String())
+		go svc.runAdmin(l)
+	}
 
 	for {
 		conn, err := svc.l.Accept()
@@ -102,24 +181,45 @@ func (svc *Service) handleConn(conn net.Conn) {
 		err = svc.handleRegisterWorker(conn, m)
 		if err != nil {
 			msg.WriteMsg(conn, &msg.RegisterWorkerResp{
-				Error: err.Error(),
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
 			})
 			conn.Close()
 		}
 	case *msg.SendFile:
 		if err = svc.handleSendFile(conn, m); err != nil {
 			msg.WriteMsg(conn, &msg.SendFileResp{
-				Error: err.Error(),
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
 			})
 			conn.Close()
 		}
 	case *msg.ReceiveFile:
 		if err = svc.handleRecvFile(conn, m); err != nil {
 			msg.WriteMsg(conn, &msg.ReceiveFileResp{
-				Error: err.Error(),
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
 			})
 			conn.Close()
 		}
+	case *msg.PutMailbox:
+		if err = svc.handlePutMailbox(conn, m); err != nil {
+			msg.WriteMsg(conn, &msg.PutMailboxResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
+			})
+			conn.Close()
+		}
+	case *msg.NewWorkConn:
+		if svc.reverseManager == nil {
+			err = fmt.Errorf("reverse workers are not accepted")
+		} else {
+			err = svc.reverseManager.PutWorkConn(m.RunID, conn)
+		}
+		if err != nil {
+			log.Warn("[%s] new work conn error: %v", conn.RemoteAddr().String(), err)
+			conn.Close()
+		}
 	default:
 		conn.Close()
 		return
@@ -127,15 +227,43 @@ func (svc *Service) handleConn(conn net.Conn) {
 }
 
 func (svc *Service) handleRegisterWorker(conn net.Conn, m *msg.RegisterWorker) error {
-	log.Debug("get register worker: remote addr [%s] port [%d], advice public IP [%s]",
-		conn.RemoteAddr().String(), m.BindPort, m.PublicIP)
-	w := NewWorker(m.BindPort, m.PublicIP, conn)
-	err := w.DetectPublicAddr()
-	if err != nil {
+	log.Debug("get register worker: remote addr [%s] port [%d], advice public IP [%s], version [%s] protocol version [%d]",
+		conn.RemoteAddr().String(), m.BindPort, m.PublicIP, m.Version, m.ProtocolVersion)
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		log.Warn("[%s] register worker error: %v", conn.RemoteAddr().String(), err)
+		return fmt.Errorf("fftw %v", err)
+	}
+
+	w := NewWorker(m.BindPort, m.PublicIP, m.Version, m.ProtocolVersion, m.Capabilities, conn)
+	if m.Reverse {
+		// clients connect to a port of server instead
+		if svc.reverseManager == nil {
+			return fmt.Errorf("reverse workers are not accepted by ffts")
+		}
+		ep, err := svc.reverseManager.Listen(w)
+		if err != nil {
+			log.Warn("[%s] listen for reverse worker error: %v", conn.RemoteAddr().String(), err)
+			return err
+		}
+		w.publicAddr = ep.publicAddr
+		go func() {
+			<-w.closeCh
+			ep.Close()
+		}()
+		msg.WriteMsg(conn, &msg.RegisterWorkerResp{
+			ProtocolVersion: msg.ProtocolVersion,
+			Capabilities:    m.Capabilities,
+			RunID:           ep.runID,
+			PublicAddr:      ep.publicAddr,
+		})
+	} else if err := w.DetectPublicAddr(); err != nil {
 		log.Warn("detect [%s] public address error: %v", conn.RemoteAddr().String(), err)
 		return err
 	} else {
-		msg.WriteMsg(conn, &msg.RegisterWorkerResp{Error: ""})
+		msg.WriteMsg(conn, &msg.RegisterWorkerResp{
+			ProtocolVersion: msg.ProtocolVersion,
+			Capabilities:    m.Capabilities,
+		})
 	}
 
 	svc.workerGroup.RegisterWorker(w)
@@ -144,48 +272,522 @@ func (svc *Service) handleRegisterWorker(conn net.Conn, m *msg.RegisterWorker) e
 }
 
 func (svc *Service) handleSendFile(conn net.Conn, m *msg.SendFile) error {
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return fmt.Errorf("fft %v", err)
+	}
 	if m.ID == "" || m.Name == "" {
 		return fmt.Errorf("id and file name is required")
 	}
-	log.Debug("new SendFile id [%s], filename [%s] size [%d]", m.ID, m.Name, m.Fsize)
+	name, err := fname.CleanName(m.Name)
+	if err != nil {
+		return err
+	}
+	m.Name = name
+	log.Debug("new SendFile id [%s], filename [%s] size [%d] capabilities %v", m.ID, m.Name, m.Fsize, m.Capabilities)
+
+	chunks := 0
+	if m.Swarm {
+		var err error
+		if chunks, err = swarmChunks(m.Fsize, m.FrameSize); err != nil {
+			return err
+		}
+	}
 
-	sc := NewSendConn(m.ID, conn, m.Name, m.Fsize, m.CacheCount)
-	cacheCount, err := svc.matchController.DealSendConn(sc, 120*time.Second)
+	sc := NewSendConn(m.ID, conn, m.Capabilities, m.Name, m.Fsize, m.FrameSize, m.CacheCount, m.MaxReceivers)
+	sc.swarm = m.Swarm
+	sc.delta = m.Delta && !m.Swarm
+	sc.sync = m.Sync
+	sc.dedup = m.Dedup && !m.Swarm && !m.Sync && !sc.delta
+	sc.files = m.Files
+	sc.fingerprint = m.Fingerprint
+	sc.protocolVersion = m.ProtocolVersion
+	if sc.sync && (sc.swarm || sc.maxReceivers != 1) {
+		return fmt.Errorf("directory can only be synced to one receiver")
+	}
+	ka := NewKeepAlive(conn, m.ProtocolVersion)
+	rcs, err := svc.matchController.DealSendConn(sc, svc.waitTimeout(m.WaitTimeout), ka.ClosedCh())
+	ka.Stop()
 	if err != nil {
 		log.Warn("deal send conn error: %v", err)
 		return err
 	}
 
+	// only use features all receivers support, sender waits for the slowest receiver's cache
+	caps := sc.capabilities
+	cacheCount := rcs[0].cacheCount
+	for _, rc := range rcs {
+		caps = msg.IntersectCapabilities(caps, rc.capabilities)
+		if rc.cacheCount < cacheCount {
+			cacheCount = rc.cacheCount
+		}
+	}
+	var required []string
+	if sc.swarm {
+		required = []string{msg.CapSwarm}
+	} else if len(rcs) > 1 {
+		required = []string{msg.CapFanout}
+	}
+	workers := svc.workerGroup.GetAvailableWorkerAddrs(caps, required)
+	if len(workers) == 0 && len(required) > 0 {
+		err = fmt.Errorf("no available workers support %s", required[0])
+		sc.Notify(err)
+		return err
+	}
+	// delta is only against one receiver's file, others get the whole file
+	if len(rcs) > 1 || sc.sync || !msg.HasCapability(caps, msg.CapDelta) {
+		sc.delta = false
+	}
+	// receiver supports dedup only if it has a chunk cache, chunks are sent as files in the same streams
+	if len(rcs) > 1 || !msg.HasCapability(caps, msg.CapDedup) || !msg.HasCapability(caps, msg.CapMultiplexing) {
+		sc.dedup = false
+	}
+	// only one receiver can answer the offer
+	sc.consent = len(rcs) == 1 && !sc.swarm && msg.HasCapability(caps, msg.CapConsent)
+	sc.agreed = caps
+	sc.required = required
+	sc.workers = workers
+	if sc.swarm {
+		sc.session = NewSwarmSession(m.ID, chunks, len(rcs))
+	}
+	sc.Notify(nil)
+	log.Info("ID [%s] matched with %d receivers", m.ID, len(rcs))
+	svc.pushPriority(conn, m.ID)
+
 	msg.WriteMsg(conn, &msg.SendFileResp{
-		ID:         m.ID,
-		Workers:    svc.workerGroup.GetAvailableWorkerAddrs(),
-		CacheCount: cacheCount,
+		ID:              m.ID,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    caps,
+		Workers:         workers,
+		CacheCount:      cacheCount,
+		Receivers:       int64(len(rcs)),
+		Swarm:           sc.swarm,
+		Delta:           sc.delta,
+		Sync:            sc.sync,
+		Dedup:           sc.dedup,
+		Consent:         sc.consent,
 	})
+	close(sc.respCh)
+	if sc.session != nil {
+		svc.runSwarmPeer(conn, sc.session, 0)
+	}
+	if sc.consent {
+		<-sc.answerCh
+		if !sc.accepted {
+			return nil
+		}
+	}
+
+	var isLast func(raw msg.Message) (bool, error)
+	if sc.sync {
+		isLast = func(raw msg.Message) (bool, error) {
+			m, ok := raw.(*msg.SyncManifest)
+			if !ok {
+				return false, fmt.Errorf("unexpected message")
+			}
+			return m.Last, nil
+		}
+	} else if sc.dedup {
+		isLast = func(raw msg.Message) (bool, error) {
+			m, ok := raw.(*msg.DedupChunks)
+			if !ok {
+				return false, fmt.Errorf("unexpected message")
+			}
+			return m.Last, nil
+		}
+	}
+	if isLast != nil {
+		rc := rcs[0]
+		<-rc.respCh
+		if err = relayMessages(conn, rc.conn, time.Minute, isLast); err != nil {
+			log.Warn("ID [%s] relay messages to receiver error: %v", m.ID, err)
+			conn.Close()
+			rc.conn.Close()
+			return nil
+		}
+	}
+	if sc.session == nil {
+		// receiver's messages are relayed through conn, nothing else should be written to it before they are done
+		if sc.delta || sc.sync || sc.dedup {
+			<-rcs[0].relayedCh
+		}
+		svc.serveWorkers(conn, sc, workers)
+	}
 	return nil
 }
 
 func (svc *Service) handleRecvFile(conn net.Conn, m *msg.ReceiveFile) error {
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return fmt.Errorf("fft %v", err)
+	}
 	if m.ID == "" {
 		return fmt.Errorf("id is required")
 	}
-	log.Debug("new ReceiveFile id [%s]", m.ID)
+	log.Debug("new ReceiveFile id [%s] capabilities %v", m.ID, m.Capabilities)
 
-	rc := NewRecvConn(m.ID, conn, m.CacheCount)
-	filename, fsize, cacheCount, err := svc.matchController.DealRecvConn(rc)
+	if mb, ok := svc.mailboxStore.Get(m.ID); ok {
+		return svc.handleRecvMailbox(conn, m, mb)
+	}
+
+	rc := NewRecvConn(m.ID, conn, m.Capabilities, m.CacheCount)
+	ka := NewKeepAlive(conn, m.ProtocolVersion)
+	sc, err := svc.matchController.DealRecvConn(rc, svc.waitTimeout(m.WaitTimeout), ka.ClosedCh())
+	ka.Stop()
 	if err != nil {
 		log.Warn("deal recv conn error: %v", err)
 		return err
 	}
 
+	senderAddr, _, _ := net.SplitHostPort(sc.conn.RemoteAddr().String())
+	workers, _ := sc.getWorkers()
+	msg.WriteMsg(conn, &msg.ReceiveFileResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    sc.agreed,
+		Name:            sc.filename,
+		Fsize:           sc.fsize,
+		FrameSize:       sc.frameSize,
+		Workers:         workers,
+		CacheCount:      sc.cacheCount,
+		Receivers:       int64(len(sc.matched)),
+		ReceiverIndex:   int64(rc.index),
+		Swarm:           sc.session != nil,
+		Delta:           sc.delta,
+		Sync:            sc.sync,
+		Dedup:           sc.dedup,
+		Files:           sc.files,
+		Fingerprint:     sc.fingerprint,
+		SenderAddr:      senderAddr,
+		Consent:         sc.consent,
+	})
+	close(rc.respCh)
+	if sc.session != nil {
+		svc.runSwarmPeer(conn, sc.session, rc.index+1)
+	}
+	if sc.consent {
+		// sender should get SendFileResp before the answer
+		<-sc.respCh
+		if !svc.relayAnswer(conn, sc, svc.waitTimeout(m.WaitTimeout)) {
+			return nil
+		}
+	}
+
+	var isLast func(raw msg.Message) (bool, error)
+	if sc.delta {
+		isLast = func(raw msg.Message) (bool, error) {
+			m, ok := raw.(*msg.DeltaSignature)
+			if !ok {
+				return false, fmt.Errorf("unexpected message")
+			}
+			return m.Last, nil
+		}
+	} else if sc.sync {
+		isLast = func(raw msg.Message) (bool, error) {
+			m, ok := raw.(*msg.SyncRequest)
+			if !ok {
+				return false, fmt.Errorf("unexpected message")
+			}
+			return m.Last, nil
+		}
+	} else if sc.dedup {
+		isLast = func(raw msg.Message) (bool, error) {
+			m, ok := raw.(*msg.DedupRequest)
+			if !ok {
+				return false, fmt.Errorf("unexpected message")
+			}
+			return m.Last, nil
+		}
+	}
+	if isLast != nil {
+		<-sc.respCh
+		// receiver may take a while to read a large file
+		err = relayMessages(conn, sc.conn, 2*time.Minute, isLast)
+		close(rc.relayedCh)
+		if err != nil {
+			log.Warn("ID [%s] relay messages to sender error: %v", m.ID, err)
+			conn.Close()
+			sc.conn.Close()
+			return nil
+		}
+	}
+	if sc.session == nil {
+		svc.serveWorkers(conn, sc, workers)
+	}
+	return nil
+}
+
+// serveWorkers answers GetWorkers from a client in transfer after it loses paths to some workers,
+// and pushes WorkerEvent to it after workers of the transfer are changed if both ends support membership events.
+// known is the list the client has got. It returns after the client closes conn.
+func (svc *Service) serveWorkers(conn net.Conn, sc *SendConn, known []string) {
+	closeCh := make(chan struct{})
+	defer close(closeCh)
+	msgCh := make(chan msg.Message)
+	go func() {
+		defer close(msgCh)
+		for {
+			raw, err := msg.ReadMsg(conn)
+			if err != nil {
+				return
+			}
+			select {
+			case msgCh <- raw:
+			case <-closeCh:
+				return
+			}
+		}
+	}()
+
+	var groupCh, workersCh chan struct{}
+	if msg.HasCapability(sc.agreed, msg.CapMembership) {
+		groupCh = svc.workerGroup.Watch()
+		defer svc.workerGroup.Unwatch(groupCh)
+		workersCh = sc.workersNotifier.Watch()
+		defer sc.workersNotifier.Unwatch(workersCh)
+
+		// workers may be changed before we watch them
+		select {
+		case groupCh <- struct{}{}:
+		default:
+		}
+	}
+
+	_, knownGeneration := sc.getWorkers()
+	for {
+		select {
+		case raw, ok := <-msgCh:
+			if !ok {
+				return
+			}
+			m, ok := raw.(*msg.GetWorkers)
+			if !ok {
+				conn.Close()
+				return
+			}
+			available := svc.workerGroup.GetAvailableWorkerAddrs(sc.agreed, sc.required)
+			workers, generation := sc.refreshWorkers(m.Generation, m.Lost, available)
+			log.Info("ID [%s] lost workers %v, new workers %v generation %d", sc.id, m.Lost, workers, generation)
+			if err := msg.WriteMsg(conn, &msg.GetWorkersResp{
+				Workers:    workers,
+				Generation: generation,
+			}); err != nil {
+				conn.Close()
+				return
+			}
+			known, knownGeneration = workers, generation
+		case <-groupCh:
+			sc.syncWorkers(svc.workerGroup.GetAvailableWorkerAddrs(sc.agreed, sc.required))
+		case <-workersCh:
+			workers, generation := sc.getWorkers()
+			if generation == knownGeneration {
+				continue
+			}
+			added, removed := diffWorkers(known, workers)
+			log.Debug("ID [%s] push workers added %v removed %v generation %d", sc.id, added, removed, generation)
+			if err := msg.WriteMsg(conn, &msg.WorkerEvent{
+				Generation: generation,
+				Added:      added,
+				Removed:    removed,
+			}); err != nil {
+				conn.Close()
+				return
+			}
+			known, knownGeneration = workers, generation
+		}
+	}
+}
+
+// relayAnswer waits for receiver's answer to the offer and forwards it to sender, sender is pinged while waiting.
+// It returns true if receiver accepts the offer.
+func (svc *Service) relayAnswer(conn net.Conn, sc *SendConn, timeout time.Duration) (accepted bool) {
+	defer func() {
+		sc.accepted = accepted
+		close(sc.answerCh)
+	}()
+
+	ka := NewKeepAlive(sc.conn, sc.protocolVersion)
+	answerCh := make(chan *msg.OfferAnswer, 1)
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		raw, err := msg.ReadMsg(conn)
+		conn.SetReadDeadline(time.Time{})
+		answer, ok := raw.(*msg.OfferAnswer)
+		if ne, isNetErr := err.(net.Error); isNetErr && ne.Timeout() {
+			answer = &msg.OfferAnswer{Reason: "receiver doesn't answer the offer in time"}
+		} else if err != nil || !ok {
+			answer = &msg.OfferAnswer{Reason: "receiver has gone without answering the offer"}
+		}
+		answerCh <- answer
+	}()
+
+	var answer *msg.OfferAnswer
+	select {
+	case answer = <-answerCh:
+		ka.Stop()
+	case <-ka.ClosedCh():
+		ka.Stop()
+		// sender has gone, tell receiver by closing it's connection
+		log.Info("ID [%s] sender has gone before receiver answers the offer", sc.id)
+		conn.Close()
+		return false
+	}
+	if !answer.Accept {
+		log.Info("ID [%s] receiver rejects the offer: %s", sc.id, answer.Reason)
+	}
+	msg.WriteMsg(sc.conn, answer)
+	return answer.Accept
+}
+
+// relayMessages forwards messages from one peer to the other until isLast returns true.
+// timeout is for reading each message.
+func relayMessages(from net.Conn, to net.Conn, timeout time.Duration, isLast func(msg.Message) (bool, error)) error {
+	for {
+		from.SetReadDeadline(time.Now().Add(timeout))
+		raw, err := msg.ReadMsg(from)
+		from.SetReadDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+		last, err := isLast(raw)
+		if err != nil {
+			return err
+		}
+		if err = msg.WriteMsg(to, raw); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (svc *Service) handlePutMailbox(conn net.Conn, m *msg.PutMailbox) error {
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return fmt.Errorf("fft %v", err)
+	}
+	if m.ProtocolVersion < msg.ProtocolVersionWorkerControl {
+		return fmt.Errorf("uploading to mailbox requires upload tokens, please upgrade fft")
+	}
+	if m.ID == "" || m.Name == "" {
+		return fmt.Errorf("id and file name is required")
+	}
+	name, err := fname.CleanName(m.Name)
+	if err != nil {
+		return err
+	}
+	m.Name = name
+	if m.ChunkSize <= 0 || m.Fsize < 0 {
+		return fmt.Errorf("invalid chunk size or file size")
+	}
+	// workers can see chunks stored on them, so they must be encrypted end to end
+	if !msg.HasCapability(m.Capabilities, msg.CapEncryption) {
+		return fmt.Errorf("end-to-end encryption is required in mailbox mode")
+	}
+	log.Debug("new PutMailbox id [%s], filename [%s] size [%d] replicas [%d]", m.ID, m.Name, m.Fsize, m.Replicas)
+
+	storageWorkers := svc.workerGroup.GetStorageWorkers()
+	if len(storageWorkers) == 0 {
+		return fmt.Errorf("no available storage workers")
+	}
+
+	mb := NewMailbox(m.ID, m.Capabilities, m.Name, m.Fsize, m.ChunkSize, nil, time.Now().Add(svc.mailboxRetention))
+	if err := svc.mailboxStore.Reserve(mb); err != nil {
+		return err
+	}
+	token, err := newUploadToken()
+	if err != nil {
+		svc.mailboxStore.Remove(mb)
+		return err
+	}
+	mb.workers = openMailbox(storageWorkers, m.ID, token, mb.expireAt)
+	if len(mb.workers) == 0 {
+		svc.mailboxStore.Remove(mb)
+		return fmt.Errorf("no available storage workers")
+	}
+
+	replicas := m.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+	if replicas > int64(len(mb.workers)) {
+		replicas = int64(len(mb.workers))
+	}
+	svc.pushPriority(conn, m.ID)
+
+	msg.WriteMsg(conn, &msg.PutMailboxResp{
+		ID:              m.ID,
+		ProtocolVersion: msg.ProtocolVersion,
+		Workers:         mb.workers,
+		Replicas:        replicas,
+		ExpireAt:        mb.expireAt.Unix(),
+		UploadToken:     token,
+	})
+
+	// wait until sender uploads all chunks, it may take a long time
+	go func() {
+		defer conn.Close()
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			svc.mailboxStore.Remove(mb)
+			log.Warn("mailbox [%s] upload failed: %v", m.ID, err)
+			return
+		}
+		cm, ok := raw.(*msg.CommitMailbox)
+		if !ok || cm.ID != m.ID {
+			svc.mailboxStore.Remove(mb)
+			return
+		}
+
+		if err = svc.mailboxStore.Commit(mb, cm.Locations); err != nil {
+			svc.mailboxStore.Remove(mb)
+			msg.WriteMsg(conn, &msg.CommitMailboxResp{
+				Error: err.Error(),
+			})
+			return
+		}
+		log.Info("mailbox [%s] committed, expire at %s", m.ID, mb.expireAt.Format(time.RFC3339))
+		msg.WriteMsg(conn, &msg.CommitMailboxResp{
+			ExpireAt: mb.expireAt.Unix(),
+		})
+	}()
+	return nil
+}
+
+func (svc *Service) handleRecvMailbox(conn net.Conn, m *msg.ReceiveFile, mb *Mailbox) error {
+	if !msg.HasCapability(m.Capabilities, msg.CapEncryption) {
+		return fmt.Errorf("file is encrypted end to end in mailbox, key is required")
+	}
+	if !msg.HasCapability(m.Capabilities, msg.CapMailbox) {
+		return fmt.Errorf("file is in mailbox, please upgrade fft to receive it")
+	}
+	log.Debug("ReceiveFile id [%s] from mailbox", m.ID)
+
+	workers, locations := mb.Locations()
 	msg.WriteMsg(conn, &msg.ReceiveFileResp{
-		Name:       filename,
-		Fsize:      fsize,
-		Workers:    svc.workerGroup.GetAvailableWorkerAddrs(),
-		CacheCount: cacheCount,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.IntersectCapabilities(mb.capabilities, m.Capabilities),
+		Name:            mb.filename,
+		Fsize:           mb.fsize,
+		FrameSize:       mb.chunkSize,
+		Workers:         workers,
+		Mailbox:         true,
+		Locations:       locations,
 	})
+	conn.Close()
 	return nil
 }
 
+// waitTimeout returns how long a client can wait for it's peer.
+// Old clients don't tell us, they wait 120 seconds.
+func (svc *Service) waitTimeout(seconds int64) time.Duration {
+	timeout := 120 * time.Second
+	if seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout > svc.maxWait {
+		timeout = svc.maxWait
+	}
+	return timeout
+}
+
 // Setup a bare-bones TLS config for the server
 func generateTLSConfig() *tls.Config {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
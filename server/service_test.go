@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// relayTestAnswer relays the answer receiver writes by answer, it returns what sender gets.
+func relayTestAnswer(t *testing.T, answer func(conn net.Conn), timeout time.Duration) (*msg.OfferAnswer, bool) {
+	senderServer, senderClient := net.Pipe()
+	defer senderServer.Close()
+	defer senderClient.Close()
+	recvServer, recvClient := net.Pipe()
+	defer recvServer.Close()
+	defer recvClient.Close()
+
+	sc := NewSendConn("abc", senderServer, nil, "a.txt", 100, 10, 10, 1)
+	sc.protocolVersion = msg.ProtocolVersion
+	ch := make(chan msg.Message, 1)
+	go answerPings(senderClient, ch)
+	go answer(recvClient)
+
+	svc := &Service{}
+	accepted := svc.relayAnswer(recvServer, sc, timeout)
+	select {
+	case <-sc.answerCh:
+	default:
+		t.Fatalf("answerCh is not closed after the answer is relayed")
+	}
+	if sc.accepted != accepted {
+		t.Fatalf("accepted is %v, relayAnswer returns %v", sc.accepted, accepted)
+	}
+	m, _ := (<-ch).(*msg.OfferAnswer)
+	if m == nil {
+		t.Fatalf("sender doesn't get the answer")
+	}
+	return m, accepted
+}
+
+func TestRelayAnswer(t *testing.T) {
+	m, accepted := relayTestAnswer(t, func(conn net.Conn) {
+		msg.WriteMsg(conn, &msg.OfferAnswer{Accept: true})
+	}, time.Second)
+	if !accepted || !m.Accept {
+		t.Fatalf("accepted offer is relayed as %v", m)
+	}
+
+	m, accepted = relayTestAnswer(t, func(conn net.Conn) {
+		msg.WriteMsg(conn, &msg.OfferAnswer{Reason: "file is too large"})
+	}, time.Second)
+	if accepted || m.Accept || m.Reason != "file is too large" {
+		t.Fatalf("rejected offer is relayed as %v", m)
+	}
+
+	// sender is told why there is no answer
+	m, accepted = relayTestAnswer(t, func(conn net.Conn) {}, 100*time.Millisecond)
+	if accepted || !strings.Contains(m.Reason, "in time") {
+		t.Fatalf("offer not answered in time is relayed as %v", m)
+	}
+	m, accepted = relayTestAnswer(t, func(conn net.Conn) {
+		conn.Close()
+	}, time.Second)
+	if accepted || !strings.Contains(m.Reason, "gone") {
+		t.Fatalf("offer not answered by a closed receiver is relayed as %v", m)
+	}
+	m, accepted = relayTestAnswer(t, func(conn net.Conn) {
+		msg.WriteMsg(conn, &msg.Pong{})
+	}, time.Second)
+	if accepted || m.Accept {
+		t.Fatalf("unexpected message from receiver is relayed as %v", m)
+	}
+}
+
+func TestRelayAnswerSenderGone(t *testing.T) {
+	senderServer, senderClient := net.Pipe()
+	defer senderServer.Close()
+	recvServer, recvClient := net.Pipe()
+	defer recvServer.Close()
+	defer recvClient.Close()
+
+	sc := NewSendConn("abc", senderServer, nil, "a.txt", 100, 10, 10, 1)
+	sc.protocolVersion = msg.ProtocolVersion
+	senderClient.Close()
+
+	// receiver is closed, so it doesn't answer an offer nobody waits for
+	svc := &Service{}
+	if svc.relayAnswer(recvServer, sc, 5*time.Second) {
+		t.Fatalf("offer is accepted after sender has gone")
+	}
+	if sc.accepted {
+		t.Fatalf("accepted is set after sender has gone")
+	}
+	recvClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := recvClient.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("receiver's connection is not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("receiver's connection is not closed")
+	}
+}
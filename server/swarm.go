@@ -0,0 +1,282 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+const (
+	// a peer is not used as source any more after failing to serve so many chunks in a row
+	maxSwarmSourceFailures = 3
+
+	// sender is treated as busier than it is, so receivers serve each other when they can
+	swarmSenderPenalty = 2
+)
+
+// SwarmSession tracks which chunks each participant has and decides which chunk a receiver
+// fetches next and from whom. Sender is peer 0 and has all chunks, receiver i is peer i+1.
+type SwarmSession struct {
+	id     string
+	chunks int
+
+	have      [][]bool
+	haveCount []int
+
+	// how many serving peers have each chunk and how many peers are fetching it
+	holders  []int
+	fetching []int
+
+	// chunks each peer is uploading to others now
+	uploads  []int
+	failures []int
+
+	// chunk => source of fetches in progress for each peer
+	pending []map[int]int
+
+	alive    []bool
+	serving  []bool
+	finished []bool
+
+	doneCh chan struct{}
+	done   bool
+	mu     sync.Mutex
+}
+
+func NewSwarmSession(id string, chunks int, receivers int) *SwarmSession {
+	peers := receivers + 1
+	ss := &SwarmSession{
+		id:        id,
+		chunks:    chunks,
+		have:      make([][]bool, peers),
+		haveCount: make([]int, peers),
+		holders:   make([]int, chunks),
+		fetching:  make([]int, chunks),
+		uploads:   make([]int, peers),
+		failures:  make([]int, peers),
+		pending:   make([]map[int]int, peers),
+		alive:     make([]bool, peers),
+		serving:   make([]bool, peers),
+		finished:  make([]bool, peers),
+		doneCh:    make(chan struct{}),
+	}
+	for i := 0; i < peers; i++ {
+		ss.have[i] = make([]bool, chunks)
+		ss.pending[i] = make(map[int]int)
+		ss.alive[i] = true
+		ss.serving[i] = true
+	}
+
+	// sender has all chunks
+	for c := 0; c < chunks; c++ {
+		ss.have[0][c] = true
+		ss.holders[c] = 1
+	}
+	ss.haveCount[0] = chunks
+	ss.finished[0] = true
+	return ss
+}
+
+// Next records result of the last chunk assigned to peer and assigns a new one.
+// The rarest chunk is chosen first, chunks being fetched count as copies,
+// so receivers get different chunks and can serve each other soon.
+func (ss *SwarmSession) Next(peer int, m *msg.SwarmNext) *msg.SwarmNextResp {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if m.ChunkID >= 0 {
+		ss.report(peer, int(m.ChunkID), int(m.Peer), m.Failed)
+	}
+	if ss.haveCount[peer] == ss.chunks {
+		if !ss.finished[peer] {
+			ss.finished[peer] = true
+			log.Info("swarm [%s] peer %d has received all chunks", ss.id, peer)
+			ss.checkDone()
+		}
+		return &msg.SwarmNextResp{ChunkID: -1, Finished: true}
+	}
+
+	best := -1
+	if ss.chunks > 0 {
+		start := rand.Intn(ss.chunks)
+		for i := 0; i < ss.chunks; i++ {
+			c := (start + i) % ss.chunks
+			if ss.have[peer][c] || ss.holders[c] == 0 {
+				continue
+			}
+			if _, ok := ss.pending[peer][c]; ok {
+				continue
+			}
+			if best < 0 || ss.holders[c]+ss.fetching[c] < ss.holders[best]+ss.fetching[best] {
+				best = c
+			}
+		}
+	}
+	if best < 0 {
+		if len(ss.pending[peer]) > 0 {
+			return &msg.SwarmNextResp{ChunkID: -1, Wait: true}
+		}
+		return &msg.SwarmNextResp{ChunkID: -1, Error: "some chunks are not available from any peer"}
+	}
+
+	src := ss.pickSource(peer, best)
+	ss.pending[peer][best] = src
+	ss.uploads[src]++
+	ss.fetching[best]++
+	log.Debug("swarm [%s] peer %d fetches chunk %d from peer %d", ss.id, peer, best, src)
+	return &msg.SwarmNextResp{ChunkID: int64(best), Peer: int64(src)}
+}
+
+// pickSource returns the least busy peer serving chunk, receivers are preferred to save sender's bandwidth.
+// It should be called with lock held and chunk has at least one holder.
+func (ss *SwarmSession) pickSource(peer int, chunk int) int {
+	src := -1
+	load := 0
+	for q := len(ss.have) - 1; q >= 0; q-- {
+		if q == peer || !ss.serving[q] || !ss.have[q][chunk] {
+			continue
+		}
+		l := ss.uploads[q]
+		if q == 0 {
+			l += swarmSenderPenalty
+		}
+		if src < 0 || l < load {
+			src, load = q, l
+		}
+	}
+	return src
+}
+
+// report should be called with lock held.
+func (ss *SwarmSession) report(peer int, chunk int, src int, failed bool) {
+	if chunk >= ss.chunks {
+		return
+	}
+	if s, ok := ss.pending[peer][chunk]; !ok || s != src {
+		return
+	}
+	delete(ss.pending[peer], chunk)
+	ss.uploads[src]--
+	ss.fetching[chunk]--
+
+	if failed {
+		ss.failures[src]++
+		if ss.failures[src] >= maxSwarmSourceFailures && ss.serving[src] {
+			log.Warn("swarm [%s] peer %d failed to serve chunks, stop using it", ss.id, src)
+			ss.stopServing(src)
+		}
+		return
+	}
+	ss.failures[src] = 0
+	if !ss.have[peer][chunk] {
+		ss.have[peer][chunk] = true
+		ss.haveCount[peer]++
+		if ss.serving[peer] {
+			ss.holders[chunk]++
+		}
+	}
+}
+
+// stopServing should be called with lock held.
+func (ss *SwarmSession) stopServing(peer int) {
+	if !ss.serving[peer] {
+		return
+	}
+	ss.serving[peer] = false
+	for c, ok := range ss.have[peer] {
+		if ok {
+			ss.holders[c]--
+		}
+	}
+}
+
+// Leave is called after peer's connection is closed, chunks it has are not available any more.
+func (ss *SwarmSession) Leave(peer int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.alive[peer] {
+		return
+	}
+	ss.alive[peer] = false
+	ss.stopServing(peer)
+	for c, src := range ss.pending[peer] {
+		delete(ss.pending[peer], c)
+		ss.uploads[src]--
+		ss.fetching[c]--
+	}
+	ss.checkDone()
+}
+
+// checkDone closes doneCh if no receivers need chunks any more.
+// It should be called with lock held.
+func (ss *SwarmSession) checkDone() {
+	if ss.done {
+		return
+	}
+	for i := 1; i < len(ss.alive); i++ {
+		if ss.alive[i] && !ss.finished[i] {
+			return
+		}
+	}
+	ss.done = true
+	close(ss.doneCh)
+	log.Info("swarm [%s] is done", ss.id)
+}
+
+// Stats returns how many receivers there are and how many of them have all chunks.
+func (ss *SwarmSession) Stats() (receivers int, finished int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i := 1; i < len(ss.finished); i++ {
+		if ss.finished[i] {
+			finished++
+		}
+	}
+	return len(ss.finished) - 1, finished
+}
+
+// runSwarmPeer serves requests from peer until it's connection is closed.
+func (svc *Service) runSwarmPeer(conn net.Conn, ss *SwarmSession, peer int) {
+	defer conn.Close()
+	defer ss.Leave(peer)
+
+	for {
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			return
+		}
+
+		switch m := raw.(type) {
+		case *msg.SwarmNext:
+			resp := ss.Next(peer, m)
+			if err = msg.WriteMsg(conn, resp); err != nil {
+				return
+			}
+		case *msg.SwarmWait:
+			// keep reading, so we know if peer leaves early
+			go func() {
+				<-ss.doneCh
+				receivers, finished := ss.Stats()
+				msg.WriteMsg(conn, &msg.SwarmWaitResp{
+					Receivers: int64(receivers),
+					Finished:  int64(finished),
+				})
+			}()
+		default:
+			log.Warn("swarm [%s] peer %d sends unexpected message", ss.id, peer)
+			return
+		}
+	}
+}
+
+// swarmChunks returns how many chunks a file is split into.
+func swarmChunks(fsize int64, chunkSize int64) (int, error) {
+	if chunkSize <= 0 || fsize < 0 {
+		return 0, fmt.Errorf("invalid chunk size or file size")
+	}
+	return int((fsize + chunkSize - 1) / chunkSize), nil
+}
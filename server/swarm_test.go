@@ -0,0 +1,145 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func isDone(ss *SwarmSession) bool {
+	select {
+	case <-ss.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSwarmSessionServeEachOther(t *testing.T) {
+	ss := NewSwarmSession("abc", 2, 2)
+	first := &msg.SwarmNext{ChunkID: -1}
+
+	// receivers fetch different chunks from sender first
+	r1 := ss.Next(1, first)
+	r2 := ss.Next(2, first)
+	if r1.Peer != 0 || r2.Peer != 0 {
+		t.Fatalf("first chunks are fetched from peer %d and %d, expect sender", r1.Peer, r2.Peer)
+	}
+	if r1.ChunkID == r2.ChunkID {
+		t.Fatalf("both receivers fetch chunk %d first", r1.ChunkID)
+	}
+
+	// receiver 2 gets the other chunk from receiver 1 after it's reported, instead of sender
+	n1 := ss.Next(1, &msg.SwarmNext{ChunkID: r1.ChunkID, Peer: r1.Peer})
+	n2 := ss.Next(2, &msg.SwarmNext{ChunkID: r2.ChunkID, Peer: r2.Peer})
+	if n1.ChunkID != r2.ChunkID {
+		t.Fatalf("receiver 1 fetches chunk %d, expect chunk %d", n1.ChunkID, r2.ChunkID)
+	}
+	if n2.ChunkID != r1.ChunkID || n2.Peer != 1 {
+		t.Fatalf("receiver 2 fetches chunk %d from peer %d, expect chunk %d from peer 1", n2.ChunkID, n2.Peer, r1.ChunkID)
+	}
+
+	if resp := ss.Next(1, &msg.SwarmNext{ChunkID: n1.ChunkID, Peer: n1.Peer}); !resp.Finished {
+		t.Fatalf("receiver 1 isn't finished after all chunks are received")
+	}
+	if isDone(ss) {
+		t.Fatalf("session is done before receiver 2 is finished")
+	}
+	if resp := ss.Next(2, &msg.SwarmNext{ChunkID: n2.ChunkID, Peer: n2.Peer}); !resp.Finished {
+		t.Fatalf("receiver 2 isn't finished after all chunks are received")
+	}
+	if !isDone(ss) {
+		t.Fatalf("session isn't done after all receivers are finished")
+	}
+	if receivers, finished := ss.Stats(); receivers != 2 || finished != 2 {
+		t.Fatalf("stats are %d receivers and %d finished", receivers, finished)
+	}
+}
+
+func TestSwarmSessionFailedSource(t *testing.T) {
+	ss := NewSwarmSession("abc", 1, 2)
+	first := &msg.SwarmNext{ChunkID: -1}
+	resp := ss.Next(1, first)
+	resp = ss.Next(1, &msg.SwarmNext{ChunkID: resp.ChunkID, Peer: resp.Peer})
+	if !resp.Finished {
+		t.Fatalf("receiver 1 isn't finished")
+	}
+
+	// receiver 1 is preferred, it's not used any more after failing too many times in a row
+	resp = ss.Next(2, first)
+	for i := 0; i < maxSwarmSourceFailures; i++ {
+		if resp.Peer != 1 {
+			t.Fatalf("chunk is fetched from peer %d after %d failures, expect receiver 1", resp.Peer, i)
+		}
+		resp = ss.Next(2, &msg.SwarmNext{ChunkID: resp.ChunkID, Peer: resp.Peer, Failed: true})
+	}
+	if resp.Peer != 0 {
+		t.Fatalf("chunk is fetched from peer %d after receiver 1 fails, expect sender", resp.Peer)
+	}
+
+	// reports of chunks not assigned are ignored
+	ss.Next(2, &msg.SwarmNext{ChunkID: resp.ChunkID, Peer: 1})
+	if ss.haveCount[2] != 0 {
+		t.Fatalf("chunk from a peer not assigned is counted")
+	}
+	if resp = ss.Next(2, &msg.SwarmNext{ChunkID: resp.ChunkID, Peer: resp.Peer}); !resp.Finished {
+		t.Fatalf("receiver 2 isn't finished")
+	}
+}
+
+func TestSwarmSessionLeave(t *testing.T) {
+	ss := NewSwarmSession("abc", 2, 2)
+	first := &msg.SwarmNext{ChunkID: -1}
+
+	// receiver 1 leaves with a chunk, it's pending fetch is given back
+	r1 := ss.Next(1, first)
+	r1 = ss.Next(1, &msg.SwarmNext{ChunkID: r1.ChunkID, Peer: r1.Peer})
+	ss.Leave(1)
+	ss.Leave(1)
+	if ss.uploads[r1.Peer] != 0 || ss.fetching[r1.ChunkID] != 0 {
+		t.Fatalf("pending fetch of the peer left is kept")
+	}
+
+	// receiver 2 gets all chunks from sender, session is done without receiver 1
+	resp := ss.Next(2, first)
+	for !resp.Finished {
+		if resp.Peer != 0 {
+			t.Fatalf("chunk is fetched from peer %d which has left", resp.Peer)
+		}
+		resp = ss.Next(2, &msg.SwarmNext{ChunkID: resp.ChunkID, Peer: resp.Peer})
+	}
+	if !isDone(ss) {
+		t.Fatalf("session isn't done after the other receiver has left")
+	}
+	if receivers, finished := ss.Stats(); receivers != 2 || finished != 1 {
+		t.Fatalf("stats are %d receivers and %d finished", receivers, finished)
+	}
+}
+
+func TestSwarmSessionNoSource(t *testing.T) {
+	ss := NewSwarmSession("abc", 1, 1)
+	ss.Leave(0)
+	if resp := ss.Next(1, &msg.SwarmNext{ChunkID: -1}); resp.Error == "" {
+		t.Fatalf("chunk is assigned after sender has left")
+	}
+}
+
+func TestSwarmChunks(t *testing.T) {
+	for _, test := range []struct {
+		fsize, chunkSize int64
+		expect           int
+	}{
+		{0, 10, 0},
+		{1, 10, 1},
+		{10, 10, 1},
+		{11, 10, 2},
+	} {
+		chunks, err := swarmChunks(test.fsize, test.chunkSize)
+		if err != nil || chunks != test.expect {
+			t.Fatalf("%d bytes in chunks of %d: %d chunks, error %v, expect %d", test.fsize, test.chunkSize, chunks, err, test.expect)
+		}
+	}
+	if _, err := swarmChunks(10, 0); err == nil {
+		t.Fatalf("chunk size 0 is accepted")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,17 +18,40 @@ var (
 )
 
 type Worker struct {
-	conn           net.Conn
-	port           int64
-	advicePublicIP string
-	publicAddr     string
+	conn            net.Conn
+	port            int64
+	advicePublicIP  string
+	publicAddr      string
+	version         string
+	protocolVersion int64
+	capabilities    []string
+
+	// no new sessions are assigned to a draining worker
+	draining bool
+
+	// stats reported in the last heartbeat
+	stats   msg.WorkerStats
+	statsAt time.Time
+
+	// answers of commands are sent to pending by ID, closeCh is closed after the worker is disconnected
+	nextID  int64
+	pending map[int64]chan *msg.WorkerCommandResp
+	closeCh chan struct{}
+	mu      sync.Mutex
 }
 
-func NewWorker(port int64, advicePublicIP string, conn net.Conn) *Worker {
+func NewWorker(port int64, advicePublicIP string, version string, protocolVersion int64,
+	capabilities []string, conn net.Conn) *Worker {
+
 	return &Worker{
-		port:           port,
-		advicePublicIP: advicePublicIP,
-		conn:           conn,
+		port:            port,
+		advicePublicIP:  advicePublicIP,
+		version:         version,
+		protocolVersion: protocolVersion,
+		capabilities:    capabilities,
+		conn:            conn,
+		pending:         make(map[int64]chan *msg.WorkerCommandResp),
+		closeCh:         make(chan struct{}),
 	}
 }
 
@@ -72,8 +96,11 @@ func (w *Worker) DetectPublicAddr() error {
 	return nil
 }
 
-func (w *Worker) RunKeepAlive(closeCallback func()) {
+// RunKeepAlive reads heartbeats and answers of commands from worker until it's disconnected.
+// drainCallback is called with the draining state worker reports.
+func (w *Worker) RunKeepAlive(drainCallback func(draining bool), closeCallback func()) {
 	defer func() {
+		close(w.closeCh)
 		if closeCallback != nil {
 			closeCallback()
 		}
@@ -87,46 +114,258 @@ func (w *Worker) RunKeepAlive(closeCallback func()) {
 			return
 		}
 
-		if _, ok := m.(*msg.Ping); !ok {
+		switch m := m.(type) {
+		case *msg.Ping:
+			msg.WriteMsg(w.conn, &msg.Pong{})
+		case *msg.WorkerStats:
+			w.mu.Lock()
+			w.stats, w.statsAt = *m, time.Now()
+			w.mu.Unlock()
+			if drainCallback != nil {
+				drainCallback(m.Draining)
+			}
+			msg.WriteMsg(w.conn, &msg.Pong{})
+		case *msg.WorkerDraining:
+			if drainCallback != nil {
+				drainCallback(true)
+			}
+		case *msg.WorkerCommandResp:
+			w.mu.Lock()
+			ch, ok := w.pending[m.ID]
+			w.mu.Unlock()
+			if ok {
+				ch <- m
+			}
+		default:
 			w.conn.Close()
 			return
 		}
-		msg.WriteMsg(w.conn, &msg.Pong{})
+	}
+}
+
+// SendCommand pushes a command to worker and waits for it's answer until timeout.
+func (w *Worker) SendCommand(m msg.WorkerCommand, timeout time.Duration) error {
+	if w.protocolVersion < msg.ProtocolVersionWorkerControl {
+		return fmt.Errorf("fftw doesn't support commands from server")
+	}
+	c := &m.Config
+	if w.protocolVersion < msg.ProtocolVersionSchedule &&
+		(c.RateSchedule != nil || c.MaxTrafficMBPerWeek != nil || c.MaxTrafficMBPerMonth != nil) {
+		return fmt.Errorf("fftw doesn't support rate_schedule, max_traffic_per_week or max_traffic_per_month")
+	}
+
+	ch := make(chan *msg.WorkerCommandResp, 1)
+	w.mu.Lock()
+	w.nextID++
+	m.ID = w.nextID
+	w.pending[m.ID] = ch
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.pending, m.ID)
+		w.mu.Unlock()
+	}()
+
+	if err := msg.WriteMsg(w.conn, &m); err != nil {
+		return err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return fmt.Errorf(resp.Error)
+		}
+		return nil
+	case <-w.closeCh:
+		return fmt.Errorf("worker is disconnected")
+	case <-time.After(timeout):
+		return fmt.Errorf("wait for worker's answer timeout")
+	}
+}
+
+// notifier tells watchers something is changed, changes are merged if a watcher doesn't read them in time.
+type notifier struct {
+	watchers map[chan struct{}]struct{}
+	mu       sync.Mutex
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		watchers: make(map[chan struct{}]struct{}),
+	}
+}
+
+// Watch returns a channel which gets a value after something is changed.
+// Unwatch should be called if the channel is not used any more.
+func (n *notifier) Watch() chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.watchers[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch
+}
+
+func (n *notifier) Unwatch(ch chan struct{}) {
+	n.mu.Lock()
+	delete(n.watchers, ch)
+	n.mu.Unlock()
+}
+
+func (n *notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
 	}
 }
 
 type WorkerGroup struct {
 	workers map[string]*Worker
 
+	// notified after workers register or leave
+	*notifier
+
 	mu sync.RWMutex
 }
 
 func NewWorkerGroup() *WorkerGroup {
 	return &WorkerGroup{
-		workers: make(map[string]*Worker),
+		workers:  make(map[string]*Worker),
+		notifier: newNotifier(),
 	}
 }
 
 func (wg *WorkerGroup) RegisterWorker(w *Worker) {
 	closeCallback := func() {
 		wg.mu.Lock()
-		delete(wg.workers, w.PublicAddr())
+		// worker may have registered again with a new connection
+		removed := wg.workers[w.PublicAddr()] == w
+		if removed {
+			delete(wg.workers, w.PublicAddr())
+		}
+		wg.mu.Unlock()
+		if removed {
+			wg.Notify()
+		}
+	}
+
+	drainCallback := func(draining bool) {
+		wg.mu.Lock()
+		changed := w.draining != draining
+		w.draining = draining
 		wg.mu.Unlock()
+		if !changed {
+			return
+		}
+		if draining {
+			log.Info("[%s] worker is draining", w.PublicAddr())
+		} else {
+			log.Info("[%s] worker is undrained", w.PublicAddr())
+		}
+		wg.Notify()
 	}
 
 	wg.mu.Lock()
 	wg.workers[w.PublicAddr()] = w
-	go w.RunKeepAlive(closeCallback)
+	go w.RunKeepAlive(drainCallback, closeCallback)
 	wg.mu.Unlock()
+	wg.Notify()
+}
+
+// GetWorkers returns workers in addrs, or all workers if addrs is empty. Addresses which are not found are returned too.
+func (wg *WorkerGroup) GetWorkers(addrs []string) (workers []*Worker, notFound []string) {
+	wg.mu.RLock()
+	defer wg.mu.RUnlock()
+	if len(addrs) == 0 {
+		for _, w := range wg.workers {
+			workers = append(workers, w)
+		}
+		return
+	}
+	for _, addr := range addrs {
+		if w, ok := wg.workers[addr]; ok {
+			workers = append(workers, w)
+		} else {
+			notFound = append(notFound, addr)
+		}
+	}
+	return
+}
+
+// ListWorkers returns information of all workers sorted by address.
+func (wg *WorkerGroup) ListWorkers() []msg.WorkerInfo {
+	wg.mu.RLock()
+	defer wg.mu.RUnlock()
+	infos := make([]msg.WorkerInfo, 0, len(wg.workers))
+	for addr, w := range wg.workers {
+		info := msg.WorkerInfo{
+			Addr:            addr,
+			Version:         w.version,
+			ProtocolVersion: w.protocolVersion,
+			Capabilities:    w.capabilities,
+			Draining:        w.draining,
+		}
+		w.mu.Lock()
+		if !w.statsAt.IsZero() {
+			info.Stats, info.StatsAt = w.stats, w.statsAt.Unix()
+		}
+		w.mu.Unlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Addr < infos[j].Addr
+	})
+	return infos
 }
 
-func (wg *WorkerGroup) GetAvailableWorkerAddrs() []string {
+// GetAvailableWorkerAddrs returns workers which support all capabilities in caps that workers care about,
+// and all capabilities in required. Draining workers are not returned.
+func (wg *WorkerGroup) GetAvailableWorkerAddrs(caps []string, required []string) []string {
 	addrs := make([]string, 0)
 
+	// clients connect to workers without TLS if data is encrypted end to end
+	needPlain := msg.HasCapability(caps, msg.CapEncryption)
+
 	wg.mu.RLock()
 	defer wg.mu.RUnlock()
-	for addr, _ := range wg.workers {
+	for addr, w := range wg.workers {
+		if w.draining {
+			continue
+		}
+		if needPlain && !msg.HasCapability(w.capabilities, msg.CapEncryption) {
+			continue
+		}
+		if !hasAllCapabilities(w.capabilities, required) {
+			continue
+		}
 		addrs = append(addrs, addr)
 	}
 	return addrs
 }
+
+// GetStorageWorkers returns workers which can store files in mailbox mode and are not draining.
+// Workers which don't take upload tokens are skipped, anyone knowing a mailbox ID could upload to them.
+func (wg *WorkerGroup) GetStorageWorkers() []*Worker {
+	workers := make([]*Worker, 0)
+
+	wg.mu.RLock()
+	defer wg.mu.RUnlock()
+	for _, w := range wg.workers {
+		if !w.draining && msg.HasCapability(w.capabilities, msg.CapMailbox) &&
+			w.protocolVersion >= msg.ProtocolVersionWorkerControl {
+			workers = append(workers, w)
+		}
+	}
+	return workers
+}
+
+func hasAllCapabilities(caps []string, required []string) bool {
+	for _, c := range required {
+		if !msg.HasCapability(caps, c) {
+			return false
+		}
+	}
+	return true
+}
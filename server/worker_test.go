@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func waitNotify(t *testing.T, ch chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("worker group is not notified")
+	}
+}
+
+func TestWorkerGroupDraining(t *testing.T) {
+	wg := NewWorkerGroup()
+	watch := wg.Watch()
+	defer wg.Unwatch(watch)
+
+	clients := make([]net.Conn, 0)
+	for _, addr := range []string{"1.1.1.1:7778", "2.2.2.2:7778"} {
+		server, client := net.Pipe()
+		defer client.Close()
+		clients = append(clients, client)
+		w := NewWorker(7778, "", "", msg.ProtocolVersion, nil, server)
+		w.publicAddr = addr
+		wg.RegisterWorker(w)
+		waitNotify(t, watch)
+	}
+	if addrs := wg.GetAvailableWorkerAddrs(nil, nil); len(addrs) != 2 {
+		t.Fatalf("available workers %v", addrs)
+	}
+
+	// a draining worker keeps registered, but no new sessions are assigned to it
+	if err := msg.WriteMsg(clients[0], &msg.WorkerDraining{}); err != nil {
+		t.Fatal(err)
+	}
+	waitNotify(t, watch)
+	if addrs := wg.GetAvailableWorkerAddrs(nil, nil); len(addrs) != 1 || addrs[0] != "2.2.2.2:7778" {
+		t.Fatalf("available workers %v after the first one is draining", addrs)
+	}
+	msg.WriteMsg(clients[0], &msg.Ping{})
+	if raw, err := msg.ReadMsg(clients[0]); err != nil {
+		t.Fatal(err)
+	} else if _, ok := raw.(*msg.Pong); !ok {
+		t.Fatalf("draining worker gets %T for a ping", raw)
+	}
+	if workers, _ := wg.GetWorkers(nil); len(workers) != 2 {
+		t.Fatalf("%d workers are registered, draining worker should be kept", len(workers))
+	}
+
+	// it's removed after it unregisters
+	clients[0].Close()
+	waitNotify(t, watch)
+	if workers, _ := wg.GetWorkers(nil); len(workers) != 1 {
+		t.Fatalf("%d workers are registered after one has left", len(workers))
+	}
+}
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+// runAdmin accepts admin commands, each connection carries one command.
+func (svc *Service) runAdmin(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Warn("admin listener exit: %v", err)
+			return
+		}
+		go svc.handleAdminConn(conn)
+	}
+}
+
+// isLoopbackAddr returns true if only local processes can connect to addr.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAdminToken returns true if token of the admin command is the one we are configured with.
+func (svc *Service) checkAdminToken(conn net.Conn, token string) bool {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(svc.adminToken)) == 1 {
+		return true
+	}
+	log.Warn("[%s] admin command with invalid token", conn.RemoteAddr().String())
+	return false
+}
+
+func (svc *Service) handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rawMsg, err := msg.ReadMsg(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch m := rawMsg.(type) {
+	case *msg.DrainWorker:
+		if !svc.checkAdminToken(conn, m.Token) {
+			msg.WriteMsg(conn, &msg.DrainWorkerResp{Error: "invalid admin token"})
+			return
+		}
+		if m.Timeout < 0 {
+			msg.WriteMsg(conn, &msg.DrainWorkerResp{
+				Error: fmt.Sprintf("invalid timeout %d", m.Timeout),
+			})
+			return
+		}
+		log.Info("[%s] admin asks to drain", conn.RemoteAddr().String())
+		svc.Drain(time.Duration(m.Timeout) * time.Second)
+		msg.WriteMsg(conn, &msg.DrainWorkerResp{
+			Sessions: int64(svc.activeSessions()),
+		})
+	}
+}
+
+// RequestDrain asks the worker listening admin commands on adminAddr to drain,
+// it returns how many sessions are left when it starts draining.
+func RequestDrain(adminAddr string, token string, timeoutSeconds int) (int64, error) {
+	conn, err := net.DialTimeout("tcp", adminAddr, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err = msg.WriteMsg(conn, &msg.DrainWorker{Timeout: int64(timeoutSeconds), Token: token}); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	raw, err := msg.ReadMsg(conn)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := raw.(*msg.DrainWorkerResp)
+	if !ok {
+		return 0, fmt.Errorf("read DrainWorkerResp format error")
+	}
+	if m.Error != "" {
+		return 0, fmt.Errorf(m.Error)
+	}
+	return m.Sessions, nil
+}
@@ -0,0 +1,279 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+
+	gio "github.com/fatedier/golib/io"
+)
+
+const (
+	// frames can be queued for each receiver, more frames are dropped for slow receivers,
+	// sender will send them again
+	fanoutQueueSize = 1024
+
+	// sender's frames are not read until all receivers connect or timeout,
+	// so early frames won't be missed by late receivers
+	fanoutJoinTimeout = 10 * time.Second
+)
+
+// FanoutGroup copies each frame from sender to all receivers with the same ID,
+// and forwards acks from receivers back to sender.
+type FanoutGroup struct {
+	id        string
+	receivers int
+	sender    *stream.FrameStream
+	outputs   map[*fanoutOutput]struct{}
+	joined    int
+
+	// acks from each receiver are scheduled by it's own flow
+	sched *Scheduler
+
+	joinCh chan struct{}
+	closed bool
+	ackMu  sync.Mutex
+	mu     sync.Mutex
+}
+
+type fanoutOutput struct {
+	conn    net.Conn
+	s       *stream.FrameStream
+	flow    *Flow
+	frameCh chan *stream.Frame
+}
+
+// addReceiver replies receiver with capabilities agreed with caps and relays frames to it.
+func (g *FanoutGroup) addReceiver(conn net.Conn, caps []string) error {
+	flow := g.sched.NewFlow(g.id, remoteIP(conn))
+	out := &fanoutOutput{
+		conn: conn,
+		s: stream.NewFrameStream(gio.WrapReadWriteCloser(fio.NewRateReader(conn, flow), conn, func() error {
+			return conn.Close()
+		})),
+		flow:    flow,
+		frameCh: make(chan *stream.Frame, fanoutQueueSize),
+	}
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		flow.Close()
+		return fmt.Errorf("sender is closed")
+	}
+	g.outputs[out] = struct{}{}
+	g.joined++
+	if g.joined == g.receivers {
+		close(g.joinCh)
+	}
+	g.mu.Unlock()
+
+	msg.WriteMsg(conn, &msg.NewReceiveFileStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.IntersectCapabilities(capabilities, caps),
+	})
+	go g.writeFrames(out)
+	go g.readAcks(out)
+	return nil
+}
+
+func (g *FanoutGroup) removeReceiver(out *fanoutOutput) {
+	g.mu.Lock()
+	if _, ok := g.outputs[out]; ok {
+		delete(g.outputs, out)
+		close(out.frameCh)
+	}
+	g.mu.Unlock()
+	out.conn.Close()
+}
+
+func (g *FanoutGroup) writeFrames(out *fanoutOutput) {
+	for frame := range out.frameCh {
+		if err := out.s.WriteFrame(frame); err != nil {
+			g.removeReceiver(out)
+			return
+		}
+	}
+	out.s.Close()
+}
+
+func (g *FanoutGroup) readAcks(out *fanoutOutput) {
+	defer out.flow.Close()
+	for {
+		ack, err := out.s.ReadAck()
+		if err != nil {
+			g.removeReceiver(out)
+			return
+		}
+		g.ackMu.Lock()
+		err = g.sender.WriteAck(ack)
+		g.ackMu.Unlock()
+		if err != nil {
+			g.removeReceiver(out)
+			return
+		}
+	}
+}
+
+// run reads frames from sender until it's closed.
+func (g *FanoutGroup) run() {
+	select {
+	case <-g.joinCh:
+	case <-time.After(fanoutJoinTimeout):
+	}
+
+	for {
+		frame, err := g.sender.ReadFrame()
+		if err != nil {
+			break
+		}
+
+		g.mu.Lock()
+		for out := range g.outputs {
+			select {
+			case out.frameCh <- frame:
+			default:
+			}
+		}
+		g.mu.Unlock()
+	}
+
+	g.mu.Lock()
+	g.closed = true
+	for out := range g.outputs {
+		delete(g.outputs, out)
+		close(out.frameCh)
+	}
+	g.mu.Unlock()
+	g.sender.Close()
+}
+
+// fanoutWaiter is shared by receivers waiting for the same sender.
+type fanoutWaiter struct {
+	ch    chan struct{}
+	count int
+}
+
+type FanoutController struct {
+	// groups and receivers waiting for sender by pairKey
+	groups  map[string]*FanoutGroup
+	waiters map[string]*fanoutWaiter
+
+	sched *Scheduler
+	mu    sync.Mutex
+}
+
+func NewFanoutController(sched *Scheduler) *FanoutController {
+	return &FanoutController{
+		groups:  make(map[string]*FanoutGroup),
+		waiters: make(map[string]*fanoutWaiter),
+		sched:   sched,
+	}
+}
+
+// DealSendConn creates a group for sender with capabilities caps, frames from it are scheduled.
+func (fc *FanoutController) DealSendConn(id string, auth string, caps []string, conn net.Conn, receivers int) error {
+	flow := fc.sched.NewFlow(id, remoteIP(conn))
+	wrapReader := fio.NewRateReader(conn, flow)
+	g := &FanoutGroup{
+		id:        id,
+		receivers: receivers,
+		sender: stream.NewFrameStream(gio.WrapReadWriteCloser(wrapReader, conn, func() error {
+			return conn.Close()
+		})),
+		outputs: make(map[*fanoutOutput]struct{}),
+		sched:   fc.sched,
+		joinCh:  make(chan struct{}),
+	}
+
+	key := pairKey(id, auth)
+	fc.mu.Lock()
+	if _, ok := fc.groups[key]; ok {
+		fc.mu.Unlock()
+		flow.Close()
+		return fmt.Errorf("id is repeated")
+	}
+	fc.groups[key] = g
+	if w, ok := fc.waiters[key]; ok {
+		delete(fc.waiters, key)
+		close(w.ch)
+	}
+	fc.mu.Unlock()
+
+	msg.WriteMsg(conn, &msg.NewSendFileStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.IntersectCapabilities(capabilities, caps),
+	})
+	go func() {
+		g.run()
+		flow.Close()
+		fc.mu.Lock()
+		if fc.groups[key] == g {
+			delete(fc.groups, key)
+		}
+		fc.mu.Unlock()
+		log.Info("ID [%s] fanout group closed", id)
+	}()
+	return nil
+}
+
+// Active returns how many groups are relaying frames.
+func (fc *FanoutController) Active() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.groups)
+}
+
+// CloseAll closes all groups, their receivers are closed after the sender.
+func (fc *FanoutController) CloseAll() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, g := range fc.groups {
+		g.sender.Close()
+	}
+}
+
+// DealRecvConn adds receiver with capabilities caps to the group with the same ID, it waits sender until timeout.
+func (fc *FanoutController) DealRecvConn(id string, auth string, caps []string, conn net.Conn, timeout time.Duration) error {
+	key := pairKey(id, auth)
+	fc.mu.Lock()
+	g, ok := fc.groups[key]
+	if !ok {
+		w, exist := fc.waiters[key]
+		if !exist {
+			w = &fanoutWaiter{
+				ch: make(chan struct{}),
+			}
+			fc.waiters[key] = w
+		}
+		w.count++
+		fc.mu.Unlock()
+
+		select {
+		case <-w.ch:
+		case <-time.After(timeout):
+			fc.mu.Lock()
+			w.count--
+			if w.count == 0 && fc.waiters[key] == w {
+				delete(fc.waiters, key)
+			}
+			fc.mu.Unlock()
+			return fmt.Errorf("timeout waiting sender")
+		}
+
+		fc.mu.Lock()
+		g, ok = fc.groups[key]
+		if !ok {
+			fc.mu.Unlock()
+			return fmt.Errorf("sender is closed")
+		}
+	}
+	fc.mu.Unlock()
+	return g.addReceiver(conn, caps)
+}
@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+)
+
+// LedgerEntry is traffic of a day, in is bytes worker read from connections and out is bytes it wrote.
+type LedgerEntry struct {
+	Date string `json:"date"`
+	In   uint64 `json:"in"`
+	Out  uint64 `json:"out"`
+}
+
+// Ledger counts traffic of each day. If file is not empty, days are saved to it as JSON lines,
+// the last line is today and it's updated while fftw is running.
+type Ledger struct {
+	file     string
+	location *time.Location
+
+	// traffic of today, it's not changed by resetting quotas
+	date string
+	in   uint64
+	out  uint64
+
+	// traffic since started
+	totalIn  uint64
+	totalOut uint64
+
+	// lines of days before today
+	past []byte
+	mu   sync.Mutex
+}
+
+func NewLedger(file string, location *time.Location) *Ledger {
+	if location == nil {
+		location = time.Local
+	}
+	return &Ledger{
+		file:     file,
+		location: location,
+		date:     time.Now().In(location).Format("2006-01-02"),
+	}
+}
+
+func (l *Ledger) Add(in int, out int) {
+	atomic.AddUint64(&l.in, uint64(in))
+	atomic.AddUint64(&l.out, uint64(out))
+	atomic.AddUint64(&l.totalIn, uint64(in))
+	atomic.AddUint64(&l.totalOut, uint64(out))
+}
+
+// Today returns traffic of today.
+func (l *Ledger) Today() (in uint64, out uint64) {
+	return atomic.LoadUint64(&l.in), atomic.LoadUint64(&l.out)
+}
+
+// Total returns traffic since started.
+func (l *Ledger) Total() (in uint64, out uint64) {
+	return atomic.LoadUint64(&l.totalIn), atomic.LoadUint64(&l.totalOut)
+}
+
+func (l *Ledger) Run() {
+	if l.file != "" {
+		if err := l.load(); err != nil {
+			log.Warn("load traffic ledger from [%s] error: %v", l.file, err)
+		}
+	}
+
+	lastIn, lastOut := l.Today()
+	for {
+		time.Sleep(5 * time.Second)
+		changed := false
+		if date := time.Now().In(l.location).Format("2006-01-02"); date != l.date {
+			l.mu.Lock()
+			entry := l.entry(atomic.SwapUint64(&l.in, 0), atomic.SwapUint64(&l.out, 0))
+			l.past = append(l.past, entry...)
+			l.date = date
+			l.mu.Unlock()
+			log.Info("traffic of the last day: %s", bytes.TrimSpace(entry))
+			changed = true
+		}
+
+		if in, out := l.Today(); l.file != "" && (changed || in != lastIn || out != lastOut) {
+			lastIn, lastOut = in, out
+			if err := l.Save(); err != nil {
+				log.Warn("save traffic ledger to [%s] error: %v", l.file, err)
+			}
+		}
+	}
+}
+
+// entry returns the line of the current date.
+func (l *Ledger) entry(in uint64, out uint64) []byte {
+	buf, _ := json.Marshal(LedgerEntry{
+		Date: l.date,
+		In:   in,
+		Out:  out,
+	})
+	return append(buf, '\n')
+}
+
+// Save writes past days and today to file.
+func (l *Ledger) Save() error {
+	if l.file == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := append(append([]byte{}, l.past...), l.entry(l.Today())...)
+
+	// a half written file is never loaded
+	tmpFile := l.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, l.file)
+}
+
+// load keeps lines of past days, traffic of today is restored from the last line.
+func (l *Ledger) load() error {
+	buf, err := ioutil.ReadFile(l.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil
+	}
+
+	last := buf
+	if idx := bytes.LastIndexByte(buf, '\n'); idx >= 0 {
+		last = buf[idx+1:]
+	}
+	var entry LedgerEntry
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if json.Unmarshal(last, &entry) == nil && entry.Date == l.date {
+		l.past = append([]byte{}, buf[:len(buf)-len(last)]...)
+		atomic.AddUint64(&l.in, entry.In)
+		atomic.AddUint64(&l.out, entry.Out)
+		log.Info("load traffic of today, in %dMB, out %dMB", entry.In/1024/1024, entry.Out/1024/1024)
+	} else {
+		l.past = append(buf, '\n')
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fftw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ledger.jsonl")
+	today := time.Now().In(time.UTC).Format("2006-01-02")
+
+	// past days are kept and traffic of today is restored from the last line
+	past := `{"date":"2019-03-18","in":1,"out":2}` + "\n"
+	err = ioutil.WriteFile(file, []byte(past+`{"date":"`+today+`","in":10,"out":20}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLedger(file, time.UTC)
+	if err = l.load(); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(5, 7)
+	if in, out := l.Today(); in != 15 || out != 27 {
+		t.Fatalf("traffic of today is %d, %d, expect 15, 27", in, out)
+	}
+	if in, out := l.Total(); in != 5 || out != 7 {
+		t.Fatalf("traffic since started is %d, %d, expect 5, 7", in, out)
+	}
+	if err = l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := past + `{"date":"` + today + `","in":15,"out":27}` + "\n"; string(buf) != expect {
+		t.Fatalf("saved ledger is %q, expect %q", buf, expect)
+	}
+
+	// the last line of another day is a past day
+	if err = ioutil.WriteFile(file, []byte(past), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l = NewLedger(file, time.UTC)
+	if err = l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if in, out := l.Today(); in != 0 || out != 0 {
+		t.Fatalf("traffic of another day is loaded as today: %d, %d", in, out)
+	}
+	if err = l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err = ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(buf)), "\n"); len(lines) != 2 || lines[0]+"\n" != past {
+		t.Fatalf("saved ledger is %q", buf)
+	}
+}
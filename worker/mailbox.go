@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+
+	gio "github.com/fatedier/golib/io"
+)
+
+func (svc *Service) handleStoreStream(conn net.Conn, m *msg.NewStoreStream) error {
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return err
+	}
+	if svc.storage == nil {
+		return fmt.Errorf("storage is not enabled on this worker")
+	}
+	if err := svc.storage.Authorize(m.ID, m.UploadToken); err != nil {
+		log.Warn("store stream of mailbox [%s] from [%s] is refused: %v", m.ID, conn.RemoteAddr(), err)
+		return err
+	}
+
+	msg.WriteMsg(conn, &msg.NewStoreStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.register.capabilities,
+	})
+	go svc.storeChunks(m.ID, conn)
+	return nil
+}
+
+// storeChunks saves each data frame as a chunk and acks it after it's on disk.
+// Connection is closed if any chunk can't be saved, sender will upload it to other workers.
+func (svc *Service) storeChunks(id string, conn net.Conn) {
+	defer conn.Close()
+	flow := svc.sched.NewFlow(id, remoteIP(conn))
+	defer flow.Close()
+
+	wrapReader := fio.NewRateReader(conn, flow)
+	s := stream.NewFrameStream(gio.WrapReadWriteCloser(wrapReader, conn, func() error {
+		return conn.Close()
+	}))
+	for {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		switch frame.Type {
+		case stream.TypeData:
+		case stream.TypeClose:
+			return
+		default:
+			continue
+		}
+		err = svc.storage.PutChunk(id, frame.FrameID, frame.Flags, frame.Buf)
+		if err != nil {
+			log.Warn("mailbox [%s] save chunk %d error: %v", id, frame.FrameID, err)
+			return
+		}
+		if err = s.WriteAck(stream.NewAck(frame.FileID, frame.FrameID, 0)); err != nil {
+			return
+		}
+	}
+}
+
+func (svc *Service) handleFetchStream(conn net.Conn, m *msg.NewFetchStream) error {
+	if err := msg.CheckProtocolVersion(m.ProtocolVersion); err != nil {
+		return err
+	}
+	if svc.storage == nil {
+		return fmt.Errorf("storage is not enabled on this worker")
+	}
+
+	msg.WriteMsg(conn, &msg.NewFetchStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    svc.register.capabilities,
+	})
+	go svc.fetchChunks(m.ID, conn)
+	return nil
+}
+
+// fetchChunks replies a frame for each FetchChunk message in order.
+// Chunks which can't be read are replied with an error frame.
+func (svc *Service) fetchChunks(id string, conn net.Conn) {
+	defer conn.Close()
+	flow := svc.sched.NewFlow(id, remoteIP(conn))
+	defer flow.Close()
+
+	wrapWriter := fio.NewRateWriter(conn, flow)
+	s := stream.NewFrameStream(gio.WrapReadWriteCloser(conn, wrapWriter, func() error {
+		return conn.Close()
+	}))
+	for {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			return
+		}
+		m, ok := raw.(*msg.FetchChunk)
+		if !ok || m.ChunkID < 0 {
+			return
+		}
+
+		frame := &stream.Frame{
+			Version: stream.Version1,
+			Type:    stream.TypeData,
+			FrameID: uint64(m.ChunkID),
+		}
+		frame.Flags, frame.Buf, err = svc.storage.GetChunk(id, uint64(m.ChunkID))
+		if err != nil {
+			frame.Type = stream.TypeError
+			frame.Flags = 0
+			frame.Buf = []byte(err.Error())
+		}
+		if err = s.WriteFrame(frame); err != nil {
+			return
+		}
+	}
+}
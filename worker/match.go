@@ -12,8 +12,6 @@ import (
 	"github.com/fatedier/fft/pkg/msg"
 
 	gio "github.com/fatedier/golib/io"
-
-	"golang.org/x/time/rate"
 )
 
 type TransferConn struct {
@@ -21,76 +19,130 @@ type TransferConn struct {
 	id       string
 	conn     net.Conn
 
+	// streams encrypted end to end are paired only if they have the same auth
+	auth string
+
+	// capabilities of the client, worker replies what it agrees with
+	caps []string
+
+	// not nil if conn is a plain TCP connection without TLS
+	tcpConn *net.TCPConn
+
+	// bytes of the connection, data relayed by splice is added to it
+	counter *fio.CountConn
+
 	pairConnCh chan *TransferConn
 }
 
-func NewTransferConn(id string, conn net.Conn, isSender bool) *TransferConn {
+func NewTransferConn(id string, auth string, caps []string, conn net.Conn, tcpConn *net.TCPConn, counter *fio.CountConn, isSender bool) *TransferConn {
 	return &TransferConn{
 		isSender:   isSender,
 		id:         id,
+		auth:       auth,
+		caps:       caps,
 		conn:       conn,
+		tcpConn:    tcpConn,
+		counter:    counter,
 		pairConnCh: make(chan *TransferConn),
 	}
 }
 
 type MatchController struct {
+	// waiting conns by pairKey
 	conns map[string]*TransferConn
 
-	rateLimit *rate.Limiter
-	statFunc  func(int)
-	mu        sync.Mutex
+	// pairs being relayed, sender's conn to receiver's conn
+	pairs map[*TransferConn]*TransferConn
+
+	sched *Scheduler
+	mu    sync.Mutex
 }
 
-func NewMatchController(rateByte int, statFunc func(int)) *MatchController {
-	if rateByte < 50*1024 {
-		rateByte = 50 * 1024
-	}
+func NewMatchController(sched *Scheduler) *MatchController {
 	return &MatchController{
-		conns:     make(map[string]*TransferConn),
-		rateLimit: rate.NewLimiter(rate.Limit(float64(rateByte)), 16*1024),
-		statFunc:  statFunc,
+		conns: make(map[string]*TransferConn),
+		pairs: make(map[*TransferConn]*TransferConn),
+		sched: sched,
 	}
 }
 
+// pairKey is what streams are paired by, streams of a transfer may be injected by others who know the ID
+// but not the key.
+func pairKey(id string, auth string) string {
+	return id + "\x00" + auth
+}
+
 // block until there is a same ID transfer conn or timeout
 func (mc *MatchController) DealTransferConn(tc *TransferConn, timeout time.Duration) error {
+	key := pairKey(tc.id, tc.auth)
 	mc.mu.Lock()
-	pairConn, ok := mc.conns[tc.id]
+	pairConn, ok := mc.conns[key]
+	if ok && pairConn.isSender == tc.isSender {
+		// anyone who knows the ID could kick out a plain stream, so only a stream with the same auth replaces
+		// the waiting one, like the same client redials after it gives up waiting
+		if tc.auth == "" {
+			mc.mu.Unlock()
+			return fmt.Errorf("duplicate transfer connection")
+		}
+		pairConn.conn.Close()
+		ok = false
+	}
 	if !ok {
-		mc.conns[tc.id] = tc
+		mc.conns[key] = tc
 	} else {
-		delete(mc.conns, tc.id)
+		delete(mc.conns, key)
 	}
 	mc.mu.Unlock()
 
 	if !ok {
 		select {
 		case pairConn := <-tc.pairConnCh:
+			mc.addPair(tc, pairConn)
+
+			// data from sender and acks from receiver are both scheduled
+			senderConn, receiverConn := tc.conn, pairConn.conn
+			if !tc.isSender {
+				senderConn, receiverConn = receiverConn, senderConn
+			}
+			flow := mc.sched.NewFlow(tc.id, remoteIP(senderConn))
+			ackFlow := mc.sched.NewFlow(tc.id, remoteIP(receiverConn))
+			if tc.tcpConn != nil && pairConn.tcpConn != nil && fio.SpliceSupported {
+				mc.joinSplice(tc, pairConn, flow, ackFlow)
+				return nil
+			}
+
 			var sender, receiver io.ReadWriteCloser
-			if tc.isSender {
-				wrapReader := fio.NewCallbackReader(fio.NewRateReader(tc.conn, mc.rateLimit), mc.statFunc)
-				sender = gio.WrapReadWriteCloser(wrapReader, tc.conn, func() error {
-					return tc.conn.Close()
-				})
-				receiver = pairConn.conn
-			} else {
-				wrapReader := fio.NewCallbackReader(fio.NewRateReader(pairConn.conn, mc.rateLimit), mc.statFunc)
-				sender = gio.WrapReadWriteCloser(wrapReader, pairConn.conn, func() error {
-					return pairConn.conn.Close()
-				})
-				receiver = tc.conn
+			senderCaps, receiverCaps := tc.caps, pairConn.caps
+			if !tc.isSender {
+				senderCaps, receiverCaps = receiverCaps, senderCaps
 			}
-			msg.WriteMsg(sender, &msg.NewSendFileStreamResp{})
-			msg.WriteMsg(receiver, &msg.NewReceiveFileStreamResp{})
+			sender = gio.WrapReadWriteCloser(fio.NewRateReader(senderConn, flow), senderConn, func() error {
+				return senderConn.Close()
+			})
+			receiver = gio.WrapReadWriteCloser(fio.NewRateReader(receiverConn, ackFlow), receiverConn, func() error {
+				return receiverConn.Close()
+			})
+			msg.WriteMsg(sender, &msg.NewSendFileStreamResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Capabilities:    msg.IntersectCapabilities(capabilities, senderCaps),
+			})
+			msg.WriteMsg(receiver, &msg.NewReceiveFileStreamResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Capabilities:    msg.IntersectCapabilities(capabilities, receiverCaps),
+			})
 
 			go func() {
 				gio.Join(sender, receiver)
-				log.Info("ID [%s] join pair connections closed", tc.id)
+				flow.Close()
+				ackFlow.Close()
+				mc.removePair(tc, pairConn)
+				in, out := pairTraffic(tc, pairConn)
+				log.Info("ID [%s] join pair connections closed, in %d bytes, out %d bytes", tc.id, in, out)
 			}()
 		case <-time.After(timeout):
 			mc.mu.Lock()
-			if tmp, ok := mc.conns[tc.id]; ok && tmp == tc {
-				delete(mc.conns, tc.id)
+			if tmp, ok := mc.conns[key]; ok && tmp == tc {
+				delete(mc.conns, key)
 			}
 			mc.mu.Unlock()
 			return fmt.Errorf("timeout waiting pair connection")
@@ -104,3 +156,94 @@ func (mc *MatchController) DealTransferConn(tc *TransferConn, timeout time.Durat
 	}
 	return nil
 }
+
+// joinSplice relays two plain TCP connections in kernel, data from sender is scheduled by flow
+// and acks from receiver are scheduled by ackFlow.
+func (mc *MatchController) joinSplice(tc *TransferConn, pairConn *TransferConn, flow *Flow, ackFlow *Flow) {
+	sender, receiver := tc, pairConn
+	if !tc.isSender {
+		sender, receiver = pairConn, tc
+	}
+	msg.WriteMsg(sender.conn, &msg.NewSendFileStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.IntersectCapabilities(capabilities, sender.caps),
+	})
+	msg.WriteMsg(receiver.conn, &msg.NewReceiveFileStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.IntersectCapabilities(capabilities, receiver.caps),
+	})
+
+	go func() {
+		var wait sync.WaitGroup
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			fio.Splice(receiver.tcpConn, sender.tcpConn, flow, func(n int) {
+				sender.counter.Add(n, 0)
+				receiver.counter.Add(0, n)
+			})
+			sender.tcpConn.Close()
+			receiver.tcpConn.Close()
+		}()
+		go func() {
+			defer wait.Done()
+			fio.Splice(sender.tcpConn, receiver.tcpConn, ackFlow, func(n int) {
+				receiver.counter.Add(n, 0)
+				sender.counter.Add(0, n)
+			})
+			sender.tcpConn.Close()
+			receiver.tcpConn.Close()
+		}()
+		wait.Wait()
+		flow.Close()
+		ackFlow.Close()
+		// sessions are released after conns are closed
+		sender.conn.Close()
+		receiver.conn.Close()
+		mc.removePair(tc, pairConn)
+		in, out := pairTraffic(tc, pairConn)
+		log.Info("ID [%s] splice pair connections closed, in %d bytes, out %d bytes", tc.id, in, out)
+	}()
+}
+
+// pairTraffic returns bytes worker read from and wrote to both connections of a pair.
+func pairTraffic(tc *TransferConn, pairConn *TransferConn) (in uint64, out uint64) {
+	in1, out1 := tc.counter.Counts()
+	in2, out2 := pairConn.counter.Counts()
+	return in1 + in2, out1 + out2
+}
+
+func (mc *MatchController) addPair(tc *TransferConn, pairConn *TransferConn) {
+	if !tc.isSender {
+		tc, pairConn = pairConn, tc
+	}
+	mc.mu.Lock()
+	mc.pairs[tc] = pairConn
+	mc.mu.Unlock()
+}
+
+func (mc *MatchController) removePair(tc *TransferConn, pairConn *TransferConn) {
+	if !tc.isSender {
+		tc = pairConn
+	}
+	mc.mu.Lock()
+	delete(mc.pairs, tc)
+	mc.mu.Unlock()
+}
+
+// Active returns how many pairs are being relayed.
+func (mc *MatchController) Active() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.pairs)
+}
+
+// CloseAll closes all pairs being relayed.
+func (mc *MatchController) CloseAll() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for sender, receiver := range mc.pairs {
+		sender.conn.Close()
+		receiver.conn.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func TestJoinSchedulesAcks(t *testing.T) {
+	sched := NewScheduler(2*schedBurst, 0, 0)
+	go sched.Run()
+	mc := NewMatchController(sched)
+
+	senderPeer, senderConn := net.Pipe()
+	receiverPeer, receiverConn := net.Pipe()
+	defer senderPeer.Close()
+	defer receiverPeer.Close()
+
+	newConn := func(conn net.Conn, isSender bool) *TransferConn {
+		counter := fio.NewCountConn(conn, func(int, int) {})
+		return NewTransferConn("abc", "", nil, counter, nil, counter, isSender)
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- mc.DealTransferConn(newConn(senderConn, true), time.Second)
+	}()
+	go func() {
+		errCh <- mc.DealTransferConn(newConn(receiverConn, false), time.Second)
+	}()
+	for _, conn := range []net.Conn{senderPeer, receiverPeer} {
+		if _, err := msg.ReadMsg(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first burst is free, the next 2 bursts take a second
+	acks := make([]byte, 3*schedBurst)
+	start := time.Now()
+	go receiverPeer.Write(acks)
+	if _, err := io.ReadFull(senderPeer, acks); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("acks from receiver are not scheduled, %d bytes in %s", len(acks), elapsed)
+	}
+}
+
+func TestDuplicateTransferConn(t *testing.T) {
+	mc := NewMatchController(NewScheduler(0, 0, 0))
+	newConn := func(auth string) (*TransferConn, net.Conn) {
+		peer, conn := net.Pipe()
+		counter := fio.NewCountConn(conn, func(int, int) {})
+		return NewTransferConn("abc", auth, nil, counter, nil, counter, true), peer
+	}
+	for _, auth := range []string{"", "token"} {
+		first, firstPeer := newConn(auth)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- mc.DealTransferConn(first, 200*time.Millisecond)
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		second, secondPeer := newConn(auth)
+		secondErrCh := make(chan error, 1)
+		go func() {
+			secondErrCh <- mc.DealTransferConn(second, 200*time.Millisecond)
+		}()
+
+		firstPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := firstPeer.Read(make([]byte, 1))
+		replaced := err == io.EOF || err == io.ErrClosedPipe
+		if auth == "" {
+			if replaced {
+				t.Fatalf("plain stream waiting is closed by a duplicate")
+			}
+			if err := <-secondErrCh; err == nil {
+				t.Fatalf("duplicate plain stream is accepted")
+			}
+		} else {
+			if !replaced {
+				t.Fatalf("stream with auth isn't replaced by it's redial, read error %v", err)
+			}
+			<-secondErrCh
+		}
+		<-errCh
+		firstPeer.Close()
+		secondPeer.Close()
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	fio "github.com/fatedier/fft/pkg/io"
 	"github.com/fatedier/fft/pkg/log"
 	"github.com/fatedier/fft/pkg/msg"
 	"github.com/fatedier/fft/version"
@@ -16,33 +17,68 @@ type Register struct {
 	port           int64
 	advicePublicIP string
 	serverAddr     string
+	capabilities   []string
 	conn           net.Conn
 
+	// protocol version of server, known after registered
+	serverVersion int64
+
+	// server is told again after registering again
+	draining bool
+
+	// stats are sent as heartbeats and commands from server are handled if server supports them
+	stats         func() *msg.WorkerStats
+	handleCommand func(m *msg.WorkerCommand) error
+	// called with bytes read from and written to connections to server
+	countTraffic func(in int, out int)
+	// the registered connection heartbeats are sent through, it's nil while registering
+	servingConn net.Conn
+
+	// a reverse worker is behind NAT, it keeps poolCount work connections to server and clients are relayed
+	// through them to serveWorkConn. runID is given by server each time it's registered.
+	reverse       bool
+	poolCount     int
+	runID         string
+	serveWorkConn func(conn net.Conn)
+
 	closed bool
 	mu     sync.Mutex
 }
 
-func NewRegister(port int64, advicePublicIP string, serverAddr string) (*Register, error) {
+func NewRegister(port int64, advicePublicIP string, serverAddr string, capabilities []string) (*Register, error) {
 	conn, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		return nil, err
 	}
-	conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
-
-	return &Register{
+	r := &Register{
 		port:           port,
 		advicePublicIP: advicePublicIP,
 		serverAddr:     serverAddr,
-		conn:           conn,
+		capabilities:   capabilities,
 		closed:         false,
-	}, nil
+	}
+	r.conn = r.wrapConn(conn)
+	return r, nil
+}
+
+// wrapConn counts bytes of a connection to server, they are counted after countTraffic is set.
+func (r *Register) wrapConn(conn net.Conn) net.Conn {
+	counter := fio.NewCountConn(conn, func(in int, out int) {
+		if r.countTraffic != nil {
+			r.countTraffic(in, out)
+		}
+	})
+	return tls.Client(counter, &tls.Config{InsecureSkipVerify: true})
 }
 
 func (r *Register) Register() error {
 	msg.WriteMsg(r.conn, &msg.RegisterWorker{
-		Version:  version.Full(),
-		PublicIP: r.advicePublicIP,
-		BindPort: r.port,
+		Version:         version.Full(),
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    r.capabilities,
+		PublicIP:        r.advicePublicIP,
+		BindPort:        r.port,
+		Reverse:         r.reverse,
 	})
 
 	r.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -61,35 +97,209 @@ func (r *Register) Register() error {
 	if resp.Error != "" {
 		return fmt.Errorf(resp.Error)
 	}
+	if err = msg.CheckProtocolVersion(resp.ProtocolVersion); err != nil {
+		return fmt.Errorf("ffts %v", err)
+	}
+	if r.reverse && (resp.ProtocolVersion < msg.ProtocolVersionReverse || resp.RunID == "") {
+		return fmt.Errorf("ffts doesn't support reverse workers")
+	}
+	if r.reverse {
+		log.Info("clients connect to this worker through [%s]", resp.PublicAddr)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serverVersion = resp.ProtocolVersion
+	r.runID = resp.RunID
+	if r.draining {
+		return msg.WriteMsg(r.conn, &msg.WorkerDraining{})
+	}
 	return nil
 }
 
-func (r *Register) RunKeepAlive() {
-	var err error
-	for {
-		// send ping and read pong
+// Drain tells server not to assign new sessions to this worker.
+// It returns an error if server is too old to understand it, the worker should unregister instead.
+func (r *Register) Drain() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.serverVersion < msg.ProtocolVersionDrain {
+		return fmt.Errorf("ffts doesn't support draining workers")
+	}
+	r.draining = true
+	if r.conn == nil {
+		return nil
+	}
+	return msg.WriteMsg(r.conn, &msg.WorkerDraining{})
+}
+
+// Undrain tells server this worker takes new sessions again.
+// It returns false if the worker has unregistered, it should be reset and registered again.
+func (r *Register) Undrain() bool {
+	r.mu.Lock()
+	r.draining = false
+	if r.closed {
+		r.mu.Unlock()
+		return false
+	}
+	r.mu.Unlock()
+
+	// server knows it by stats at once
+	r.heartbeat(nil)
+	return true
+}
+
+// Controlled returns true if server can push commands to this worker, a drained worker keeps registered for them.
+func (r *Register) Controlled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.serverVersion >= msg.ProtocolVersionWorkerControl && r.handleCommand != nil
+}
+
+// heartbeat sends stats to server through conn, or Ping if server is too old. The serving connection is used if conn is nil.
+func (r *Register) heartbeat(conn net.Conn) error {
+	// stats are collected without the lock, since the service calls Register with it's lock held
+	var m msg.Message = &msg.Ping{}
+	if r.stats != nil {
+		m = r.stats()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn == nil {
+		conn = r.servingConn
+	}
+	if conn == nil || conn != r.servingConn {
+		return fmt.Errorf("not registered")
+	}
+	if _, ok := m.(*msg.WorkerStats); ok && r.serverVersion < msg.ProtocolVersionWorkerControl {
+		m = &msg.Ping{}
+	}
+	return msg.WriteMsg(conn, m)
+}
+
+// serve sends heartbeats and handles commands from server until the connection is broken.
+func (r *Register) serve() {
+	r.mu.Lock()
+	conn := r.conn
+	r.servingConn = conn
+	runID := r.runID
+	r.mu.Unlock()
+
+	if r.reverse {
+		for i := 0; i < r.poolCount; i++ {
+			go r.newWorkConn(runID)
+		}
+	}
+
+	stopCh := make(chan struct{})
+	defer func() {
+		r.mu.Lock()
+		r.servingConn = nil
+		r.mu.Unlock()
+		close(stopCh)
+	}()
+	go func() {
 		for {
-			// in case it is closed before
-			if r.conn == nil {
-				break
+			if err := r.heartbeat(conn); err != nil {
+				conn.Close()
+				return
+			}
+			select {
+			case <-time.After(10 * time.Second):
+			case <-stopCh:
+				return
 			}
+		}
+	}()
 
-			msg.WriteMsg(r.conn, &msg.Ping{})
+	for {
+		// server answers each heartbeat with Pong
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		raw, err := msg.ReadMsg(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
 
-			_, err = msg.ReadMsg(r.conn)
-			if err != nil {
-				r.conn.Close()
-				break
-			}
+		// server asks for a work connection after one in pool is used
+		if _, ok := raw.(*msg.ReqWorkConn); ok && r.reverse {
+			go r.newWorkConn(runID)
+			continue
+		}
 
-			time.Sleep(10 * time.Second)
+		m, ok := raw.(*msg.WorkerCommand)
+		if !ok || r.handleCommand == nil {
+			continue
+		}
+		log.Info("get command [%s] from server", m.Action)
+		resp := &msg.WorkerCommandResp{ID: m.ID}
+		if err = r.handleCommand(m); err != nil {
+			log.Warn("command [%s] from server error: %v", m.Action, err)
+			resp.Error = err.Error()
+		}
+		r.mu.Lock()
+		msg.WriteMsg(conn, resp)
+		r.mu.Unlock()
+
+		// server shows changes made by the command at once
+		r.heartbeat(conn)
+	}
+}
+
+// newWorkConn dials a work connection to server, it's idle in pool until a client connects to server for this worker.
+func (r *Register) newWorkConn(runID string) {
+	conn, err := net.Dial("tcp", r.serverAddr)
+	if err != nil {
+		log.Warn("dial work connection error: %v", err)
+		return
+	}
+	conn = r.wrapConn(conn)
+	if err = msg.WriteMsg(conn, &msg.NewWorkConn{RunID: runID}); err != nil {
+		conn.Close()
+		return
+	}
+
+	// server closes it if the worker is disconnected
+	raw, err := msg.ReadMsg(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	m, ok := raw.(*msg.StartWorkConn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	r.serveWorkConn(&workConn{Conn: conn, remoteAddr: clientAddr(m.ClientAddr)})
+}
+
+// workConn is a connection relayed from the client, it's RemoteAddr is the client's address.
+type workConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *workConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+type clientAddr string
+
+func (a clientAddr) Network() string { return "tcp" }
+func (a clientAddr) String() string  { return string(a) }
+
+func (r *Register) RunKeepAlive() {
+	for {
+		// in case it is closed before
+		if r.conn != nil {
+			r.serve()
 		}
 
 		for {
 			r.mu.Lock()
 			closed := r.closed
 			r.mu.Unlock()
-			if r.closed {
+			if closed {
 				return
 			}
 
@@ -98,7 +308,7 @@ func (r *Register) RunKeepAlive() {
 				time.Sleep(10 * time.Second)
 				continue
 			}
-			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			conn = r.wrapConn(conn)
 
 			r.mu.Lock()
 			closed = r.closed
@@ -131,6 +341,9 @@ func (r *Register) Close() {
 
 // Reset can be only called after Close
 func (r *Register) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.closed = false
+	r.draining = false
 	r.conn = nil
 }
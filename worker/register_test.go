@@ -0,0 +1,31 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func TestRegisterDrain(t *testing.T) {
+	// worker unregisters instead if server can't stop assigning sessions to it
+	r := &Register{serverVersion: msg.ProtocolVersionDrain - 1}
+	if err := r.Drain(); err == nil {
+		t.Fatalf("drain with an old server: expect error")
+	}
+	if r.draining {
+		t.Fatalf("draining is set with an old server")
+	}
+
+	// server is told again after registering again, draining is cleared by Reset
+	r.serverVersion = msg.ProtocolVersion
+	if err := r.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.draining {
+		t.Fatalf("draining is not set")
+	}
+	r.Reset()
+	if r.draining {
+		t.Fatalf("draining is kept after Reset")
+	}
+}
@@ -0,0 +1,330 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// bytes a flow can get at a time
+	schedBurst = 16 * 1024
+
+	// priorities of transfers unused for this long are forgotten
+	priorityTTL = time.Hour
+
+	// how long the flow served last can be waited for
+	schedAnticipation = 5 * time.Millisecond
+)
+
+// weights of priority classes, a flow of higher priority gets more bandwidth when the worker is busy
+var priorityWeights = map[string]float64{
+	msg.PriorityHigh:   4,
+	msg.PriorityNormal: 2,
+	msg.PriorityLow:    1,
+}
+
+type schedRequest struct {
+	flow   *Flow
+	n      int
+	start  float64
+	doneCh chan struct{}
+}
+
+// schedClient is the state of a client IP, it's removed after all of it's sessions and flows are closed.
+type schedClient struct {
+	sessions int
+	flows    int
+
+	// nil if bandwidth of a client is not limited
+	limiter *rate.Limiter
+}
+
+type schedPriority struct {
+	class    string
+	lastUsed time.Time
+}
+
+// Scheduler shares the worker's bandwidth between flows. Tokens of the global limiter are given to waiting
+// flows in order of start-time fair queuing, so each flow gets a share in proportion to the weight of it's
+// priority class. A client IP can be limited in bandwidth and in concurrent sessions.
+type Scheduler struct {
+	global *rate.Limiter
+
+	// virtual time, it's the start tag of the request served last
+	vtime    float64
+	queue    []*schedRequest
+	notifyCh chan struct{}
+
+	clients          map[string]*schedClient
+	maxSessionsPerIP int
+	rateBytePerIP    int
+
+	// priority classes of transfer IDs set by server
+	priorities map[string]*schedPriority
+
+	mu sync.Mutex
+}
+
+// NewScheduler creates a scheduler, rateBytePerIP and maxSessionsPerIP are not limited if they are 0.
+func NewScheduler(rateByte int, rateBytePerIP int, maxSessionsPerIP int) *Scheduler {
+	return &Scheduler{
+		global:           rate.NewLimiter(rate.Limit(float64(rateByte)), schedBurst),
+		notifyCh:         make(chan struct{}, 1),
+		clients:          make(map[string]*schedClient),
+		maxSessionsPerIP: maxSessionsPerIP,
+		rateBytePerIP:    rateBytePerIP,
+		priorities:       make(map[string]*schedPriority),
+	}
+}
+
+// SetRate changes the global rate.
+func (s *Scheduler) SetRate(rateByte int) {
+	s.global.SetLimit(rate.Limit(float64(rateByte)))
+}
+
+// SetPriority sets the priority class of flows of the transfer, existing flows are changed too.
+func (s *Scheduler) SetPriority(id string, class string) error {
+	if _, ok := priorityWeights[class]; !ok {
+		return fmt.Errorf("unknown priority [%s]", class)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.priorities[id] = &schedPriority{
+		class:    class,
+		lastUsed: time.Now(),
+	}
+	return nil
+}
+
+func (s *Scheduler) client(ip string) *schedClient {
+	c, ok := s.clients[ip]
+	if !ok {
+		c = &schedClient{}
+		if s.rateBytePerIP > 0 {
+			c.limiter = rate.NewLimiter(rate.Limit(float64(s.rateBytePerIP)), schedBurst)
+		}
+		s.clients[ip] = c
+	}
+	return c
+}
+
+func (s *Scheduler) releaseClient(ip string, c *schedClient) {
+	if c.sessions == 0 && c.flows == 0 && s.clients[ip] == c {
+		delete(s.clients, ip)
+	}
+}
+
+// Acquire takes a session of the client IP, release should be called after the session is closed.
+func (s *Scheduler) Acquire(ip string) (release func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(ip)
+	if s.maxSessionsPerIP > 0 && c.sessions >= s.maxSessionsPerIP {
+		s.releaseClient(ip, c)
+		return nil, fmt.Errorf("too many sessions from %s", ip)
+	}
+	c.sessions++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			c.sessions--
+			s.releaseClient(ip, c)
+		})
+	}, nil
+}
+
+// NewFlow creates a flow of the transfer reading from the client IP, it should be closed after it's not used.
+func (s *Scheduler) NewFlow(id string, ip string) *Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(ip)
+	c.flows++
+	return &Flow{
+		s:      s,
+		id:     id,
+		ip:     ip,
+		client: c,
+	}
+}
+
+// Run gives tokens to waiting flows one by one.
+// A flow queues again only after it has written the data of it's last request, so the flow served last is waited
+// for a moment if it will be chosen next. Otherwise flows would be served in turn whatever their weights are.
+func (s *Scheduler) Run() {
+	var (
+		last     *Flow
+		deadline time.Time
+	)
+	for {
+		s.mu.Lock()
+		if last != nil && s.anticipate(last) {
+			s.mu.Unlock()
+			if deadline.IsZero() {
+				deadline = time.Now().Add(schedAnticipation)
+			}
+			select {
+			case <-s.notifyCh:
+			case <-time.After(time.Until(deadline)):
+				last = nil
+			}
+			continue
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			last = nil
+			<-s.notifyCh
+			continue
+		}
+		idx := s.next()
+		req := s.queue[idx]
+		s.queue = append(s.queue[:idx], s.queue[idx+1:]...)
+		s.vtime = req.start
+		req.flow.waiting = false
+		last, deadline = req.flow, time.Time{}
+		s.mu.Unlock()
+
+		s.global.WaitN(context.Background(), req.n)
+
+		s.mu.Lock()
+		req.flow.servedAt = time.Now()
+		s.mu.Unlock()
+		close(req.doneCh)
+	}
+}
+
+// anticipate returns true if flow f which doesn't wait now will be chosen next.
+// Flows which didn't queue again in time before are not waited for.
+func (s *Scheduler) anticipate(f *Flow) bool {
+	if f.waiting || f.closed || !f.quick {
+		return false
+	}
+	if len(s.queue) == 0 {
+		return true
+	}
+	start := s.vtime
+	if f.finish > start {
+		start = f.finish
+	}
+	return start < s.queue[s.next()].start
+}
+
+// next returns index of the request with the smallest start tag, requests are in arriving order if they are equal.
+func (s *Scheduler) next() int {
+	idx := 0
+	for i, req := range s.queue {
+		if req.start < s.queue[idx].start {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// RunGC forgets priorities of transfers which are not used for a long time.
+func (s *Scheduler) RunGC() {
+	for {
+		time.Sleep(10 * time.Minute)
+		s.mu.Lock()
+		for id, p := range s.priorities {
+			if time.Since(p.lastUsed) > priorityTTL {
+				delete(s.priorities, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Flow is data read from a client in a session, it's a fio.Limiter.
+type Flow struct {
+	s      *Scheduler
+	id     string
+	ip     string
+	client *schedClient
+
+	// finish tag of the last request
+	finish float64
+	closed bool
+
+	// waiting is true if a request is in queue, quick is true if the flow queued again in time after it was served
+	waiting  bool
+	quick    bool
+	servedAt time.Time
+}
+
+func (f *Flow) Burst() int {
+	return schedBurst
+}
+
+// WaitN waits for the client's limiter and then for the flow's turn to get tokens of the global limiter.
+func (f *Flow) WaitN(ctx context.Context, n int) error {
+	if f.client.limiter != nil {
+		if err := f.client.limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	s := f.s
+	s.mu.Lock()
+	weight := priorityWeights[msg.PriorityNormal]
+	if p, ok := s.priorities[f.id]; ok {
+		weight = priorityWeights[p.class]
+		p.lastUsed = time.Now()
+	}
+	start := s.vtime
+	if f.finish > start {
+		start = f.finish
+	}
+	f.finish = start + float64(n)/weight
+	f.waiting = true
+	f.quick = !f.servedAt.IsZero() && time.Since(f.servedAt) <= schedAnticipation
+	req := &schedRequest{
+		flow:   f,
+		n:      n,
+		start:  start,
+		doneCh: make(chan struct{}),
+	}
+	s.queue = append(s.queue, req)
+	s.mu.Unlock()
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-req.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *Flow) Close() {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.client.flows--
+	s.releaseClient(f.ip, f.client)
+}
+
+// remoteIP returns IP of the remote address of conn.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fatedier/fft/pkg/msg"
+)
+
+func TestSchedulerSessionsPerIP(t *testing.T) {
+	s := NewScheduler(0, 0, 2)
+	release1, err := s.Acquire("1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := s.Acquire("1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Acquire("1.1.1.1"); err == nil {
+		t.Fatalf("sessions more than the limit are acquired")
+	}
+	release3, err := s.Acquire("2.2.2.2")
+	if err != nil {
+		t.Fatalf("sessions of another IP are limited: %v", err)
+	}
+
+	// release is idempotent, a session is given back only once
+	release1()
+	release1()
+	release4, err := s.Acquire("1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Acquire("1.1.1.1"); err == nil {
+		t.Fatalf("sessions more than the limit are acquired after release is called twice")
+	}
+
+	// state of an IP is removed after all of it's sessions and flows are closed
+	flow := s.NewFlow("abc", "1.1.1.1")
+	release2()
+	release3()
+	release4()
+	s.mu.Lock()
+	clients := len(s.clients)
+	s.mu.Unlock()
+	if clients != 1 {
+		t.Fatalf("%d clients are kept, expect 1 with an open flow", clients)
+	}
+	flow.Close()
+	flow.Close()
+	s.mu.Lock()
+	clients = len(s.clients)
+	s.mu.Unlock()
+	if clients != 0 {
+		t.Fatalf("%d clients are kept after all sessions and flows are closed", clients)
+	}
+}
+
+func TestSchedulerRatePerIP(t *testing.T) {
+	s := NewScheduler(100*1024*1024, 4*schedBurst, 0)
+	go s.Run()
+
+	// the first burst is free, the next 2 bursts take half a second
+	flow := s.NewFlow("abc", "1.1.1.1")
+	other := s.NewFlow("def", "2.2.2.2")
+	defer flow.Close()
+	defer other.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := flow.WaitN(context.Background(), schedBurst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("3 bursts from one IP in %s, rate per IP is not limited", elapsed)
+	}
+
+	// another IP has it's own limiter
+	start = time.Now()
+	if err := other.WaitN(context.Background(), schedBurst); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("first burst of another IP takes %s", elapsed)
+	}
+}
+
+// runFlows reads bursts through flows as fast as the scheduler allows for d, it returns bursts of each flow.
+func runFlows(flows []*Flow, d time.Duration) []int64 {
+	counts := make([]int64, len(flows))
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var wait sync.WaitGroup
+	for i, f := range flows {
+		wait.Add(1)
+		go func(i int, f *Flow) {
+			defer wait.Done()
+			for f.WaitN(ctx, schedBurst) == nil {
+				atomic.AddInt64(&counts[i], 1)
+			}
+		}(i, f)
+	}
+	wait.Wait()
+	return counts
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	// 64 bursts per second are shared
+	s := NewScheduler(64*schedBurst, 0, 0)
+	go s.Run()
+
+	// flows of the same priority get the same share, whoever comes first
+	a := s.NewFlow("a", "1.1.1.1")
+	b := s.NewFlow("b", "2.2.2.2")
+	counts := runFlows([]*Flow{a, b}, time.Second)
+	a.Close()
+	b.Close()
+	if ratio := float64(counts[0]) / float64(counts[1]); ratio < 0.7 || ratio > 1.4 {
+		t.Fatalf("flows of the same priority get %d and %d bursts", counts[0], counts[1])
+	}
+
+	// shares are in proportion to weights of priorities
+	if err := s.SetPriority("high", msg.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPriority("low", msg.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPriority("bad", "urgent"); err == nil {
+		t.Fatalf("unknown priority is set")
+	}
+	high := s.NewFlow("high", "1.1.1.1")
+	low := s.NewFlow("low", "2.2.2.2")
+	counts = runFlows([]*Flow{high, low}, 2*time.Second)
+	high.Close()
+	low.Close()
+	if ratio := float64(counts[0]) / float64(counts[1]); ratio < 2.5 || ratio > 6 {
+		t.Fatalf("high and low priority flows get %d and %d bursts, expect about 4:1", counts[0], counts[1])
+	}
+}
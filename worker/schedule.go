@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// rateWindow is a time range on weekdays, end is less than or equal to start if it crosses midnight.
+// start and end are minutes of a day.
+type rateWindow struct {
+	weekdays [7]bool
+	start    int
+	end      int
+	rateKB   int
+}
+
+func (w *rateWindow) match(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	wd := int(t.Weekday())
+	if w.start < w.end {
+		return w.weekdays[wd] && m >= w.start && m < w.end
+	}
+	// the part after midnight belongs to the day before
+	return (w.weekdays[wd] && m >= w.start) || (w.weekdays[(wd+6)%7] && m < w.end)
+}
+
+// RateSchedule changes rate in time windows, the first matched window is used.
+type RateSchedule []rateWindow
+
+// ParseRateSchedule parses windows separated by ';', each one is like "[weekdays ]HH:MM-HH:MM=rate".
+// Weekdays are like "mon-fri" or "sat,sun", every day is matched if they are omitted. Rate's unit is KB.
+// For example: "mon-fri 09:00-18:00=1024;22:00-08:00=8192".
+func ParseRateSchedule(s string) (RateSchedule, error) {
+	rs := make(RateSchedule, 0)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		w, err := parseRateWindow(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate window [%s]: %v", item, err)
+		}
+		rs = append(rs, w)
+	}
+	return rs, nil
+}
+
+func parseRateWindow(s string) (w rateWindow, err error) {
+	eq := strings.LastIndex(s, "=")
+	if eq < 0 {
+		return w, fmt.Errorf("rate is required")
+	}
+	if w.rateKB, err = strconv.Atoi(strings.TrimSpace(s[eq+1:])); err != nil {
+		return w, fmt.Errorf("invalid rate")
+	}
+	if w.rateKB < 50 {
+		return w, fmt.Errorf("rate should be greater than 50KB")
+	}
+
+	fields := strings.Fields(s[:eq])
+	switch len(fields) {
+	case 1:
+		for i := range w.weekdays {
+			w.weekdays[i] = true
+		}
+	case 2:
+		if w.weekdays, err = parseWeekdays(fields[0]); err != nil {
+			return
+		}
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("time range is required")
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("invalid time range")
+	}
+	if w.start, err = parseClock(times[0]); err != nil {
+		return
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM to minutes of a day, 24:00 is the end of a day.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("invalid time [%s]", s)
+}
+
+func parseWeekdays(s string) (weekdays [7]bool, err error) {
+	for _, part := range strings.Split(s, ",") {
+		names := strings.Split(part, "-")
+		if len(names) > 2 {
+			return weekdays, fmt.Errorf("invalid weekdays [%s]", part)
+		}
+		from, err := ParseWeekday(names[0])
+		if err != nil {
+			return weekdays, err
+		}
+		to := from
+		if len(names) == 2 {
+			if to, err = ParseWeekday(names[1]); err != nil {
+				return weekdays, err
+			}
+		}
+		// mon-fri or fri-mon
+		for d := from; ; d = (d + 1) % 7 {
+			weekdays[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return weekdays, nil
+}
+
+// ParseWeekday parses short names of weekdays like "mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range weekdayNames {
+		if s == name {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday [%s]", s)
+}
+
+// RateKB returns rate of the first window t is in, or defaultRateKB.
+func (rs RateSchedule) RateKB(t time.Time, defaultRateKB int) int {
+	for i := range rs {
+		if rs[i].match(t) {
+			return rs[i].rateKB
+		}
+	}
+	return defaultRateKB
+}
@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	for _, s := range []string{
+		"09:00-18:00",
+		"09:00-18:00=abc",
+		"09:00-18:00=10",
+		"09:00=1024",
+		"9am-6pm=1024",
+		"mon-fri sat 09:00-18:00=1024",
+		"monday 09:00-18:00=1024",
+		"mon-tue-wed 09:00-18:00=1024",
+		"09:00-25:00=1024",
+	} {
+		if _, err := ParseRateSchedule(s); err == nil {
+			t.Fatalf("%q: expect error", s)
+		}
+	}
+
+	rs, err := ParseRateSchedule(" mon-fri 09:00-18:00=1024; ;sat,sun 00:00-24:00=4096;22:00-08:00=8192 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 {
+		t.Fatalf("%d windows are parsed, expect 3", len(rs))
+	}
+}
+
+func TestRateScheduleRateKB(t *testing.T) {
+	rs, err := ParseRateSchedule("mon-fri 09:00-18:00=1024;sat,sun 00:00-24:00=4096;22:00-08:00=8192;fri-mon 20:00-21:00=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2019-03-18 is a monday
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2019, 3, 18+day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		t      time.Time
+		expect int
+	}{
+		{at(0, "09:00"), 1024},
+		{at(0, "17:59"), 1024},
+		{at(0, "18:00"), 512},
+		{at(4, "12:00"), 1024},
+		{at(5, "12:00"), 4096},
+		{at(6, "23:59"), 4096},
+		// the window after midnight belongs to the day before
+		{at(1, "23:00"), 8192},
+		{at(2, "07:59"), 8192},
+		{at(2, "08:00"), 512},
+		// the first matched window is used
+		{at(5, "23:00"), 4096},
+		// fri-mon wraps around the week
+		{at(4, "20:30"), 100},
+		{at(0, "20:30"), 100},
+		{at(1, "20:30"), 512},
+	}
+	for _, test := range tests {
+		if rate := rs.RateKB(test.t, 512); rate != test.expect {
+			t.Fatalf("%s: rate is %d, expect %d", test.t.Format("Mon 15:04"), rate, test.expect)
+		}
+	}
+
+	var empty RateSchedule
+	if rate := empty.RateKB(at(0, "12:00"), 512); rate != 512 {
+		t.Fatalf("empty schedule: rate is %d, expect the default", rate)
+	}
+}
@@ -7,15 +7,42 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	fio "github.com/fatedier/fft/pkg/io"
 	"github.com/fatedier/fft/pkg/log"
 	"github.com/fatedier/fft/pkg/msg"
 )
 
+const (
+	// first byte of a TLS ClientHello
+	tlsRecordTypeHandshake = 0x16
+
+	// how often a draining worker checks whether sessions are finished
+	drainCheckInterval = time.Second
+)
+
+// directions of traffic counted in quotas, in is bytes worker reads from connections and out is bytes it writes
+const (
+	QuotaDirectionIn   = "in"
+	QuotaDirectionOut  = "out"
+	QuotaDirectionBoth = "both"
+)
+
+// capabilities which fftw supports.
+// CapEncryption means clients can connect without TLS since data has been encrypted end to end.
+// CapFanout means worker can copy frames from one sender to many receivers.
+// CapSwarm means worker can forward chunks between participants of a swarm.
+var capabilities = []string{msg.CapEncryption, msg.CapFanout, msg.CapSwarm}
+
 type Options struct {
 	ServerAddr         string
 	BindAddr           string
@@ -23,6 +50,47 @@ type Options struct {
 	RateKB             int // xx KB/s
 	MaxTrafficMBPerDay int // xx MB, 0 is no limit
 
+	// rate in time windows, see ParseRateSchedule
+	RateSchedule string
+
+	// bandwidth and concurrent sessions of each client IP, 0 is no limit
+	RatePerIPKB      int // xx KB/s
+	MaxSessionsPerIP int
+
+	// weeks begin on QuotaResetWeekday and months begin on QuotaResetDay in Timezone
+	MaxTrafficMBPerWeek  int // xx MB, 0 is no limit
+	MaxTrafficMBPerMonth int // xx MB, 0 is no limit
+	QuotaResetWeekday    string
+	QuotaResetDay        int
+	Timezone             string
+
+	// traffic counts are kept in QuotaFile across restarts if it's not empty
+	QuotaFile string
+
+	// traffic of QuotaDirection is counted in quotas, it's in, out or both
+	QuotaDirection string
+
+	// traffic of each day is saved to LedgerFile if it's not empty
+	LedgerFile string
+
+	// store files uploaded in mailbox mode if StorageDir is not empty
+	StorageDir               string
+	StorageQuotaMB           int // xx MB, 0 is no limit
+	StorageMaxRetentionHours int
+
+	// seconds existing sessions can last after the worker starts draining
+	DrainTimeoutSeconds int
+
+	// admin commands like drain are accepted on AdminAddr if it's not empty,
+	// they must carry AdminToken which is required if AdminAddr is not a loopback address
+	AdminAddr  string
+	AdminToken string
+
+	// a reverse worker is behind NAT and doesn't listen on BindAddr, clients are relayed by server
+	// through ReversePoolCount idle work connections it keeps
+	Reverse          bool
+	ReversePoolCount int
+
 	LogFile    string
 	LogLevel   string
 	LogMaxDays int64
@@ -38,20 +106,92 @@ func (op *Options) Check() error {
 	if op.MaxTrafficMBPerDay < 128 && op.MaxTrafficMBPerDay != 0 {
 		return fmt.Errorf("max_traffic_per_day should be greater than 128MB")
 	}
+	if op.RatePerIPKB < 50 && op.RatePerIPKB != 0 {
+		return fmt.Errorf("rate_per_ip should be greater than 50KB")
+	}
+	if op.MaxSessionsPerIP < 0 {
+		return fmt.Errorf("max_sessions_per_ip should not be less than 0")
+	}
+	if op.MaxTrafficMBPerWeek < 128 && op.MaxTrafficMBPerWeek != 0 {
+		return fmt.Errorf("max_traffic_per_week should be greater than 128MB")
+	}
+	if op.MaxTrafficMBPerMonth < 128 && op.MaxTrafficMBPerMonth != 0 {
+		return fmt.Errorf("max_traffic_per_month should be greater than 128MB")
+	}
+	if op.AdminAddr != "" && op.AdminToken == "" && !isLoopbackAddr(op.AdminAddr) {
+		return fmt.Errorf("admin_token is required if admin_addr is not a loopback address")
+	}
+	if op.QuotaResetDay < 1 || op.QuotaResetDay > 31 {
+		return fmt.Errorf("quota_reset_day should be between 1 and 31")
+	}
+	if _, err := ParseWeekday(op.QuotaResetWeekday); err != nil {
+		return fmt.Errorf("quota_reset_weekday: %v", err)
+	}
+	if _, err := loadLocation(op.Timezone); err != nil {
+		return fmt.Errorf("timezone: %v", err)
+	}
+	switch op.QuotaDirection {
+	case QuotaDirectionIn, QuotaDirectionOut, QuotaDirectionBoth:
+	default:
+		return fmt.Errorf("quota_direction should be in, out or both")
+	}
+	if _, err := ParseRateSchedule(op.RateSchedule); err != nil {
+		return fmt.Errorf("rate_schedule: %v", err)
+	}
+	if op.DrainTimeoutSeconds < 0 {
+		return fmt.Errorf("drain_timeout should not be less than 0")
+	}
+	if op.Reverse && op.ReversePoolCount <= 0 {
+		return fmt.Errorf("reverse_pool should be greater than 0")
+	}
+	if op.StorageDir != "" {
+		if op.StorageQuotaMB < 0 {
+			return fmt.Errorf("storage_quota should not be less than 0")
+		}
+		if op.StorageMaxRetentionHours <= 0 {
+			return fmt.Errorf("storage_max_retention should be greater than 0")
+		}
+	}
 	return nil
 }
 
 type Service struct {
-	serverAddr         string
-	advicePublicIP     string
-	rateKB             int
-	maxTrafficMBPerDay int
+	serverAddr     string
+	advicePublicIP string
+	rateKB         int
+
+	// rate is changed by rateSchedule in location, currentRateKB is the one in use
+	rateSchedule  RateSchedule
+	location      *time.Location
+	currentRateKB int
 
 	l              net.Listener
+	sched          *Scheduler
 	matchCtl       *MatchController
+	fanoutCtl      *FanoutController
+	swarmRelay     *SwarmRelay
 	register       *Register
 	trafficLimiter *TrafficLimiter
+	quotaDirection string
+	ledger         *Ledger
+	storage        *Storage
 	tlsConfig      *tls.Config
+	adminAddr      string
+	adminToken     string
+
+	// drainDoneCh is closed after the worker is drained, it's nil if the worker is not draining.
+	// Draining stops if undrainCh is closed.
+	drainTimeout  time.Duration
+	drainDoneCh   chan struct{}
+	undrainCh     chan struct{}
+	drainForQuota bool
+	exiting       bool
+
+	// traffic when stats are sent last time
+	lastOut     uint64
+	lastStatsAt time.Time
+
+	mu sync.Mutex
 
 	stopCh chan struct{}
 }
@@ -67,57 +207,130 @@ func NewService(options Options) (*Service, error) {
 	}
 	log.InitLog(logway, options.LogFile, options.LogLevel, options.LogMaxDays)
 
-	l, err := net.Listen("tcp", options.BindAddr)
-	if err != nil {
-		return nil, err
-	}
-	log.Info("fftw listen on: %s", l.Addr().String())
+	var (
+		l    net.Listener
+		port int
+		err  error
+	)
+	if options.Reverse {
+		log.Info("fftw serves clients through server as a reverse worker")
+	} else {
+		l, err = net.Listen("tcp", options.BindAddr)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("fftw listen on: %s", l.Addr().String())
 
-	_, portStr, err := net.SplitHostPort(l.Addr().String())
-	if err != nil {
-		return nil, fmt.Errorf("get bind port error, bind address: %v", l.Addr().String())
+		_, portStr, err := net.SplitHostPort(l.Addr().String())
+		if err != nil {
+			return nil, fmt.Errorf("get bind port error, bind address: %v", l.Addr().String())
+		}
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("get bind port error: %v", err)
+		}
 	}
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, fmt.Errorf("get bind port error: %v", err)
+
+	var storage *Storage
+	caps := capabilities
+	if options.StorageDir != "" {
+		storage, err = NewStorage(options.StorageDir, int64(options.StorageQuotaMB)*1024*1024,
+			time.Duration(options.StorageMaxRetentionHours)*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("new storage error: %v", err)
+		}
+		caps = append([]string{msg.CapMailbox}, capabilities...)
 	}
 
-	register, err := NewRegister(int64(port), options.AdvicePublicIP, options.ServerAddr)
+	register, err := NewRegister(int64(port), options.AdvicePublicIP, options.ServerAddr, caps)
 	if err != nil {
 		return nil, fmt.Errorf("new register error: %v", err)
 	}
 
 	svc := &Service{
-		serverAddr:         options.ServerAddr,
-		advicePublicIP:     options.AdvicePublicIP,
-		rateKB:             options.RateKB,
-		maxTrafficMBPerDay: options.MaxTrafficMBPerDay,
+		serverAddr:     options.ServerAddr,
+		advicePublicIP: options.AdvicePublicIP,
+		rateKB:         options.RateKB,
 
-		l:         l,
-		register:  register,
-		tlsConfig: generateTLSConfig(),
+		l:          l,
+		register:   register,
+		storage:    storage,
+		tlsConfig:  generateTLSConfig(),
+		adminAddr:  options.AdminAddr,
+		adminToken: options.AdminToken,
+
+		drainTimeout: time.Duration(options.DrainTimeoutSeconds) * time.Second,
 
 		stopCh: make(chan struct{}),
 	}
 
-	svc.trafficLimiter = NewTrafficLimiter(uint64(options.MaxTrafficMBPerDay*1024*1024), func() {
-		svc.register.Close()
-		log.Info("reach traffic limit %dMB one day, unregister from server", options.MaxTrafficMBPerDay)
+	// they are checked in options.Check
+	svc.location, _ = loadLocation(options.Timezone)
+	svc.rateSchedule, _ = ParseRateSchedule(options.RateSchedule)
+	resetWeekday, _ := ParseWeekday(options.QuotaResetWeekday)
+
+	svc.trafficLimiter = NewTrafficLimiter(TrafficLimiterOptions{
+		MaxCountPerDay:   uint64(options.MaxTrafficMBPerDay) * 1024 * 1024,
+		MaxCountPerWeek:  uint64(options.MaxTrafficMBPerWeek) * 1024 * 1024,
+		MaxCountPerMonth: uint64(options.MaxTrafficMBPerMonth) * 1024 * 1024,
+		ResetWeekday:     resetWeekday,
+		ResetDay:         options.QuotaResetDay,
+		Location:         svc.location,
+		File:             options.QuotaFile,
 	}, func() {
-		svc.register.Reset()
-		go svc.register.RunKeepAlive()
-		log.Info("restore from traffic limit since it's a new day")
+		svc.mu.Lock()
+		svc.drainForQuota = svc.drainDoneCh == nil
+		svc.mu.Unlock()
+		svc.Drain(0)
+	}, func() {
+		if svc.resume() {
+			log.Info("restore from traffic limit")
+		}
 	})
 
-	svc.matchCtl = NewMatchController(options.RateKB*1024, func(n int) {
-		svc.trafficLimiter.AddCount(uint64(n))
-	})
+	svc.quotaDirection = options.QuotaDirection
+	svc.ledger = NewLedger(options.LedgerFile, svc.location)
+
+	svc.sched = NewScheduler(options.RateKB*1024, options.RatePerIPKB*1024, options.MaxSessionsPerIP)
+	svc.matchCtl = NewMatchController(svc.sched)
+	svc.fanoutCtl = NewFanoutController(svc.sched)
+	svc.swarmRelay = NewSwarmRelay(svc.sched)
+
+	register.stats = svc.stats
+	register.handleCommand = svc.handleCommand
+	register.countTraffic = svc.countTraffic
+	if options.Reverse {
+		// work connections are counted by register
+		register.reverse = true
+		register.poolCount = options.ReversePoolCount
+		register.serveWorkConn = func(conn net.Conn) {
+			svc.handleConn(conn, nil)
+		}
+	}
 	return svc, nil
 }
 
 func (svc *Service) Run() error {
-	go svc.worker()
+	go svc.sched.Run()
+	go svc.sched.RunGC()
+	if svc.l != nil {
+		go svc.worker()
+	}
 	go svc.trafficLimiter.Run()
+	go svc.ledger.Run()
+	go svc.runRateSchedule()
+	if svc.storage != nil {
+		go svc.storage.RunGC()
+	}
+
+	if svc.adminAddr != "" {
+		l, err := net.Listen("tcp", svc.adminAddr)
+		if err != nil {
+			return fmt.Errorf("listen admin address error: %v", err)
+		}
+		log.Info("fftw admin listen on: %s", l.Addr().String())
+		go svc.runAdmin(l)
+	}
 
 	err := svc.register.Register()
 	if err != nil {
@@ -125,28 +338,328 @@ func (svc *Service) Run() error {
 	}
 	log.Info("register to server success")
 
-	svc.register.RunKeepAlive()
-	<-svc.stopCh
+	go svc.register.RunKeepAlive()
+
+	// drain before exit, exit at once if it's signaled again
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	select {
+	case <-sigCh:
+	case <-svc.stopCh:
+		return nil
+	}
+	log.Info("drain before exit, send SIGTERM again to exit at once")
+	svc.mu.Lock()
+	svc.exiting = true
+	svc.mu.Unlock()
+	select {
+	case <-svc.Drain(0):
+	case <-sigCh:
+	}
+	if err = svc.trafficLimiter.Save(); err != nil {
+		log.Warn("save traffic counts error: %v", err)
+	}
+	if err = svc.ledger.Save(); err != nil {
+		log.Warn("save traffic ledger error: %v", err)
+	}
 	return nil
 }
 
+// countTraffic is called with bytes read from and written to all connections, including the one to server.
+func (svc *Service) countTraffic(in int, out int) {
+	svc.ledger.Add(in, out)
+
+	var count int
+	switch svc.quotaDirection {
+	case QuotaDirectionIn:
+		count = in
+	case QuotaDirectionOut:
+		count = out
+	default:
+		count = in + out
+	}
+	if count > 0 {
+		svc.trafficLimiter.AddCount(uint64(count))
+	}
+}
+
+// loadLocation returns local time zone if name is empty.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// runRateSchedule changes rate when a window in rate schedule begins or ends.
+func (svc *Service) runRateSchedule() {
+	for {
+		svc.updateRate()
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// updateRate changes rate to the one in rate schedule, or the default one.
+func (svc *Service) updateRate() {
+	svc.mu.Lock()
+	rateKB := svc.rateSchedule.RateKB(time.Now().In(svc.location), svc.rateKB)
+	changed := rateKB != svc.currentRateKB
+	svc.currentRateKB = rateKB
+	svc.mu.Unlock()
+
+	if changed {
+		svc.sched.SetRate(rateKB * 1024)
+		log.Info("rate is %dKB/s now", rateKB)
+	}
+}
+
+// Drain stops taking new sessions and tells server not to assign new ones to this worker, existing sessions
+// can finish or move to other workers until timeout, then they are closed. The drained worker keeps registered
+// if server can push commands to it, or it unregisters from server. Default timeout is used if timeout is 0.
+// It returns a channel closed after the worker is drained or undrained, the first drain goes on if it's called again.
+func (svc *Service) Drain(timeout time.Duration) <-chan struct{} {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.drainDoneCh != nil {
+		return svc.drainDoneCh
+	}
+	if timeout <= 0 {
+		timeout = svc.drainTimeout
+	}
+	doneCh, undrainCh := make(chan struct{}), make(chan struct{})
+	svc.drainDoneCh, svc.undrainCh = doneCh, undrainCh
+
+	go func() {
+		defer close(doneCh)
+		log.Info("start draining, %d sessions left, wait them for %s", svc.activeSessions(), timeout)
+		if err := svc.register.Drain(); err != nil {
+			// server will assign new sessions, unregister at once
+			log.Warn("%v, unregister from server", err)
+			svc.register.Close()
+		}
+
+		deadline := time.Now().Add(timeout)
+		for svc.activeSessions() > 0 && time.Now().Before(deadline) {
+			select {
+			case <-time.After(drainCheckInterval):
+			case <-undrainCh:
+				return
+			}
+		}
+		if n := svc.activeSessions(); n > 0 {
+			log.Info("drain timeout, close %d sessions", n)
+			svc.matchCtl.CloseAll()
+			svc.fanoutCtl.CloseAll()
+			svc.swarmRelay.CloseAll()
+		}
+		if svc.register.Controlled() {
+			log.Info("drained, keep registered for commands from server")
+			return
+		}
+		svc.register.Close()
+		log.Info("drained, unregister from server")
+	}()
+	return doneCh
+}
+
+// resume takes new sessions again if the worker is drained because of traffic limit.
+func (svc *Service) resume() bool {
+	svc.mu.Lock()
+	forQuota := svc.drainForQuota
+	svc.mu.Unlock()
+	return forQuota && svc.undrain() == nil
+}
+
+// undrain stops draining or takes new sessions again after drained, the worker registers to server again
+// if it has unregistered.
+func (svc *Service) undrain() error {
+	svc.mu.Lock()
+	if svc.exiting {
+		svc.mu.Unlock()
+		return fmt.Errorf("worker is exiting")
+	}
+	doneCh := svc.drainDoneCh
+	if doneCh == nil {
+		svc.mu.Unlock()
+		return fmt.Errorf("worker is not draining")
+	}
+	close(svc.undrainCh)
+	svc.drainDoneCh, svc.undrainCh = nil, nil
+	svc.drainForQuota = false
+	svc.mu.Unlock()
+
+	<-doneCh
+	if !svc.register.Undrain() {
+		svc.register.Reset()
+		go svc.register.RunKeepAlive()
+	}
+	log.Info("undrained, take new sessions again")
+	return nil
+}
+
+// handleCommand handles commands pushed by server.
+func (svc *Service) handleCommand(m *msg.WorkerCommand) error {
+	switch m.Action {
+	case msg.WorkerActionConfig:
+		return svc.applyConfig(&m.Config)
+	case msg.WorkerActionDrain:
+		if m.Timeout < 0 {
+			return fmt.Errorf("invalid timeout %d", m.Timeout)
+		}
+		svc.Drain(time.Duration(m.Timeout) * time.Second)
+	case msg.WorkerActionUndrain:
+		return svc.undrain()
+	case msg.WorkerActionResetQuota:
+		svc.trafficLimiter.Reset()
+	case msg.WorkerActionPriority:
+		return svc.sched.SetPriority(m.Transfer, m.Priority)
+	case msg.WorkerActionMailbox:
+		if svc.storage == nil {
+			return fmt.Errorf("storage is not enabled on this worker")
+		}
+		if err := svc.storage.Open(m.Mailbox, m.UploadToken, time.Unix(m.ExpireAt, 0)); err != nil {
+			log.Warn("open mailbox [%s] error: %v", m.Mailbox, err)
+			return fmt.Errorf("open mailbox error")
+		}
+	default:
+		return fmt.Errorf("unknown action [%s]", m.Action)
+	}
+	return nil
+}
+
+// applyConfig changes options which can be changed in running, nothing is changed if any of them is invalid.
+func (svc *Service) applyConfig(c *msg.WorkerConfig) error {
+	if c.RateKB != nil && *c.RateKB < 50 {
+		return fmt.Errorf("rate should be greater than 50KB")
+	}
+	limits := []struct {
+		name   string
+		period string
+		mb     *int64
+	}{
+		{"max_traffic_per_day", PeriodDay, c.MaxTrafficMBPerDay},
+		{"max_traffic_per_week", PeriodWeek, c.MaxTrafficMBPerWeek},
+		{"max_traffic_per_month", PeriodMonth, c.MaxTrafficMBPerMonth},
+	}
+	for _, l := range limits {
+		if l.mb != nil && *l.mb < 128 && *l.mb != 0 {
+			return fmt.Errorf("%s should be greater than 128MB", l.name)
+		}
+	}
+	if c.DrainTimeoutSeconds != nil && *c.DrainTimeoutSeconds < 0 {
+		return fmt.Errorf("drain_timeout should not be less than 0")
+	}
+	var schedule RateSchedule
+	if c.RateSchedule != nil {
+		var err error
+		if schedule, err = ParseRateSchedule(*c.RateSchedule); err != nil {
+			return fmt.Errorf("rate_schedule: %v", err)
+		}
+	}
+
+	svc.mu.Lock()
+	if c.RateKB != nil {
+		svc.rateKB = int(*c.RateKB)
+		log.Info("rate is changed to %dKB/s", *c.RateKB)
+	}
+	if c.RateSchedule != nil {
+		svc.rateSchedule = schedule
+		log.Info("rate_schedule is changed to [%s]", *c.RateSchedule)
+	}
+	if c.DrainTimeoutSeconds != nil {
+		svc.drainTimeout = time.Duration(*c.DrainTimeoutSeconds) * time.Second
+		log.Info("drain_timeout is changed to %ds", *c.DrainTimeoutSeconds)
+	}
+	svc.mu.Unlock()
+	svc.updateRate()
+
+	// the worker may drain or resume at once, so they are set without the lock
+	for _, l := range limits {
+		if l.mb != nil {
+			log.Info("%s is changed to %dMB", l.name, *l.mb)
+			svc.trafficLimiter.SetLimit(l.period, uint64(*l.mb)*1024*1024)
+		}
+	}
+	return nil
+}
+
+// stats are sent to server as heartbeats.
+func (svc *Service) stats() *msg.WorkerStats {
+	now := time.Now()
+	_, totalOut := svc.ledger.Total()
+	inToday, outToday := svc.ledger.Today()
+
+	svc.mu.Lock()
+	var bytesPerSecond int64
+	if elapsed := now.Sub(svc.lastStatsAt).Seconds(); !svc.lastStatsAt.IsZero() && elapsed > 0 {
+		bytesPerSecond = int64(float64(totalOut-svc.lastOut) / elapsed)
+	}
+	svc.lastOut, svc.lastStatsAt = totalOut, now
+	m := &msg.WorkerStats{
+		Sessions:         int64(svc.activeSessions()),
+		BytesPerSecond:   bytesPerSecond,
+		RateKB:           int64(svc.currentRateKB),
+		TrafficToday:     int64(svc.trafficLimiter.Count(PeriodDay)),
+		RemainingTraffic: svc.trafficLimiter.Remaining(),
+		TrafficInToday:   int64(inToday),
+		TrafficOutToday:  int64(outToday),
+		Draining:         svc.drainDoneCh != nil,
+	}
+	svc.mu.Unlock()
+	return m
+}
+
+func (svc *Service) isDraining() bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.drainDoneCh != nil
+}
+
+// activeSessions returns how many transfers are relayed through this worker.
+func (svc *Service) activeSessions() int {
+	return svc.matchCtl.Active() + svc.fanoutCtl.Active() + svc.swarmRelay.Active()
+}
+
 func (svc *Service) worker() error {
 	for {
 		conn, err := svc.l.Accept()
 		if err != nil {
 			return err
 		}
-		conn = tls.Server(conn, svc.tlsConfig)
-		go svc.handleConn(conn)
+		go svc.handleConn(conn, svc.countTraffic)
 	}
 }
 
-func (svc *Service) handleConn(conn net.Conn) {
+// handleConn serves a connection from client, bytes of it are counted by countTraffic if it's not nil.
+func (svc *Service) handleConn(rawConn net.Conn, countTraffic func(in int, out int)) {
 	var (
 		rawMsg msg.Message
 		err    error
 	)
 
+	// all bytes including TLS records are counted
+	counter := fio.NewCountConn(rawConn, countTraffic)
+
+	// TLS is optional if frames are encrypted end to end by clients,
+	// plain connections can be relayed in kernel.
+	counter.SetReadDeadline(time.Now().Add(5 * time.Second))
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(counter, first); err != nil {
+		counter.Close()
+		return
+	}
+
+	var (
+		conn    net.Conn
+		tcpConn *net.TCPConn
+	)
+	if first[0] == tlsRecordTypeHandshake {
+		conn = tls.Server(fio.NewPrefixConn(counter, first), svc.tlsConfig)
+	} else {
+		conn = fio.NewPrefixConn(counter, first)
+		tcpConn, _ = rawConn.(*net.TCPConn)
+	}
+
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	if rawMsg, err = msg.ReadMsg(conn); err != nil {
 		conn.Close()
@@ -154,22 +667,97 @@ func (svc *Service) handleConn(conn net.Conn) {
 	}
 	conn.SetReadDeadline(time.Time{})
 
+	// clients move to other workers after they get errors
+	var release func()
+	if _, isPing := rawMsg.(*msg.Ping); !isPing && svc.isDraining() {
+		err = fmt.Errorf("worker is draining")
+	} else if isSession(rawMsg) {
+		release, err = svc.sched.Acquire(remoteIP(rawConn))
+	}
+	if id := streamID(rawMsg); id != "" {
+		conn = &streamConn{Conn: conn, id: id, counter: counter, release: release}
+	}
+
 	switch m := rawMsg.(type) {
 	case *msg.NewSendFileStream:
 		log.Debug("new send file stream [%s]", m.ID)
-		tc := NewTransferConn(m.ID, conn, true)
-		if err = svc.matchCtl.DealTransferConn(tc, 20*time.Second); err != nil {
+		if err == nil {
+			err = msg.CheckProtocolVersion(m.ProtocolVersion)
+		}
+		if err == nil && m.Receivers > 1 {
+			err = svc.fanoutCtl.DealSendConn(m.ID, m.Auth, m.Capabilities, conn, int(m.Receivers))
+		} else if err == nil {
+			tc := NewTransferConn(m.ID, m.Auth, m.Capabilities, conn, tcpConn, counter, true)
+			err = svc.matchCtl.DealTransferConn(tc, 20*time.Second)
+		}
+		if err != nil {
 			msg.WriteMsg(conn, &msg.NewSendFileStreamResp{
-				Error: err.Error(),
+				ProtocolVersion: msg.ProtocolVersion,
+				Capabilities:    msg.IntersectCapabilities(capabilities, m.Capabilities),
+				Error:           err.Error(),
 			})
 			conn.Close()
 		}
 	case *msg.NewReceiveFileStream:
 		log.Debug("new recv file stream [%s]", m.ID)
-		tc := NewTransferConn(m.ID, conn, false)
-		if err = svc.matchCtl.DealTransferConn(tc, 20*time.Second); err != nil {
+		if err == nil {
+			err = msg.CheckProtocolVersion(m.ProtocolVersion)
+		}
+		if err == nil && m.Fanout {
+			err = svc.fanoutCtl.DealRecvConn(m.ID, m.Auth, m.Capabilities, conn, 20*time.Second)
+		} else if err == nil {
+			tc := NewTransferConn(m.ID, m.Auth, m.Capabilities, conn, tcpConn, counter, false)
+			err = svc.matchCtl.DealTransferConn(tc, 20*time.Second)
+		}
+		if err != nil {
 			msg.WriteMsg(conn, &msg.NewReceiveFileStreamResp{
-				Error: err.Error(),
+				ProtocolVersion: msg.ProtocolVersion,
+				Capabilities:    msg.IntersectCapabilities(capabilities, m.Capabilities),
+				Error:           err.Error(),
+			})
+			conn.Close()
+		}
+	case *msg.NewStoreStream:
+		log.Debug("new store stream [%s]", m.ID)
+		if err == nil {
+			err = svc.handleStoreStream(conn, m)
+		}
+		if err != nil {
+			msg.WriteMsg(conn, &msg.NewStoreStreamResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
+			})
+			conn.Close()
+		}
+	case *msg.NewFetchStream:
+		log.Debug("new fetch stream [%s]", m.ID)
+		if err == nil && m.Swarm {
+			err = msg.CheckProtocolVersion(m.ProtocolVersion)
+			if err == nil {
+				err = svc.swarmRelay.DealFetchConn(m.ID, conn)
+			}
+		} else if err == nil {
+			err = svc.handleFetchStream(conn, m)
+		}
+		if err != nil {
+			msg.WriteMsg(conn, &msg.NewFetchStreamResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
+			})
+			conn.Close()
+		}
+	case *msg.NewSeedStream:
+		log.Debug("new seed stream [%s] peer %d", m.ID, m.Peer)
+		if err == nil {
+			err = msg.CheckProtocolVersion(m.ProtocolVersion)
+		}
+		if err == nil {
+			err = svc.swarmRelay.DealSeedConn(m.ID, m.Peer, conn)
+		}
+		if err != nil {
+			msg.WriteMsg(conn, &msg.NewSeedStreamResp{
+				ProtocolVersion: msg.ProtocolVersion,
+				Error:           err.Error(),
 			})
 			conn.Close()
 		}
@@ -184,6 +772,35 @@ func (svc *Service) handleConn(conn net.Conn) {
 	}
 }
 
+// isSession returns true if the stream is the source of a pair, it's counted in sessions of the client IP.
+// Receivers waiting for senders are not counted, or pairs from the same IP could block each other.
+func isSession(m msg.Message) bool {
+	switch m := m.(type) {
+	case *msg.NewSendFileStream, *msg.NewStoreStream, *msg.NewSeedStream:
+		return true
+	case *msg.NewFetchStream:
+		return !m.Swarm
+	}
+	return false
+}
+
+// streamID returns ID of the transfer a stream belongs to, or empty string if it's not a stream.
+func streamID(m msg.Message) string {
+	switch m := m.(type) {
+	case *msg.NewSendFileStream:
+		return m.ID
+	case *msg.NewReceiveFileStream:
+		return m.ID
+	case *msg.NewStoreStream:
+		return m.ID
+	case *msg.NewFetchStream:
+		return m.ID
+	case *msg.NewSeedStream:
+		return m.ID
+	}
+	return ""
+}
+
 // Setup a bare-bones TLS config for the server
 func generateTLSConfig() *tls.Config {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
@@ -204,3 +821,26 @@ func generateTLSConfig() *tls.Config {
 	}
 	return &tls.Config{Certificates: []tls.Certificate{tlsCert}}
 }
+
+// streamConn logs traffic of a stream and releases it's session after it's closed.
+type streamConn struct {
+	net.Conn
+	id      string
+	counter *fio.CountConn
+
+	// nil if the stream is not counted in sessions
+	release func()
+	once    sync.Once
+}
+
+func (c *streamConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+		in, out := c.counter.Counts()
+		log.Debug("[%s] stream [%s] closed, in %d bytes, out %d bytes", c.RemoteAddr().String(), c.id, in, out)
+	})
+	return err
+}
@@ -0,0 +1,269 @@
+package worker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+)
+
+var (
+	ErrQuotaExceeded  = errors.New("storage quota exceeded")
+	ErrChunkNotFound  = errors.New("chunk not found")
+	ErrMailboxExpired = errors.New("mailbox is expired")
+	ErrInvalidToken   = errors.New("invalid upload token")
+	ErrChunkExists    = errors.New("chunk is already stored")
+)
+
+const (
+	expireFileName = "expire"
+	tokenFileName  = "token"
+)
+
+// Storage keeps chunks uploaded in mailbox mode on disk.
+// Each mailbox is a directory named by the hash of it's ID, so IDs can't escape the storage directory.
+// The directory has an expire file with unix time, it will be removed by GC after that,
+// and a token file with the hash of the upload token server issues for it.
+type Storage struct {
+	dir          string
+	quota        int64 // bytes, 0 is no limit
+	maxRetention time.Duration
+
+	used int64
+	mu   sync.Mutex
+}
+
+func NewStorage(dir string, quota int64, maxRetention time.Duration) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		dir:          dir,
+		quota:        quota,
+		maxRetention: maxRetention,
+	}
+
+	// count chunks left by last run, expired ones will be removed by GC
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			s.used += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("storage [%s] used %d bytes, quota %d bytes", dir, s.used, quota)
+	return s, nil
+}
+
+func (s *Storage) mailboxDir(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// Open prepares a mailbox for uploading by store streams with token. ExpireAt is reduced to the max retention of this worker.
+// Chunks left by an older mailbox with the same ID are removed.
+func (s *Storage) Open(id string, token string, expireAt time.Time) error {
+	if token == "" {
+		return fmt.Errorf("upload token is required")
+	}
+	if max := time.Now().Add(s.maxRetention); expireAt.After(max) {
+		expireAt = max
+	}
+	dir := s.mailboxDir(id)
+	if _, err := os.Stat(dir); err == nil {
+		size := dirSize(dir)
+		if err = os.RemoveAll(dir); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.used -= size
+		s.mu.Unlock()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// only the hash of token is on disk
+	sum := sha256.Sum256([]byte(token))
+	files := map[string][]byte{
+		tokenFileName:  []byte(hex.EncodeToString(sum[:])),
+		expireFileName: []byte(strconv.FormatInt(expireAt.Unix(), 10)),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.used += int64(len(content))
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Authorize returns an error if token is not the upload token of mailbox id or the mailbox is expired.
+func (s *Storage) Authorize(id string, token string) error {
+	dir := s.mailboxDir(id)
+	expected, err := ioutil.ReadFile(filepath.Join(dir, tokenFileName))
+	if err != nil {
+		return ErrInvalidToken
+	}
+	sum := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(expected, []byte(hex.EncodeToString(sum[:]))) != 1 {
+		return ErrInvalidToken
+	}
+	expireAt, err := readExpire(dir)
+	if err != nil || time.Now().After(expireAt) {
+		return ErrMailboxExpired
+	}
+	return nil
+}
+
+// PutChunk writes chunk to disk with a flags byte before data.
+// It's written to a temporary file and linked after sync, so a chunk is either complete or missing,
+// and a stored chunk is never overwritten.
+func (s *Storage) PutChunk(id string, chunkID uint64, flags uint8, data []byte) error {
+	dir := s.mailboxDir(id)
+	path := filepath.Join(dir, strconv.FormatUint(chunkID, 10))
+	size := int64(len(data) + 1)
+
+	if _, err := os.Stat(path); err == nil {
+		return ErrChunkExists
+	}
+
+	s.mu.Lock()
+	if s.quota > 0 && s.used+size > s.quota {
+		s.mu.Unlock()
+		return ErrQuotaExceeded
+	}
+	s.used += size
+	s.mu.Unlock()
+
+	err := writeChunk(dir, path, flags, data)
+	if err != nil {
+		s.mu.Lock()
+		s.used -= size
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func writeChunk(dir string, path string, flags uint8, data []byte) error {
+	f, err := ioutil.TempFile(dir, "chunk-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err = f.Write(append([]byte{flags}, data...)); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// unlike rename, link fails if another stream has stored the chunk
+	if err = os.Link(tmpPath, path); os.IsExist(err) {
+		return ErrChunkExists
+	}
+	return err
+}
+
+// GetChunk returns flags and data of a chunk.
+func (s *Storage) GetChunk(id string, chunkID uint64) (uint8, []byte, error) {
+	dir := s.mailboxDir(id)
+	expireAt, err := readExpire(dir)
+	if err != nil {
+		return 0, nil, ErrChunkNotFound
+	}
+	if time.Now().After(expireAt) {
+		return 0, nil, ErrMailboxExpired
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, strconv.FormatUint(chunkID, 10)))
+	if err != nil || len(buf) == 0 {
+		return 0, nil, ErrChunkNotFound
+	}
+	return buf[0], buf[1:], nil
+}
+
+func readExpire(dir string) (time.Time, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, expireFileName))
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse expire time error: %v", err)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// RunGC removes expired mailboxes periodically.
+func (s *Storage) RunGC() {
+	for {
+		s.gc()
+		time.Sleep(time.Minute)
+	}
+}
+
+func (s *Storage) gc() {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Warn("read storage dir error: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.dir, info.Name())
+		expireAt, err := readExpire(dir)
+		// a mailbox without expire file is broken, remove it after max retention since it's created
+		if err != nil {
+			expireAt = info.ModTime().Add(s.maxRetention)
+		}
+		if now.Before(expireAt) {
+			continue
+		}
+
+		size := dirSize(dir)
+		if err = os.RemoveAll(dir); err != nil {
+			log.Warn("remove expired mailbox [%s] error: %v", info.Name(), err)
+			continue
+		}
+		s.mu.Lock()
+		s.used -= size
+		s.mu.Unlock()
+		log.Info("remove expired mailbox [%s], free %d bytes", info.Name(), size)
+	}
+}
+
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T) (*Storage, func()) {
+	dir, err := ioutil.TempDir("", "fftw-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStorage(dir, 0, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestStorageUploadToken(t *testing.T) {
+	s, clean := newTestStorage(t)
+	defer clean()
+
+	if err := s.Authorize("box", "token"); err != ErrInvalidToken {
+		t.Fatalf("mailbox not opened: expect ErrInvalidToken, got %v", err)
+	}
+	if err := s.Open("box", "", time.Now().Add(time.Minute)); err == nil {
+		t.Fatalf("open without token: expect error")
+	}
+	if err := s.Open("box", "token", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Authorize("box", "token"); err != nil {
+		t.Fatalf("right token: %v", err)
+	}
+	for _, token := range []string{"", "other"} {
+		if err := s.Authorize("box", token); err != ErrInvalidToken {
+			t.Fatalf("token %q: expect ErrInvalidToken, got %v", token, err)
+		}
+	}
+	if err := s.Authorize("other", "token"); err != ErrInvalidToken {
+		t.Fatalf("token of another mailbox: expect ErrInvalidToken, got %v", err)
+	}
+
+	if err := s.Open("expired", "token", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Authorize("expired", "token"); err != ErrMailboxExpired {
+		t.Fatalf("expired mailbox: expect ErrMailboxExpired, got %v", err)
+	}
+}
+
+func TestStoragePutChunk(t *testing.T) {
+	s, clean := newTestStorage(t)
+	defer clean()
+
+	if err := s.Open("box", "token", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutChunk("box", 1, 3, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	used := s.used
+	if err := s.PutChunk("box", 1, 0, []byte("overwritten")); err != ErrChunkExists {
+		t.Fatalf("overwrite chunk: expect ErrChunkExists, got %v", err)
+	}
+	if s.used != used {
+		t.Fatalf("used is changed by refused chunk, %d != %d", s.used, used)
+	}
+
+	flags, data, err := s.GetChunk("box", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != 3 || string(data) != "chunk" {
+		t.Fatalf("get chunk: flags %d data %q", flags, data)
+	}
+	if _, _, err = s.GetChunk("box", 2); err != ErrChunkNotFound {
+		t.Fatalf("missing chunk: expect ErrChunkNotFound, got %v", err)
+	}
+
+	// a new mailbox with the same ID doesn't get chunks of the old one
+	if err = s.Open("box", "new", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.GetChunk("box", 1); err != ErrChunkNotFound {
+		t.Fatalf("chunk of old mailbox: expect ErrChunkNotFound, got %v", err)
+	}
+	if err = s.Authorize("box", "token"); err != ErrInvalidToken {
+		t.Fatalf("token of old mailbox: expect ErrInvalidToken, got %v", err)
+	}
+	if s.used != dirSize(s.dir) {
+		t.Fatalf("used %d, files on disk %d", s.used, dirSize(s.dir))
+	}
+}
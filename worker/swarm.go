@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	fio "github.com/fatedier/fft/pkg/io"
+	"github.com/fatedier/fft/pkg/log"
+	"github.com/fatedier/fft/pkg/msg"
+	"github.com/fatedier/fft/pkg/stream"
+
+	gio "github.com/fatedier/golib/io"
+)
+
+type swarmPeerKey struct {
+	id   string
+	peer int64
+}
+
+// swarmSeed is a participant serving chunks it has.
+// Requests are written to it with tags and chunks are replied with the tag in FileID.
+type swarmSeed struct {
+	key      swarmPeerKey
+	conn     net.Conn
+	flow     *Flow
+	s        *stream.FrameStream
+	nextTag  int64
+	requests map[int64]*swarmRequest
+	closed   bool
+	mu       sync.Mutex
+}
+
+type swarmRequest struct {
+	fetcher *swarmFetcher
+	chunkID uint64
+}
+
+// swarmFetcher gets chunks from different seeds, writes are serialized.
+type swarmFetcher struct {
+	conn net.Conn
+	s    *stream.FrameStream
+	mu   sync.Mutex
+}
+
+func (f *swarmFetcher) writeFrame(frame *stream.Frame) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.s.WriteFrame(frame)
+}
+
+func (f *swarmFetcher) writeError(chunkID uint64, err error) error {
+	return f.writeFrame(&stream.Frame{
+		Version: stream.Version1,
+		Type:    stream.TypeError,
+		FrameID: chunkID,
+		Buf:     []byte(err.Error()),
+	})
+}
+
+// SwarmRelay forwards chunk requests from fetchers to seeds of other peers in the same swarm.
+type SwarmRelay struct {
+	seeds map[swarmPeerKey]*swarmSeed
+
+	sched *Scheduler
+	mu    sync.Mutex
+}
+
+func NewSwarmRelay(sched *Scheduler) *SwarmRelay {
+	return &SwarmRelay{
+		seeds: make(map[swarmPeerKey]*swarmSeed),
+		sched: sched,
+	}
+}
+
+// DealSeedConn registers a seed, chunks from it are scheduled.
+func (sr *SwarmRelay) DealSeedConn(id string, peer int64, conn net.Conn) error {
+	flow := sr.sched.NewFlow(id, remoteIP(conn))
+	wrapReader := fio.NewRateReader(conn, flow)
+	seed := &swarmSeed{
+		key:  swarmPeerKey{id: id, peer: peer},
+		conn: conn,
+		flow: flow,
+		s: stream.NewFrameStream(gio.WrapReadWriteCloser(wrapReader, conn, func() error {
+			return conn.Close()
+		})),
+		requests: make(map[int64]*swarmRequest),
+	}
+
+	sr.mu.Lock()
+	if _, ok := sr.seeds[seed.key]; ok {
+		sr.mu.Unlock()
+		flow.Close()
+		return fmt.Errorf("peer is repeated")
+	}
+	sr.seeds[seed.key] = seed
+	sr.mu.Unlock()
+
+	msg.WriteMsg(conn, &msg.NewSeedStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    capabilities,
+	})
+	go sr.readSeed(seed)
+	return nil
+}
+
+// readSeed forwards chunks to fetchers who ask for them until seed is closed.
+func (sr *SwarmRelay) readSeed(seed *swarmSeed) {
+	for {
+		frame, err := seed.s.ReadFrame()
+		if err != nil {
+			break
+		}
+
+		tag := int64(frame.FileID)
+		seed.mu.Lock()
+		req, ok := seed.requests[tag]
+		delete(seed.requests, tag)
+		seed.mu.Unlock()
+		if !ok {
+			continue
+		}
+		frame.FileID = 0
+		req.fetcher.writeFrame(frame)
+	}
+
+	sr.mu.Lock()
+	if sr.seeds[seed.key] == seed {
+		delete(sr.seeds, seed.key)
+	}
+	sr.mu.Unlock()
+
+	seed.mu.Lock()
+	seed.closed = true
+	requests := seed.requests
+	seed.requests = make(map[int64]*swarmRequest)
+	seed.mu.Unlock()
+	seed.conn.Close()
+	seed.flow.Close()
+
+	for _, req := range requests {
+		req.fetcher.writeError(req.chunkID, fmt.Errorf("peer is closed"))
+	}
+	log.Debug("swarm [%s] peer %d seed closed", seed.key.id, seed.key.peer)
+}
+
+// Active returns how many seeds are connected.
+func (sr *SwarmRelay) Active() int {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return len(sr.seeds)
+}
+
+// CloseAll closes all seeds, fetchers waiting for their chunks get errors.
+func (sr *SwarmRelay) CloseAll() {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for _, seed := range sr.seeds {
+		seed.conn.Close()
+	}
+}
+
+// DealFetchConn forwards each FetchChunk from conn to the seed of the peer it asks.
+func (sr *SwarmRelay) DealFetchConn(id string, conn net.Conn) error {
+	f := &swarmFetcher{
+		conn: conn,
+		s:    stream.NewFrameStream(conn),
+	}
+
+	msg.WriteMsg(conn, &msg.NewFetchStreamResp{
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    capabilities,
+	})
+	go func() {
+		defer conn.Close()
+		for {
+			raw, err := msg.ReadMsg(conn)
+			if err != nil {
+				return
+			}
+			m, ok := raw.(*msg.FetchChunk)
+			if !ok || m.ChunkID < 0 {
+				return
+			}
+
+			if err = sr.request(id, m, f); err != nil {
+				if err = f.writeError(uint64(m.ChunkID), err); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (sr *SwarmRelay) request(id string, m *msg.FetchChunk, f *swarmFetcher) error {
+	sr.mu.Lock()
+	seed, ok := sr.seeds[swarmPeerKey{id: id, peer: m.Peer}]
+	sr.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer is not connected to this worker")
+	}
+
+	seed.mu.Lock()
+	defer seed.mu.Unlock()
+	if seed.closed {
+		return fmt.Errorf("peer is closed")
+	}
+	seed.nextTag++
+	tag := seed.nextTag
+	seed.requests[tag] = &swarmRequest{
+		fetcher: f,
+		chunkID: uint64(m.ChunkID),
+	}
+	err := msg.WriteMsg(seed.conn, &msg.FetchChunk{
+		ChunkID: m.ChunkID,
+		Tag:     tag,
+	})
+	if err != nil {
+		delete(seed.requests, tag)
+		return fmt.Errorf("peer is closed")
+	}
+	return nil
+}
@@ -1,68 +1,314 @@
 package worker
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/fatedier/fft/pkg/log"
+)
+
+// periods traffic is limited in
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
 )
 
+var periods = []string{PeriodDay, PeriodWeek, PeriodMonth}
+
+type TrafficLimiterOptions struct {
+	// max traffic in each period, 0 is no limit
+	MaxCountPerDay   uint64
+	MaxCountPerWeek  uint64
+	MaxCountPerMonth uint64
+
+	// weeks begin on ResetWeekday and months begin on ResetDay in Location,
+	// months without ResetDay begin on their last day
+	ResetWeekday time.Weekday
+	ResetDay     int
+	Location     *time.Location
+
+	// counts are saved to File and loaded after restarting if it's not empty
+	File string
+}
+
+// quota counts traffic in the current period which begins at start, it's unix time.
+type quota struct {
+	count    uint64
+	maxCount uint64
+	start    int64
+}
+
 type TrafficLimiter struct {
-	count          uint64
-	maxCountPerDay uint64
+	quotas map[string]*quota
+
+	// all traffic since started, it's never reset
+	total uint64
+
+	resetWeekday time.Weekday
+	resetDay     int
+	location     *time.Location
+	file         string
+	saveMu       sync.Mutex
 
 	exceedCh            chan struct{}
+	limitCh             chan struct{}
+	resetCh             chan struct{}
 	exceedLimitCallback func()
 	restoreCallback     func()
 }
 
-func NewTrafficLimiter(maxCountPerDay uint64, exceedLimitCallback func(), restoreCallback func()) *TrafficLimiter {
-	if maxCountPerDay == 0 {
-		maxCountPerDay = math.MaxUint64
+func NewTrafficLimiter(options TrafficLimiterOptions, exceedLimitCallback func(), restoreCallback func()) *TrafficLimiter {
+	if options.Location == nil {
+		options.Location = time.Local
 	}
-
-	return &TrafficLimiter{
-		count:          0,
-		maxCountPerDay: maxCountPerDay,
+	if options.ResetDay <= 0 {
+		options.ResetDay = 1
+	}
+	tl := &TrafficLimiter{
+		quotas: map[string]*quota{
+			PeriodDay:   {maxCount: noLimit(options.MaxCountPerDay)},
+			PeriodWeek:  {maxCount: noLimit(options.MaxCountPerWeek)},
+			PeriodMonth: {maxCount: noLimit(options.MaxCountPerMonth)},
+		},
+		resetWeekday: options.ResetWeekday,
+		resetDay:     options.ResetDay,
+		location:     options.Location,
+		file:         options.File,
 
 		exceedCh:            make(chan struct{}),
+		limitCh:             make(chan struct{}),
+		resetCh:             make(chan struct{}),
 		exceedLimitCallback: exceedLimitCallback,
 		restoreCallback:     restoreCallback,
 	}
+
+	now := time.Now()
+	for _, period := range periods {
+		tl.quotas[period].start = tl.periodStart(period, now).Unix()
+	}
+	return tl
+}
+
+func noLimit(maxCount uint64) uint64 {
+	if maxCount == 0 {
+		return math.MaxUint64
+	}
+	return maxCount
+}
+
+// periodStart returns the beginning of the period t is in.
+func (tl *TrafficLimiter) periodStart(period string, t time.Time) time.Time {
+	t = t.In(tl.location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, tl.location)
+	switch period {
+	case PeriodWeek:
+		return day.AddDate(0, 0, -((int(t.Weekday()) - int(tl.resetWeekday) + 7) % 7))
+	case PeriodMonth:
+		start := monthDay(t.Year(), t.Month(), tl.resetDay, tl.location)
+		if day.Before(start) {
+			start = monthDay(t.Year(), t.Month()-1, tl.resetDay, tl.location)
+		}
+		return start
+	default:
+		return day
+	}
+}
+
+// monthDay returns the day of month, or the last day if month is shorter.
+func monthDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc); day > last.Day() {
+		return last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
 }
 
 func (tl *TrafficLimiter) AddCount(count uint64) {
-	newCount := atomic.AddUint64(&tl.count, count)
-	if newCount-count < tl.maxCountPerDay && newCount >= tl.maxCountPerDay {
+	atomic.AddUint64(&tl.total, count)
+	exceed := false
+	for _, q := range tl.quotas {
+		newCount := atomic.AddUint64(&q.count, count)
+		maxCount := atomic.LoadUint64(&q.maxCount)
+		if newCount-count < maxCount && newCount >= maxCount {
+			exceed = true
+		}
+	}
+	if exceed {
 		tl.exceedCh <- struct{}{}
 	}
 }
 
+// SetLimit changes max traffic in period, 0 is no limit.
+func (tl *TrafficLimiter) SetLimit(period string, maxCount uint64) {
+	atomic.StoreUint64(&tl.quotas[period].maxCount, noLimit(maxCount))
+	tl.limitCh <- struct{}{}
+}
+
+// Reset changes counts of all periods to 0 as new periods begin.
+func (tl *TrafficLimiter) Reset() {
+	tl.resetCh <- struct{}{}
+}
+
+// Count returns traffic in the current period.
+func (tl *TrafficLimiter) Count(period string) uint64 {
+	return atomic.LoadUint64(&tl.quotas[period].count)
+}
+
+// Remaining returns traffic left before any limit is reached, -1 means no limit.
+func (tl *TrafficLimiter) Remaining() int64 {
+	remaining := int64(-1)
+	for _, q := range tl.quotas {
+		maxCount := atomic.LoadUint64(&q.maxCount)
+		if maxCount == math.MaxUint64 {
+			continue
+		}
+		left := int64(maxCount) - int64(atomic.LoadUint64(&q.count))
+		if left < 0 {
+			left = 0
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+func (tl *TrafficLimiter) Total() uint64 {
+	return atomic.LoadUint64(&tl.total)
+}
+
+// exceeded returns the first period whose limit is reached, or empty string.
+func (tl *TrafficLimiter) exceeded() string {
+	for _, period := range periods {
+		q := tl.quotas[period]
+		if atomic.LoadUint64(&q.count) >= atomic.LoadUint64(&q.maxCount) {
+			return period
+		}
+	}
+	return ""
+}
+
 func (tl *TrafficLimiter) Run() {
+	if tl.file != "" {
+		if err := tl.load(); err != nil {
+			log.Warn("load traffic counts from [%s] error: %v", tl.file, err)
+		}
+	}
 	go tl.restoreWorker()
 }
 
-// change count to 0 every day
+// change counts to 0 after periods end
 func (tl *TrafficLimiter) restoreWorker() {
-	now := time.Now()
-	lastRestoreTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 	exceed := false
 
+	// counts are saved if they are changed
+	lastTotal := tl.Total()
+	dirty := false
+
+	// counts loaded from file may have reached limits
+	check := func() {
+		if period := tl.exceeded(); period != "" && !exceed {
+			exceed = true
+			log.Info("reach traffic limit %dMB this %s", atomic.LoadUint64(&tl.quotas[period].maxCount)/1024/1024, period)
+			tl.exceedLimitCallback()
+		} else if period == "" && exceed {
+			exceed = false
+			tl.restoreCallback()
+		}
+	}
+	check()
+
 	for {
 		select {
 		case <-tl.exceedCh:
-			exceed = true
-			tl.exceedLimitCallback()
+		case <-tl.limitCh:
+		case <-tl.resetCh:
+			now := time.Now()
+			for _, period := range periods {
+				q := tl.quotas[period]
+				atomic.StoreUint64(&q.count, 0)
+				atomic.StoreInt64(&q.start, tl.periodStart(period, now).Unix())
+			}
+			dirty = true
 		case now := <-time.After(5 * time.Second):
-			nowDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-			days := int(nowDay.Sub(lastRestoreTime).Hours() / 24)
-			if days > 0 {
-				atomic.StoreUint64(&tl.count, 0)
-				lastRestoreTime = nowDay
-				if exceed {
-					exceed = false
-					tl.restoreCallback()
+			for _, period := range periods {
+				q := tl.quotas[period]
+				if start := tl.periodStart(period, now).Unix(); start != atomic.LoadInt64(&q.start) {
+					atomic.StoreUint64(&q.count, 0)
+					atomic.StoreInt64(&q.start, start)
+					dirty = true
 				}
 			}
 		}
+		check()
+
+		if total := tl.Total(); tl.file != "" && (dirty || total != lastTotal) {
+			lastTotal, dirty = total, false
+			if err := tl.Save(); err != nil {
+				log.Warn("save traffic counts to [%s] error: %v", tl.file, err)
+			}
+		}
+	}
+}
+
+type savedQuota struct {
+	Start int64  `json:"start"`
+	Count uint64 `json:"count"`
+}
+
+// Save writes counts to file, they are loaded after restarting if periods have not ended.
+func (tl *TrafficLimiter) Save() error {
+	if tl.file == "" {
+		return nil
+	}
+	tl.saveMu.Lock()
+	defer tl.saveMu.Unlock()
+
+	saved := make(map[string]savedQuota)
+	for period, q := range tl.quotas {
+		saved[period] = savedQuota{
+			Start: atomic.LoadInt64(&q.start),
+			Count: atomic.LoadUint64(&q.count),
+		}
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// a half written file is never loaded
+	tmpFile := tl.file + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, tl.file)
+}
+
+func (tl *TrafficLimiter) load() error {
+	buf, err := ioutil.ReadFile(tl.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := make(map[string]savedQuota)
+	if err = json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("parse error: %v", err)
+	}
+
+	for period, q := range tl.quotas {
+		s, ok := saved[period]
+		if ok && s.Start == q.start {
+			atomic.AddUint64(&q.count, s.Count)
+		}
 	}
+	log.Info("load traffic counts, today %dMB, this week %dMB, this month %dMB", tl.Count(PeriodDay)/1024/1024,
+		tl.Count(PeriodWeek)/1024/1024, tl.Count(PeriodMonth)/1024/1024)
+	return nil
 }
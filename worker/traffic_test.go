@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficPeriodStart(t *testing.T) {
+	tl := NewTrafficLimiter(TrafficLimiterOptions{
+		ResetWeekday: time.Monday,
+		ResetDay:     31,
+		Location:     time.UTC,
+	}, func() {}, func() {})
+
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		period string
+		t      time.Time
+		expect time.Time
+	}{
+		{PeriodDay, date(2019, 3, 24).Add(23 * time.Hour), date(2019, 3, 24)},
+		// 2019-03-18 is a monday
+		{PeriodWeek, date(2019, 3, 24), date(2019, 3, 18)},
+		{PeriodWeek, date(2019, 3, 25), date(2019, 3, 25)},
+		// months without day 31 begin on their last day
+		{PeriodMonth, date(2019, 3, 15), date(2019, 2, 28)},
+		{PeriodMonth, date(2019, 3, 31), date(2019, 3, 31)},
+		{PeriodMonth, date(2019, 4, 29), date(2019, 3, 31)},
+		{PeriodMonth, date(2019, 4, 30), date(2019, 4, 30)},
+		{PeriodMonth, date(2019, 1, 5), date(2018, 12, 31)},
+	}
+	for _, test := range tests {
+		if start := tl.periodStart(test.period, test.t); !start.Equal(test.expect) {
+			t.Fatalf("%s of %s begins at %s, expect %s", test.period, test.t, start, test.expect)
+		}
+	}
+}
+
+func TestTrafficLimit(t *testing.T) {
+	exceedCh := make(chan struct{}, 1)
+	restoreCh := make(chan struct{}, 1)
+	tl := NewTrafficLimiter(TrafficLimiterOptions{
+		MaxCountPerDay:  100,
+		MaxCountPerWeek: 1000,
+	}, func() { exceedCh <- struct{}{} }, func() { restoreCh <- struct{}{} })
+	tl.Run()
+
+	wait := func(ch chan struct{}, what string) {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not called", what)
+		}
+	}
+
+	tl.AddCount(60)
+	if remaining := tl.Remaining(); remaining != 40 {
+		t.Fatalf("remaining is %d, expect 40", remaining)
+	}
+	tl.AddCount(50)
+	wait(exceedCh, "exceed callback")
+	if remaining := tl.Remaining(); remaining != 0 {
+		t.Fatalf("remaining is %d after the limit is reached", remaining)
+	}
+
+	// a larger limit restores the worker, counts are kept
+	tl.SetLimit(PeriodDay, 200)
+	wait(restoreCh, "restore callback")
+	if count := tl.Count(PeriodWeek); count != 110 {
+		t.Fatalf("count of the week is %d, expect 110", count)
+	}
+
+	tl.AddCount(100)
+	wait(exceedCh, "exceed callback")
+	tl.Reset()
+	wait(restoreCh, "restore callback")
+	if count := tl.Count(PeriodDay); count != 0 {
+		t.Fatalf("count is %d after reset", count)
+	}
+	if total := tl.Total(); total != 210 {
+		t.Fatalf("total is %d, it's never reset", total)
+	}
+
+	tl.SetLimit(PeriodDay, 0)
+	tl.SetLimit(PeriodWeek, 0)
+	if remaining := tl.Remaining(); remaining != -1 {
+		t.Fatalf("remaining is %d without limits", remaining)
+	}
+}
+
+func TestTrafficSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fftw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	options := TrafficLimiterOptions{
+		MaxCountPerDay: 100,
+		File:           filepath.Join(dir, "traffic.json"),
+	}
+
+	tl := NewTrafficLimiter(options, func() {}, func() {})
+	tl.quotas[PeriodDay].count = 30
+	tl.quotas[PeriodMonth].count = 50
+	if err = tl.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// counts of the current periods are loaded after restarting
+	exceedCh := make(chan struct{}, 1)
+	tl = NewTrafficLimiter(options, func() { exceedCh <- struct{}{} }, func() {})
+	if err = tl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if tl.Count(PeriodDay) != 30 || tl.Count(PeriodMonth) != 50 || tl.Count(PeriodWeek) != 0 {
+		t.Fatalf("loaded counts are %d, %d, %d", tl.Count(PeriodDay), tl.Count(PeriodWeek), tl.Count(PeriodMonth))
+	}
+
+	// counts of periods which have ended are dropped
+	tl.quotas[PeriodDay].start -= 24 * 3600
+	tl.quotas[PeriodDay].count = 200
+	if err = tl.Save(); err != nil {
+		t.Fatal(err)
+	}
+	tl = NewTrafficLimiter(options, func() { exceedCh <- struct{}{} }, func() {})
+	tl.Run()
+	if count := tl.Count(PeriodDay); count != 0 {
+		t.Fatalf("count of yesterday is loaded: %d", count)
+	}
+	select {
+	case <-exceedCh:
+		t.Fatalf("limit is reached by the count of yesterday")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = ioutil.WriteFile(options.File, []byte("{bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = NewTrafficLimiter(options, func() {}, func() {}).load(); err == nil {
+		t.Fatalf("bad file is loaded")
+	}
+}